@@ -0,0 +1,402 @@
+// Package history defines the records of calculation results and the
+// asynchronous jobs the service keeps, and the Store holding them. The
+// SQLite and Postgres stores are in the sqlstore package, so code only
+// reading the types (such as impactclient) does not link the drivers.
+package history
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// ErrNotFound is returned for a record or job ID the store does not hold.
+var ErrNotFound = errors.New("not found")
+
+// ErrKeyReused is returned when an idempotency key comes back with a
+// different request than it was first used for.
+var ErrKeyReused = errors.New("idempotency key already used for a different request")
+
+// ErrLeaseLost is returned to a worker that no longer holds the lease on a
+// job: it expired and the job may have passed to another worker.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// MaxJobAttempts is how many times a job is claimed before a job whose
+// worker keeps disappearing is failed.
+const MaxJobAttempts = 3
+
+// Record is one stored calculation.
+type Record struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Reference is the request's reference, the key trends follow.
+	Reference string `json:"reference,omitempty"`
+	// Tags are the request's tags, indexed for Filter.Tags.
+	Tags            []string          `json:"tags,omitempty"`
+	ImpactType      impact.ImpactType `json:"impact_type"`
+	Instance        string            `json:"instance,omitempty"`
+	TotalImpact     float64           `json:"total_impact"`
+	NormalizedScore float64           `json:"normalized_score"`
+	Partial         bool              `json:"partial,omitempty"`
+	// WindowStart and WindowEnd are the maintenance window the request
+	// scored, if it had one; a window without an end is an instant.
+	WindowStart *time.Time           `json:"window_start,omitempty"`
+	WindowEnd   *time.Time           `json:"window_end,omitempty"`
+	Request     impact.ImpactRequest `json:"request"`
+	// Result is only loaded by Get and by List with Filter.WithResults.
+	Result *impact.ImpactResult `json:"result,omitempty"`
+	// Outcome is what the change did, once recorded; only Get loads it.
+	Outcome *Outcome `json:"outcome,omitempty"`
+	// IdempotencyKey, when set, makes saving the record again return the
+	// first save instead of a copy. Only KeyedRecords loads it back.
+	IdempotencyKey string `json:"-"`
+	// Tenants are the tenants the result scores, indexed for
+	// Filter.Tenants. Only KeyedRecords loads them back.
+	Tenants []string `json:"-"`
+	// Sites are the sites of the devices the result scores, counted by
+	// Stats. Only KeyedRecords loads them back.
+	Sites []string `json:"-"`
+}
+
+// NewRecord is the record of req's result, to be saved.
+func NewRecord(req impact.ImpactRequest, result impact.ImpactResult) Record {
+	r := Record{
+		Reference:       req.Reference,
+		Tags:            req.Tags,
+		ImpactType:      req.ImpactType,
+		Instance:        req.Instance,
+		TotalImpact:     result.TotalImpact,
+		NormalizedScore: result.NormalizedScore,
+		Partial:         result.Partial,
+		Request:         req,
+		Result:          &result,
+		Tenants:         result.Tenants(),
+		Sites:           result.Sites(),
+	}
+	if w := result.Window; w != nil {
+		r.WindowStart, r.WindowEnd = &w.StartUTC, w.EndUTC
+	}
+	return r
+}
+
+// Filter selects records; zero fields match everything. Since is
+// inclusive and Until exclusive.
+type Filter struct {
+	Reference string
+	// Tags selects the records carrying every one of them.
+	Tags []string
+	// Tenants, when set, selects the records scoring any of them: the
+	// records a tenant-scoped API key may see.
+	Tenants    []string
+	ImpactType impact.ImpactType
+	Instance   string
+	Since      time.Time
+	Until      time.Time
+	// Limit caps the records List returns, newest first (0 = DefaultLimit);
+	// Offset skips that many.
+	Limit       int
+	Offset      int
+	WithResults bool
+}
+
+// DefaultLimit and MaxLimit bound a List.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// TrendPoint aggregates the calculations of one UTC day.
+type TrendPoint struct {
+	Day           string  `json:"day"`
+	Count         int     `json:"count"`
+	AverageImpact float64 `json:"average_impact"`
+	MinImpact     float64 `json:"min_impact"`
+	MaxImpact     float64 `json:"max_impact"`
+}
+
+// NoImpact is the actual severity of a change customers did not notice.
+const NoImpact = "none"
+
+// ActualSeverities lists the severities an outcome may report, least
+// severe first.
+var ActualSeverities = []string{NoImpact, string(impact.SeverityLow), string(impact.SeverityMedium), string(impact.SeverityHigh), string(impact.SeverityCritical)}
+
+// MaxOutcomeNotes bounds an outcome's notes.
+const MaxOutcomeNotes = 4000
+
+// Outcome is what a change actually did, recorded by the NOC after it
+// completed. Recording another replaces it.
+type Outcome struct {
+	// ActualSeverity is one of ActualSeverities.
+	ActualSeverity  string    `json:"actual_severity"`
+	CustomerTickets int       `json:"customer_tickets"`
+	Notes           string    `json:"notes,omitempty"`
+	RecordedAt      time.Time `json:"recorded_at"`
+}
+
+// Check rejects an unknown severity, negative ticket counts and notes
+// longer than MaxOutcomeNotes.
+func (o Outcome) Check() error {
+	if !slices.Contains(ActualSeverities, o.ActualSeverity) {
+		return fmt.Errorf("actual_severity: %q is not one of %s", o.ActualSeverity, strings.Join(ActualSeverities, ", "))
+	}
+	if o.CustomerTickets < 0 {
+		return fmt.Errorf("customer_tickets: %d is negative", o.CustomerTickets)
+	}
+	if len(o.Notes) > MaxOutcomeNotes {
+		return fmt.Errorf("notes: longer than %d bytes", MaxOutcomeNotes)
+	}
+	return nil
+}
+
+// CalibrationSample is a recorded estimate with its outcome. Multiplier is
+// the impact type multiplier the estimate was calculated with.
+type CalibrationSample struct {
+	HistoryID       int64             `json:"history_id"`
+	ImpactType      impact.ImpactType `json:"impact_type"`
+	TotalImpact     float64           `json:"total_impact"`
+	NormalizedScore float64           `json:"normalized_score"`
+	Multiplier      float64           `json:"multiplier"`
+	Outcome         Outcome           `json:"outcome"`
+}
+
+// CalibrationRow compares the estimates of one impact type in one
+// severity band (impact.ScoreSeverity of their normalized score) with what
+// the changes actually did.
+type CalibrationRow struct {
+	ImpactType impact.ImpactType `json:"impact_type"`
+	Band       impact.Severity   `json:"band"`
+	Count      int               `json:"count"`
+	// Impacted counts the changes with any actual impact and ImpactedRate
+	// is their share: how often a "low" estimate still hurt.
+	Impacted     int     `json:"impacted"`
+	ImpactedRate float64 `json:"impacted_rate"`
+	// Matched, Under and Over count the outcomes as severe as the band (a
+	// change without impact matches the low band), more severe (the
+	// estimate was too low) and less severe.
+	Matched        int     `json:"matched"`
+	Under          int     `json:"under"`
+	Over           int     `json:"over"`
+	AverageTickets float64 `json:"average_tickets"`
+	// Actual counts the outcomes per actual severity.
+	Actual map[string]int `json:"actual"`
+}
+
+// Calibrate aggregates samples per impact type and band, ordered by impact
+// type and then from the critical band down.
+func Calibrate(samples []CalibrationSample) []CalibrationRow {
+	type key struct {
+		impactType impact.ImpactType
+		band       impact.Severity
+	}
+	rows := map[key]*CalibrationRow{}
+	tickets := map[key]int{}
+	for _, s := range samples {
+		k := key{s.ImpactType, impact.ScoreSeverity(s.NormalizedScore)}
+		row := rows[k]
+		if row == nil {
+			row = &CalibrationRow{ImpactType: k.impactType, Band: k.band, Actual: map[string]int{}}
+			rows[k] = row
+		}
+		row.Count++
+		row.Actual[s.Outcome.ActualSeverity]++
+		tickets[k] += s.Outcome.CustomerTickets
+		if s.Outcome.ActualSeverity != NoImpact {
+			row.Impacted++
+		}
+		switch d := bandDistance(s.NormalizedScore, s.Outcome.ActualSeverity); {
+		case d > 0:
+			row.Under++
+		case d < 0:
+			row.Over++
+		default:
+			row.Matched++
+		}
+	}
+	out := make([]CalibrationRow, 0, len(rows))
+	for k, row := range rows {
+		row.ImpactedRate = float64(row.Impacted) / float64(row.Count)
+		row.AverageTickets = float64(tickets[k]) / float64(row.Count)
+		out = append(out, *row)
+	}
+	slices.SortFunc(out, func(a, b CalibrationRow) int {
+		if c := cmp.Compare(a.ImpactType, b.ImpactType); c != 0 {
+			return c
+		}
+		return cmp.Compare(slices.Index(impact.Severities, a.Band), slices.Index(impact.Severities, b.Band))
+	})
+	return out
+}
+
+// WriteCalibrationCSV writes rows as CSV with a header line, one actual_*
+// column per actual severity.
+func WriteCalibrationCSV(w io.Writer, rows []CalibrationRow) error {
+	cw := csv.NewWriter(w)
+	header := []string{"impact_type", "band", "count", "impacted", "impacted_rate", "matched", "under", "over", "average_tickets"}
+	for _, s := range ActualSeverities {
+		header = append(header, "actual_"+s)
+	}
+	cw.Write(header)
+	for _, r := range rows {
+		record := []string{string(r.ImpactType), string(r.Band), strconv.Itoa(r.Count), strconv.Itoa(r.Impacted),
+			strconv.FormatFloat(r.ImpactedRate, 'f', 4, 64), strconv.Itoa(r.Matched), strconv.Itoa(r.Under), strconv.Itoa(r.Over),
+			strconv.FormatFloat(r.AverageTickets, 'f', 2, 64)}
+		for _, s := range ActualSeverities {
+			record = append(record, strconv.Itoa(r.Actual[s]))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type JobState string
+
+// A job is queued, then claimed by a worker, running and finally done or
+// failed. A claimed or running job whose lease expires is claimed again.
+const (
+	JobQueued  JobState = "queued"
+	JobClaimed JobState = "claimed"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// Job is an asynchronous calculation. A done job names the record of its
+// result; a failed one says why.
+type Job struct {
+	ID        int64                `json:"id"`
+	State     JobState             `json:"state"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Request   impact.ImpactRequest `json:"request"`
+	HistoryID int64                `json:"history_id,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	// Worker is the worker that claimed the job last, LeaseUntil when its
+	// claim runs out unless renewed, and Attempts how often it was claimed.
+	Worker     string     `json:"worker,omitempty"`
+	LeaseUntil *time.Time `json:"lease_until,omitempty"`
+	Attempts   int        `json:"attempts"`
+	// IdempotencyKey is the key the job was created with, for State.
+	IdempotencyKey string `json:"-"`
+}
+
+// Store holds records and jobs. The sqlstore backends implement it with
+// the same behavior, checked by one test suite.
+type Store interface {
+	// Save stores r, setting its ID and, when zero, its CreatedAt. A
+	// record whose IdempotencyKey was saved before is not stored again:
+	// Save returns it with the earlier record's ID, or ErrKeyReused when
+	// the requests differ.
+	Save(ctx context.Context, r Record) (Record, error)
+	Get(ctx context.Context, id int64) (Record, error)
+	// GetForTenants is Get limited to the records scoring any of tenants;
+	// the others are ErrNotFound.
+	GetForTenants(ctx context.Context, id int64, tenants []string) (Record, error)
+	// List returns the records f selects, newest first.
+	List(ctx context.Context, f Filter) ([]Record, error)
+	// Trend returns the daily aggregates of the records f selects, oldest
+	// first; Limit and Offset do not apply.
+	Trend(ctx context.Context, f Filter) ([]TrendPoint, error)
+	// Scheduled returns the records whose window overlaps [start, end),
+	// counting only the latest record of each reference so a revised
+	// estimate replaces the earlier ones. Records of excludeReference are
+	// left out; records without a reference each count.
+	Scheduled(ctx context.Context, start, end time.Time, excludeReference string) ([]Record, error)
+	// RecordOutcome stores the outcome of record id, replacing an earlier
+	// one, and returns the record with it.
+	RecordOutcome(ctx context.Context, id int64, o Outcome) (Record, error)
+	// Outcomes returns the records f selects that have an outcome, oldest
+	// first, for Calibrate and SuggestMultipliers; Limit and Offset do not
+	// apply.
+	Outcomes(ctx context.Context, f Filter) ([]CalibrationSample, error)
+	// Stats aggregates the records created since since; groups of fewer
+	// than minGroupSize records are left out, and at most topSites sites
+	// are listed.
+	Stats(ctx context.Context, since time.Time, minGroupSize, topSites int) (Stats, error)
+	// KeyedRecords returns the records created since since that carry an
+	// idempotency key, oldest first, with their results, keys, tenants and
+	// sites.
+	KeyedRecords(ctx context.Context, since time.Time) ([]Record, error)
+	// Prune deletes the records, their outcomes and the finished jobs
+	// created before before and returns how many records it deleted.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+
+	// CreateJob queues req. A non-empty idempotencyKey used before returns
+	// that job instead, with created false, or ErrKeyReused when the
+	// requests differ.
+	CreateJob(ctx context.Context, req impact.ImpactRequest, idempotencyKey string) (job Job, created bool, err error)
+	GetJob(ctx context.Context, id int64) (Job, error)
+	// ListJobs returns up to limit jobs in state, or in any state for "",
+	// newest first.
+	ListJobs(ctx context.Context, state JobState, limit int) ([]Job, error)
+	// ClaimJob leases the oldest job that is queued, or whose lease has
+	// expired, to worker for lease; ok is false when there is none. Expired
+	// jobs claimed MaxJobAttempts times are failed instead.
+	ClaimJob(ctx context.Context, worker string, lease time.Duration) (job Job, ok bool, err error)
+	// RenewLease extends worker's lease on job id to lease from now.
+	RenewLease(ctx context.Context, id int64, worker string, lease time.Duration) error
+	// ReleaseJob queues a job worker holds again, without counting the
+	// attempt.
+	ReleaseJob(ctx context.Context, id int64, worker string) error
+	// UpdateJob moves a job worker holds to running, or to failed with
+	// errMsg.
+	UpdateJob(ctx context.Context, id int64, worker string, state JobState, errMsg string) error
+	// CompleteJob saves r and marks the job done with it, in one
+	// transaction. The methods changing a job return ErrLeaseLost, and
+	// change nothing, when worker no longer holds it.
+	CompleteJob(ctx context.Context, id int64, worker string, r Record) (Record, error)
+
+	// SchemaVersion returns the version of the applied migrations.
+	SchemaVersion(ctx context.Context) (int, error)
+	Close() error
+}
+
+// Export writes the records f selects, results included, as JSON lines,
+// newest first, ignoring f's Limit and Offset. redact, when set,
+// sanitizes each record before it is written.
+func Export(ctx context.Context, s Store, f Filter, w io.Writer, redact func(*Record)) error {
+	f.WithResults, f.Limit, f.Offset = true, MaxLimit, 0
+	// Records saved while exporting would shift the pages.
+	if f.Until.IsZero() {
+		f.Until = time.Now()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		records, err := s.List(ctx, f)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if redact != nil {
+				redact(&r)
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		if len(records) < f.Limit {
+			return nil
+		}
+		f.Offset += len(records)
+	}
+}
+
+// CheckJobState rejects an unknown state.
+func CheckJobState(s JobState) error {
+	switch s {
+	case JobQueued, JobClaimed, JobRunning, JobDone, JobFailed:
+		return nil
+	}
+	return fmt.Errorf("unknown job state %q", s)
+}
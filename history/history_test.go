@@ -0,0 +1,71 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+func sample(impactType impact.ImpactType, total, multiplier float64, actual string) CalibrationSample {
+	weights := impact.DefaultWeightConfig()
+	return CalibrationSample{ImpactType: impactType, TotalImpact: total, NormalizedScore: weights.NormalizedScore(total), Multiplier: multiplier, Outcome: Outcome{ActualSeverity: actual, CustomerTickets: 2}}
+}
+
+func TestSuggestMultipliers(t *testing.T) {
+	weights := impact.DefaultWeightConfig()
+	// With the default normalization_k of 100 a total below 33.3 is in the
+	// low band and one from there to 100 in the medium band.
+	samples := []CalibrationSample{
+		sample(impact.PlannedWork, 20, 1, "medium"),
+		sample(impact.PlannedWork, 25, 1, "medium"),
+		// Calculated with a multiplier of 2: the same 30 points before it.
+		sample(impact.PlannedWork, 60, 2, "medium"),
+		sample(impact.PlannedWork, 500, 0, "none"),
+		sample(impact.FiberWorks, 20, 1.5, "critical"),
+		sample(impact.IncidentWork, 50, 10, "medium"),
+		sample(impact.IncidentWork, 10, 10, NoImpact),
+	}
+	got := SuggestMultipliers(samples, weights, 2)
+	want := []MultiplierSuggestion{{
+		ImpactType: impact.PlannedWork, Current: 1, Suggested: 1.68, Samples: 3,
+		ErrorBefore: 1, ErrorAfter: 0, MatchedBefore: 0, MatchedAfter: 3, UnderBefore: 3,
+	}}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("SuggestMultipliers =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := SuggestMultipliers(samples, weights, 4); len(got) != 0 {
+		t.Errorf("suggestions from too few samples: %+v", got)
+	}
+
+	rows := Calibrate(samples)
+	var b bytes.Buffer
+	if err := WriteCalibrationCSV(&b, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "impact_type,band,count,impacted,impacted_rate,matched,under,over,average_tickets,actual_none,actual_low,actual_medium,actual_high,actual_critical\n" +
+		"fiber-works,low,1,1,1.0000,0,1,0,2.00,0,0,0,0,1\n"
+	if b.String() != wantCSV {
+		t.Errorf("CSV =\n%s\nwant\n%s", b.String(), wantCSV)
+	}
+}
+
+func TestOutcomeCheck(t *testing.T) {
+	tests := []struct {
+		outcome Outcome
+		ok      bool
+	}{
+		{Outcome{ActualSeverity: NoImpact}, true},
+		{Outcome{ActualSeverity: "critical", CustomerTickets: 40, Notes: "core outage"}, true},
+		{Outcome{ActualSeverity: ""}, false},
+		{Outcome{ActualSeverity: "severe"}, false},
+		{Outcome{ActualSeverity: "low", CustomerTickets: -1}, false},
+		{Outcome{ActualSeverity: "low", Notes: string(make([]byte, MaxOutcomeNotes+1))}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.outcome.Check(); (err == nil) != tt.ok {
+			t.Errorf("Check(%+v) = %v", tt.outcome.ActualSeverity, err)
+		}
+	}
+}
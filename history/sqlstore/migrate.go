@@ -0,0 +1,140 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Migration is one schema step, with the statements of the database's
+// dialect.
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+func (d dialect) migration(version int) Migration {
+	m := migrations[version-1]
+	statements := m.sqlite
+	if d.name == "postgres" {
+		statements = m.postgres
+	}
+	return Migration{Version: version, Name: m.name, Statements: statements}
+}
+
+// tooNew returns the SchemaTooNewError of a database at version, with the
+// release that migrated it when schema_migrations recorded one.
+func (s *sqlStore) tooNew(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}, version int) error {
+	err := &SchemaTooNewError{Version: version, Known: len(migrations)}
+	q.QueryRowContext(ctx, s.rebind(`SELECT release FROM schema_migrations WHERE version = ?`), version).Scan(&err.Release)
+	return err
+}
+
+// Migrator migrates a history database on demand, where Open migrates it
+// implicitly: it reports the pending migrations first and backs SQLite up.
+type Migrator struct {
+	s    *sqlStore
+	path string
+}
+
+// NewMigrator opens the database a DSN names, as Open does, without
+// migrating it. A SQLite database must exist already.
+func NewMigrator(ctx context.Context, dsn string) (*Migrator, error) {
+	d, dsn, err := dialectFor(dsn)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{}
+	if d.name == "sqlite" {
+		m.path, _, _ = strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+		if _, err := os.Stat(m.path); err != nil {
+			return nil, fmt.Errorf("sqlite history: %w", err)
+		}
+		if dsn, err = sqliteDSN(dsn); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s history: %w", d.name, err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s history: %w", d.name, err)
+	}
+	m.s = &sqlStore{db: db, dialect: d}
+	return m, nil
+}
+
+// Path is the file of a SQLite database, and empty for Postgres.
+func (m *Migrator) Path() string { return m.path }
+
+// Latest is the schema version this build migrates to.
+func (m *Migrator) Latest() int { return len(migrations) }
+
+// Version returns the schema version of the database, 0 when it was never
+// migrated.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	var tables int
+	if err := m.s.db.QueryRowContext(ctx, m.s.rebind(m.s.hasTable), "schema_migrations").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("reading the history schema version: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	version, err := m.s.SchemaVersion(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("reading the history schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Pending returns the migrations Migrate would apply, or a
+// SchemaTooNewError.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, m.s.tooNew(ctx, m.s.db, version)
+	}
+	var pending []Migration
+	for v := version + 1; v <= len(migrations); v++ {
+		pending = append(pending, m.s.migration(v))
+	}
+	return pending, nil
+}
+
+// Backup copies a SQLite database to target, a file that must not exist
+// yet, consistently while others write to it. Postgres is backed up with
+// its own tools.
+func (m *Migrator) Backup(ctx context.Context, target string) error {
+	if m.path == "" {
+		return errors.New("back up Postgres history with pg_dump")
+	}
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("backup %s exists already", target)
+	}
+	if _, err := m.s.db.ExecContext(ctx, `VACUUM INTO ?`, target); err != nil {
+		return fmt.Errorf("backing up %s: %w", m.path, err)
+	}
+	return nil
+}
+
+// Migrate applies the pending migrations as Open does; progress, when set,
+// hears of each one applied and how long it took.
+func (m *Migrator) Migrate(ctx context.Context, progress func(m Migration, took time.Duration)) error {
+	return m.s.migrate(ctx, len(migrations), progress)
+}
+
+func (m *Migrator) Close() error {
+	return m.s.Close()
+}
@@ -0,0 +1,1046 @@
+// Package sqlstore implements history.Store on SQLite and Postgres, with
+// migrations compiled in and applied on Open or by a Migrator.
+package sqlstore
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Open opens the store a DSN names, applying pending migrations:
+// "postgres://…" (or "postgresql://…") for Postgres, and "sqlite:PATH" or
+// a plain file path for SQLite.
+func Open(ctx context.Context, dsn string) (history.Store, error) {
+	d, dsn, err := dialectFor(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return openSQL(ctx, d, dsn)
+}
+
+// dialectFor returns the dialect of a DSN and what its driver opens.
+func dialectFor(dsn string) (dialect, string, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres, dsn, nil
+	case dsn == "":
+		return dialect{}, "", errors.New("empty history DSN")
+	default:
+		return sqlite, strings.TrimPrefix(dsn, "sqlite:"), nil
+	}
+}
+
+// dialect is what differs between the backends: the driver, the
+// placeholders, the schema and how migrations are serialized.
+type dialect struct {
+	name   string
+	driver string
+	// numbered placeholders ($1) instead of ?.
+	numbered bool
+	// lock serializes migrations across processes sharing the database.
+	lock func(ctx context.Context, conn *sql.Conn) (unlock func(), err error)
+	// month formats a column of Unix milliseconds as its UTC month,
+	// 2006-01.
+	month string
+	// hasTable counts the tables named ? in the current schema.
+	hasTable string
+}
+
+// migrationLockKey is the Postgres advisory lock held while migrating.
+const migrationLockKey = 0x6e62696d70616374 // "nbimpact"
+
+var (
+	postgres = dialect{name: "postgres", driver: "pgx", numbered: true, month: `to_char(to_timestamp(%s / 1000) AT TIME ZONE 'UTC', 'YYYY-MM')`, hasTable: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`, lock: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(migrationLockKey)); err != nil {
+			return nil, fmt.Errorf("taking the migration lock: %w", err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", int64(migrationLockKey))
+		}, nil
+	}}
+	// SQLite needs no lock of its own: transactions begin IMMEDIATE, so the
+	// first to begin holds the database's write lock and the others wait
+	// for it, then see its migration applied.
+	sqlite = dialect{name: "sqlite", driver: "sqlite3", month: `strftime('%%Y-%%m', %s / 1000, 'unixepoch')`, hasTable: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, lock: func(context.Context, *sql.Conn) (func(), error) {
+		return func() {}, nil
+	}}
+)
+
+// migration is one schema step. Steps are only ever appended: the version
+// of a database is the number of steps applied to it.
+type migration struct {
+	name     string
+	sqlite   []string
+	postgres []string
+}
+
+var migrations = []migration{
+	{
+		name: "records and jobs",
+		sqlite: []string{
+			`CREATE TABLE records (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at INTEGER NOT NULL,
+				reference TEXT NOT NULL DEFAULT '',
+				impact_type TEXT NOT NULL,
+				instance TEXT NOT NULL DEFAULT '',
+				total_impact REAL NOT NULL,
+				normalized_score REAL NOT NULL,
+				partial BOOLEAN NOT NULL DEFAULT FALSE,
+				request TEXT NOT NULL,
+				result TEXT NOT NULL
+			)`,
+			`CREATE INDEX records_created_at ON records (created_at)`,
+			`CREATE INDEX records_reference ON records (reference, created_at)`,
+			`CREATE TABLE jobs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				state TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL,
+				request TEXT NOT NULL,
+				history_id INTEGER NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX jobs_state ON jobs (state, created_at)`,
+		},
+		postgres: []string{
+			`CREATE TABLE records (
+				id BIGSERIAL PRIMARY KEY,
+				created_at BIGINT NOT NULL,
+				reference TEXT NOT NULL DEFAULT '',
+				impact_type TEXT NOT NULL,
+				instance TEXT NOT NULL DEFAULT '',
+				total_impact DOUBLE PRECISION NOT NULL,
+				normalized_score DOUBLE PRECISION NOT NULL,
+				partial BOOLEAN NOT NULL DEFAULT FALSE,
+				request TEXT NOT NULL,
+				result TEXT NOT NULL
+			)`,
+			`CREATE INDEX records_created_at ON records (created_at)`,
+			`CREATE INDEX records_reference ON records (reference, created_at)`,
+			`CREATE TABLE jobs (
+				id BIGSERIAL PRIMARY KEY,
+				state TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL,
+				request TEXT NOT NULL,
+				history_id BIGINT NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX jobs_state ON jobs (state, created_at)`,
+		},
+	},
+	{
+		name: "idempotency keys",
+		sqlite: []string{
+			`ALTER TABLE records ADD COLUMN idempotency_key TEXT`,
+			`CREATE UNIQUE INDEX records_idempotency_key ON records (idempotency_key)`,
+			`ALTER TABLE jobs ADD COLUMN idempotency_key TEXT`,
+			`CREATE UNIQUE INDEX jobs_idempotency_key ON jobs (idempotency_key)`,
+		},
+		postgres: []string{
+			`ALTER TABLE records ADD COLUMN idempotency_key TEXT`,
+			`CREATE UNIQUE INDEX records_idempotency_key ON records (idempotency_key)`,
+			`ALTER TABLE jobs ADD COLUMN idempotency_key TEXT`,
+			`CREATE UNIQUE INDEX jobs_idempotency_key ON jobs (idempotency_key)`,
+		},
+	},
+	{
+		name: "maintenance windows",
+		sqlite: []string{
+			`ALTER TABLE records ADD COLUMN window_start INTEGER`,
+			`ALTER TABLE records ADD COLUMN window_end INTEGER`,
+			`CREATE INDEX records_window ON records (window_start)`,
+		},
+		postgres: []string{
+			`ALTER TABLE records ADD COLUMN window_start BIGINT`,
+			`ALTER TABLE records ADD COLUMN window_end BIGINT`,
+			`CREATE INDEX records_window ON records (window_start)`,
+		},
+	},
+	{
+		name: "record tags",
+		sqlite: []string{
+			`CREATE TABLE record_tags (record_id INTEGER NOT NULL, tag TEXT NOT NULL, PRIMARY KEY (record_id, tag))`,
+			`CREATE INDEX record_tags_tag ON record_tags (tag, record_id)`,
+		},
+		postgres: []string{
+			`CREATE TABLE record_tags (record_id BIGINT NOT NULL, tag TEXT NOT NULL, PRIMARY KEY (record_id, tag))`,
+			`CREATE INDEX record_tags_tag ON record_tags (tag, record_id)`,
+		},
+	},
+	{
+		name: "job leases",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN worker TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE jobs ADD COLUMN lease_until INTEGER`,
+			`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN worker TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE jobs ADD COLUMN lease_until BIGINT`,
+			`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		name: "outcomes",
+		sqlite: []string{
+			`CREATE TABLE outcomes (
+				record_id INTEGER PRIMARY KEY,
+				actual_severity TEXT NOT NULL,
+				customer_tickets INTEGER NOT NULL,
+				notes TEXT NOT NULL DEFAULT '',
+				recorded_at INTEGER NOT NULL
+			)`,
+		},
+		postgres: []string{
+			`CREATE TABLE outcomes (
+				record_id BIGINT PRIMARY KEY,
+				actual_severity TEXT NOT NULL,
+				customer_tickets INTEGER NOT NULL,
+				notes TEXT NOT NULL DEFAULT '',
+				recorded_at BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		name: "record tenants",
+		sqlite: []string{
+			`CREATE TABLE record_tenants (record_id INTEGER NOT NULL, tenant TEXT NOT NULL, PRIMARY KEY (record_id, tenant))`,
+			`CREATE INDEX record_tenants_tenant ON record_tenants (tenant, record_id)`,
+		},
+		postgres: []string{
+			`CREATE TABLE record_tenants (record_id BIGINT NOT NULL, tenant TEXT NOT NULL, PRIMARY KEY (record_id, tenant))`,
+			`CREATE INDEX record_tenants_tenant ON record_tenants (tenant, record_id)`,
+		},
+	},
+	{
+		name: "record sites",
+		sqlite: []string{
+			`CREATE TABLE record_sites (record_id INTEGER NOT NULL, site TEXT NOT NULL, PRIMARY KEY (record_id, site))`,
+		},
+		postgres: []string{
+			`CREATE TABLE record_sites (record_id BIGINT NOT NULL, site TEXT NOT NULL, PRIMARY KEY (record_id, site))`,
+		},
+	},
+	{
+		name:     "migration releases",
+		sqlite:   []string{`ALTER TABLE schema_migrations ADD COLUMN release TEXT NOT NULL DEFAULT ''`},
+		postgres: []string{`ALTER TABLE schema_migrations ADD COLUMN release TEXT NOT NULL DEFAULT ''`},
+	},
+}
+
+// releaseVersion is the migration from which schema_migrations records
+// the release that applied each one.
+const releaseVersion = 9
+
+// SchemaTooNewError refuses a database a newer binary has migrated.
+// Release is the netbox-impact release that applied its newest migration,
+// when the database recorded it.
+type SchemaTooNewError struct {
+	Version, Known int
+	Release        string
+}
+
+func (e *SchemaTooNewError) Error() string {
+	msg := fmt.Sprintf("history schema version %d is newer than netbox-impact %s knows (%d)", e.Version, netbox.Version, e.Known)
+	if e.Release != "" {
+		return msg + fmt.Sprintf("; it was migrated by netbox-impact %s: run that release or a newer one", e.Release)
+	}
+	return msg + "; run the netbox-impact release that migrated it, or a newer one"
+}
+
+type sqlStore struct {
+	db *sql.DB
+	dialect
+}
+
+func openSQL(ctx context.Context, d dialect, dsn string) (history.Store, error) {
+	if d.name == "sqlite" {
+		var err error
+		if dsn, err = sqliteDSN(dsn); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s history: %w", d.name, err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	if err := s.migrate(ctx, len(migrations), nil); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sqliteDSN adds the settings the store relies on to a SQLite path: a busy
+// timeout so writers wait for each other and IMMEDIATE transactions.
+func sqliteDSN(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("empty SQLite path")
+	}
+	file, query, _ := strings.Cut(path, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid SQLite DSN %q: %w", path, err)
+	}
+	params.Set("_txlock", "immediate")
+	if params.Get("_busy_timeout") == "" {
+		params.Set("_busy_timeout", "10000")
+	}
+	if params.Get("_journal_mode") == "" {
+		params.Set("_journal_mode", "WAL")
+	}
+	return "file:" + strings.TrimPrefix(file, "file:") + "?" + params.Encode(), nil
+}
+
+// migrate applies the pending migrations up to version to, each in its
+// own transaction, under the dialect's lock; progress, when set, hears of
+// each one applied.
+func (s *sqlStore) migrate(ctx context.Context, to int, progress func(m Migration, took time.Duration)) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting to %s history: %w", s.name, err)
+	}
+	defer conn.Close()
+	unlock, err := s.lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at BIGINT NOT NULL)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	for {
+		start := time.Now()
+		applied, err := s.migrateStep(ctx, conn, to)
+		if err != nil || applied == 0 {
+			return err
+		}
+		if progress != nil {
+			progress(s.migration(applied), time.Since(start))
+		}
+	}
+}
+
+// migrateStep applies the next pending migration up to version to and
+// returns its version, or 0 when none was left.
+func (s *sqlStore) migrateStep(ctx context.Context, conn *sql.Conn, to int) (int, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("reading the history schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return 0, s.tooNew(ctx, tx, version)
+	}
+	if version >= to {
+		return 0, nil
+	}
+	m := s.migration(version + 1)
+	for _, stmt := range m.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return 0, fmt.Errorf("history migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	insert, args := `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, []any{m.Version, m.Name, time.Now().UnixMilli()}
+	if m.Version >= releaseVersion {
+		insert, args = `INSERT INTO schema_migrations (version, name, applied_at, release) VALUES (?, ?, ?, ?)`, append(args, netbox.Version)
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(insert), args...); err != nil {
+		return 0, err
+	}
+	return m.Version, tx.Commit()
+}
+
+func (s *sqlStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind turns ? placeholders into $1, $2… for Postgres.
+func (s *sqlStore) rebind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Save(ctx context.Context, r history.Record) (history.Record, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return history.Record{}, fmt.Errorf("saving history record: %w", err)
+	}
+	defer tx.Rollback()
+	if r, err = s.save(ctx, tx, r); err != nil {
+		return history.Record{}, err
+	}
+	return r, tx.Commit()
+}
+
+func (s *sqlStore) save(ctx context.Context, tx *sql.Tx, r history.Record) (history.Record, error) {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	r.CreatedAt = r.CreatedAt.UTC().Truncate(time.Millisecond)
+	request, err := json.Marshal(r.Request)
+	if err != nil {
+		return history.Record{}, err
+	}
+	result, err := json.Marshal(r.Result)
+	if err != nil {
+		return history.Record{}, err
+	}
+	err = tx.QueryRowContext(ctx, s.rebind(`INSERT INTO records (created_at, reference, impact_type, instance, total_impact, normalized_score, partial, window_start, window_end, request, result, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (idempotency_key) DO NOTHING RETURNING id`),
+		r.CreatedAt.UnixMilli(), r.Reference, string(r.ImpactType), r.Instance, r.TotalImpact, r.NormalizedScore, r.Partial, nullTime(r.WindowStart), nullTime(r.WindowEnd),
+		string(request), string(result), nullKey(r.IdempotencyKey)).Scan(&r.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The key was saved before: a retry.
+		var saved string
+		err = tx.QueryRowContext(ctx, s.rebind(`SELECT id, request FROM records WHERE idempotency_key = ?`), r.IdempotencyKey).Scan(&r.ID, &saved)
+		if err == nil && saved != string(request) {
+			return history.Record{}, fmt.Errorf("history record %d: %w", r.ID, history.ErrKeyReused)
+		}
+		if err != nil {
+			return history.Record{}, fmt.Errorf("saving history record: %w", err)
+		}
+		return r, nil
+	}
+	if err != nil {
+		return history.Record{}, fmt.Errorf("saving history record: %w", err)
+	}
+	for _, tag := range r.Tags {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO record_tags (record_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`), r.ID, tag); err != nil {
+			return history.Record{}, fmt.Errorf("saving history record tags: %w", err)
+		}
+	}
+	for _, tenant := range r.Tenants {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO record_tenants (record_id, tenant) VALUES (?, ?) ON CONFLICT DO NOTHING`), r.ID, tenant); err != nil {
+			return history.Record{}, fmt.Errorf("saving history record tenants: %w", err)
+		}
+	}
+	for _, site := range r.Sites {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO record_sites (record_id, site) VALUES (?, ?) ON CONFLICT DO NOTHING`), r.ID, site); err != nil {
+			return history.Record{}, fmt.Errorf("saving history record sites: %w", err)
+		}
+	}
+	return r, nil
+}
+
+func nullTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
+
+func timeFrom(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := time.UnixMilli(ms.Int64).UTC()
+	return &t
+}
+
+// nullKey stores an empty idempotency key as NULL, which the unique
+// index does not compare.
+func nullKey(key string) sql.NullString {
+	return sql.NullString{String: key, Valid: key != ""}
+}
+
+const recordColumns = `id, created_at, reference, impact_type, instance, total_impact, normalized_score, partial, window_start, window_end, request`
+
+// scanRecord scans recordColumns, plus result when withResult is set.
+func scanRecord(row interface{ Scan(...any) error }, withResult bool) (history.Record, error) {
+	var r history.Record
+	var createdAt int64
+	var impactType, request, result string
+	var windowStart, windowEnd sql.NullInt64
+	dest := []any{&r.ID, &createdAt, &r.Reference, &impactType, &r.Instance, &r.TotalImpact, &r.NormalizedScore, &r.Partial, &windowStart, &windowEnd, &request}
+	if withResult {
+		dest = append(dest, &result)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return history.Record{}, err
+	}
+	r.CreatedAt = time.UnixMilli(createdAt).UTC()
+	r.WindowStart, r.WindowEnd = timeFrom(windowStart), timeFrom(windowEnd)
+	r.ImpactType = impact.ImpactType(impactType)
+	if err := json.Unmarshal([]byte(request), &r.Request); err != nil {
+		return history.Record{}, fmt.Errorf("history record %d: request: %w", r.ID, err)
+	}
+	r.Tags = r.Request.Tags
+	if withResult {
+		r.Result = new(impact.ImpactResult)
+		if err := json.Unmarshal([]byte(result), r.Result); err != nil {
+			return history.Record{}, fmt.Errorf("history record %d: result: %w", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, id int64) (history.Record, error) {
+	return s.get(ctx, id, "", nil)
+}
+
+func (s *sqlStore) GetForTenants(ctx context.Context, id int64, tenants []string) (history.Record, error) {
+	cond, args := tenantCondition(tenants)
+	return s.get(ctx, id, " AND "+cond, args)
+}
+
+// get loads record id if it also meets cond.
+func (s *sqlStore) get(ctx context.Context, id int64, cond string, args []any) (history.Record, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+recordColumns+`, result FROM records WHERE id = ?`+cond), append([]any{id}, args...)...)
+	r, err := scanRecord(row, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		return history.Record{}, fmt.Errorf("history record %d: %w", id, history.ErrNotFound)
+	}
+	if err != nil {
+		return history.Record{}, err
+	}
+	var o history.Outcome
+	var recordedAt int64
+	err = s.db.QueryRowContext(ctx, s.rebind(`SELECT actual_severity, customer_tickets, notes, recorded_at FROM outcomes WHERE record_id = ?`), id).
+		Scan(&o.ActualSeverity, &o.CustomerTickets, &o.Notes, &recordedAt)
+	switch {
+	case err == nil:
+		o.RecordedAt = time.UnixMilli(recordedAt).UTC()
+		r.Outcome = &o
+	case !errors.Is(err, sql.ErrNoRows):
+		return history.Record{}, fmt.Errorf("history record %d: outcome: %w", id, err)
+	}
+	return r, nil
+}
+
+func (s *sqlStore) RecordOutcome(ctx context.Context, id int64, o history.Outcome) (history.Record, error) {
+	if err := o.Check(); err != nil {
+		return history.Record{}, err
+	}
+	if o.RecordedAt.IsZero() {
+		o.RecordedAt = time.Now()
+	}
+	// The insert only finds the record when it exists.
+	res, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO outcomes (record_id, actual_severity, customer_tickets, notes, recorded_at)
+		SELECT id, ?, ?, ?, ? FROM records WHERE id = ?
+		ON CONFLICT (record_id) DO UPDATE SET actual_severity = excluded.actual_severity, customer_tickets = excluded.customer_tickets,
+			notes = excluded.notes, recorded_at = excluded.recorded_at`),
+		o.ActualSeverity, o.CustomerTickets, o.Notes, o.RecordedAt.UnixMilli(), id)
+	if err != nil {
+		return history.Record{}, fmt.Errorf("history record %d: recording outcome: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return history.Record{}, err
+	} else if n == 0 {
+		return history.Record{}, fmt.Errorf("history record %d: %w", id, history.ErrNotFound)
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *sqlStore) Outcomes(ctx context.Context, f history.Filter) ([]history.CalibrationSample, error) {
+	where, args := where(f)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, impact_type, total_impact, normalized_score, result, actual_severity, customer_tickets, notes, recorded_at
+		FROM records JOIN outcomes ON outcomes.record_id = records.id`+where+` ORDER BY created_at, id`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing outcomes: %w", err)
+	}
+	defer rows.Close()
+	samples := []history.CalibrationSample{}
+	for rows.Next() {
+		var sample history.CalibrationSample
+		var impactType, result string
+		var recordedAt int64
+		if err := rows.Scan(&sample.HistoryID, &impactType, &sample.TotalImpact, &sample.NormalizedScore, &result,
+			&sample.Outcome.ActualSeverity, &sample.Outcome.CustomerTickets, &sample.Outcome.Notes, &recordedAt); err != nil {
+			return nil, err
+		}
+		var multiplier struct {
+			Multiplier float64 `json:"multiplier"`
+		}
+		if err := json.Unmarshal([]byte(result), &multiplier); err != nil {
+			return nil, fmt.Errorf("history record %d: result: %w", sample.HistoryID, err)
+		}
+		sample.ImpactType = impact.ImpactType(impactType)
+		sample.Multiplier = multiplier.Multiplier
+		sample.Outcome.RecordedAt = time.UnixMilli(recordedAt).UTC()
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// where renders the conditions of f.
+func where(f history.Filter) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg ...any) {
+		conds = append(conds, cond)
+		args = append(args, arg...)
+	}
+	if f.Reference != "" {
+		add("reference = ?", f.Reference)
+	}
+	for _, tag := range f.Tags {
+		add("id IN (SELECT record_id FROM record_tags WHERE tag = ?)", tag)
+	}
+	if f.Tenants != nil {
+		cond, tenants := tenantCondition(f.Tenants)
+		add(cond, tenants...)
+	}
+	if f.ImpactType != "" {
+		add("impact_type = ?", string(f.ImpactType))
+	}
+	if f.Instance != "" {
+		add("instance = ?", f.Instance)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= ?", f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		add("created_at < ?", f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// tenantCondition selects the records scoring any of tenants; none
+// selects nothing.
+func tenantCondition(tenants []string) (string, []any) {
+	if len(tenants) == 0 {
+		return "1 = 0", nil
+	}
+	args := make([]any, len(tenants))
+	for i, t := range tenants {
+		args[i] = t
+	}
+	return "id IN (SELECT record_id FROM record_tenants WHERE tenant IN (?" + strings.Repeat(", ?", len(tenants)-1) + "))", args
+}
+
+func (s *sqlStore) List(ctx context.Context, f history.Filter) ([]history.Record, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = history.DefaultLimit
+	}
+	limit = min(limit, history.MaxLimit)
+	columns := recordColumns
+	if f.WithResults {
+		columns += ", result"
+	}
+	where, args := where(f)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+columns+` FROM records`+where+` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`), append(args, limit, max(f.Offset, 0))...)
+	if err != nil {
+		return nil, fmt.Errorf("listing history: %w", err)
+	}
+	defer rows.Close()
+	records := []history.Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows, f.WithResults)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) KeyedRecords(ctx context.Context, since time.Time) ([]history.Record, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+recordColumns+`, result, idempotency_key FROM records
+		WHERE idempotency_key IS NOT NULL AND created_at >= ? ORDER BY created_at, id`), since.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("listing keyed history: %w", err)
+	}
+	records := []history.Record{}
+	for rows.Next() {
+		var key string
+		r, err := scanRecord(keyedRow{rows, &key}, true)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.IdempotencyKey = key
+		records = append(records, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		var err error
+		if records[i].Tenants, err = s.indexed(ctx, "record_tenants", "tenant", records[i].ID); err != nil {
+			return nil, err
+		}
+		if records[i].Sites, err = s.indexed(ctx, "record_sites", "site", records[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// keyedRow scans a row of scanRecord's columns followed by the
+// idempotency key.
+type keyedRow struct {
+	row interface{ Scan(...any) error }
+	key *string
+}
+
+func (k keyedRow) Scan(dest ...any) error {
+	return k.row.Scan(append(dest, k.key)...)
+}
+
+// indexed reads the column of table indexing record id: its tenants or
+// sites.
+func (s *sqlStore) indexed(ctx context.Context, table, column string, id int64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+column+` FROM `+table+` WHERE record_id = ? ORDER BY `+column), id)
+	if err != nil {
+		return nil, fmt.Errorf("history record %d: %s: %w", id, table, err)
+	}
+	defer rows.Close()
+	var tenants []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+const msPerDay = int64(24 * time.Hour / time.Millisecond)
+
+func (s *sqlStore) Trend(ctx context.Context, f history.Filter) ([]history.TrendPoint, error) {
+	where, args := where(f)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT created_at / ? AS day, COUNT(*), AVG(total_impact), MIN(total_impact), MAX(total_impact)
+		FROM records`+where+` GROUP BY day ORDER BY day`), append([]any{msPerDay}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("history trend: %w", err)
+	}
+	defer rows.Close()
+	points := []history.TrendPoint{}
+	for rows.Next() {
+		var day int64
+		var p history.TrendPoint
+		if err := rows.Scan(&day, &p.Count, &p.AverageImpact, &p.MinImpact, &p.MaxImpact); err != nil {
+			return nil, err
+		}
+		p.Day = time.UnixMilli(day * msPerDay).UTC().Format(time.DateOnly)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// severityCase bands normalized_score as impact.ScoreSeverity does.
+const severityCase = `CASE WHEN normalized_score >= 75 THEN 'critical' WHEN normalized_score >= 50 THEN 'high' WHEN normalized_score >= 25 THEN 'medium' ELSE 'low' END`
+
+func (s *sqlStore) Stats(ctx context.Context, since time.Time, minGroupSize, topSites int) (history.Stats, error) {
+	st := history.Stats{GeneratedAt: time.Now().UTC(), MinGroupSize: max(minGroupSize, 1),
+		Months: []history.MonthStats{}, Severities: []history.SeverityCount{}, TopSites: []history.SiteCount{}}
+	// query runs one GROUP BY and hands each row to scan.
+	query := func(q string, args []any, scan func(*sql.Rows) error) error {
+		rows, err := s.db.QueryContext(ctx, s.rebind(q), args...)
+		if err != nil {
+			return fmt.Errorf("history stats: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	from, minGroup := since.UnixMilli(), st.MinGroupSize
+	month := fmt.Sprintf(s.month, "created_at")
+	err := query(`SELECT `+month+` AS month, impact_type, COUNT(*), SUM(total_impact), AVG(total_impact) FROM records
+		WHERE created_at >= ? GROUP BY month, impact_type HAVING COUNT(*) >= ? ORDER BY month, impact_type`, []any{from, minGroup}, func(rows *sql.Rows) error {
+		var m history.MonthStats
+		if err := rows.Scan(&m.Month, &m.ImpactType, &m.Count, &m.TotalImpact, &m.AverageImpact); err != nil {
+			return err
+		}
+		st.Months = append(st.Months, m)
+		return nil
+	})
+	if err != nil {
+		return history.Stats{}, err
+	}
+	err = query(`SELECT `+severityCase+` AS severity, COUNT(*) FROM records
+		WHERE created_at >= ? GROUP BY severity HAVING COUNT(*) >= ?`, []any{from, minGroup}, func(rows *sql.Rows) error {
+		var c history.SeverityCount
+		if err := rows.Scan(&c.Severity, &c.Count); err != nil {
+			return err
+		}
+		st.Severities = append(st.Severities, c)
+		return nil
+	})
+	if err != nil {
+		return history.Stats{}, err
+	}
+	slices.SortFunc(st.Severities, func(a, b history.SeverityCount) int {
+		return cmp.Compare(slices.Index(impact.Severities, a.Severity), slices.Index(impact.Severities, b.Severity))
+	})
+	err = query(`SELECT site, COUNT(*) AS n FROM record_sites WHERE record_id IN (SELECT id FROM records WHERE created_at >= ?)
+		GROUP BY site HAVING COUNT(*) >= ? ORDER BY n DESC, site LIMIT ?`, []any{from, minGroup, max(topSites, 0)}, func(rows *sql.Rows) error {
+		var c history.SiteCount
+		if err := rows.Scan(&c.Site, &c.Count); err != nil {
+			return err
+		}
+		st.TopSites = append(st.TopSites, c)
+		return nil
+	})
+	if err != nil {
+		return history.Stats{}, err
+	}
+	return st, nil
+}
+
+func (s *sqlStore) Scheduled(ctx context.Context, start, end time.Time, excludeReference string) ([]history.Record, error) {
+	// A window without an end overlaps when its start is inside.
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+recordColumns+` FROM records
+		WHERE window_start < ? AND (window_end > ? OR (window_end IS NULL AND window_start >= ?))
+		AND (reference = '' OR id = (SELECT MAX(id) FROM records latest WHERE latest.reference = records.reference))
+		AND (reference = '' OR reference <> ?)
+		ORDER BY window_start, id`), end.UnixMilli(), start.UnixMilli(), start.UnixMilli(), excludeReference)
+	if err != nil {
+		return nil, fmt.Errorf("listing scheduled history: %w", err)
+	}
+	defer rows.Close()
+	records := []history.Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM record_tags WHERE record_id IN (SELECT id FROM records WHERE created_at < ?)`), before.UnixMilli()); err != nil {
+		return 0, fmt.Errorf("pruning history tags: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM record_tenants WHERE record_id IN (SELECT id FROM records WHERE created_at < ?)`), before.UnixMilli()); err != nil {
+		return 0, fmt.Errorf("pruning history tenants: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM record_sites WHERE record_id IN (SELECT id FROM records WHERE created_at < ?)`), before.UnixMilli()); err != nil {
+		return 0, fmt.Errorf("pruning history sites: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM outcomes WHERE record_id IN (SELECT id FROM records WHERE created_at < ?)`), before.UnixMilli()); err != nil {
+		return 0, fmt.Errorf("pruning history outcomes: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM records WHERE created_at < ?`), before.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("pruning history: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM jobs WHERE created_at < ? AND state IN (?, ?)`), before.UnixMilli(), string(history.JobDone), string(history.JobFailed)); err != nil {
+		return 0, fmt.Errorf("pruning jobs: %w", err)
+	}
+	return n, nil
+}
+
+func (s *sqlStore) CreateJob(ctx context.Context, req impact.ImpactRequest, idempotencyKey string) (history.Job, bool, error) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return history.Job{}, false, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	job := history.Job{State: history.JobQueued, CreatedAt: now, UpdatedAt: now, Request: req}
+	err = s.db.QueryRowContext(ctx, s.rebind(`INSERT INTO jobs (state, created_at, updated_at, request, idempotency_key) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (idempotency_key) DO NOTHING RETURNING id`),
+		string(job.State), now.UnixMilli(), now.UnixMilli(), string(request), nullKey(idempotencyKey)).Scan(&job.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The key was used before: a retry, answered with that job.
+		job, err = scanJob(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+jobColumns+` FROM jobs WHERE idempotency_key = ?`), idempotencyKey))
+		if err != nil {
+			return history.Job{}, false, fmt.Errorf("creating job: %w", err)
+		}
+		if saved, _ := json.Marshal(job.Request); string(saved) != string(request) {
+			return history.Job{}, false, fmt.Errorf("job %d: %w", job.ID, history.ErrKeyReused)
+		}
+		return job, false, nil
+	}
+	if err != nil {
+		return history.Job{}, false, fmt.Errorf("creating job: %w", err)
+	}
+	return job, true, nil
+}
+
+const jobColumns = `id, state, created_at, updated_at, request, history_id, error, worker, lease_until, attempts, idempotency_key`
+
+func scanJob(row interface{ Scan(...any) error }) (history.Job, error) {
+	var j history.Job
+	var state, request string
+	var createdAt, updatedAt int64
+	var leaseUntil sql.NullInt64
+	var key sql.NullString
+	if err := row.Scan(&j.ID, &state, &createdAt, &updatedAt, &request, &j.HistoryID, &j.Error, &j.Worker, &leaseUntil, &j.Attempts, &key); err != nil {
+		return history.Job{}, err
+	}
+	j.IdempotencyKey = key.String
+	j.State = history.JobState(state)
+	j.CreatedAt, j.UpdatedAt = time.UnixMilli(createdAt).UTC(), time.UnixMilli(updatedAt).UTC()
+	j.LeaseUntil = timeFrom(leaseUntil)
+	if err := json.Unmarshal([]byte(request), &j.Request); err != nil {
+		return history.Job{}, fmt.Errorf("job %d: request: %w", j.ID, err)
+	}
+	return j, nil
+}
+
+func (s *sqlStore) GetJob(ctx context.Context, id int64) (history.Job, error) {
+	j, err := scanJob(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return history.Job{}, fmt.Errorf("job %d: %w", id, history.ErrNotFound)
+	}
+	return j, err
+}
+
+func (s *sqlStore) ListJobs(ctx context.Context, state history.JobState, limit int) ([]history.Job, error) {
+	if limit <= 0 {
+		limit = history.DefaultLimit
+	}
+	query, args := `SELECT `+jobColumns+` FROM jobs`, []any{}
+	if state != "" {
+		query += ` WHERE state = ?`
+		args = append(args, string(state))
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+` ORDER BY created_at DESC, id DESC LIMIT ?`), append(args, min(limit, history.MaxLimit))...)
+	if err != nil {
+		return nil, fmt.Errorf("listing jobs: %w", err)
+	}
+	defer rows.Close()
+	jobs := []history.Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// held is the condition selecting job ? while worker ? holds it. A worker
+// whose lease expired still holds the job until another claims it.
+const held = `id = ? AND worker = ? AND state IN ('claimed', 'running')`
+
+// expired is the condition selecting the claimed and running jobs whose
+// lease ran out before ?. Jobs left running by a version without leases
+// have none and count as expired.
+const expired = `state IN ('claimed', 'running') AND (lease_until IS NULL OR lease_until < ?)`
+
+func (s *sqlStore) ClaimJob(ctx context.Context, worker string, lease time.Duration) (history.Job, bool, error) {
+	now := time.Now().UnixMilli()
+	if _, err := s.db.ExecContext(ctx, s.rebind(`UPDATE jobs SET state = 'failed', error = ?, lease_until = NULL, updated_at = ? WHERE `+expired+` AND attempts >= ?`),
+		fmt.Sprintf("abandoned after %d attempts: the workers running it stopped renewing its lease", history.MaxJobAttempts), now, now, history.MaxJobAttempts); err != nil {
+		return history.Job{}, false, fmt.Errorf("failing abandoned jobs: %w", err)
+	}
+	// Postgres workers skip the rows others are claiming; SQLite runs one
+	// write at a time.
+	lock := ""
+	if s.name == "postgres" {
+		lock = " FOR UPDATE SKIP LOCKED"
+	}
+	job, err := scanJob(s.db.QueryRowContext(ctx, s.rebind(`UPDATE jobs SET state = 'claimed', worker = ?, lease_until = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE state = 'queued' OR (`+expired+`) ORDER BY id LIMIT 1`+lock+`)
+		RETURNING `+jobColumns),
+		worker, now+lease.Milliseconds(), now, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return history.Job{}, false, nil
+	}
+	if err != nil {
+		return history.Job{}, false, fmt.Errorf("claiming a job: %w", err)
+	}
+	return job, true, nil
+}
+
+// updateHeld runs an UPDATE of a job worker holds, set being its SET
+// clause, and returns ErrLeaseLost when it changed nothing.
+func updateHeld(ctx context.Context, exec interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, s *sqlStore, id int64, worker, set string, args ...any) error {
+	res, err := exec.ExecContext(ctx, s.rebind(`UPDATE jobs SET `+set+` WHERE `+held), append(args, id, worker)...)
+	if err != nil {
+		return fmt.Errorf("updating job %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("job %d, worker %s: %w", id, worker, history.ErrLeaseLost)
+	}
+	return nil
+}
+
+func (s *sqlStore) RenewLease(ctx context.Context, id int64, worker string, lease time.Duration) error {
+	now := time.Now().UnixMilli()
+	return updateHeld(ctx, s.db, s, id, worker, `lease_until = ?, updated_at = ?`, now+lease.Milliseconds(), now)
+}
+
+func (s *sqlStore) ReleaseJob(ctx context.Context, id int64, worker string) error {
+	return updateHeld(ctx, s.db, s, id, worker, `state = 'queued', lease_until = NULL, attempts = attempts - 1, updated_at = ?`, time.Now().UnixMilli())
+}
+
+func (s *sqlStore) UpdateJob(ctx context.Context, id int64, worker string, state history.JobState, errMsg string) error {
+	if state != history.JobRunning && state != history.JobFailed {
+		return fmt.Errorf("job %d: cannot move to %q", id, state)
+	}
+	set := `state = ?, error = ?, updated_at = ?`
+	if state == history.JobFailed {
+		set += `, lease_until = NULL`
+	}
+	return updateHeld(ctx, s.db, s, id, worker, set, string(state), errMsg, time.Now().UnixMilli())
+}
+
+func (s *sqlStore) CompleteJob(ctx context.Context, id int64, worker string, r history.Record) (history.Record, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return history.Record{}, fmt.Errorf("completing job %d: %w", id, err)
+	}
+	defer tx.Rollback()
+	if r, err = s.save(ctx, tx, r); err != nil {
+		return history.Record{}, err
+	}
+	if err := updateHeld(ctx, tx, s, id, worker, `state = 'done', history_id = ?, error = '', lease_until = NULL, updated_at = ?`, r.ID, time.Now().UnixMilli()); err != nil {
+		return history.Record{}, err
+	}
+	return r, tx.Commit()
+}
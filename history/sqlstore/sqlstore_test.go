@@ -0,0 +1,1022 @@
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// postgresDSNEnv names a Postgres database the tests may create schemas
+// in; without it the Postgres runs are skipped.
+const postgresDSNEnv = "NETBOX_IMPACT_TEST_POSTGRES_DSN"
+
+// backends returns a function per backend giving the DSN of a fresh,
+// empty database.
+func backends(t *testing.T) map[string]func(t *testing.T) string {
+	return map[string]func(t *testing.T) string{
+		"sqlite": func(t *testing.T) string {
+			return "sqlite:" + filepath.Join(t.TempDir(), "history.db")
+		},
+		"postgres": func(t *testing.T) string {
+			dsn := os.Getenv(postgresDSNEnv)
+			if dsn == "" {
+				t.Skipf("set %s to run against Postgres", postgresDSNEnv)
+			}
+			db, err := sql.Open("pgx", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			schema := fmt.Sprintf("netbox_impact_test_%d", time.Now().UnixNano())
+			if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				db, err := sql.Open("pgx", dsn)
+				if err == nil {
+					db.Exec("DROP SCHEMA " + schema + " CASCADE")
+					db.Close()
+				}
+			})
+			u, err := url.Parse(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		},
+	}
+}
+
+func open(t *testing.T, dsn string) history.Store {
+	t.Helper()
+	s, err := Open(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func record(reference string, impactType impact.ImpactType, total float64, at time.Time) history.Record {
+	req := impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impactType, Reference: reference}
+	result := impact.ImpactResult{ImpactType: impactType, TotalImpact: total, NormalizedScore: total / 2, Warnings: []impact.DataWarning{{ObjectType: "device", ID: 1, Severity: impact.SeverityLow, Message: "no cable label"}}}
+	r := history.NewRecord(req, result)
+	r.CreatedAt = at
+	return r
+}
+
+// TestStore runs the same suite against every backend, so they stay
+// interchangeable.
+func TestStore(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			day := time.Date(2026, 7, 12, 22, 0, 0, 0, time.UTC)
+			var saved []history.Record
+			for i, r := range []history.Record{
+				record("CHG-1", impact.PlannedWork, 10, day),
+				record("CHG-1", impact.PlannedWork, 20, day.Add(time.Hour)),
+				record("CHG-1", impact.PlannedWork, 60, day.Add(26*time.Hour)),
+				record("CHG-2", impact.FiberWorks, 5, day.Add(2*time.Hour)),
+				record("", impact.IncidentWork, 1, day.Add(-48*time.Hour)),
+			} {
+				got, err := s.Save(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.ID == 0 || (i > 0 && got.ID == saved[i-1].ID) {
+					t.Errorf("record %d got ID %d", i, got.ID)
+				}
+				saved = append(saved, got)
+			}
+
+			got, err := s.Get(ctx, saved[1].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Result == nil || got.Result.TotalImpact != 20 || got.Result.Warnings[0].Severity != impact.SeverityLow || got.Request.Reference != "CHG-1" || !got.CreatedAt.Equal(day.Add(time.Hour)) {
+				t.Errorf("Get = %+v", got)
+			}
+			if _, err := s.Get(ctx, 9999); !errors.Is(err, history.ErrNotFound) {
+				t.Errorf("Get(9999) error = %v, want history.ErrNotFound", err)
+			}
+
+			ids := func(records []history.Record) []int64 {
+				var ids []int64
+				for _, r := range records {
+					ids = append(ids, r.ID)
+				}
+				return ids
+			}
+			filters := []struct {
+				name string
+				f    history.Filter
+				want []history.Record
+			}{
+				{"everything, newest first", history.Filter{}, []history.Record{saved[2], saved[3], saved[1], saved[0], saved[4]}},
+				{"reference", history.Filter{Reference: "CHG-1"}, []history.Record{saved[2], saved[1], saved[0]}},
+				{"impact type", history.Filter{ImpactType: impact.FiberWorks}, []history.Record{saved[3]}},
+				{"since inclusive, until exclusive", history.Filter{Since: day, Until: day.Add(2 * time.Hour)}, []history.Record{saved[1], saved[0]}},
+				{"page", history.Filter{Limit: 2, Offset: 1}, []history.Record{saved[3], saved[1]}},
+				{"no match", history.Filter{Reference: "CHG-3"}, nil},
+			}
+			for _, tt := range filters {
+				records, err := s.List(ctx, tt.f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(ids(records)) != fmt.Sprint(ids(tt.want)) {
+					t.Errorf("%s: %v, want %v", tt.name, ids(records), ids(tt.want))
+				}
+				for _, r := range records {
+					if r.Result != nil {
+						t.Errorf("%s: List loaded a result without WithResults", tt.name)
+					}
+				}
+			}
+			if records, err := s.List(ctx, history.Filter{Reference: "CHG-2", WithResults: true}); err != nil || len(records) != 1 || records[0].Result == nil || records[0].Result.TotalImpact != 5 {
+				t.Errorf("List with results = %+v, %v", records, err)
+			}
+
+			trend, err := s.Trend(ctx, history.Filter{Reference: "CHG-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTrend := []history.TrendPoint{
+				{Day: "2026-07-12", Count: 2, AverageImpact: 15, MinImpact: 10, MaxImpact: 20},
+				{Day: "2026-07-14", Count: 1, AverageImpact: 60, MinImpact: 60, MaxImpact: 60},
+			}
+			if fmt.Sprint(trend) != fmt.Sprint(wantTrend) {
+				t.Errorf("trend = %+v, want %+v", trend, wantTrend)
+			}
+
+			var export bytes.Buffer
+			if err := history.Export(ctx, s, history.Filter{Reference: "CHG-1", Limit: 1}, &export, nil); err != nil {
+				t.Fatal(err)
+			}
+			dec := json.NewDecoder(&export)
+			var exported []int64
+			for dec.More() {
+				var r history.Record
+				if err := dec.Decode(&r); err != nil {
+					t.Fatal(err)
+				}
+				if r.Result == nil {
+					t.Errorf("exported record %d without its result", r.ID)
+				}
+				exported = append(exported, r.ID)
+			}
+			if fmt.Sprint(exported) != fmt.Sprint([]int64{saved[2].ID, saved[1].ID, saved[0].ID}) {
+				t.Errorf("exported %v", exported)
+			}
+
+			job, created, err := s.CreateJob(ctx, saved[0].Request, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !created || job.State != history.JobQueued || job.ID == 0 {
+				t.Errorf("new job = %+v", job)
+			}
+			failed, _, err := s.CreateJob(ctx, saved[3].Request, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []int64{job.ID, failed.ID} {
+				if claimed, ok, err := s.ClaimJob(ctx, "w1", time.Minute); err != nil || !ok || claimed.ID != id || claimed.State != history.JobClaimed || claimed.Attempts != 1 || claimed.LeaseUntil == nil {
+					t.Fatalf("ClaimJob = %+v, %v, %v; want job %d", claimed, ok, err, id)
+				}
+			}
+			if _, ok, err := s.ClaimJob(ctx, "w1", time.Minute); ok || err != nil {
+				t.Errorf("ClaimJob with nothing queued = %v, %v", ok, err)
+			}
+			done, err := s.CompleteJob(ctx, job.ID, "w1", record("CHG-1", impact.PlannedWork, 30, day.Add(3*time.Hour)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.UpdateJob(ctx, failed.ID, "w1", history.JobFailed, "NetBox unavailable"); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.GetJob(ctx, job.ID); err != nil || got.State != history.JobDone || got.HistoryID != done.ID || got.Request.Reference != "CHG-1" || got.Worker != "w1" || got.LeaseUntil != nil {
+				t.Errorf("GetJob = %+v, %v", got, err)
+			}
+			if jobs, err := s.ListJobs(ctx, history.JobFailed, 0); err != nil || len(jobs) != 1 || jobs[0].Error != "NetBox unavailable" {
+				t.Errorf("failed jobs = %+v, %v", jobs, err)
+			}
+			if jobs, err := s.ListJobs(ctx, "", 0); err != nil || len(jobs) != 2 || jobs[0].ID != failed.ID {
+				t.Errorf("all jobs = %+v, %v", jobs, err)
+			}
+			if err := s.UpdateJob(ctx, 9999, "w1", history.JobRunning, ""); !errors.Is(err, history.ErrLeaseLost) {
+				t.Errorf("UpdateJob(9999) error = %v", err)
+			}
+			if _, err := s.GetJob(ctx, 9999); !errors.Is(err, history.ErrNotFound) {
+				t.Errorf("GetJob(9999) error = %v", err)
+			}
+
+			pruned, err := s.Prune(ctx, day)
+			if err != nil || pruned != 1 {
+				t.Errorf("Prune = %d, %v; want 1", pruned, err)
+			}
+			if records, _ := s.List(ctx, history.Filter{}); len(records) != 5 {
+				t.Errorf("%d records left after pruning, want 5", len(records))
+			}
+			// The jobs were created now, after the cutoff.
+			if jobs, _ := s.ListJobs(ctx, "", 0); len(jobs) != 2 {
+				t.Errorf("%d jobs left after pruning, want 2", len(jobs))
+			}
+		})
+	}
+}
+
+// TestIdempotencyKeys checks a retried save or job creation returns the
+// first one, and a key reused for another request is refused.
+func TestIdempotencyKeys(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			now := time.Now()
+			first := record("CHG-1", impact.PlannedWork, 10, now)
+			first.IdempotencyKey = "key-1"
+			saved, err := s.Save(ctx, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, err := s.Save(ctx, first); err != nil || again.ID != saved.ID {
+				t.Errorf("retried Save = %d, %v; want record %d", again.ID, err, saved.ID)
+			}
+			other := record("CHG-2", impact.PlannedWork, 10, now)
+			other.IdempotencyKey = "key-1"
+			if _, err := s.Save(ctx, other); !errors.Is(err, history.ErrKeyReused) {
+				t.Errorf("Save with a reused key: %v, want history.ErrKeyReused", err)
+			}
+			// Records without a key never collide.
+			for i := 0; i < 2; i++ {
+				if _, err := s.Save(ctx, record("CHG-3", impact.PlannedWork, 1, now)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if records, _ := s.List(ctx, history.Filter{}); len(records) != 3 {
+				t.Errorf("%d records, want 3", len(records))
+			}
+
+			job, created, err := s.CreateJob(ctx, first.Request, "key-1")
+			if err != nil || !created {
+				t.Fatalf("CreateJob = %+v, %t, %v", job, created, err)
+			}
+			if again, created, err := s.CreateJob(ctx, first.Request, "key-1"); err != nil || created || again.ID != job.ID {
+				t.Errorf("retried CreateJob = %d, %t, %v; want job %d", again.ID, created, err, job.ID)
+			}
+			if _, _, err := s.CreateJob(ctx, other.Request, "key-1"); !errors.Is(err, history.ErrKeyReused) {
+				t.Errorf("CreateJob with a reused key: %v, want history.ErrKeyReused", err)
+			}
+		})
+	}
+}
+
+// TestScheduled checks which calculations count against a window.
+func TestScheduled(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			night := time.Date(2026, 7, 12, 22, 0, 0, 0, time.UTC)
+			save := func(reference string, total float64, start time.Time, hours int) history.Record {
+				r := record(reference, impact.PlannedWork, total, time.Now())
+				r.WindowStart = &start
+				if hours > 0 {
+					end := start.Add(time.Duration(hours) * time.Hour)
+					r.WindowEnd = &end
+				}
+				saved, err := s.Save(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return saved
+			}
+			save("CHG-1", 10, night, 2)
+			revised := save("CHG-1", 30, night.Add(time.Hour), 2)
+			moved := save("CHG-2", 5, night, 1)
+			save("CHG-2", 5, night.Add(48*time.Hour), 1) // moved out of the night
+			adjacent := save("", 7, night.Add(-2*time.Hour), 2)
+			instant := save("", 3, night.Add(30*time.Minute), 0)
+			save("CHG-3", 9, night.Add(8*time.Hour), 1)
+			if _, err := s.Save(ctx, record("CHG-4", impact.PlannedWork, 100, time.Now())); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name    string
+				exclude string
+				want    []int64
+			}{
+				{"latest per reference, instants inside", "", []int64{instant.ID, revised.ID}},
+				{"excluding CHG-1", "CHG-1", []int64{instant.ID}},
+			}
+			for _, tt := range tests {
+				records, err := s.Scheduled(ctx, night, night.Add(8*time.Hour), tt.exclude)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []int64
+				for _, r := range records {
+					ids = append(ids, r.ID)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+					t.Errorf("%s: %v, want %v (adjacent %d, moved %d)", tt.name, ids, tt.want, adjacent.ID, moved.ID)
+				}
+			}
+			if got, err := s.Get(ctx, revised.ID); err != nil || got.WindowStart == nil || !got.WindowStart.Equal(night.Add(time.Hour)) || got.WindowEnd == nil {
+				t.Errorf("Get = %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			now := time.Now()
+			save := func(reference string, total float64, at time.Time, tags ...string) history.Record {
+				r := record(reference, impact.PlannedWork, total, at)
+				r.Request.Tags, r.Tags = tags, tags
+				saved, err := s.Save(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return saved
+			}
+			old := save("CHG-1", 10, now.Add(-48*time.Hour), "dc-move", "q3")
+			move := save("CHG-2", 20, now, "dc-move")
+			save("CHG-3", 5, now, "q3")
+			save("CHG-4", 1, now)
+
+			tests := []struct {
+				tags []string
+				want []int64
+			}{
+				{[]string{"dc-move"}, []int64{move.ID, old.ID}},
+				{[]string{"dc-move", "q3"}, []int64{old.ID}},
+				{[]string{"other"}, nil},
+			}
+			for _, tt := range tests {
+				records, err := s.List(ctx, history.Filter{Tags: tt.tags})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []int64
+				for _, r := range records {
+					ids = append(ids, r.ID)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+					t.Errorf("tags %v: %v, want %v", tt.tags, ids, tt.want)
+				}
+			}
+			if got, err := s.Get(ctx, old.ID); err != nil || fmt.Sprint(got.Tags) != "[dc-move q3]" {
+				t.Errorf("Get = %+v, %v", got.Tags, err)
+			}
+			points, err := s.Trend(ctx, history.Filter{Tags: []string{"dc-move"}})
+			if err != nil || len(points) != 2 || points[0].Count != 1 || points[1].MaxImpact != 20 {
+				t.Errorf("Trend = %+v, %v", points, err)
+			}
+
+			if n, err := s.Prune(ctx, now.Add(-time.Hour)); err != nil || n != 1 {
+				t.Fatalf("Prune = %d, %v", n, err)
+			}
+			if records, err := s.List(ctx, history.Filter{Tags: []string{"q3"}}); err != nil || len(records) != 1 {
+				t.Errorf("after pruning: %+v, %v", records, err)
+			}
+		})
+	}
+}
+
+func TestTenants(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			now := time.Now()
+			save := func(reference string, at time.Time, tenants ...string) history.Record {
+				r := record(reference, impact.PlannedWork, 10, at)
+				r.Tenants = tenants
+				saved, err := s.Save(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return saved
+			}
+			old := save("CHG-1", now.Add(-48*time.Hour), "Acme")
+			shared := save("CHG-2", now, "Acme", "Globex")
+			globex := save("CHG-3", now, "Globex")
+			save("CHG-4", now)
+
+			tests := []struct {
+				tenants []string
+				want    []int64
+			}{
+				{[]string{"Acme"}, []int64{shared.ID, old.ID}},
+				{[]string{"Globex", "Initech"}, []int64{globex.ID, shared.ID}},
+				{[]string{"Acme", "Globex"}, []int64{globex.ID, shared.ID, old.ID}},
+				{[]string{}, nil},
+			}
+			for _, tt := range tests {
+				records, err := s.List(ctx, history.Filter{Tenants: tt.tenants})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []int64
+				for _, r := range records {
+					ids = append(ids, r.ID)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+					t.Errorf("tenants %v: %v, want %v", tt.tenants, ids, tt.want)
+				}
+			}
+			if records, err := s.List(ctx, history.Filter{Tenants: []string{"Acme"}, Limit: 1, Offset: 1}); err != nil || len(records) != 1 || records[0].ID != old.ID {
+				t.Errorf("second page for Acme = %+v, %v", records, err)
+			}
+			if got, err := s.GetForTenants(ctx, shared.ID, []string{"Globex"}); err != nil || got.Reference != "CHG-2" {
+				t.Errorf("GetForTenants = %+v, %v", got, err)
+			}
+			if _, err := s.GetForTenants(ctx, old.ID, []string{"Globex"}); !errors.Is(err, history.ErrNotFound) {
+				t.Errorf("GetForTenants of another tenant's record: %v, want ErrNotFound", err)
+			}
+			points, err := s.Trend(ctx, history.Filter{Tenants: []string{"Acme"}})
+			if err != nil || len(points) != 2 || points[0].Count != 1 || points[1].Count != 1 {
+				t.Errorf("Trend = %+v, %v", points, err)
+			}
+
+			if n, err := s.Prune(ctx, now.Add(-time.Hour)); err != nil || n != 1 {
+				t.Fatalf("Prune = %d, %v", n, err)
+			}
+			var left int
+			if err := s.(*sqlStore).db.QueryRow(`SELECT COUNT(*) FROM record_tenants`).Scan(&left); err != nil || left != 3 {
+				t.Errorf("%d tenant rows after pruning, %v; want 3", left, err)
+			}
+		})
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			now := time.Now()
+			// record scores total/2: 20 is in the low band, 160 critical.
+			outcome := func(total float64, at time.Time, severity string, tickets int) history.Record {
+				r, err := s.Save(ctx, record("CHG", impact.PlannedWork, total, at))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if severity == "" {
+					return r
+				}
+				if r, err = s.RecordOutcome(ctx, r.ID, history.Outcome{ActualSeverity: severity, CustomerTickets: tickets}); err != nil {
+					t.Fatal(err)
+				}
+				return r
+			}
+			outcome(10, now, history.NoImpact, 0)
+			outcome(20, now, "medium", 4)
+			revised := outcome(20, now, history.NoImpact, 0)
+			outcome(160, now, "low", 1)
+			outcome(20, now, "", 0)
+			outcome(20, now.Add(-48*time.Hour), "critical", 30)
+
+			got, err := s.RecordOutcome(ctx, revised.ID, history.Outcome{ActualSeverity: "high", CustomerTickets: 6, Notes: "LACP flap"})
+			if err != nil || got.Outcome == nil || got.Outcome.ActualSeverity != "high" || got.Outcome.Notes != "LACP flap" || got.Outcome.RecordedAt.IsZero() {
+				t.Fatalf("RecordOutcome again = %+v, %v", got.Outcome, err)
+			}
+			if got, err := s.Get(ctx, revised.ID); err != nil || got.Outcome == nil || got.Outcome.CustomerTickets != 6 {
+				t.Errorf("Get = %+v, %v", got.Outcome, err)
+			}
+			if _, err := s.RecordOutcome(ctx, 9999, history.Outcome{ActualSeverity: history.NoImpact}); !errors.Is(err, history.ErrNotFound) {
+				t.Errorf("outcome of a missing record: %v", err)
+			}
+			if _, err := s.RecordOutcome(ctx, revised.ID, history.Outcome{ActualSeverity: "catastrophic"}); err == nil {
+				t.Error("outcome with an unknown severity accepted")
+			}
+
+			calibration := func(f history.Filter) ([]history.CalibrationRow, error) {
+				samples, err := s.Outcomes(ctx, f)
+				return history.Calibrate(samples), err
+			}
+			samples, err := s.Outcomes(ctx, history.Filter{Since: now.Add(-time.Hour)})
+			if err != nil || len(samples) != 4 || samples[2].HistoryID != revised.ID || samples[2].TotalImpact != 20 || samples[2].Outcome.CustomerTickets != 6 {
+				t.Fatalf("Outcomes = %+v, %v", samples, err)
+			}
+			rows := history.Calibrate(samples)
+			want := []history.CalibrationRow{
+				{ImpactType: impact.PlannedWork, Band: impact.SeverityCritical, Count: 1, Impacted: 1, ImpactedRate: 1, Over: 1, AverageTickets: 1, Actual: map[string]int{"low": 1}},
+				{ImpactType: impact.PlannedWork, Band: impact.SeverityLow, Count: 3, Impacted: 2, ImpactedRate: 2.0 / 3, Matched: 1, Under: 2, AverageTickets: 10.0 / 3,
+					Actual: map[string]int{history.NoImpact: 1, "medium": 1, "high": 1}},
+			}
+			if fmt.Sprintf("%+v", rows) != fmt.Sprintf("%+v", want) {
+				t.Errorf("Calibration =\n%+v\nwant\n%+v", rows, want)
+			}
+			if rows, err := calibration(history.Filter{}); err != nil || len(rows) != 2 || rows[1].Count != 4 {
+				t.Errorf("Calibration of all time = %+v, %v", rows, err)
+			}
+
+			if _, err := s.Prune(ctx, now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if rows, err := calibration(history.Filter{}); err != nil || len(rows) != 2 || rows[1].Count != 3 {
+				t.Errorf("Calibration after pruning = %+v, %v", rows, err)
+			}
+		})
+	}
+}
+
+// TestJobLeases checks that workers on several instances claim each job
+// once, that a job whose worker stops renewing its lease is claimed again
+// and the first worker can no longer finish it, and that a job that keeps
+// losing its workers is failed.
+func TestJobLeases(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			dsn := dsn(t)
+			stores := []history.Store{open(t, dsn), open(t, dsn)}
+			s := stores[0]
+			ctx := context.Background()
+			req := impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork}
+
+			for range 20 {
+				if _, _, err := s.CreateJob(ctx, req, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var mu sync.Mutex
+			claims := map[int64]int{}
+			var wg sync.WaitGroup
+			for w := range 6 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					worker := fmt.Sprintf("w%d", w)
+					for {
+						job, ok, err := stores[w%2].ClaimJob(ctx, worker, time.Minute)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if !ok {
+							return
+						}
+						mu.Lock()
+						claims[job.ID]++
+						mu.Unlock()
+						if err := stores[w%2].ReleaseJob(ctx, job.ID, "someone else"); !errors.Is(err, history.ErrLeaseLost) {
+							t.Errorf("releasing another worker's job: %v", err)
+						}
+						if _, err := stores[w%2].CompleteJob(ctx, job.ID, worker, history.NewRecord(req, impact.ImpactResult{})); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if len(claims) != 20 {
+				t.Errorf("%d jobs claimed, want 20", len(claims))
+			}
+			for id, n := range claims {
+				if n != 1 {
+					t.Errorf("job %d claimed %d times", id, n)
+				}
+			}
+
+			// w1 crashes: its lease runs out and w2 takes over.
+			job, _, _ := s.CreateJob(ctx, req, "")
+			if _, ok, err := s.ClaimJob(ctx, "w1", time.Millisecond); !ok || err != nil {
+				t.Fatalf("ClaimJob = %v, %v", ok, err)
+			}
+			if err := s.UpdateJob(ctx, job.ID, "w1", history.JobRunning, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, _ := s.ClaimJob(ctx, "w2", time.Minute); ok {
+				t.Fatal("claimed a job under a live lease")
+			}
+			time.Sleep(5 * time.Millisecond)
+			taken, ok, err := s.ClaimJob(ctx, "w2", time.Minute)
+			if err != nil || !ok || taken.ID != job.ID || taken.Attempts != 2 || taken.Worker != "w2" {
+				t.Fatalf("ClaimJob after the lease ran out = %+v, %v, %v", taken, ok, err)
+			}
+			if err := s.RenewLease(ctx, job.ID, "w1", time.Minute); !errors.Is(err, history.ErrLeaseLost) {
+				t.Errorf("w1 renewing: %v", err)
+			}
+			before, _ := s.List(ctx, history.Filter{Limit: history.MaxLimit})
+			if _, err := s.CompleteJob(ctx, job.ID, "w1", history.NewRecord(req, impact.ImpactResult{})); !errors.Is(err, history.ErrLeaseLost) {
+				t.Errorf("w1 completing: %v", err)
+			}
+			if after, _ := s.List(ctx, history.Filter{Limit: history.MaxLimit}); len(after) != len(before) {
+				t.Errorf("w1's completion left a record: %d records, want %d", len(after), len(before))
+			}
+			if err := s.RenewLease(ctx, job.ID, "w2", time.Minute); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.CompleteJob(ctx, job.ID, "w2", history.NewRecord(req, impact.ImpactResult{})); err != nil {
+				t.Error(err)
+			}
+
+			// A released job is queued again without counting the attempt.
+			job, _, _ = s.CreateJob(ctx, req, "")
+			s.ClaimJob(ctx, "w1", time.Minute)
+			if err := s.ReleaseJob(ctx, job.ID, "w1"); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := s.GetJob(ctx, job.ID); got.State != history.JobQueued || got.Attempts != 0 || got.LeaseUntil != nil {
+				t.Errorf("released job = %+v", got)
+			}
+
+			// Each worker that claims it dies: it is failed after the last
+			// attempt instead of being claimed again.
+			for attempt := 1; attempt <= history.MaxJobAttempts; attempt++ {
+				claimed, ok, err := s.ClaimJob(ctx, fmt.Sprintf("crash%d", attempt), time.Millisecond)
+				if err != nil || !ok || claimed.ID != job.ID || claimed.Attempts != attempt {
+					t.Fatalf("attempt %d: %+v, %v, %v", attempt, claimed, ok, err)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if _, ok, err := s.ClaimJob(ctx, "w3", time.Minute); ok || err != nil {
+				t.Errorf("ClaimJob of an abandoned job = %v, %v", ok, err)
+			}
+			if got, _ := s.GetJob(ctx, job.ID); got.State != history.JobFailed || !strings.Contains(got.Error, "abandoned after 3 attempts") {
+				t.Errorf("abandoned job = %+v", got)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, dsn(t))
+			ctx := context.Background()
+			july, august := time.Date(2026, 7, 31, 23, 0, 0, 0, time.UTC), time.Date(2026, 8, 1, 1, 0, 0, 0, time.UTC)
+			// record scores total/2: 10 is low, 60 medium and 160 critical.
+			for _, r := range []struct {
+				impactType impact.ImpactType
+				total      float64
+				at         time.Time
+				sites      []string
+			}{
+				{impact.PlannedWork, 10, july, []string{"AMS01", "RTM01"}},
+				{impact.PlannedWork, 60, july, []string{"AMS01"}},
+				{impact.PlannedWork, 160, july, []string{"FRA01"}},
+				{impact.FiberWorks, 20, july, nil},
+				{impact.PlannedWork, 10, august, []string{"AMS01", "RTM01"}},
+				{impact.PlannedWork, 10, august, nil},
+			} {
+				rec := record("CHG-1", r.impactType, r.total, r.at)
+				rec.Sites = r.sites
+				if _, err := s.Save(ctx, rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			st, err := s.Stats(ctx, time.Time{}, 2, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := history.Stats{
+				GeneratedAt:  st.GeneratedAt,
+				MinGroupSize: 2,
+				Months: []history.MonthStats{
+					{Month: "2026-07", ImpactType: impact.PlannedWork, Count: 3, TotalImpact: 230, AverageImpact: 230.0 / 3},
+					{Month: "2026-08", ImpactType: impact.PlannedWork, Count: 2, TotalImpact: 20, AverageImpact: 10},
+				},
+				Severities: []history.SeverityCount{{Severity: impact.SeverityLow, Count: 4}},
+				TopSites:   []history.SiteCount{{Site: "AMS01", Count: 3}, {Site: "RTM01", Count: 2}},
+			}
+			if fmt.Sprintf("%+v", st) != fmt.Sprintf("%+v", want) {
+				t.Errorf("Stats =\n%+v\nwant\n%+v", st, want)
+			}
+			if st, err := s.Stats(ctx, august, 1, 1); err != nil || len(st.Months) != 1 || st.Months[0].Month != "2026-08" || len(st.Severities) != 1 ||
+				fmt.Sprint(st.TopSites) != "[{AMS01 1}]" {
+				t.Errorf("Stats since August = %+v, %v", st, err)
+			}
+		})
+	}
+}
+
+// TestState moves the state of one store into a store of its own, as a
+// standby with its own database would take over.
+func TestState(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			active, standby := open(t, dsn(t)), open(t, dsn(t))
+			ctx := context.Background()
+			now := time.Now()
+			keyed := record("CHG-1", impact.PlannedWork, 10, now)
+			keyed.IdempotencyKey, keyed.Tenants = "retry-1", []string{"Acme"}
+			if _, err := active.Save(ctx, keyed); err != nil {
+				t.Fatal(err)
+			}
+			old := record("CHG-2", impact.PlannedWork, 10, now.Add(-48*time.Hour))
+			old.IdempotencyKey = "retry-2"
+			for _, r := range []history.Record{old, record("CHG-3", impact.PlannedWork, 10, now)} {
+				if _, err := active.Save(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			req := impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork}
+			for _, key := range []string{"done", "", "claimed"} {
+				if _, _, err := active.CreateJob(ctx, req, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			finished, ok, err := active.ClaimJob(ctx, "w", time.Minute)
+			if err != nil || !ok || finished.IdempotencyKey != "done" {
+				t.Fatalf("ClaimJob = %+v, %v, %v", finished, ok, err)
+			}
+			if _, err := active.CompleteJob(ctx, finished.ID, "w", record("CHG-4", impact.PlannedWork, 1, now)); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := active.ClaimJob(ctx, "w", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := history.ExportState(ctx, active, now.Add(-time.Hour))
+			if err != nil || len(st.Jobs) != 2 || len(st.Records) != 1 || st.Records[0].IdempotencyKey != "retry-1" || fmt.Sprint(st.Records[0].Tenants) != "[Acme]" {
+				t.Fatalf("ExportState = %+v, %v", st, err)
+			}
+			data, err := json.Marshal(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded history.State
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []history.StateImport{{Jobs: 2, Records: 1}, {Records: 1}} {
+				if n, err := history.ImportState(ctx, standby, decoded); err != nil || n != want {
+					t.Errorf("import %d = %+v, %v; want %+v", i+1, n, err, want)
+				}
+			}
+			jobs, err := standby.ListJobs(ctx, history.JobQueued, 10)
+			if err != nil || len(jobs) != 2 {
+				t.Fatalf("standby jobs = %+v, %v", jobs, err)
+			}
+			if again, created, err := standby.CreateJob(ctx, req, "claimed"); err != nil || created {
+				t.Errorf("job resubmitted to the standby = %+v, %v, %v; want the imported one", again, created, err)
+			}
+			saved, err := standby.Save(ctx, keyed)
+			if err != nil || saved.ID == 0 {
+				t.Fatalf("retried save = %+v, %v", saved, err)
+			}
+			if records, err := standby.List(ctx, history.Filter{Tenants: []string{"Acme"}}); err != nil || len(records) != 1 || records[0].ID != saved.ID {
+				t.Errorf("standby records of Acme = %+v, %v; want only record %d", records, err, saved.ID)
+			}
+
+			decoded.Version = history.StateVersion + 1
+			var versionErr *history.StateVersionError
+			if _, err := history.ImportState(ctx, standby, decoded); !errors.As(err, &versionErr) {
+				t.Errorf("import of a newer state: %v, want a StateVersionError", err)
+			}
+		})
+	}
+}
+
+// TestMigrateConcurrently opens one database from several stores at once,
+// as instances starting together would.
+func TestMigrateConcurrently(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			dsn := dsn(t)
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s, err := Open(context.Background(), dsn)
+					if err == nil {
+						s.Close()
+					}
+					errs[i] = err
+				}()
+			}
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := open(t, dsn)
+			if version, err := s.SchemaVersion(context.Background()); err != nil || version != len(migrations) {
+				t.Errorf("schema version %d, %v; want %d", version, err, len(migrations))
+			}
+			var applied int
+			if err := s.(*sqlStore).db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil || applied != len(migrations) {
+				t.Errorf("%d migrations recorded, %v; want %d", applied, err, len(migrations))
+			}
+		})
+	}
+}
+
+func TestNewerSchemaRefused(t *testing.T) {
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			dsn := dsn(t)
+			s := open(t, dsn)
+			db := s.(*sqlStore)
+			if _, err := db.db.Exec(db.rebind(`INSERT INTO schema_migrations (version, name, applied_at, release) VALUES (?, ?, ?, ?)`), len(migrations)+1, "from the future", 0, "9.9.0"); err != nil {
+				t.Fatal(err)
+			}
+			var tooNew *SchemaTooNewError
+			_, err := Open(context.Background(), dsn)
+			if !errors.As(err, &tooNew) || tooNew.Version != len(migrations)+1 || tooNew.Release != "9.9.0" {
+				t.Fatalf("Open error = %v, want a SchemaTooNewError from 9.9.0", err)
+			}
+			if msg := err.Error(); !strings.Contains(msg, "netbox-impact "+netbox.Version+" knows") || !strings.Contains(msg, "migrated by netbox-impact 9.9.0") {
+				t.Errorf("error %q does not name both releases", msg)
+			}
+			m, err := NewMigrator(context.Background(), dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if _, err := m.Pending(context.Background()); !errors.As(err, &tooNew) {
+				t.Errorf("Pending error = %v, want a SchemaTooNewError", err)
+			}
+		})
+	}
+}
+
+// migrateTo returns the database of dsn migrated to version only, as an
+// older release left it.
+func migrateTo(t *testing.T, dsn string, version int) *sqlStore {
+	t.Helper()
+	d, dsn, err := dialectFor(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.name == "sqlite" {
+		if dsn, err = sqliteDSN(dsn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	t.Cleanup(func() { s.Close() })
+	if err := s.migrate(context.Background(), version, nil); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestUpgradeFromEverySnapshot upgrades a database left at every schema
+// version, holding a record and a queued job written with the columns that
+// version had, and checks both survive and the store works.
+func TestUpgradeFromEverySnapshot(t *testing.T) {
+	ctx := context.Background()
+	for name, dsn := range backends(t) {
+		for version := 0; version <= len(migrations); version++ {
+			t.Run(fmt.Sprintf("%s/v%d", name, version), func(t *testing.T) {
+				dsn := dsn(t)
+				old := migrateTo(t, dsn, version)
+				r := record("CHG-OLD", impact.PlannedWork, 10, time.Now().Add(-time.Hour))
+				if version >= 1 {
+					req, _ := json.Marshal(r.Request)
+					result, _ := json.Marshal(r.Result)
+					at := r.CreatedAt.UnixMilli()
+					if _, err := old.db.Exec(old.rebind(`INSERT INTO records (created_at, reference, impact_type, instance, total_impact, normalized_score, partial, request, result) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+						at, r.Reference, string(r.ImpactType), "", r.TotalImpact, r.NormalizedScore, false, string(req), string(result)); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := old.db.Exec(old.rebind(`INSERT INTO jobs (state, created_at, updated_at, request) VALUES (?, ?, ?, ?)`), "queued", at, at, string(req)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				old.Close()
+
+				s := open(t, dsn)
+				if got, err := s.SchemaVersion(ctx); err != nil || got != len(migrations) {
+					t.Fatalf("schema version %d, %v; want %d", got, err, len(migrations))
+				}
+				var release string
+				if err := s.(*sqlStore).db.QueryRow(s.(*sqlStore).rebind(`SELECT release FROM schema_migrations WHERE version = ?`), len(migrations)).Scan(&release); err != nil || release != netbox.Version {
+					t.Errorf("release of the last migration = %q, %v; want %q", release, err, netbox.Version)
+				}
+				if version >= 1 {
+					got, err := s.Get(ctx, 1)
+					if err != nil || got.Reference != "CHG-OLD" || got.Result == nil || got.Result.TotalImpact != 10 {
+						t.Errorf("old record = %+v, %v", got, err)
+					}
+					job, claimed, err := s.ClaimJob(ctx, "w1", time.Minute)
+					if err != nil || !claimed || job.Request.Reference != "CHG-OLD" {
+						t.Errorf("ClaimJob = %+v, %v, %v; want the old job", job, claimed, err)
+					}
+				}
+				r = record("CHG-NEW", impact.PlannedWork, 4, time.Now())
+				r.Tags, r.Tenants, r.Sites = []string{"core"}, []string{"Acme"}, []string{"AMS1"}
+				saved, err := s.Save(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				records, err := s.List(ctx, history.Filter{Tags: []string{"core"}})
+				if err != nil || len(records) != 1 || records[0].ID != saved.ID {
+					t.Errorf("List by tag = %+v, %v; want record %d", records, err, saved.ID)
+				}
+			})
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if _, err := NewMigrator(ctx, missing); err == nil {
+		t.Error("NewMigrator opened a missing SQLite database")
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("NewMigrator created the missing database")
+	}
+
+	for name, dsn := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			dsn := dsn(t)
+			migrateTo(t, dsn, 3).Close()
+			m, err := NewMigrator(ctx, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if v, err := m.Version(ctx); err != nil || v != 3 {
+				t.Fatalf("Version = %d, %v; want 3", v, err)
+			}
+			pending, err := m.Pending(ctx)
+			if err != nil || len(pending) != len(migrations)-3 || pending[0].Version != 4 || pending[0].Name != migrations[3].name || len(pending[0].Statements) == 0 {
+				t.Fatalf("Pending = %+v, %v", pending, err)
+			}
+			backup := filepath.Join(t.TempDir(), "backup.db")
+			if m.Path() != "" {
+				if err := m.Backup(ctx, backup); err != nil {
+					t.Fatal(err)
+				}
+				if err := m.Backup(ctx, backup); err == nil {
+					t.Error("Backup overwrote an existing file")
+				}
+			} else if err := m.Backup(ctx, backup); err == nil {
+				t.Error("Backup of Postgres succeeded")
+			}
+			var applied []int
+			if err := m.Migrate(ctx, func(m Migration, took time.Duration) { applied = append(applied, m.Version) }); err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(migrations)-3 || applied[0] != 4 || applied[len(applied)-1] != m.Latest() {
+				t.Errorf("progress reported %v", applied)
+			}
+			if pending, err := m.Pending(ctx); err != nil || len(pending) != 0 {
+				t.Errorf("Pending after Migrate = %+v, %v", pending, err)
+			}
+			if m.Path() == "" {
+				return
+			}
+			b, err := NewMigrator(ctx, backup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if v, err := b.Version(ctx); err != nil || v != 3 {
+				t.Errorf("backup Version = %d, %v; want 3", v, err)
+			}
+		})
+	}
+
+	empty := "sqlite:" + filepath.Join(t.TempDir(), "empty.db")
+	if err := os.WriteFile(strings.TrimPrefix(empty, "sqlite:"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMigrator(ctx, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if v, err := m.Version(ctx); err != nil || v != 0 {
+		t.Errorf("Version of an empty database = %d, %v; want 0", v, err)
+	}
+}
@@ -0,0 +1,130 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// StateVersion is the version of the State this build writes. It reads
+// every version up to it; fields it does not know are ignored.
+const StateVersion = 1
+
+// State is what an instance with a database of its own needs to take over
+// from another: the jobs not finished yet, and the recent records created
+// with an idempotency key, so a retry of the request they answered gets
+// the same record. It holds no configuration, so no secrets, and no
+// caches, which refill from NetBox.
+type State struct {
+	Version    int           `json:"version"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Jobs       []StateJob    `json:"jobs"`
+	Records    []StateRecord `json:"records"`
+}
+
+// StateJob is a job to queue again. ID is the job's ID where it was
+// exported, which keys a job created without an idempotency key.
+type StateJob struct {
+	ID             int64                `json:"id"`
+	CreatedAt      time.Time            `json:"created_at"`
+	Request        impact.ImpactRequest `json:"request"`
+	IdempotencyKey string               `json:"idempotency_key,omitempty"`
+}
+
+type StateRecord struct {
+	IdempotencyKey string   `json:"idempotency_key"`
+	Tenants        []string `json:"tenants,omitempty"`
+	Sites          []string `json:"sites,omitempty"`
+	Record         Record   `json:"record"`
+}
+
+// StateImport counts the jobs ImportState queued and the records it saved
+// or found saved already; Conflicts are the keys the importing store holds
+// for a different request.
+type StateImport struct {
+	Jobs      int `json:"jobs"`
+	Records   int `json:"records"`
+	Conflicts int `json:"conflicts"`
+}
+
+// StateVersionError refuses a State this build cannot read.
+type StateVersionError struct {
+	Version int
+}
+
+func (e *StateVersionError) Error() string {
+	return fmt.Sprintf("state version %d: this build reads versions 1 to %d; import it with the release that exported it or a later one", e.Version, StateVersion)
+}
+
+// ExportState returns the state of s: the queued, claimed and running jobs
+// (a claimed job is queued again on import, as its worker is gone) and the
+// records with an idempotency key created since keysSince.
+func ExportState(ctx context.Context, s Store, keysSince time.Time) (State, error) {
+	st := State{Version: StateVersion, ExportedAt: time.Now().UTC(), Jobs: []StateJob{}}
+	for _, state := range []JobState{JobQueued, JobClaimed, JobRunning} {
+		jobs, err := s.ListJobs(ctx, state, MaxLimit)
+		if err != nil {
+			return State{}, err
+		}
+		for _, j := range jobs {
+			st.Jobs = append(st.Jobs, StateJob{ID: j.ID, CreatedAt: j.CreatedAt, Request: j.Request, IdempotencyKey: j.IdempotencyKey})
+		}
+	}
+	records, err := s.KeyedRecords(ctx, keysSince)
+	if err != nil {
+		return State{}, err
+	}
+	st.Records = make([]StateRecord, len(records))
+	for i, r := range records {
+		st.Records[i] = StateRecord{IdempotencyKey: r.IdempotencyKey, Tenants: r.Tenants, Sites: r.Sites, Record: r}
+	}
+	return st, nil
+}
+
+// ImportState queues the jobs of st in s and saves its records. Both keep
+// their idempotency keys, and a job without one is keyed by its exported
+// ID and creation time, so importing the same state again adds nothing.
+// It is meant for another database than the exporting one, where jobs
+// without a key would be queued twice.
+func ImportState(ctx context.Context, s Store, st State) (StateImport, error) {
+	var n StateImport
+	if st.Version < 1 || st.Version > StateVersion {
+		return n, &StateVersionError{Version: st.Version}
+	}
+	for _, sr := range st.Records {
+		r := sr.Record
+		r.ID, r.IdempotencyKey, r.Tenants, r.Sites = 0, sr.IdempotencyKey, sr.Tenants, sr.Sites
+		if r.IdempotencyKey == "" {
+			continue
+		}
+		if r.Result != nil {
+			r.Result.Metadata.HistoryID = 0
+		}
+		if _, err := s.Save(ctx, r); errors.Is(err, ErrKeyReused) {
+			n.Conflicts++
+		} else if err != nil {
+			return n, err
+		} else {
+			n.Records++
+		}
+	}
+	for _, sj := range st.Jobs {
+		key := sj.IdempotencyKey
+		if key == "" {
+			key = fmt.Sprintf("state:%d:%d", sj.ID, sj.CreatedAt.UnixMilli())
+		}
+		_, created, err := s.CreateJob(ctx, sj.Request, key)
+		switch {
+		case errors.Is(err, ErrKeyReused):
+			n.Conflicts++
+		case err != nil:
+			return n, err
+		case created:
+			n.Jobs++
+		}
+	}
+	return n, nil
+}
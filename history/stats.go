@@ -0,0 +1,40 @@
+package history
+
+import (
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// Stats are aggregates of the recorded calculations that can be shown to
+// anyone: they name no reference, tenant or object ID, and a group of
+// fewer than MinGroupSize records is left out entirely.
+type Stats struct {
+	GeneratedAt  time.Time `json:"generated_at"`
+	MinGroupSize int       `json:"min_group_size"`
+	// Months are per UTC month and impact type, oldest first.
+	Months []MonthStats `json:"months"`
+	// Severities count the records per band of their normalized score
+	// (impact.ScoreSeverity), from critical down.
+	Severities []SeverityCount `json:"severities"`
+	// TopSites count the records scoring devices at each site, most first.
+	TopSites []SiteCount `json:"top_sites"`
+}
+
+type MonthStats struct {
+	Month         string            `json:"month"`
+	ImpactType    impact.ImpactType `json:"impact_type"`
+	Count         int               `json:"count"`
+	TotalImpact   float64           `json:"total_impact"`
+	AverageImpact float64           `json:"average_impact"`
+}
+
+type SeverityCount struct {
+	Severity impact.Severity `json:"severity"`
+	Count    int             `json:"count"`
+}
+
+type SiteCount struct {
+	Site  string `json:"site"`
+	Count int    `json:"count"`
+}
@@ -0,0 +1,114 @@
+package history
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// MultiplierSuggestion proposes a new impact type multiplier, with the
+// evidence for it. The errors are the mean distance, in severity bands,
+// between the band of each estimate and its actual severity.
+type MultiplierSuggestion struct {
+	ImpactType    impact.ImpactType `json:"impact_type"`
+	Current       float64           `json:"current_multiplier"`
+	Suggested     float64           `json:"suggested_multiplier"`
+	Samples       int               `json:"samples"`
+	ErrorBefore   float64           `json:"error_before"`
+	ErrorAfter    float64           `json:"error_after"`
+	MatchedBefore int               `json:"matched_before"`
+	MatchedAfter  int               `json:"matched_after"`
+	// UnderBefore and OverBefore count the estimates below and above their
+	// actual severity with the current multiplier.
+	UnderBefore int `json:"under_before"`
+	OverBefore  int `json:"over_before"`
+}
+
+// multiplierSteps are the factors SuggestMultipliers tries on the current
+// multiplier: quarter powers of two from 1/4 to 4.
+var multiplierSteps = func() []float64 {
+	var steps []float64
+	for i := -8; i <= 8; i++ {
+		steps = append(steps, math.Pow(2, float64(i)/4))
+	}
+	return steps
+}()
+
+// bandDistance is how many bands actual is above the band of score; no
+// impact at all counts as the low band.
+func bandDistance(score float64, actual string) int {
+	return max(slices.Index(ActualSeverities, actual), 1) - slices.Index(ActualSeverities, string(impact.ScoreSeverity(score)))
+}
+
+// SuggestMultipliers searches, per impact type with at least minSamples
+// samples, the multiplier under weights that brings the estimated bands
+// closest to the actual severities. A sample's total is rescaled by the
+// ratio of the candidate to the multiplier it was calculated with, which
+// is exact as the multiplier applies after every cap. Impact types whose
+// current multiplier is already best get no suggestion. Nothing is
+// applied: the caller decides.
+func SuggestMultipliers(samples []CalibrationSample, weights impact.WeightConfig, minSamples int) []MultiplierSuggestion {
+	byType := map[impact.ImpactType][]CalibrationSample{}
+	for _, s := range samples {
+		if s.Multiplier > 0 {
+			byType[s.ImpactType] = append(byType[s.ImpactType], s)
+		}
+	}
+	var suggestions []MultiplierSuggestion
+	for impactType, samples := range byType {
+		current, ok := weights.ImpactTypes[impactType]
+		if !ok || current <= 0 || len(samples) < max(minSamples, 1) {
+			continue
+		}
+		// evaluate returns the mean band distance, the matches, and the
+		// estimates too low and too high with multiplier m.
+		evaluate := func(m float64) (float64, int, int, int) {
+			total, matched, under, over := 0, 0, 0, 0
+			for _, s := range samples {
+				d := bandDistance(weights.NormalizedScore(s.TotalImpact/s.Multiplier*m), s.Outcome.ActualSeverity)
+				switch {
+				case d > 0:
+					under++
+				case d < 0:
+					over++
+				default:
+					matched++
+				}
+				total += max(d, -d)
+			}
+			return float64(total) / float64(len(samples)), matched, under, over
+		}
+		before, matchedBefore, under, over := evaluate(current)
+		best, bestErr, bestMatched := current, before, matchedBefore
+		for _, step := range multiplierSteps {
+			m := math.Round(current*step*100) / 100
+			if m <= 0 {
+				continue
+			}
+			// Ties keep the multiplier closest to the current one.
+			e, matched, _, _ := evaluate(m)
+			if e < bestErr || e == bestErr && math.Abs(math.Log(m/current)) < math.Abs(math.Log(best/current)) {
+				best, bestErr, bestMatched = m, e, matched
+			}
+		}
+		if bestErr >= before {
+			continue
+		}
+		suggestions = append(suggestions, MultiplierSuggestion{
+			ImpactType:    impactType,
+			Current:       current,
+			Suggested:     best,
+			Samples:       len(samples),
+			ErrorBefore:   before,
+			ErrorAfter:    bestErr,
+			MatchedBefore: matchedBefore,
+			MatchedAfter:  bestMatched,
+			UnderBefore:   under,
+			OverBefore:    over,
+		})
+	}
+	slices.SortFunc(suggestions, func(a, b MultiplierSuggestion) int { return cmp.Compare(a.ImpactType, b.ImpactType) })
+	return suggestions
+}
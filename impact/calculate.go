@@ -0,0 +1,923 @@
+// Package impact scores the impact of a change on the objects NetBox knows
+// about: weights, requests, expansion, the breakdown and comparisons.
+package impact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// Totals over every calculation, served by the metrics endpoint.
+var (
+	CalculationsTotal      atomic.Int64
+	CalculationNetboxCalls atomic.Int64
+	CallBudgetExhaustions  atomic.Int64
+)
+
+type phaseTimer struct {
+	timings map[string]float64
+	start   time.Time
+	debug   bool
+}
+
+func newPhaseTimer(debug bool) *phaseTimer {
+	return &phaseTimer{timings: make(map[string]float64), start: time.Now(), debug: debug}
+}
+
+func (t *phaseTimer) done(phase string) {
+	elapsed := time.Since(t.start)
+	t.timings[phase] += float64(elapsed.Microseconds()) / 1000
+	if t.debug {
+		log.Printf("debug: phase %s took %s", phase, elapsed)
+	}
+	t.start = time.Now()
+}
+
+// prepared is a request after the steps every calculation starts with:
+// policy, overrides, object URLs, composites and exclusions applied, IDs
+// deduplicated and validated, and cables resolved to the interfaces and
+// circuits they carry. Normalize stops here; Calculate goes on to score.
+type prepared struct {
+	req                    ImpactRequest
+	weights                WeightConfig
+	warnings               []DataWarning
+	ex                     *exclusions
+	direct                 directReasons
+	policy                 ImpactType
+	policyDefaults         []string
+	strict                 bool
+	guards                 guardReports
+	depth, top             int
+	durationMinutes        float64
+	cables                 []CableImpactDetail
+	cableOfCircuit         map[int]string
+	cableDerivedInterfaces int
+	interfaceIn            inclusions
+	explicitCircuits       map[int]bool
+	circuitIn              inclusions
+}
+
+func (c *Calculator) prepare(ctx context.Context, req ImpactRequest, client netbox.NetboxAPI, weights WeightConfig, timer *phaseTimer) (prepared, error) {
+	if err := weights.CheckImpactType(req.ImpactType); err != nil {
+		return prepared{}, err
+	}
+	req, policyDefaults := c.ApplyPolicy(weights, req)
+	var policy ImpactType
+	if _, ok := weights.Policies[req.ImpactType]; ok {
+		policy = req.ImpactType
+	}
+	if req.Overrides != nil {
+		var err error
+		if weights, err = weights.WithOverrides(req.Overrides, req.ImpactType, c.MaxWeightOverride); err != nil {
+			return prepared{}, err
+		}
+	}
+	req, err := c.expandObjectURLs(req, client.BaseURL())
+	if err != nil {
+		return prepared{}, err
+	}
+	ex, err := newExclusions(req)
+	if err != nil {
+		return prepared{}, err
+	}
+	req, direct, warnings, err := c.expandComposites(ctx, req, client)
+	if err != nil {
+		return prepared{}, err
+	}
+	if weights.ImpactTypes[req.ImpactType] == 0 {
+		message := fmt.Sprintf("impact type %q has multiplier 0, which scores every change 0", req.ImpactType)
+		if c.Features.Enabled(StrictMultiplierValidation) {
+			return prepared{}, &netbox.ValidationError{Field: "impact_type", Message: message}
+		}
+		warnings = append(warnings, DataWarning{ObjectType: "request", Field: "impact_type", Severity: SeverityMedium, Message: message})
+	}
+	req.DeviceIDs = ex.dropIDs("device", req.DeviceIDs, ex.devices, "exclude_device_ids")
+	req.CircuitIDs = ex.dropIDs("circuit", req.CircuitIDs, ex.circuits, "exclude_circuit_ids")
+	strict := c.isStrict(req)
+	if strict {
+		req.StrictData = true
+	}
+	if err := CheckTags(req.Tags); err != nil {
+		return prepared{}, err
+	}
+	depth := c.BlastRadiusDepth
+	if req.BlastRadiusDepth != nil {
+		depth = *req.BlastRadiusDepth
+	}
+	if depth < 0 {
+		return prepared{}, &netbox.ValidationError{Field: "blast_radius_depth", Message: "must not be negative"}
+	}
+	top := DefaultTopContributors
+	if req.TopContributors != nil {
+		top = *req.TopContributors
+	}
+	if top < 0 {
+		return prepared{}, &netbox.ValidationError{Field: "top_contributors", Message: "must not be negative"}
+	}
+	durationMinutes, err := requestDuration(&req)
+	if err != nil {
+		return prepared{}, err
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return prepared{}, &netbox.ValidationError{Field: "timezone", Message: fmt.Sprintf("unknown timezone %q", req.Timezone)}
+		}
+		weights.Timezone = req.Timezone
+	}
+	// Score every object once, however often it was listed.
+	for _, ids := range []*[]int{&req.DeviceIDs, &req.CircuitIDs, &req.InterfaceIDs, &req.SiteIDs, &req.RackIDs, &req.PowerFeedIDs, &req.CableIDs} {
+		*ids = appendMissing(nil, *ids, nil)
+	}
+	lookup := newIDLookup(client)
+	var guards guardReports
+	if err := c.sanityCheckRequest(ctx, req, lookup); err != nil {
+		return prepared{}, err
+	}
+	if strict {
+		guards.add("sanity_checks", len(req.DeviceIDs)+len(req.InterfaceIDs) > 0)
+	}
+	if isPartial(req) && strict {
+		return prepared{}, &netbox.ValidationError{Field: "allow_partial", Message: "cannot be combined with strict mode"}
+	}
+	// Strict mode always validates; skip_validation cannot loosen it.
+	if (!req.SkipValidation && !c.Compat) || strict {
+		missing, err := missingObjects(ctx, lookup, req.DeviceIDs, nil, req.InterfaceIDs)
+		switch {
+		case err != nil && isPartial(req) && ctx.Err() == nil:
+			warnings = append(warnings, DataWarning{
+				ObjectType: "request",
+				Field:      "device_ids",
+				Severity:   SeverityHigh,
+				Message:    fmt.Sprintf("IDs could not be validated: %v", err),
+			})
+		case err != nil:
+			return prepared{}, fmt.Errorf("failed to validate IDs: %w", err)
+		case len(missing) > 0:
+			return prepared{}, &GuardError{Guard: "id_validation", Err: &UnknownObjectsError{Missing: missing}}
+		}
+	}
+	if strict {
+		guards.add("id_validation", len(req.DeviceIDs)+len(req.InterfaceIDs) > 0)
+	}
+	timer.done("validation")
+
+	var cableDetails []CableImpactDetail
+	cableOfCircuit := make(map[int]string)
+	cableDerivedInterfaces := 0
+	explicitInterfaces := make(map[int]bool)
+	interfaceIn := make(inclusions)
+	for _, id := range req.InterfaceIDs {
+		explicitInterfaces[id] = true
+		for _, reason := range direct.of("interface", id) {
+			interfaceIn.add(id, reason, 1)
+		}
+	}
+	explicitCircuits := make(map[int]bool)
+	circuitIn := make(inclusions)
+	for _, id := range req.CircuitIDs {
+		explicitCircuits[id] = true
+		for _, reason := range direct.of("circuit", id) {
+			circuitIn.add(id, reason, 1)
+		}
+	}
+	for _, id := range req.CableIDs {
+		detail, cableWarnings, err := resolveCable(ctx, client, id)
+		if err != nil {
+			return prepared{}, fmt.Errorf("failed to resolve cable %d: %w", id, err)
+		}
+		warnings = append(warnings, cableWarnings...)
+		cableDetails = append(cableDetails, detail)
+		for _, ifaceID := range detail.InterfaceIDs {
+			interfaceIn.add(ifaceID, "cable "+cableName(detail), 1)
+			if !explicitInterfaces[ifaceID] {
+				explicitInterfaces[ifaceID] = true
+				req.InterfaceIDs = append(req.InterfaceIDs, ifaceID)
+				cableDerivedInterfaces++
+			}
+		}
+		for _, circuitID := range detail.CircuitIDs {
+			circuitIn.add(circuitID, "cable "+cableName(detail), 1)
+			if !explicitCircuits[circuitID] {
+				explicitCircuits[circuitID] = true
+				req.CircuitIDs = append(req.CircuitIDs, circuitID)
+				cableOfCircuit[circuitID] = cableName(detail)
+			}
+		}
+	}
+	timer.done("resolve_cables")
+	return prepared{
+		req:                    req,
+		weights:                weights,
+		warnings:               warnings,
+		ex:                     ex,
+		direct:                 direct,
+		policy:                 policy,
+		policyDefaults:         policyDefaults,
+		strict:                 strict,
+		guards:                 guards,
+		depth:                  depth,
+		top:                    top,
+		durationMinutes:        durationMinutes,
+		cables:                 cableDetails,
+		cableOfCircuit:         cableOfCircuit,
+		cableDerivedInterfaces: cableDerivedInterfaces,
+		interfaceIn:            interfaceIn,
+		explicitCircuits:       explicitCircuits,
+		circuitIn:              circuitIn,
+	}, nil
+}
+
+// Calculate scores req against the NetBox behind client.
+func (c *Calculator) Calculate(ctx context.Context, req ImpactRequest, client netbox.NetboxAPI, weights WeightConfig) (ImpactResult, error) {
+	timer := newPhaseTimer(c.Debug)
+	ctx, budget := netbox.NewCallBudget(ctx, c.CallBudget)
+	defer func() {
+		CalculationsTotal.Add(1)
+		CalculationNetboxCalls.Add(budget.Used())
+		if budget.Exhausted() {
+			CallBudgetExhaustions.Add(1)
+		}
+	}()
+	expandCtx := netbox.Expanding(ctx)
+	p, err := c.prepare(ctx, req, client, weights, timer)
+	if err != nil {
+		return ImpactResult{}, err
+	}
+	req, weights, warnings, ex, direct := p.req, p.weights, p.warnings, p.ex, p.direct
+	policy, policyDefaults, strict, guards := p.policy, p.policyDefaults, p.strict, p.guards
+	depth, top, durationMinutes := p.depth, p.top, p.durationMinutes
+	cableDetails, cableOfCircuit, cableDerivedInterfaces := p.cables, p.cableOfCircuit, p.cableDerivedInterfaces
+	interfaceIn, explicitCircuits, circuitIn := p.interfaceIn, p.explicitCircuits, p.circuitIn
+	partial := false
+	// Expansion stops once the call budget is spent and the result is
+	// partial; strict mode fails instead.
+	var unexpanded []string
+	budgetSpent := func(err error, phase string) bool {
+		if strict || !errors.Is(err, netbox.ErrCallBudgetExhausted) {
+			return false
+		}
+		if !slices.Contains(unexpanded, phase) {
+			unexpanded = append(unexpanded, phase)
+		}
+		return true
+	}
+
+	deviceWeight := weights.Device
+	circuitWeight := weights.Circuit
+	interfaceWeight := weights.Interface
+
+	// Tenants are fetched for their TierField once the objects to score are
+	// known. Partial requests fall back to tenant_tiers, warning once.
+	tiers := newTenantTiers(weights)
+	tiersFailed := false
+	loadTiers := func(tenants []*netbox.Node) error {
+		if tiersFailed {
+			return nil
+		}
+		err := tiers.load(ctx, client, tenants)
+		if err != nil && isPartial(req) && ctx.Err() == nil {
+			tiersFailed = true
+			warnings = append(warnings, DataWarning{
+				ObjectType: "tenant",
+				Field:      weights.TierField,
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("%v; only tenant_tiers from the configuration were applied", err),
+			})
+			partial = true
+			return nil
+		}
+		return err
+	}
+
+	var deviceDetails []DeviceImpactDetail
+	deviceIn := make(inclusions)
+	explicitDevice := func(d *netbox.Device) DeviceImpactDetail {
+		detail := weights.scoreDevice(d, 1)
+		for _, reason := range direct.of("device", d.ID) {
+			deviceIn.add(d.ID, reason, 1)
+		}
+		detail.Reason, _ = deviceIn.reasons(d.ID)
+		return detail
+	}
+	devices, err := client.FetchDevicesByIDs(ctx, req.DeviceIDs)
+	var verr *netbox.ValidationError
+	if err != nil && isPartial(req) && ctx.Err() == nil && !errors.As(err, &verr) {
+		found, fetchWarnings, err := fetchEach(ctx, "device", req.DeviceIDs, c.FetchConcurrency, client.FetchDeviceByID)
+		if err != nil {
+			return ImpactResult{}, err
+		}
+		warnings = append(warnings, fetchWarnings...)
+		devices = nil
+		for _, id := range req.DeviceIDs {
+			if d, ok := found[id]; ok {
+				if excluded, err := ex.device(d, "composite"); err != nil {
+					return ImpactResult{}, err
+				} else if excluded {
+					continue
+				}
+				devices = append(devices, d)
+				deviceDetails = append(deviceDetails, explicitDevice(d))
+				continue
+			}
+			detail := explicitDevice(&netbox.Device{ID: id})
+			detail.Unavailable = true
+			deviceDetails = append(deviceDetails, detail)
+			partial = true
+		}
+	} else if err != nil {
+		return ImpactResult{}, err
+	} else {
+		kept := make([]*netbox.Device, 0, len(devices))
+		for _, d := range devices {
+			if excluded, err := ex.device(d, "composite"); err != nil {
+				return ImpactResult{}, err
+			} else if excluded {
+				continue
+			}
+			kept = append(kept, d)
+			deviceDetails = append(deviceDetails, explicitDevice(d))
+		}
+		devices = kept
+	}
+	timer.done("fetch_devices")
+
+	var rackDetails []RackImpactDetail
+	if len(req.RackIDs) > 0 {
+		racks, rackDevices, err := expandRacks(expandCtx, client, req.RackIDs)
+		if err != nil && !budgetSpent(err, "racks") {
+			return ImpactResult{}, err
+		}
+		for i := range racks {
+			for j := range rackDevices[i] {
+				d := &rackDevices[i][j]
+				if excluded, err := ex.device(d, "rack "+racks[i].Name); err != nil {
+					return ImpactResult{}, err
+				} else if excluded {
+					continue
+				}
+				detail := weights.scoreDevice(d, 1)
+				detail.Reason = "rack " + racks[i].Name
+				deviceIn.add(d.ID, detail.Reason, 1)
+				deviceDetails = append(deviceDetails, detail)
+			}
+		}
+		rackDetails = racks
+		timer.done("expand_racks")
+	}
+
+	expandVMs := c.ExpandVMs
+	if req.ExpandVMs != nil {
+		expandVMs = *req.ExpandVMs
+	}
+	var vmImpact *VirtualMachineImpact
+	if expandVMs && len(devices) > 0 {
+		vmImpact, err = c.hostedVMs(expandCtx, client, devices, weights.VirtualMachine)
+		if err != nil && !budgetSpent(err, "virtual machines") {
+			return ImpactResult{}, err
+		}
+		timer.done("fetch_vms")
+	}
+
+	var siteDeviceDetails []DeviceImpactDetail
+	if len(req.SiteIDs) > 0 {
+		siteDevices, err := expandSites(expandCtx, client, req.SiteIDs)
+		if err != nil && !budgetSpent(err, "sites") {
+			return ImpactResult{}, err
+		}
+		for i := range siteDevices {
+			reason := "site " + siteDevices[i].Site.NameOrEmpty()
+			if excluded, err := ex.device(&siteDevices[i], reason); err != nil {
+				return ImpactResult{}, err
+			} else if excluded {
+				continue
+			}
+			detail := weights.scoreDevice(&siteDevices[i], 1)
+			detail.Reason = reason
+			deviceIn.add(detail.ID, reason, 1)
+			siteDeviceDetails = append(siteDeviceDetails, detail)
+		}
+		timer.done("expand_sites")
+	}
+
+	var powerFeedDetails []PowerFeedImpactDetail
+	if len(req.PowerFeedIDs) > 0 {
+		var feedWarnings []DataWarning
+		powerFeedDetails, feedWarnings, err = c.powerFeedImpact(expandCtx, client, req.PowerFeedIDs, weights, deviceIn, ex)
+		if err != nil && !budgetSpent(err, "power feeds") {
+			return ImpactResult{}, err
+		}
+		warnings = append(warnings, feedWarnings...)
+		timer.done("power_feeds")
+	}
+
+	var blast *DeviceImpact
+	if depth > 0 && len(devices) > 0 {
+		// Unavailable devices have no known cabling to walk.
+		from := make([]int, len(devices))
+		seen := make(map[int]bool)
+		for i, d := range devices {
+			from[i] = d.ID
+			seen[d.ID] = true
+		}
+		discovered, err := c.blastRadius(expandCtx, client, from, depth, seen)
+		var found []*netbox.Device
+		if err == nil {
+			ids := make([]int, len(discovered))
+			for i, d := range discovered {
+				ids[i] = d.ID
+			}
+			found, err = client.FetchDevicesByIDs(expandCtx, ids)
+		}
+		if err != nil && !budgetSpent(err, "blast radius") {
+			return ImpactResult{}, err
+		}
+		if err == nil {
+			var items []DeviceImpactDetail
+			for i, d := range found {
+				if excluded, err := ex.device(d, "blast_radius"); err != nil {
+					return ImpactResult{}, err
+				} else if excluded {
+					continue
+				}
+				detail := weights.scoreDevice(d, weights.BlastRadiusFactor)
+				detail.DiscoveredVia = discovered[i].Via
+				detail.Hops = discovered[i].Hops
+				detail.Reason = "blast_radius"
+				deviceIn.add(d.ID, detail.Reason, weights.BlastRadiusFactor)
+				items = append(items, detail)
+			}
+			radius := newDeviceImpact(items, deviceWeight*weights.BlastRadiusFactor)
+			blast = &radius
+		}
+		timer.done("blast_radius")
+	}
+
+	// Every device is scored once, in the section of its highest-weight
+	// path.
+	deviceDetails = deviceIn.keep(deviceDetails)
+	for i := range rackDetails {
+		for _, d := range deviceDetails {
+			if d.Reason == "rack "+rackDetails[i].Name {
+				rackDetails[i].DeviceCount++
+			}
+		}
+	}
+	deviceImpact := newDeviceImpact(deviceDetails, deviceWeight)
+	siteDeviceDetails = deviceIn.keep(siteDeviceDetails)
+	siteDeviceImpact := newDeviceImpact(siteDeviceDetails, deviceWeight)
+	for i := range powerFeedDetails {
+		powerFeedDetails[i].devices = deviceIn.keep(powerFeedDetails[i].devices)
+		powerFeedDetails[i].sumDevices()
+	}
+	if blast != nil {
+		*blast = newDeviceImpact(deviceIn.keep(blast.Items), blast.WeightPerDevice)
+	}
+
+	var interfaceDetails []InterfaceImpactDetail
+	interfaceImpact := 0.0
+	interfaces, err := client.FetchInterfacesByIDs(ctx, req.InterfaceIDs)
+	switch {
+	case err != nil && isPartial(req) && ctx.Err() == nil:
+		// Without details every interface keeps the flat weight.
+		for _, id := range req.InterfaceIDs {
+			interfaceDetails = append(interfaceDetails, InterfaceImpactDetail{ID: id, Enabled: true, SpeedFactor: 1, DisabledFactor: 1, ConnectedFactor: 1, Weight: interfaceWeight, Impact: interfaceWeight, Unavailable: true})
+			warnings = append(warnings, DataWarning{
+				ObjectType: "interface",
+				ID:         id,
+				Field:      "interface_ids",
+				Severity:   SeverityHigh,
+				Message:    fmt.Sprintf("could not be fetched from NetBox (%v); scored at base weight", err),
+			})
+			partial = true
+		}
+	case err != nil:
+		return ImpactResult{}, fmt.Errorf("failed to fetch interfaces: %w", err)
+	default:
+		var missingInterfaces []int
+		for _, id := range req.InterfaceIDs {
+			iface, ok := interfaces[id]
+			if !ok {
+				missingInterfaces = append(missingInterfaces, id)
+				continue
+			}
+			interfaceDetails = append(interfaceDetails, weights.scoreInterface(iface))
+		}
+		if len(missingInterfaces) > 0 {
+			return ImpactResult{}, &netbox.ValidationError{
+				Field:   "interface_ids",
+				Message: "interfaces not found in NetBox: " + netbox.IDList(missingInterfaces),
+			}
+		}
+	}
+	for i, d := range interfaceDetails {
+		interfaceDetails[i].Reason, interfaceDetails[i].OtherReasons = interfaceIn.reasons(d.ID)
+		interfaceImpact += d.Impact
+	}
+	timer.done("fetch_interfaces")
+
+	var circuitDetails []CircuitImpactDetail
+	var circuitWarnings []DataWarning
+	totalCircuitImpact := 0.0
+	implicit := ImplicitDeviceImpact{WeightPerDevice: deviceWeight * weights.ImplicitDeviceFactor}
+	implicitIndex := make(map[string]int)
+	parallelSearches := make(map[string][]netbox.Circuit)
+	// Devices at an expanded site are already scored, so circuits landing
+	// there add no implicit device.
+	expandedSites := make(map[string]bool)
+	for _, id := range req.SiteIDs {
+		expandedSites[fmt.Sprintf("site:%d", id)] = true
+	}
+
+	circuits, err := client.FetchCircuitsByIDs(ctx, req.CircuitIDs)
+	unavailableCircuits := make(map[int]bool)
+	if err != nil && isPartial(req) && ctx.Err() == nil {
+		found, fetchWarnings, err := fetchEach(ctx, "circuit", req.CircuitIDs, c.FetchConcurrency, client.FetchCircuitByID)
+		if err != nil {
+			return ImpactResult{}, err
+		}
+		warnings = append(warnings, fetchWarnings...)
+		circuits = make(map[int]netbox.Circuit, len(found))
+		for id, circuit := range found {
+			circuits[id] = *circuit
+		}
+		for _, w := range fetchWarnings {
+			unavailableCircuits[w.ID] = true
+		}
+	} else if err != nil {
+		return ImpactResult{}, fmt.Errorf("failed to fetch circuits: %w", err)
+	}
+	var missingCircuits []int
+	for _, id := range req.CircuitIDs {
+		if _, ok := circuits[id]; !ok && !unavailableCircuits[id] {
+			missingCircuits = append(missingCircuits, id)
+		}
+	}
+	if len(missingCircuits) > 0 {
+		return ImpactResult{}, &netbox.ValidationError{
+			Field:   "circuit_ids",
+			Message: "circuits not found in NetBox: " + netbox.IDList(missingCircuits),
+		}
+	}
+	// A circuit end cabled to a scored device adds no implicit device: the
+	// device is already counted, once. The circuit's nested terminations
+	// lack link peers, so they are listed when the request scores devices.
+	scoredPeers := make(map[int]bool)
+	if len(deviceIn) > 0 && len(circuits) > 0 {
+		terminations, err := client.FetchCircuitTerminations(expandCtx, slices.Sorted(maps.Keys(circuits)))
+		switch {
+		case err != nil && budgetSpent(err, "circuit terminations"):
+		case err != nil && isPartial(req) && ctx.Err() == nil:
+			warnings = append(warnings, DataWarning{
+				ObjectType: "circuit",
+				Field:      "termination",
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("failed to fetch circuit terminations: %v; circuit ends on scored devices may add implicit devices", err),
+			})
+			partial = true
+		case err != nil:
+			return ImpactResult{}, fmt.Errorf("failed to fetch circuit terminations: %w", err)
+		}
+		for _, t := range terminations {
+			if d := t.PeerDevice(); d != nil && deviceIn[d.ID] != nil {
+				scoredPeers[t.ID] = true
+			}
+		}
+	}
+	var circuitTenants []*netbox.Node
+	for _, circuit := range circuits {
+		circuitTenants = append(circuitTenants, circuit.Tenant)
+	}
+	if err := loadTiers(circuitTenants); err != nil {
+		return ImpactResult{}, err
+	}
+	for _, id := range req.CircuitIDs {
+		source := "composite"
+		if cable, ok := cableOfCircuit[id]; ok {
+			source = "cable " + cable
+		}
+		candidate, ok := circuits[id]
+		if !ok {
+			candidate = netbox.Circuit{ID: id}
+		}
+		if excluded, err := ex.circuit(&candidate, source); err != nil {
+			return ImpactResult{}, err
+		} else if excluded {
+			continue
+		}
+		if unavailableCircuits[id] {
+			circuitDetails = append(circuitDetails, CircuitImpactDetail{
+				ID:                id,
+				RedundancyFactor:  1,
+				CriticalityFactor: 1,
+				StatusFactor:      1,
+				BandwidthFactor:   1,
+				ProviderFactor:    1,
+				TierFactor:        1,
+				Weight:            circuitWeight,
+				Impact:            circuitWeight,
+				Cable:             cableOfCircuit[id],
+				Unavailable:       true,
+			})
+			totalCircuitImpact += circuitWeight
+			partial = true
+			continue
+		}
+		circuit := circuits[id]
+		circuitWarnings = append(circuitWarnings, circuitDataWarnings(circuit, client.BaseURL())...)
+		rf := redundancyFactorCircuit(circuit, weights.CircuitRedundancyFactor)
+		redundantVia, err := parallelCircuit(expandCtx, client, circuit, explicitCircuits, parallelSearches)
+		if err != nil && budgetSpent(err, "parallel circuit search") {
+			redundantVia, err = "", nil
+		}
+		if err != nil && isPartial(req) && ctx.Err() == nil {
+			// Without the search the circuit keeps its full weight.
+			warnings = append(warnings, DataWarning{
+				ObjectType: "circuit",
+				ID:         circuit.ID,
+				Field:      "redundant_via",
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("parallel circuit search failed (%v); no discount applied", err),
+			})
+			redundantVia, err = "", nil
+			partial = true
+		}
+		if err != nil {
+			return ImpactResult{}, err
+		}
+		if redundantVia != "" {
+			rf *= weights.ParallelCircuitFactor
+		}
+		criticality, cf := weights.CriticalityOf(circuit.CustomFields)
+		sf := weights.StatusFactorOf(circuit.Status)
+		bf := weights.BandwidthFactorOf(circuit.CommitRate)
+		pf := weights.ProviderFactorOf(circuit.Provider)
+		tier, tf := tiers.of(circuit.Tenant)
+		impact, uncapped, circuitCap := capImpact(circuitWeight*rf*cf*sf*bf*pf*tf, weights.Caps.Circuit)
+		detail := CircuitImpactDetail{
+			ID:                circuit.ID,
+			CID:               circuit.CID,
+			RedundancyFactor:  rf,
+			RedundantVia:      redundantVia,
+			Criticality:       criticality,
+			CriticalityFactor: cf,
+			StatusFactor:      sf,
+			CommitRateKbps:    circuit.CommitRate,
+			BandwidthFactor:   bf,
+			Provider:          circuit.Provider.NameOrEmpty(),
+			ProviderFactor:    pf,
+			Tenant:            circuit.Tenant.NameOrEmpty(),
+			Tier:              tier,
+			TierFactor:        tf,
+			Weight:            circuitWeight,
+			Impact:            impact,
+			UncappedImpact:    uncapped,
+			Cap:               circuitCap,
+			Cable:             cableOfCircuit[circuit.ID],
+		}
+		if circuit.Status != nil {
+			detail.Status = circuit.Status.Value
+		}
+		circuitDetails = append(circuitDetails, detail)
+		totalCircuitImpact += impact
+
+		for _, t := range []*netbox.CircuitTermination{circuit.TerminationA, circuit.TerminationZ} {
+			endpoint := t.Endpoint()
+			if endpoint == "" || expandedSites[endpoint] || scoredPeers[t.ID] {
+				continue
+			}
+			i, ok := implicitIndex[endpoint]
+			if !ok {
+				i = len(implicit.Items)
+				implicitIndex[endpoint] = i
+				implicit.Items = append(implicit.Items, ImplicitDeviceDetail{Endpoint: endpoint, Name: t.EndpointName(), Impact: implicit.WeightPerDevice, siteID: t.SiteID()})
+			}
+			// A looped circuit lands on the same endpoint twice.
+			if !slices.Contains(implicit.Items[i].Circuits, circuit.CID) {
+				implicit.Items[i].Circuits = append(implicit.Items[i].Circuits, circuit.CID)
+			}
+		}
+	}
+
+	for i, detail := range circuitDetails {
+		circuitDetails[i].Reason, circuitDetails[i].OtherReasons = circuitIn.reasons(detail.ID)
+	}
+	timer.done("fetch_circuits")
+	if req.StrictData && len(circuitWarnings) > 0 {
+		labelWarnings(circuitWarnings, c.Lang)
+		return ImpactResult{}, &GuardError{Guard: "strict_data", Err: &DataQualityError{Warnings: circuitWarnings}}
+	}
+	if strict {
+		guards.add("strict_data", len(circuits) > 0)
+	}
+	warnings = append(warnings, circuitWarnings...)
+
+	implicit.Count = len(implicit.Items)
+	implicit.Impact = float64(implicit.Count) * implicit.WeightPerDevice
+
+	var siteTenants map[int]string
+	if req.IncludeTenants || req.IncludeAffectedTenants {
+		var siteIDs []int
+		for _, d := range implicit.Items {
+			if d.siteID != 0 {
+				siteIDs = append(siteIDs, d.siteID)
+			}
+		}
+		sites, err := client.FetchSitesByIDs(ctx, siteIDs)
+		switch {
+		case err != nil && isPartial(req) && ctx.Err() == nil:
+			warnings = append(warnings, DataWarning{
+				ObjectType: "site",
+				Field:      "tenant",
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("failed to fetch circuit endpoint sites: %v; implicit devices were counted as untenanted", err),
+			})
+			partial = true
+		case err != nil:
+			return ImpactResult{}, fmt.Errorf("failed to fetch circuit endpoint sites: %w", err)
+		}
+		siteTenants = make(map[int]string, len(sites))
+		for id, site := range sites {
+			siteTenants[id] = site.Tenant.NameOrEmpty()
+		}
+		timer.done("fetch_endpoint_sites")
+	}
+
+	multiplier := weights.ImpactTypes[req.ImpactType]
+	factor := multiplier
+	timeMultiplier, timeBand := 0.0, ""
+	if req.StartTime != nil {
+		if timeMultiplier, timeBand, err = weights.WindowMultiplier(*req.StartTime, req.EndTime); err != nil {
+			return ImpactResult{}, err
+		}
+		factor *= timeMultiplier
+	}
+	calendarMultiplier, freezeWindow := 0.0, ""
+	if req.StartTime != nil {
+		if calendarMultiplier, freezeWindow, err = weights.CalendarMultiplier(*req.StartTime, req.EndTime); err != nil {
+			return ImpactResult{}, err
+		}
+		if freezeWindow != "" {
+			factor *= calendarMultiplier
+		}
+	}
+	var window *MaintenanceWindow
+	if req.StartTime != nil {
+		if window, err = weights.resolveWindow(*req.StartTime, req.EndTime); err != nil {
+			return ImpactResult{}, err
+		}
+	}
+	durationFactor := 0.0
+	if durationMinutes > 0 {
+		durationFactor = weights.DurationFactorOf(durationMinutes)
+		factor *= durationFactor
+	}
+	sections := [][]DeviceImpactDetail{deviceDetails, siteDeviceDetails}
+	if blast != nil {
+		sections = append(sections, blast.Items)
+	}
+	for _, f := range powerFeedDetails {
+		sections = append(sections, f.devices)
+	}
+	if weights.TierField != "" {
+		if err := loadTiers(untieredTenants(sections)); err != nil {
+			return ImpactResult{}, err
+		}
+		applyTenantTiers(sections, tiers, weights.Caps.Device)
+	}
+	if c.ConfigContextPath != "" {
+		hintWarnings, err := c.applyConfigContextHints(expandCtx, client, sections, weights.Caps.Device)
+		if err != nil {
+			return ImpactResult{}, err
+		}
+		warnings = append(warnings, hintWarnings...)
+		if budget.Exhausted() && !slices.Contains(unexpanded, "config context hints") {
+			unexpanded = append(unexpanded, "config context hints")
+		}
+		timer.done("config_context")
+	}
+	if len(weights.OOBRoles) > 0 {
+		oobWarnings, err := c.applyRecoveryPathCheck(expandCtx, client, sections, weights)
+		if err != nil && !budgetSpent(err, "recovery paths") {
+			return ImpactResult{}, err
+		}
+		warnings = append(oobWarnings, warnings...)
+		timer.done("recovery_paths")
+	}
+	if len(c.Enrichers) > 0 {
+		enricherWarnings, err := c.enrich(ctx, req, sections, circuitDetails, interfaceDetails, weights.Caps)
+		if err != nil {
+			return ImpactResult{}, err
+		}
+		warnings = append(warnings, enricherWarnings...)
+		interfaceImpact = 0
+		for _, d := range interfaceDetails {
+			interfaceImpact += d.Impact
+		}
+		timer.done("enrichers")
+	}
+	if weights.TierField != "" || c.ConfigContextPath != "" || len(weights.OOBRoles) > 0 || len(c.Enrichers) > 0 {
+		deviceImpact = newDeviceImpact(deviceDetails, deviceWeight)
+		siteDeviceImpact = newDeviceImpact(siteDeviceDetails, deviceWeight)
+		if blast != nil {
+			*blast = newDeviceImpact(blast.Items, blast.WeightPerDevice)
+		}
+		for i := range powerFeedDetails {
+			powerFeedDetails[i].sumDevices()
+		}
+	}
+	if budget.Exhausted() {
+		warnings = append(warnings, DataWarning{
+			ObjectType: "request",
+			Field:      "netbox_calls",
+			Severity:   SeverityHigh,
+			Message:    fmt.Sprintf("netbox call budget exhausted after %d calls; not fully expanded: %s", budget.Limit(), strings.Join(unexpanded, ", ")),
+		})
+		partial = true
+	}
+	breakdown := ImpactBreakdown{
+		Devices:             deviceImpact,
+		SiteExpandedDevices: siteDeviceImpact,
+		BlastRadius:         blast,
+		VirtualMachines:     vmImpact,
+		PowerFeeds:          powerFeedDetails,
+		Racks:               rackDetails,
+		ImplicitDevices:     implicit,
+		Circuits:            newCircuitImpact(circuitDetails),
+		Interfaces: InterfaceImpact{
+			Count:              len(interfaceDetails),
+			CableDerived:       cableDerivedInterfaces,
+			WeightPerInterface: interfaceWeight,
+			Impact:             interfaceImpact,
+			Items:              interfaceDetails,
+		},
+		Cables:     cableDetails,
+		Composites: c.compositeRollups(req),
+	}
+	breakdown.ShareCaps = breakdown.applyShareCaps(weights.Caps.Shares)
+	mpts := newMilliPointTotals(breakdown.sections(), factor)
+	totalBeforeMultiplier := float64(mpts.beforeMultiplier) / 1000
+	totalImpact := float64(mpts.total) / 1000
+
+	tenants := tenantTotals(breakdown, siteTenants)
+	if req.IncludeTenants {
+		breakdown.Tenants = tenantImpacts(tenants, factor, totalBeforeMultiplier)
+	}
+	timer.done("scoring")
+
+	labelWarnings(warnings, c.Lang)
+	result := ImpactResult{
+		ImpactType:                  req.ImpactType,
+		ImpactTypeLabel:             ImpactTypeLabel(req.ImpactType, c.Lang),
+		TotalImpact:                 totalImpact,
+		TotalImpactBeforeMultiplier: totalBeforeMultiplier,
+		Multiplier:                  multiplier,
+		TimeMultiplier:              timeMultiplier,
+		TimeBand:                    timeBand,
+		DurationMinutes:             durationMinutes,
+		DurationFactor:              durationFactor,
+		FreezeWindow:                freezeWindow,
+		CalendarMultiplier:          calendarMultiplier,
+		Window:                      window,
+		Exclusions:                  ex.excluded,
+		NormalizedScore:             weights.NormalizedScore(totalImpact),
+		Breakdown:                   breakdown,
+		Warnings:                    warnings,
+		Partial:                     partial,
+		OverridesApplied:            req.Overrides,
+		Metadata: ResultMetadata{
+			TimingsMs:      timer.timings,
+			Strict:         strict,
+			Guards:         guards,
+			Weights:        weights,
+			NetboxCalls:    budget.Used(),
+			Policy:         policy,
+			PolicyDefaults: policyDefaults,
+			Features:       c.Features.Active(),
+		},
+		mpts: mpts,
+	}
+	for _, t := range tenants {
+		if t.name != untenanted {
+			result.tenants = append(result.tenants, t.name)
+		}
+	}
+	result.sites = siteNames(result.Breakdown)
+	result.Breakdown.Tiers = tierRollup(result.Breakdown)
+	result.TopContributors = topContributors(result.Breakdown, top)
+	if req.IncludeAffectedTenants {
+		result.AffectedTenants = tenantSummaries(tenants, factor)
+	}
+	if req.Explain {
+		result.Explanation = explainResult(result, req.ImpactType)
+	}
+	return result, nil
+}
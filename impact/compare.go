@@ -0,0 +1,276 @@
+package impact
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// CompareRequest is the body of POST /compareImpact: two versions of a
+// change to score side by side.
+type CompareRequest struct {
+	A ImpactRequest `json:"a"`
+	B ImpactRequest `json:"b"`
+}
+
+type CompareResult struct {
+	A     ImpactResult `json:"a"`
+	B     ImpactResult `json:"b"`
+	Delta ImpactDelta  `json:"delta"`
+}
+
+// ImpactDelta is B minus A. Categories holds the change in each breakdown
+// section's impact before the multipliers.
+type ImpactDelta struct {
+	TotalImpact                 float64            `json:"total_impact"`
+	TotalImpactBeforeMultiplier float64            `json:"total_impact_before_multiplier"`
+	NormalizedScore             float64            `json:"normalized_score"`
+	OnlyInA                     []Contributor      `json:"only_in_a"`
+	OnlyInB                     []Contributor      `json:"only_in_b"`
+	Categories                  map[string]float64 `json:"categories"`
+}
+
+// MilliPointComparison is the ?units=millipoints form of a comparison.
+type MilliPointComparison struct {
+	A     MilliPointResult `json:"a"`
+	B     MilliPointResult `json:"b"`
+	Delta struct {
+		ImpactDelta
+		TotalImpactMpts                 int64 `json:"total_impact_mpts"`
+		TotalImpactBeforeMultiplierMpts int64 `json:"total_impact_before_multiplier_mpts"`
+	} `json:"delta"`
+}
+
+func (c CompareResult) MilliPoints() MilliPointComparison {
+	m := MilliPointComparison{A: c.A.MilliPoints(), B: c.B.MilliPoints()}
+	m.Delta.ImpactDelta = c.Delta
+	m.Delta.TotalImpactMpts = m.B.TotalImpactMpts - m.A.TotalImpactMpts
+	m.Delta.TotalImpactBeforeMultiplierMpts = m.B.TotalImpactBeforeMultiplierMpts - m.A.TotalImpactBeforeMultiplierMpts
+	return m
+}
+
+// Compare scores both sides of req. When they use the same instance
+// the devices, circuits and interfaces either side names are fetched once
+// up front and both sides are scored from them, whatever the client's
+// cache. Errors name the side that failed.
+func (c *Calculator) Compare(ctx context.Context, req CompareRequest, instances *netbox.NetboxInstances, weights WeightConfig) (CompareResult, error) {
+	sides := []struct {
+		name string
+		req  ImpactRequest
+	}{{"a", req.A}, {"b", req.B}}
+	var clients [2]netbox.NetboxAPI
+	for i, side := range sides {
+		client, err := instances.Client(side.req.Instance)
+		if err != nil {
+			return CompareResult{}, fmt.Errorf("request %s: %w", side.name, err)
+		}
+		clients[i] = client
+	}
+	if clients[0] == clients[1] {
+		shared := prefetch(ctx, clients[0], req.A, req.B)
+		clients[0], clients[1] = shared, shared
+	}
+	var results [2]ImpactResult
+	for i, side := range sides {
+		var err error
+		if results[i], err = c.Calculate(ctx, side.req, clients[i], weights); err != nil {
+			return CompareResult{}, fmt.Errorf("request %s: %w", side.name, err)
+		}
+	}
+	a, b := results[0], results[1]
+	return CompareResult{A: a, B: b, Delta: impactDelta(a, b)}, nil
+}
+
+// prefetchedNetbox answers device, circuit and interface lookups from the
+// objects prefetch got and passes other IDs and calls to the embedded
+// client.
+type prefetchedNetbox struct {
+	netbox.NetboxAPI
+	devices    map[int]netbox.Device
+	circuits   map[int]netbox.Circuit
+	interfaces map[int]netbox.Interface
+}
+
+// prefetch fetches the union of the requests' device, circuit and interface
+// IDs in one bulk call each. A failed call only leaves that kind to the
+// embedded client, so the error surfaces from the request it belongs to.
+func prefetch(ctx context.Context, client netbox.NetboxAPI, reqs ...ImpactRequest) *prefetchedNetbox {
+	p := &prefetchedNetbox{NetboxAPI: client, devices: make(map[int]netbox.Device)}
+	var deviceIDs, circuitIDs, interfaceIDs []int
+	for _, req := range reqs {
+		deviceIDs = append(deviceIDs, req.DeviceIDs...)
+		circuitIDs = append(circuitIDs, req.CircuitIDs...)
+		interfaceIDs = append(interfaceIDs, req.InterfaceIDs...)
+	}
+	if len(deviceIDs) > 0 {
+		slices.Sort(deviceIDs)
+		if devices, err := client.FetchDevicesByIDs(ctx, slices.Compact(deviceIDs)); err == nil {
+			for _, d := range devices {
+				p.devices[d.ID] = *d
+			}
+		}
+	}
+	if len(circuitIDs) > 0 {
+		slices.Sort(circuitIDs)
+		p.circuits, _ = client.FetchCircuitsByIDs(ctx, slices.Compact(circuitIDs))
+	}
+	if len(interfaceIDs) > 0 {
+		slices.Sort(interfaceIDs)
+		p.interfaces, _ = client.FetchInterfacesByIDs(ctx, slices.Compact(interfaceIDs))
+	}
+	return p
+}
+
+func (p *prefetchedNetbox) FetchDeviceByID(ctx context.Context, id int) (*netbox.Device, error) {
+	if d, ok := p.devices[id]; ok {
+		return &d, nil
+	}
+	return p.NetboxAPI.FetchDeviceByID(ctx, id)
+}
+
+func (p *prefetchedNetbox) FetchDevicesByIDs(ctx context.Context, ids []int) ([]*netbox.Device, error) {
+	var missing []int
+	for _, id := range ids {
+		if _, ok := p.devices[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	fetched := make(map[int]*netbox.Device, len(missing))
+	if len(missing) > 0 {
+		found, err := p.NetboxAPI.FetchDevicesByIDs(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range found {
+			fetched[d.ID] = d
+		}
+	}
+	devices := make([]*netbox.Device, len(ids))
+	for i, id := range ids {
+		if d, ok := p.devices[id]; ok {
+			devices[i] = &d
+		} else {
+			devices[i] = fetched[id]
+		}
+	}
+	return devices, nil
+}
+
+func (p *prefetchedNetbox) FetchCircuitByID(ctx context.Context, id int) (*netbox.Circuit, error) {
+	if c, ok := p.circuits[id]; ok {
+		return &c, nil
+	}
+	return p.NetboxAPI.FetchCircuitByID(ctx, id)
+}
+
+func (p *prefetchedNetbox) FetchCircuitsByIDs(ctx context.Context, ids []int) (map[int]netbox.Circuit, error) {
+	return fetchHeld(ctx, p.circuits, ids, p.NetboxAPI.FetchCircuitsByIDs)
+}
+
+func (p *prefetchedNetbox) FetchInterfacesByIDs(ctx context.Context, ids []int) (map[int]netbox.Interface, error) {
+	return fetchHeld(ctx, p.interfaces, ids, p.NetboxAPI.FetchInterfacesByIDs)
+}
+
+// fetchHeld returns the objects of ids found in held and asks fetch for the
+// rest.
+func fetchHeld[T any](ctx context.Context, held map[int]T, ids []int, fetch func(context.Context, []int) (map[int]T, error)) (map[int]T, error) {
+	objects := make(map[int]T, len(ids))
+	var missing []int
+	for _, id := range ids {
+		if v, ok := held[id]; ok {
+			objects[id] = v
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		fetched, err := fetch(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(objects, fetched)
+	}
+	return objects, nil
+}
+
+// CompareSnapshots runs the same request against two snapshots of the
+// network: A is the current one, B the baseline (e.g. with the planned
+// circuits added), so a negative delta is the risk the change removes.
+func (c *Calculator) CompareSnapshots(ctx context.Context, req ImpactRequest, current, baseline netbox.NetboxAPI, weights WeightConfig) (CompareResult, error) {
+	a, err := c.Calculate(ctx, req, current, weights)
+	if err != nil {
+		return CompareResult{}, fmt.Errorf("snapshot: %w", err)
+	}
+	b, err := c.Calculate(ctx, req, baseline, weights)
+	if err != nil {
+		return CompareResult{}, fmt.Errorf("baseline snapshot: %w", err)
+	}
+	return CompareResult{A: a, B: b, Delta: impactDelta(a, b)}, nil
+}
+
+func impactDelta(a, b ImpactResult) ImpactDelta {
+	delta := ImpactDelta{
+		// Subtract the milli-point totals so the delta has no float error.
+		TotalImpact:                 float64(b.mpts.total-a.mpts.total) / 1000,
+		TotalImpactBeforeMultiplier: float64(b.mpts.beforeMultiplier-a.mpts.beforeMultiplier) / 1000,
+		NormalizedScore:             b.NormalizedScore - a.NormalizedScore,
+		OnlyInA:                     onlyIn(a.Breakdown, b.Breakdown),
+		OnlyInB:                     onlyIn(b.Breakdown, a.Breakdown),
+		Categories:                  make(map[string]float64),
+	}
+	categoriesA, categoriesB := categoryImpacts(a.Breakdown), categoryImpacts(b.Breakdown)
+	for name, impact := range categoriesB {
+		delta.Categories[name] = impact - categoriesA[name]
+	}
+	for name, impact := range categoriesA {
+		if _, ok := categoriesB[name]; !ok {
+			delta.Categories[name] = -impact
+		}
+	}
+	return delta
+}
+
+// onlyIn lists the objects scored in x but not in y, highest impact first.
+func onlyIn(x, y ImpactBreakdown) []Contributor {
+	seen := make(map[string]bool)
+	for _, c := range contributors(y) {
+		seen[fmt.Sprintf("%s:%d", c.Type, c.ID)] = true
+	}
+	only := []Contributor{}
+	for _, c := range contributors(x) {
+		if !seen[fmt.Sprintf("%s:%d", c.Type, c.ID)] {
+			only = append(only, c)
+		}
+	}
+	sort.SliceStable(only, func(i, j int) bool { return only[i].Impact > only[j].Impact })
+	return only
+}
+
+// categoryImpacts returns the impact of each non-empty breakdown section.
+func categoryImpacts(b ImpactBreakdown) map[string]float64 {
+	categories := make(map[string]float64)
+	add := func(name string, impact float64) {
+		if impact != 0 {
+			categories[name] += impact
+		}
+	}
+	add("devices", b.Devices.Impact)
+	add("site_expanded_devices", b.SiteExpandedDevices.Impact)
+	if b.BlastRadius != nil {
+		add("blast_radius", b.BlastRadius.Impact)
+	}
+	if b.VirtualMachines != nil {
+		add("virtual_machines", b.VirtualMachines.Impact)
+	}
+	for _, f := range b.PowerFeeds {
+		add("power_feeds", f.Impact)
+	}
+	add("implicit_devices", b.ImplicitDevices.Impact)
+	add("circuits", b.Circuits.TotalImpact)
+	add("interfaces", b.Interfaces.Impact)
+	return categories
+}
@@ -0,0 +1,183 @@
+package impact
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+type Composite struct {
+	Name         string `json:"name"`
+	DeviceIDs    []int  `json:"device_ids,omitempty"`
+	CircuitIDs   []int  `json:"circuit_ids,omitempty"`
+	InterfaceIDs []int  `json:"interface_ids,omitempty"`
+	Notes        string `json:"notes,omitempty"`
+}
+
+func (c Composite) Validate() error {
+	if c.Name == "" || strings.Trim(c.Name, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return &netbox.ValidationError{Field: "name", Message: "must be non-empty and use only a-z, 0-9, - and _"}
+	}
+	if len(c.DeviceIDs)+len(c.CircuitIDs)+len(c.InterfaceIDs) == 0 {
+		return &netbox.ValidationError{Field: "name", Message: fmt.Sprintf("composite %q has no members", c.Name)}
+	}
+	return nil
+}
+
+type CompositeStore struct {
+	mu    sync.RWMutex
+	items map[string]Composite
+	// Path, when set, is rewritten with every definition after each Put
+	// and Delete, so definitions made through the API survive a restart.
+	Path string
+}
+
+func NewCompositeStore() *CompositeStore {
+	return &CompositeStore{items: make(map[string]Composite)}
+}
+
+func (s *CompositeStore) Get(name string) (Composite, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.items[name]
+	return c, ok
+}
+
+func (s *CompositeStore) List() []Composite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list()
+}
+
+func (s *CompositeStore) list() []Composite {
+	list := make([]Composite, 0, len(s.items))
+	for _, c := range s.items {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// save writes the definitions to Path through a temporary file, so a crash
+// never leaves a half-written file behind. The caller holds s.mu.
+func (s *CompositeStore) save() error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("saving composites: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("saving composites: %w", err)
+	}
+	return nil
+}
+
+// Put adds or replaces c. When Path cannot be written the store is left as
+// it was.
+func (s *CompositeStore) Put(c Composite) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.items[c.Name]
+	s.items[c.Name] = c
+	if err := s.save(); err != nil {
+		if existed {
+			s.items[c.Name] = old
+		} else {
+			delete(s.items, c.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *CompositeStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.items[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.items, name)
+	if err := s.save(); err != nil {
+		s.items[name] = old
+		return true, err
+	}
+	return true, nil
+}
+
+func LoadCompositesFile(path string, store *CompositeStore) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var composites []Composite
+	if err := json.Unmarshal(data, &composites); err != nil {
+		return netbox.JSONErrorAt(path, data, err)
+	}
+	for _, c := range composites {
+		if err := store.Put(c); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// MissingCompositeMembers returns, per member field, the IDs NetBox does not know.
+func MissingCompositeMembers(ctx context.Context, client netbox.NetboxAPI, c Composite) (map[string][]int, error) {
+	return missingObjects(ctx, newIDLookup(client), c.DeviceIDs, c.CircuitIDs, c.InterfaceIDs)
+}
+
+// missingObjects looks the IDs up with batched id__in queries and returns,
+// per request field, the ones NetBox does not know.
+func missingObjects(ctx context.Context, client *idLookup, deviceIDs, circuitIDs, interfaceIDs []int) (map[string][]int, error) {
+	missing := make(map[string][]int)
+	for _, m := range []struct {
+		field    string
+		endpoint string
+		ids      []int
+	}{
+		{"device_ids", "/api/dcim/devices/", deviceIDs},
+		{"circuit_ids", "/api/circuits/circuits/", circuitIDs},
+		{"interface_ids", "/api/dcim/interfaces/", interfaceIDs},
+	} {
+		found, err := client.FetchNamesByIDs(ctx, m.endpoint, m.ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range m.ids {
+			if _, ok := found[id]; !ok {
+				missing[m.field] = append(missing[m.field], id)
+			}
+		}
+	}
+	return missing, nil
+}
+
+func appendMissing(ids []int, add []int, skip map[int]bool) []int {
+	present := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+	for _, id := range add {
+		if !present[id] && !skip[id] {
+			present[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
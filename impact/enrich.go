@@ -0,0 +1,397 @@
+package impact
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// Enricher adds what NetBox does not know, such as the customer count of
+// a circuit kept in a capacity database, to a calculation. Enrichers run
+// after the request is resolved in NetBox and before the breakdown is
+// totalled, in the order they are configured. An error is reported as a
+// warning and drops the enricher's annotations; the calculation goes on.
+type Enricher interface {
+	Enrich(ctx context.Context, ic *ImpactContext) error
+}
+
+// EnricherFactory builds an enricher from the "config" of an enrichers
+// file entry.
+type EnricherFactory func(config json.RawMessage) (Enricher, error)
+
+var (
+	enricherKindsMu sync.Mutex
+	enricherKinds   = map[string]EnricherFactory{"http": NewHTTPEnricher}
+)
+
+// RegisterEnricher makes kind available to enrichers files. It panics when
+// kind is already registered.
+func RegisterEnricher(kind string, factory EnricherFactory) {
+	enricherKindsMu.Lock()
+	defer enricherKindsMu.Unlock()
+	if _, ok := enricherKinds[kind]; ok {
+		panic("impact: enricher kind " + kind + " registered twice")
+	}
+	enricherKinds[kind] = factory
+}
+
+// EnricherKinds returns the registered enricher kinds.
+func EnricherKinds() []string {
+	enricherKindsMu.Lock()
+	defer enricherKindsMu.Unlock()
+	kinds := make([]string, 0, len(enricherKinds))
+	for kind := range enricherKinds {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+// NamedEnricher is a configured enricher; Name is the source shown on the
+// breakdown items it annotates.
+type NamedEnricher struct {
+	Name string
+	Kind string
+	Enricher
+}
+
+type enricherEntry struct {
+	Name   string          `json:"name"`
+	Kind   string          `json:"kind"`
+	Config json.RawMessage `json:"config"`
+}
+
+// LoadEnrichersFile reads a JSON list of {"name", "kind", "config"}
+// entries and builds each enricher with the factory of its kind.
+func LoadEnrichersFile(path string) ([]NamedEnricher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var entries []enricherEntry
+	if err := dec.Decode(&entries); err != nil {
+		return nil, netbox.JSONErrorAt(path, data, err)
+	}
+	var enrichers []NamedEnricher
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("%s: enricher %d has no name", path, i)
+		}
+		if slices.ContainsFunc(enrichers, func(n NamedEnricher) bool { return n.Name == e.Name }) {
+			return nil, fmt.Errorf("%s: enricher %q defined twice", path, e.Name)
+		}
+		enricherKindsMu.Lock()
+		factory, ok := enricherKinds[e.Kind]
+		enricherKindsMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("%s: enricher %q: unknown kind %q (expected one of %v)", path, e.Name, e.Kind, EnricherKinds())
+		}
+		enricher, err := factory(e.Config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: enricher %q: %w", path, e.Name, err)
+		}
+		enrichers = append(enrichers, NamedEnricher{Name: e.Name, Kind: e.Kind, Enricher: enricher})
+	}
+	return enrichers, nil
+}
+
+// Enrichment is what one enricher did to a breakdown item: its weight
+// multiplier, 1 for a note alone, and its note.
+type Enrichment struct {
+	Source string  `json:"source"`
+	Factor float64 `json:"factor"`
+	Note   string  `json:"note,omitempty"`
+}
+
+// ImpactContext is what an enricher sees of a calculation: the request and
+// copies of the scored devices, circuits and interfaces. Enrichers change
+// the calculation only through Annotate.
+type ImpactContext struct {
+	Request    ImpactRequest
+	Devices    []DeviceImpactDetail
+	Circuits   []CircuitImpactDetail
+	Interfaces []InterfaceImpactDetail
+
+	source      string
+	enrichments map[enrichedObject][]Enrichment
+}
+
+type enrichedObject struct {
+	objectType string
+	id         int
+}
+
+// Objects returns the IDs of the scored objects of objectType: "device",
+// "circuit" or "interface".
+func (ic *ImpactContext) Objects(objectType string) []int {
+	ids := []int{}
+	switch objectType {
+	case "device":
+		for _, d := range ic.Devices {
+			ids = append(ids, d.ID)
+		}
+	case "circuit":
+		for _, c := range ic.Circuits {
+			ids = append(ids, c.ID)
+		}
+	case "interface":
+		for _, i := range ic.Interfaces {
+			ids = append(ids, i.ID)
+		}
+	}
+	return ids
+}
+
+// Annotate multiplies the impact of a scored object by factor, re-applying
+// its point cap, and attaches note. Annotating an object twice multiplies
+// the factors.
+func (ic *ImpactContext) Annotate(objectType string, id int, factor float64, note string) error {
+	if factor <= 0 {
+		return fmt.Errorf("%s %d: factor %v must be positive", objectType, id, factor)
+	}
+	if !slices.Contains(ic.Objects(objectType), id) {
+		return fmt.Errorf("%s %d is not scored in this calculation", objectType, id)
+	}
+	key := enrichedObject{objectType, id}
+	ic.enrichments[key] = append(ic.enrichments[key], Enrichment{Source: ic.source, Factor: factor, Note: note})
+	return nil
+}
+
+// enrich runs c's enrichers over the scored objects of sections, circuits
+// and interfaces and applies their annotations. A failing enricher leaves
+// the items as they were and adds a warning; only the calculation's own
+// context ending is an error.
+func (c *Calculator) enrich(ctx context.Context, req ImpactRequest, sections [][]DeviceImpactDetail, circuits []CircuitImpactDetail, interfaces []InterfaceImpactDetail, caps ContributionCaps) ([]DataWarning, error) {
+	devices := make(map[int]*DeviceImpactDetail)
+	ic := &ImpactContext{Request: req}
+	for _, items := range sections {
+		for i := range items {
+			if d := &items[i]; !d.Unavailable {
+				devices[d.ID] = d
+				ic.Devices = append(ic.Devices, *d)
+			}
+		}
+	}
+	for _, ci := range circuits {
+		if !ci.Unavailable {
+			ic.Circuits = append(ic.Circuits, ci)
+		}
+	}
+	for _, i := range interfaces {
+		if !i.Unavailable {
+			ic.Interfaces = append(ic.Interfaces, i)
+		}
+	}
+	var warnings []DataWarning
+	enrichments := make(map[enrichedObject][]Enrichment)
+	for _, e := range c.Enrichers {
+		ic.source, ic.enrichments = e.Name, make(map[enrichedObject][]Enrichment)
+		err := e.Enrich(ctx, ic)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			warnings = append(warnings, DataWarning{
+				ObjectType: "request",
+				Field:      "enrichers",
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("enricher %s failed, its annotations were not applied: %v", e.Name, err),
+			})
+			continue
+		}
+		for key, es := range ic.enrichments {
+			enrichments[key] = append(enrichments[key], es...)
+		}
+	}
+	factorOf := func(es []Enrichment) float64 {
+		factor := 1.0
+		for _, e := range es {
+			factor *= e.Factor
+		}
+		return factor
+	}
+	for _, d := range devices {
+		if es := enrichments[enrichedObject{"device", d.ID}]; len(es) > 0 {
+			d.Enrichments = es
+			d.Impact, d.UncappedImpact, d.Cap = capImpact(cmp.Or(d.UncappedImpact, d.Impact)*factorOf(es), caps.Device)
+		}
+	}
+	for i := range circuits {
+		if es := enrichments[enrichedObject{"circuit", circuits[i].ID}]; len(es) > 0 && !circuits[i].Unavailable {
+			ci := &circuits[i]
+			ci.Enrichments = es
+			ci.Impact, ci.UncappedImpact, ci.Cap = capImpact(cmp.Or(ci.UncappedImpact, ci.Impact)*factorOf(es), caps.Circuit)
+		}
+	}
+	for i := range interfaces {
+		if es := enrichments[enrichedObject{"interface", interfaces[i].ID}]; len(es) > 0 && !interfaces[i].Unavailable {
+			iface := &interfaces[i]
+			iface.Enrichments = es
+			iface.Impact, iface.UncappedImpact, iface.Cap = capImpact(cmp.Or(iface.UncappedImpact, iface.Impact)*factorOf(es), caps.Interface)
+		}
+	}
+	return warnings, nil
+}
+
+// explainEnrichments returns the factors of es for explainFactors and
+// their notes as ": source: note" suffixes.
+func explainEnrichments(es []Enrichment) ([]explainFactor, string) {
+	var factors []explainFactor
+	var notes []string
+	for _, e := range es {
+		factors = append(factors, explainFactor{"enricher " + e.Source, e.Factor})
+		if e.Note != "" {
+			notes = append(notes, e.Source+": "+e.Note)
+		}
+	}
+	if len(notes) == 0 {
+		return factors, ""
+	}
+	return factors, "; " + strings.Join(notes, "; ")
+}
+
+// DefaultEnricherTimeout bounds an HTTP enricher call unless its config sets
+// "timeout".
+const DefaultEnricherTimeout = 5 * time.Second
+
+// maxEnricherResponse is the largest response an HTTP enricher reads.
+const maxEnricherResponse = 4 << 20
+
+// HTTPEnricher POSTs the IDs of the scored objects to a URL and applies the
+// weight multipliers and notes it answers with.
+//
+// The request body is {"impact_type", "device_ids", "circuit_ids",
+// "interface_ids"}; the response must be {"objects": [{"object_type",
+// "id", "weight_multiplier", "note"}]} naming only posted objects, with an
+// optional positive weight_multiplier. A response that does not match is
+// rejected as a whole.
+type HTTPEnricher struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+type httpEnricherConfig struct {
+	URL     string            `json:"url"`
+	Timeout string            `json:"timeout,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NewHTTPEnricher is the factory of the "http" kind; config is {"url",
+// "timeout", "headers"}, timeout being a duration such as "2s".
+func NewHTTPEnricher(config json.RawMessage) (Enricher, error) {
+	var cfg httpEnricherConfig
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid http enricher config: %w", err)
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q is not an http(s) URL", cfg.URL)
+	}
+	timeout := DefaultEnricherTimeout
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("timeout %q is not a positive duration", cfg.Timeout)
+		}
+	}
+	return &HTTPEnricher{URL: cfg.URL, Headers: cfg.Headers, Client: &http.Client{Timeout: timeout}}, nil
+}
+
+type httpEnricherRequest struct {
+	ImpactType   ImpactType `json:"impact_type"`
+	DeviceIDs    []int      `json:"device_ids"`
+	CircuitIDs   []int      `json:"circuit_ids"`
+	InterfaceIDs []int      `json:"interface_ids"`
+}
+
+type httpEnricherResponse struct {
+	Objects []struct {
+		ObjectType       string   `json:"object_type"`
+		ID               int      `json:"id"`
+		WeightMultiplier *float64 `json:"weight_multiplier"`
+		Note             string   `json:"note"`
+	} `json:"objects"`
+}
+
+func (e *HTTPEnricher) Enrich(ctx context.Context, ic *ImpactContext) error {
+	body, err := json.Marshal(httpEnricherRequest{
+		ImpactType:   ic.Request.ImpactType,
+		DeviceIDs:    ic.Objects("device"),
+		CircuitIDs:   ic.Objects("circuit"),
+		InterfaceIDs: ic.Objects("interface"),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", e.URL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxEnricherResponse+1))
+	if err != nil {
+		return fmt.Errorf("reading the response of %s: %w", e.URL, err)
+	}
+	if len(data) > maxEnricherResponse {
+		return fmt.Errorf("the response of %s is larger than %d bytes", e.URL, maxEnricherResponse)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var parsed httpEnricherResponse
+	if err := dec.Decode(&parsed); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", e.URL, err)
+	}
+	if parsed.Objects == nil {
+		return fmt.Errorf("invalid response from %s: no objects list", e.URL)
+	}
+	// Validate everything before annotating anything, so a bad entry
+	// rejects the response as a whole.
+	for i, o := range parsed.Objects {
+		if !slices.Contains(ic.Objects(o.ObjectType), o.ID) {
+			return fmt.Errorf("invalid response from %s: objects[%d]: %s %d was not sent", e.URL, i, cmp.Or(o.ObjectType, `""`), o.ID)
+		}
+		if o.WeightMultiplier != nil && *o.WeightMultiplier <= 0 {
+			return fmt.Errorf("invalid response from %s: objects[%d]: weight_multiplier %v must be positive", e.URL, i, *o.WeightMultiplier)
+		}
+		if o.WeightMultiplier == nil && o.Note == "" {
+			return fmt.Errorf("invalid response from %s: objects[%d]: neither weight_multiplier nor note", e.URL, i)
+		}
+	}
+	for _, o := range parsed.Objects {
+		factor := 1.0
+		if o.WeightMultiplier != nil {
+			factor = *o.WeightMultiplier
+		}
+		if err := ic.Annotate(o.ObjectType, o.ID, factor, o.Note); err != nil {
+			return fmt.Errorf("invalid response from %s: %w", e.URL, err)
+		}
+	}
+	return nil
+}
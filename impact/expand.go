@@ -0,0 +1,753 @@
+package impact
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// Exclusion is an object a request's exclude rules kept out of the score.
+// Source says how it was pulled in, e.g. "site AMS01" or "blast_radius".
+type Exclusion struct {
+	Type   string `json:"type"`
+	ID     int    `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+}
+
+// exclusions applies a request's exclude rules and records what they
+// removed. Objects listed in device_ids or circuit_ids cannot be excluded.
+type exclusions struct {
+	requestedDevices  map[int]bool
+	requestedCircuits map[int]bool
+	devices           map[int]bool
+	circuits          map[int]bool
+	tags              []string
+	excluded          []Exclusion
+	seen              map[string]bool
+}
+
+func newExclusions(req ImpactRequest) (*exclusions, error) {
+	ex := &exclusions{
+		requestedDevices:  make(map[int]bool),
+		requestedCircuits: make(map[int]bool),
+		devices:           make(map[int]bool),
+		circuits:          make(map[int]bool),
+		tags:              req.ExcludeTags,
+		seen:              make(map[string]bool),
+	}
+	for _, id := range req.DeviceIDs {
+		ex.requestedDevices[id] = true
+	}
+	for _, id := range req.CircuitIDs {
+		ex.requestedCircuits[id] = true
+	}
+	for _, id := range req.ExcludeDeviceIDs {
+		if ex.requestedDevices[id] {
+			return nil, &netbox.ValidationError{Field: "exclude_device_ids", Message: fmt.Sprintf("device %d is also listed in device_ids", id)}
+		}
+		ex.devices[id] = true
+	}
+	for _, id := range req.ExcludeCircuitIDs {
+		if ex.requestedCircuits[id] {
+			return nil, &netbox.ValidationError{Field: "exclude_circuit_ids", Message: fmt.Sprintf("circuit %d is also listed in circuit_ids", id)}
+		}
+		ex.circuits[id] = true
+	}
+	return ex, nil
+}
+
+// tagOf returns the exclude_tags entry matching one of tags, or "".
+func (ex *exclusions) tagOf(tags []netbox.Node) string {
+	for _, t := range tags {
+		for _, tag := range ex.tags {
+			if strings.EqualFold(tag, t.Slug) || strings.EqualFold(tag, t.Name) {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+func (ex *exclusions) record(e Exclusion) {
+	key := fmt.Sprintf("%s:%d", e.Type, e.ID)
+	if !ex.seen[key] {
+		ex.seen[key] = true
+		ex.excluded = append(ex.excluded, e)
+	}
+}
+
+// dropIDs removes the IDs excluded by rule from ids, which composites added.
+func (ex *exclusions) dropIDs(kind string, ids []int, excluded map[int]bool, rule string) []int {
+	var kept []int
+	for _, id := range ids {
+		if excluded[id] {
+			ex.record(Exclusion{Type: kind, ID: id, Rule: rule, Source: "composite"})
+			continue
+		}
+		kept = append(kept, id)
+	}
+	return kept
+}
+
+// device reports whether d, pulled in by source, is excluded. A requested
+// device carrying an excluded tag is an error.
+func (ex *exclusions) device(d *netbox.Device, source string) (bool, error) {
+	rule := ""
+	if ex.devices[d.ID] {
+		rule = "exclude_device_ids"
+	} else if tag := ex.tagOf(d.Tags); tag != "" {
+		rule = "exclude_tags: " + tag
+	}
+	switch {
+	case rule == "":
+		return false, nil
+	case ex.requestedDevices[d.ID]:
+		return false, &netbox.ValidationError{Field: "exclude_tags", Message: fmt.Sprintf("device %d (%s) is listed in device_ids but tagged %q", d.ID, d.Name, ex.tagOf(d.Tags))}
+	}
+	ex.record(Exclusion{Type: "device", ID: d.ID, Name: d.Name, Rule: rule, Source: source})
+	return true, nil
+}
+
+// circuit is device for circuits.
+func (ex *exclusions) circuit(c *netbox.Circuit, source string) (bool, error) {
+	rule := ""
+	if ex.circuits[c.ID] {
+		rule = "exclude_circuit_ids"
+	} else if tag := ex.tagOf(c.Tags); tag != "" {
+		rule = "exclude_tags: " + tag
+	}
+	switch {
+	case rule == "":
+		return false, nil
+	case ex.requestedCircuits[c.ID]:
+		return false, &netbox.ValidationError{Field: "exclude_tags", Message: fmt.Sprintf("circuit %d (%s) is listed in circuit_ids but tagged %q", c.ID, c.CID, ex.tagOf(c.Tags))}
+	}
+	ex.record(Exclusion{Type: "circuit", ID: c.ID, Name: c.CID, Rule: rule, Source: source})
+	return true, nil
+}
+
+// directReasons records, per object type, why a requested object is in the
+// request: "explicit" when the request lists it itself, "composite NAME" for
+// each composite that lists it.
+type directReasons map[string]map[int][]string
+
+// of returns the reasons for id, "explicit" for objects no composite added.
+func (d directReasons) of(kind string, id int) []string {
+	if reasons := d[kind][id]; len(reasons) > 0 {
+		return reasons
+	}
+	return []string{"explicit"}
+}
+
+func (c *Calculator) expandComposites(ctx context.Context, req ImpactRequest, client netbox.NetboxAPI) (ImpactRequest, directReasons, []DataWarning, error) {
+	var warnings []DataWarning
+	direct := make(directReasons)
+	own := map[string][]int{"device": req.DeviceIDs, "circuit": req.CircuitIDs, "interface": req.InterfaceIDs}
+	for i, name := range req.Composites {
+		composite, ok := c.Composites.Get(name)
+		if !ok {
+			return req, nil, nil, &netbox.ValidationError{
+				Field:   fmt.Sprintf("composites[%d]", i),
+				Message: fmt.Sprintf("unknown composite %q", name),
+			}
+		}
+		missing, err := MissingCompositeMembers(ctx, client, composite)
+		if err != nil {
+			return req, nil, nil, fmt.Errorf("failed to verify composite %q: %w", name, err)
+		}
+		skip := make(map[string]map[int]bool)
+		for field, ids := range missing {
+			skip[field] = make(map[int]bool)
+			for _, id := range ids {
+				skip[field][id] = true
+				warnings = append(warnings, DataWarning{
+					ObjectType: "composite",
+					Field:      field,
+					Severity:   SeverityHigh,
+					ID:         id,
+					Message:    fmt.Sprintf("composite %q references %s %d which does not exist in NetBox; it was not scored", name, strings.TrimSuffix(field, "_ids"), id),
+				})
+			}
+		}
+		for kind, ids := range map[string][]int{"device": composite.DeviceIDs, "circuit": composite.CircuitIDs, "interface": composite.InterfaceIDs} {
+			if direct[kind] == nil {
+				direct[kind] = make(map[int][]string)
+			}
+			for _, id := range ids {
+				if skip[kind+"_ids"][id] || slices.Contains(direct[kind][id], "composite "+name) {
+					continue
+				}
+				if len(direct[kind][id]) == 0 && slices.Contains(own[kind], id) {
+					direct[kind][id] = []string{"explicit"}
+				}
+				direct[kind][id] = append(direct[kind][id], "composite "+name)
+			}
+		}
+		req.DeviceIDs = appendMissing(req.DeviceIDs, composite.DeviceIDs, skip["device_ids"])
+		req.CircuitIDs = appendMissing(req.CircuitIDs, composite.CircuitIDs, skip["circuit_ids"])
+		req.InterfaceIDs = appendMissing(req.InterfaceIDs, composite.InterfaceIDs, skip["interface_ids"])
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		if warnings[i].Field != warnings[j].Field {
+			return warnings[i].Field < warnings[j].Field
+		}
+		return warnings[i].ID < warnings[j].ID
+	})
+	return req, direct, warnings, nil
+}
+
+func (c *Calculator) compositeRollups(req ImpactRequest) []CompositeRollup {
+	affected := map[string]map[int]bool{"device": {}, "circuit": {}, "interface": {}}
+	for _, id := range req.DeviceIDs {
+		affected["device"][id] = true
+	}
+	for _, id := range req.CircuitIDs {
+		affected["circuit"][id] = true
+	}
+	for _, id := range req.InterfaceIDs {
+		affected["interface"][id] = true
+	}
+	requested := make(map[string]bool)
+	for _, name := range req.Composites {
+		requested[name] = true
+	}
+	var rollups []CompositeRollup
+	for _, composite := range c.Composites.List() {
+		rollup := CompositeRollup{Name: composite.Name, Requested: requested[composite.Name], Notes: composite.Notes}
+		for kind, ids := range map[string][]int{"device": composite.DeviceIDs, "circuit": composite.CircuitIDs, "interface": composite.InterfaceIDs} {
+			rollup.Members += len(ids)
+			for _, id := range ids {
+				if affected[kind][id] {
+					rollup.AffectedMembers++
+				}
+			}
+		}
+		if rollup.AffectedMembers == 0 {
+			continue
+		}
+		rollup.Status = "partial"
+		if rollup.AffectedMembers == rollup.Members {
+			rollup.Status = "full"
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups
+}
+
+func circuitDataWarnings(c netbox.Circuit, netboxURL string) []DataWarning {
+	var warnings []DataWarning
+	for _, t := range []struct {
+		field       string
+		termination *netbox.CircuitTermination
+	}{{"termination_a", c.TerminationA}, {"termination_z", c.TerminationZ}} {
+		message := ""
+		switch {
+		case t.termination == nil:
+			message = fmt.Sprintf("circuit %s has no %s; redundancy cannot be determined", c.CID, t.field)
+		case t.termination.Endpoint() == "":
+			message = fmt.Sprintf("circuit %s %s is not connected to a site or provider network; redundancy cannot be determined", c.CID, t.field)
+		default:
+			continue
+		}
+		warnings = append(warnings, DataWarning{
+			ObjectType: "circuit",
+			ID:         c.ID,
+			Field:      t.field,
+			Severity:   SeverityMedium,
+			Message:    message,
+			URL:        fmt.Sprintf("%s/circuits/circuits/%d/edit/", strings.TrimRight(netboxURL, "/"), c.ID),
+		})
+	}
+	return warnings
+}
+
+// fetchEach looks every ID up on its own so a failure only loses that
+// object; the failures come back as warnings. Unknown IDs and a cancelled
+// context still fail the call.
+func fetchEach[T any](ctx context.Context, kind string, ids []int, workers int, fetch func(context.Context, int) (*T, error)) (map[int]*T, []DataWarning, error) {
+	objects := make([]*T, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			objects[i], errs[i] = fetch(ctx, id)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	found := make(map[int]*T, len(ids))
+	var warnings []DataWarning
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			found[ids[i]] = objects[i]
+		case errors.Is(err, netbox.ErrNotFound):
+			return nil, nil, &netbox.ValidationError{
+				Field:   kind + "_ids",
+				Message: fmt.Sprintf("%s %d does not exist in NetBox", kind, ids[i]),
+			}
+		default:
+			warnings = append(warnings, DataWarning{
+				ObjectType: kind,
+				ID:         ids[i],
+				Field:      kind + "_ids",
+				Severity:   SeverityHigh,
+				Message:    fmt.Sprintf("could not be fetched from NetBox (%v); scored at base weight", err),
+			})
+		}
+	}
+	return found, warnings, nil
+}
+
+// expandSites returns the devices at the given sites after checking that
+// every site exists.
+func expandSites(ctx context.Context, client netbox.NetboxAPI, siteIDs []int) ([]netbox.Device, error) {
+	sites, err := client.FetchNamesByIDs(ctx, "/api/dcim/sites/", siteIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sites: %w", err)
+	}
+	var missing []int
+	for _, id := range siteIDs {
+		if _, ok := sites[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &netbox.ValidationError{
+			Field:   "site_ids",
+			Message: "sites not found in NetBox: " + netbox.IDList(missing),
+		}
+	}
+	devices, err := client.FetchDevicesBySites(ctx, siteIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch devices at sites: %w", err)
+	}
+	return devices, nil
+}
+
+type discoveredDevice struct {
+	ID   int
+	Via  int
+	Hops int
+}
+
+// blastRadius walks cable connections outward from roots for up to depth
+// hops and returns every device it reaches that is not in seen, together
+// with the root it was first reached from. seen is updated as devices are
+// found, so cycles in the cabling end the walk.
+func (c *Calculator) blastRadius(ctx context.Context, client netbox.NetboxAPI, roots []int, depth int, seen map[int]bool) ([]discoveredDevice, error) {
+	var frontier, found []discoveredDevice
+	queued := make(map[int]bool)
+	for _, id := range roots {
+		if !queued[id] {
+			queued[id] = true
+			frontier = append(frontier, discoveredDevice{ID: id, Via: id})
+		}
+	}
+	fetchCables := func(ctx context.Context, id int) (*[]netbox.Cable, error) {
+		cables, err := client.FetchCablesByDevice(ctx, id)
+		return &cables, err
+	}
+	for hop := 1; hop <= depth && len(frontier) > 0; hop++ {
+		ids := make([]int, len(frontier))
+		for i, d := range frontier {
+			ids[i] = d.ID
+		}
+		cables, err := netbox.FetchConcurrently(ctx, "device", ids, c.FetchConcurrency, fetchCables)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk cables: %w", err)
+		}
+		var next []discoveredDevice
+		for i, from := range frontier {
+			for _, cable := range *cables[i] {
+				for _, peer := range cable.PeerDevices(from.ID) {
+					if seen[peer] {
+						continue
+					}
+					seen[peer] = true
+					d := discoveredDevice{ID: peer, Via: from.Via, Hops: hop}
+					found = append(found, d)
+					next = append(next, d)
+				}
+			}
+		}
+		frontier = next
+	}
+	return found, nil
+}
+
+// configContextHint reads the hint at path from a rendered config context.
+// Devices without one get multiplier 1 and no note.
+func configContextHint(context map[string]interface{}, path string) (float64, string, error) {
+	var value interface{} = context
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 1, "", nil
+		}
+		if value, ok = object[key]; !ok {
+			return 1, "", nil
+		}
+	}
+	hint, ok := value.(map[string]interface{})
+	if !ok {
+		return 1, "", fmt.Errorf("%s is a %T, not an object", path, value)
+	}
+	multiplier := 1.0
+	if raw, ok := hint["weight_multiplier"]; ok {
+		m, ok := raw.(float64)
+		if !ok || m <= 0 {
+			return 1, "", fmt.Errorf("%s.weight_multiplier must be a positive number (got %v)", path, raw)
+		}
+		multiplier = m
+	}
+	var note string
+	if raw, ok := hint["note"]; ok {
+		if note, ok = raw.(string); !ok {
+			return 1, "", fmt.Errorf("%s.note must be a string (got %v)", path, raw)
+		}
+	}
+	return multiplier, note, nil
+}
+
+// applyConfigContextHints multiplies each scored device by the
+// weight_multiplier of its config context hint, re-applying the device
+// cap, and attaches the hint's note. Devices whose context cannot be
+// fetched or holds a malformed hint keep their score, with a warning.
+func (c *Calculator) applyConfigContextHints(ctx context.Context, client netbox.NetboxAPI, sections [][]DeviceImpactDetail, deviceCap float64) ([]DataWarning, error) {
+	var devices []*DeviceImpactDetail
+	for _, items := range sections {
+		for i := range items {
+			if !items[i].Unavailable {
+				devices = append(devices, &items[i])
+			}
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].Impact > devices[j].Impact })
+	var warnings []DataWarning
+	if c.ConfigContextMaxDevices > 0 && len(devices) > c.ConfigContextMaxDevices {
+		warnings = append(warnings, DataWarning{
+			ObjectType: "device",
+			Field:      "config_context",
+			Severity:   SeverityMedium,
+			Message:    fmt.Sprintf("config context hints were read for the %d highest-impact devices only; %d devices were scored without them", c.ConfigContextMaxDevices, len(devices)-c.ConfigContextMaxDevices),
+		})
+		devices = devices[:c.ConfigContextMaxDevices]
+	}
+	contexts := make([]map[string]interface{}, len(devices))
+	errs := make([]error, len(devices))
+	sem := make(chan struct{}, max(c.FetchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			contexts[i], errs[i] = client.FetchConfigContext(ctx, d.ID)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, d := range devices {
+		err := errs[i]
+		multiplier, note := 1.0, ""
+		if err == nil {
+			multiplier, note, err = configContextHint(contexts[i], c.ConfigContextPath)
+		}
+		if err != nil {
+			warnings = append(warnings, DataWarning{
+				ObjectType: "device",
+				ID:         d.ID,
+				Field:      "config_context",
+				Severity:   SeverityMedium,
+				Message:    fmt.Sprintf("no impact hint applied: %v", err),
+			})
+			continue
+		}
+		d.HintNote = note
+		if multiplier != 1 {
+			d.HintFactor = multiplier
+			d.Impact, d.UncappedImpact, d.Cap = capImpact(cmp.Or(d.UncappedImpact, d.Impact)*multiplier, deviceCap)
+		}
+	}
+	return warnings, nil
+}
+
+// untieredTenants returns the tenants of the devices TenantTiers gives no
+// tier.
+func untieredTenants(sections [][]DeviceImpactDetail) []*netbox.Node {
+	var tenants []*netbox.Node
+	for _, items := range sections {
+		for _, d := range items {
+			if d.Tier == "" && d.tenant != nil {
+				tenants = append(tenants, d.tenant)
+			}
+		}
+	}
+	return tenants
+}
+
+// applyTenantTiers multiplies the devices without a configured tier by the
+// tier of their NetBox tenant's TierField.
+func applyTenantTiers(sections [][]DeviceImpactDetail, tiers *tenantTiers, deviceCap float64) {
+	for _, items := range sections {
+		for i := range items {
+			d := &items[i]
+			if d.Tier != "" || d.tenant == nil {
+				continue
+			}
+			d.Tier, d.TierFactor = tiers.of(d.tenant)
+			d.Impact, d.UncappedImpact, d.Cap = capImpact(cmp.Or(d.UncappedImpact, d.Impact)*d.TierFactor, deviceCap)
+		}
+	}
+}
+
+// applyRecoveryPathCheck looks up the console server ports of the scored
+// devices with an OOB role. A scored device cabled to one of them loses its
+// production and its out-of-band path at once; it is multiplied by the
+// no-recovery-path factor, re-applying the device cap, and listed in a
+// warning.
+func (c *Calculator) applyRecoveryPathCheck(ctx context.Context, client netbox.NetboxAPI, sections [][]DeviceImpactDetail, weights WeightConfig) ([]DataWarning, error) {
+	scored := make(map[int]*DeviceImpactDetail)
+	var oob []int
+	for _, items := range sections {
+		for i := range items {
+			d := &items[i]
+			if d.Unavailable {
+				continue
+			}
+			scored[d.ID] = d
+			if slices.Contains(weights.OOBRoles, d.roleSlug) {
+				oob = append(oob, d.ID)
+			}
+		}
+	}
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	sort.Ints(oob)
+	fetchPorts := func(ctx context.Context, id int) (*[]netbox.ConsoleServerPort, error) {
+		ports, err := client.FetchConsoleServerPorts(ctx, id)
+		return &ports, err
+	}
+	portsPerDevice, err := netbox.FetchConcurrently(ctx, "device", oob, c.FetchConcurrency, fetchPorts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch console server ports: %w", err)
+	}
+	var lost []*DeviceImpactDetail
+	for i, ports := range portsPerDevice {
+		server := scored[oob[i]]
+		for _, port := range *ports {
+			for _, end := range port.ConnectedEndpoints {
+				if end.Device == nil || end.Device.ID == server.ID {
+					continue
+				}
+				d := scored[end.Device.ID]
+				if d == nil || slices.Contains(d.OOBVia, server.Name) {
+					continue
+				}
+				if len(d.OOBVia) == 0 {
+					lost = append(lost, d)
+				}
+				d.OOBVia = append(d.OOBVia, server.Name)
+			}
+		}
+	}
+	if len(lost) == 0 {
+		return nil, nil
+	}
+	sort.Slice(lost, func(i, j int) bool { return lost[i].ID < lost[j].ID })
+	names := make([]string, len(lost))
+	for i, d := range lost {
+		d.NoRecoveryPathFactor = weights.NoRecoveryPathFactor
+		d.Impact, d.UncappedImpact, d.Cap = capImpact(cmp.Or(d.UncappedImpact, d.Impact)*weights.NoRecoveryPathFactor, weights.Caps.Device)
+		names[i] = fmt.Sprintf("%s (console via %s)", cmp.Or(d.Name, strconv.Itoa(d.ID)), strings.Join(d.OOBVia, ", "))
+	}
+	return []DataWarning{{
+		ObjectType: "request",
+		Field:      "no_recovery_path",
+		Severity:   SeverityCritical,
+		Message:    fmt.Sprintf("NO RECOVERY PATH: %d devices lose their production path and their out-of-band access in this request: %s", len(lost), strings.Join(names, "; ")),
+	}}, nil
+}
+
+// hostedVMs looks up the VMs on each device, counting a VM once even when
+// several hosts of its cluster were requested.
+func (c *Calculator) hostedVMs(ctx context.Context, client netbox.NetboxAPI, devices []*netbox.Device, weight float64) (*VirtualMachineImpact, error) {
+	hosts := make([]int, 0, len(devices))
+	byID := make(map[int]*netbox.Device)
+	for _, d := range devices {
+		if byID[d.ID] == nil {
+			byID[d.ID] = d
+			hosts = append(hosts, d.ID)
+		}
+	}
+	fetchVMs := func(ctx context.Context, id int) (*[]netbox.VirtualMachine, error) {
+		vms, err := client.FetchVirtualMachinesByDevice(ctx, *byID[id])
+		return &vms, err
+	}
+	vmsPerHost, err := netbox.FetchConcurrently(ctx, "device", hosts, c.FetchConcurrency, fetchVMs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch virtual machines: %w", err)
+	}
+	seen := make(map[int]bool)
+	var items []VirtualMachineImpactDetail
+	for i, vms := range vmsPerHost {
+		for _, vm := range *vms {
+			if seen[vm.ID] {
+				continue
+			}
+			seen[vm.ID] = true
+			detail := VirtualMachineImpactDetail{
+				ID:      vm.ID,
+				Name:    vm.Name,
+				Host:    byID[hosts[i]].Name,
+				Cluster: vm.Cluster.NameOrEmpty(),
+				Impact:  weight,
+			}
+			if vm.Status != nil {
+				detail.Status = vm.Status.Value
+			}
+			items = append(items, detail)
+		}
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return &VirtualMachineImpact{
+		Count:       len(items),
+		WeightPerVM: weight,
+		Impact:      float64(len(items)) * weight,
+		Items:       items,
+	}, nil
+}
+
+// expandRacks returns the devices in each rack after checking that every
+// rack exists.
+func expandRacks(ctx context.Context, client netbox.NetboxAPI, rackIDs []int) ([]RackImpactDetail, [][]netbox.Device, error) {
+	names, err := client.FetchNamesByIDs(ctx, "/api/dcim/racks/", rackIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch racks: %w", err)
+	}
+	var missing []int
+	for _, id := range rackIDs {
+		if _, ok := names[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, &netbox.ValidationError{
+			Field:   "rack_ids",
+			Message: "racks not found in NetBox: " + netbox.IDList(missing),
+		}
+	}
+	racks := make([]RackImpactDetail, len(rackIDs))
+	devices := make([][]netbox.Device, len(rackIDs))
+	for i, id := range rackIDs {
+		racks[i] = RackImpactDetail{ID: id, Name: names[id]}
+		devices[i], err = client.FetchDevicesByRack(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch devices in rack %d: %w", id, err)
+		}
+	}
+	return racks, devices, nil
+}
+
+// redundancyFactorPowerFeed discounts a rack that keeps another active feed
+// (A/B power) outside the maintenance.
+func redundancyFactorPowerFeed(rackFeeds []netbox.PowerFeed, affected map[int]bool, factor float64) float64 {
+	for _, f := range rackFeeds {
+		if !affected[f.ID] && (f.Status == nil || f.Status.Value == "active") {
+			return factor
+		}
+	}
+	return 1.0
+}
+
+// powerFeedImpact scores the devices in the racks fed by the given power
+// feeds and records each feed as a path to them in in.
+func (c *Calculator) powerFeedImpact(ctx context.Context, client netbox.NetboxAPI, feedIDs []int, weights WeightConfig, in inclusions, ex *exclusions) ([]PowerFeedImpactDetail, []DataWarning, error) {
+	feeds, err := netbox.FetchConcurrently(ctx, "power_feed", feedIDs, c.FetchConcurrency, client.FetchPowerFeedByID)
+	if err != nil {
+		return nil, nil, err
+	}
+	affected := make(map[int]bool)
+	for _, f := range feeds {
+		affected[f.ID] = true
+	}
+	var details []PowerFeedImpactDetail
+	var warnings []DataWarning
+	for _, f := range feeds {
+		detail := PowerFeedImpactDetail{ID: f.ID, Name: f.Name, RedundancyFactor: 1.0}
+		if f.Rack == nil {
+			warnings = append(warnings, DataWarning{
+				ObjectType: "power_feed",
+				ID:         f.ID,
+				Field:      "rack",
+				Severity:   SeverityHigh,
+				Message:    fmt.Sprintf("power feed %q has no rack in NetBox; no devices were scored for it", f.Name),
+			})
+			details = append(details, detail)
+			continue
+		}
+		detail.Rack = f.Rack.Name
+		rackFeeds, err := client.FetchPowerFeedsByRack(ctx, f.Rack.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch power feeds of rack %d: %w", f.Rack.ID, err)
+		}
+		detail.RedundancyFactor = redundancyFactorPowerFeed(rackFeeds, affected, weights.PowerFeedRedundancyFactor)
+		devices, err := client.FetchDevicesByRack(ctx, f.Rack.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch devices in rack %d: %w", f.Rack.ID, err)
+		}
+		for i := range devices {
+			d := &devices[i]
+			excluded, err := ex.device(d, "power_feed "+f.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !excluded {
+				scored := weights.scoreDevice(d, detail.RedundancyFactor)
+				scored.Reason = "power_feed " + f.Name
+				in.add(d.ID, scored.Reason, detail.RedundancyFactor)
+				detail.devices = append(detail.devices, scored)
+			}
+		}
+		detail.sumDevices()
+		details = append(details, detail)
+	}
+	return details, warnings, nil
+}
+
+// redundancyFactorCircuit discounts a circuit whose two ends land on the same
+// site or provider network. Without both endpoints it counts in full.
+func redundancyFactorCircuit(c netbox.Circuit, factor float64) float64 {
+	a, b := c.TerminationA.Endpoint(), c.TerminationZ.Endpoint()
+	if a == "" || b == "" {
+		return 1.0
+	}
+	if a == b {
+		return factor
+	}
+	return 1.0
+}
@@ -0,0 +1,116 @@
+package impact
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Feature is a behaviour being phased in or out. Until Sunset, the release
+// that removes the switch and keeps the new behaviour, -features can turn
+// it on early or keep the old one.
+type Feature struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	Sunset  string `json:"sunset"`
+	Effect  string `json:"effect"`
+}
+
+const StrictMultiplierValidation = "strict_multiplier_validation"
+
+// Features is the registry of every switchable behaviour.
+var Features = []Feature{
+	{
+		Name:   StrictMultiplierValidation,
+		Sunset: "2.0",
+		Effect: "a request whose impact type multiplier is 0, from the weights file or its overrides, is refused with 400 instead of scored 0 with a warning",
+	},
+}
+
+func feature(name string) (Feature, bool) {
+	i := slices.IndexFunc(Features, func(f Feature) bool { return f.Name == name })
+	if i < 0 {
+		return Feature{}, false
+	}
+	return Features[i], true
+}
+
+// FeatureFlags are the features -features set; the others keep their
+// default.
+type FeatureFlags map[string]bool
+
+// ParseFeatureFlags reads a comma-separated list of feature names, each
+// optionally "=false" or "=true".
+func ParseFeatureFlags(spec string) (FeatureFlags, error) {
+	flags := FeatureFlags{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(item, "=")
+		if _, ok := feature(name); !ok {
+			names := make([]string, len(Features))
+			for i, f := range Features {
+				names[i] = f.Name
+			}
+			return nil, fmt.Errorf("unknown feature %q (known: %s)", name, strings.Join(names, ", "))
+		}
+		on := true
+		if hasValue {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("feature %s: %q is not true or false", name, value)
+			}
+		}
+		flags[name] = on
+	}
+	return flags, nil
+}
+
+// Enabled says whether feature name is on.
+func (f FeatureFlags) Enabled(name string) bool {
+	if on, ok := f[name]; ok {
+		return on
+	}
+	d, _ := feature(name)
+	return d.Default
+}
+
+// Active names the features that are on, in registry order.
+func (f FeatureFlags) Active() []string {
+	var active []string
+	for _, d := range Features {
+		if f.Enabled(d.Name) {
+			active = append(active, d.Name)
+		}
+	}
+	return active
+}
+
+// Deprecations are the startup warnings, one per feature, about settings
+// that stop working at its sunset: turning it off explicitly, and for
+// strict_multiplier_validation, weights with an impact type multiplier of
+// 0 while it is off.
+func (f FeatureFlags) Deprecations(w WeightConfig) []string {
+	var warnings []string
+	for _, d := range Features {
+		if on, ok := f[d.Name]; ok && !on {
+			warnings = append(warnings, fmt.Sprintf("feature %s=false is deprecated: from %s it is always on (%s)", d.Name, d.Sunset, d.Effect))
+			continue
+		}
+		if d.Name == StrictMultiplierValidation && !f.Enabled(d.Name) {
+			var zero []string
+			for _, t := range w.ImpactTypeNames() {
+				if w.ImpactTypes[ImpactType(t)] == 0 {
+					zero = append(zero, t)
+				}
+			}
+			if len(zero) > 0 {
+				warnings = append(warnings, fmt.Sprintf("impact types with multiplier 0 (%s) are deprecated: from %s their requests are refused; enable %s to refuse them now", strings.Join(zero, ", "), d.Sunset, d.Name))
+			}
+		}
+	}
+	return warnings
+}
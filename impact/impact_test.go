@@ -0,0 +1,1694 @@
+package impact
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+)
+
+// fixtureServer serves the files in routes, keyed by URL path, as a NetBox
+// API would.
+func fixtureServer(t *testing.T, routes map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := routes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("reading fixture: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCircuitTerminationsNetbox3List(t *testing.T) {
+	srv := fixtureServer(t, map[string]string{
+		"/api/circuits/circuits/": "testdata/netbox-3.7/circuits.json",
+	})
+	client := netbox.NewNetboxClient(srv.URL, "token")
+	circuits, err := client.FetchCircuitsByIDs(context.Background(), []int{100, 101, 102, 103})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id         int
+		a, z       string
+		redundancy float64
+		warnings   []string
+	}{
+		{id: 100, a: "site:1", z: "site:2", redundancy: 1},
+		{id: 101, a: "site:1", z: "site:1", redundancy: 0.8},
+		{id: 102, a: "site:1", z: "provider_network:5", redundancy: 1},
+		{id: 103, a: "site:2", z: "", redundancy: 1, warnings: []string{"termination_z"}},
+	}
+	for _, tt := range tests {
+		c, ok := circuits[tt.id]
+		if !ok {
+			t.Errorf("circuit %d not decoded", tt.id)
+			continue
+		}
+		if got := c.TerminationA.Endpoint(); got != tt.a {
+			t.Errorf("circuit %d termination_a = %q, want %q", tt.id, got, tt.a)
+		}
+		if got := c.TerminationZ.Endpoint(); got != tt.z {
+			t.Errorf("circuit %d termination_z = %q, want %q", tt.id, got, tt.z)
+		}
+		if got := redundancyFactorCircuit(c, 0.8); got != tt.redundancy {
+			t.Errorf("circuit %d redundancy = %v, want %v", tt.id, got, tt.redundancy)
+		}
+		var fields []string
+		for _, w := range circuitDataWarnings(c, srv.URL) {
+			fields = append(fields, w.Field)
+		}
+		if len(fields) != len(tt.warnings) || (len(fields) > 0 && fields[0] != tt.warnings[0]) {
+			t.Errorf("circuit %d warnings on %v, want %v", tt.id, fields, tt.warnings)
+		}
+	}
+}
+
+func TestCircuitTerminationsNetbox3Detail(t *testing.T) {
+	srv := fixtureServer(t, map[string]string{
+		"/api/circuits/circuits/101/": "testdata/netbox-3.7/circuit-101.json",
+	})
+	client := netbox.NewNetboxClient(srv.URL, "token")
+	c, err := client.FetchCircuitByID(context.Background(), 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TerminationA.EndpointName() != "AMS01" || c.TerminationZ.EndpointName() != "AMS01" {
+		t.Errorf("terminations = %q, %q, want AMS01 on both sides", c.TerminationA.EndpointName(), c.TerminationZ.EndpointName())
+	}
+	if got := redundancyFactorCircuit(*c, 0.8); got != 0.8 {
+		t.Errorf("redundancy = %v, want 0.8", got)
+	}
+}
+
+// calculate scores req with the flag defaults.
+func calculate(ctx context.Context, req ImpactRequest, client netbox.NetboxAPI, weights WeightConfig) (ImpactResult, error) {
+	return NewCalculator(DefaultOptions()).Calculate(ctx, req, client, weights)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestCalculateImpactScoring(t *testing.T) {
+	noBlast := ptr(0)
+	tests := []struct {
+		name    string
+		req     ImpactRequest
+		weights func(*WeightConfig)
+		// before is the total before the impact type multiplier.
+		before, total float64
+	}{
+		{name: "device", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast}, before: 5, total: 5},
+		{name: "duplicate device counts once", req: ImpactRequest{DeviceIDs: []int{1, 1}, BlastRadiusDepth: noBlast}, before: 5, total: 5},
+		{name: "device criticality", req: ImpactRequest{DeviceIDs: []int{2}, BlastRadiusDepth: noBlast}, before: 10, total: 10},
+		{name: "device status", req: ImpactRequest{DeviceIDs: []int{3}, BlastRadiusDepth: noBlast}, before: 1, total: 1},
+		{name: "role weight", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast},
+			weights: func(w *WeightConfig) { w.Roles = map[string]float64{"core-router": 8} }, before: 8, total: 8},
+		{name: "blast radius", req: ImpactRequest{DeviceIDs: []int{1}}, before: 5 + 5*0.5*0.2, total: 5.5},
+		{name: "hosted virtual machines", req: ImpactRequest{DeviceIDs: []int{4}, BlastRadiusDepth: noBlast}, before: 7, total: 7},
+		{name: "virtual machines disabled", req: ImpactRequest{DeviceIDs: []int{4}, BlastRadiusDepth: noBlast, ExpandVMs: ptr(false)}, before: 5, total: 5},
+		{name: "tenant tier from configuration", req: ImpactRequest{DeviceIDs: []int{4}, BlastRadiusDepth: noBlast, ExpandVMs: ptr(false)},
+			weights: func(w *WeightConfig) { w.TenantTiers = map[string]string{"globex": "gold"} }, before: 7.5, total: 7.5},
+		{name: "tenant tier from custom field", req: ImpactRequest{DeviceIDs: []int{4}, BlastRadiusDepth: noBlast, ExpandVMs: ptr(false)},
+			weights: func(w *WeightConfig) { w.TierField = "sla" }, before: 10, total: 10},
+		{name: "parallel circuit", req: ImpactRequest{CircuitIDs: []int{100}}, before: 3*0.4*1.5 + 2*2.5, total: 6.8},
+		{name: "both parallel circuits", req: ImpactRequest{CircuitIDs: []int{100, 101}}, before: 3*1.5 + 3 + 2*2.5, total: 12.5},
+		{name: "looped circuit", req: ImpactRequest{CircuitIDs: []int{102}}, before: 3*0.8 + 2.5, total: 4.9},
+		{name: "circuit to provider network", req: ImpactRequest{CircuitIDs: []int{103}}, before: 3*0.2 + 2*2.5, total: 5.6},
+		{name: "circuit endpoint at expanded site", req: ImpactRequest{CircuitIDs: []int{102}, SiteIDs: []int{1}}, before: 2.4 + 5 + 10, total: 17.4},
+		{name: "provider factor", req: ImpactRequest{CircuitIDs: []int{103}},
+			weights: func(w *WeightConfig) { w.Providers = map[string]float64{"lumen": 2} }, before: 3*0.2*2 + 2*2.5, total: 6.2},
+		{name: "interfaces", req: ImpactRequest{InterfaceIDs: []int{200, 201, 202}}, before: 1 + 0.2 + 1.5*1.5, total: 3.45},
+		{name: "site expansion", req: ImpactRequest{SiteIDs: []int{2}}, before: 1 + 5, total: 6},
+		{name: "site device already requested", req: ImpactRequest{DeviceIDs: []int{3}, SiteIDs: []int{2}, BlastRadiusDepth: noBlast}, before: 1 + 5, total: 6},
+		{name: "rack", req: ImpactRequest{RackIDs: []int{10}}, before: 5 + 10, total: 15},
+		{name: "power feed with redundancy", req: ImpactRequest{PowerFeedIDs: []int{30}}, before: (1 + 5) * 0.5, total: 3},
+		{name: "both power feeds", req: ImpactRequest{PowerFeedIDs: []int{30, 31}}, before: 6, total: 6},
+		{name: "power feed without rack", req: ImpactRequest{PowerFeedIDs: []int{32}}, before: 0, total: 0},
+		{name: "cable to circuit", req: ImpactRequest{CableIDs: []int{51}}, before: 1 + 3*0.4 + 2*2.5, total: 7.2},
+		{name: "impact type multiplier", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast, ImpactType: ElectricalWork}, before: 5, total: 10},
+		{name: "overrides", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast, Overrides: &WeightOverrides{DeviceWeight: ptr(7.0)}}, before: 7, total: 7},
+		{name: "time band", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast, StartTime: ptr(time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC))},
+			before: 5, total: 7.5},
+		{name: "duration", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: noBlast, StartTime: ptr(time.Date(2026, 10, 14, 19, 0, 0, 0, time.UTC)), DurationMinutes: ptr(240.0)},
+			before: 5, total: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights := DefaultWeightConfig()
+			if tt.weights != nil {
+				tt.weights(&weights)
+			}
+			if tt.req.ImpactType == "" {
+				tt.req.ImpactType = PlannedWork
+			}
+			result, err := calculate(context.Background(), tt.req, netboxfake.Sample(), weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approxEqual(result.TotalImpactBeforeMultiplier, tt.before) {
+				t.Errorf("total before multiplier = %v, want %v", result.TotalImpactBeforeMultiplier, tt.before)
+			}
+			if !approxEqual(result.TotalImpact, tt.total) {
+				t.Errorf("total = %v, want %v", result.TotalImpact, tt.total)
+			}
+		})
+	}
+}
+
+func TestCalculateImpactErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   ImpactRequest
+		fake  func(*netboxfake.FakeNetbox)
+		check func(error) bool
+	}{
+		{name: "unknown device", req: ImpactRequest{DeviceIDs: []int{99}},
+			check: func(err error) bool { var uerr *UnknownObjectsError; return errors.As(err, &uerr) }},
+		{name: "unknown circuit", req: ImpactRequest{CircuitIDs: []int{99}},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "circuit_ids"
+			}},
+		{name: "unknown site", req: ImpactRequest{SiteIDs: []int{99}},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "site_ids"
+			}},
+		{name: "unknown impact type", req: ImpactRequest{DeviceIDs: []int{1}, ImpactType: "reboot"},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "impact_type"
+			}},
+		{name: "negative blast radius", req: ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: ptr(-1)},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "blast_radius_depth"
+			}},
+		{name: "netbox error", req: ImpactRequest{CircuitIDs: []int{100}},
+			fake: func(f *netboxfake.FakeNetbox) {
+				f.Errors = map[string]error{"FetchCircuitsByIDs": &netbox.StatusError{StatusCode: http.StatusBadGateway}}
+			},
+			check: func(err error) bool { var serr *netbox.StatusError; return errors.As(err, &serr) }},
+		{name: "excluded device also requested", req: ImpactRequest{DeviceIDs: []int{1}, ExcludeDeviceIDs: []int{1}},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "exclude_device_ids"
+			}},
+		{name: "requested device carries excluded tag", req: ImpactRequest{DeviceIDs: []int{1}, ExcludeTags: []string{"lab"}},
+			fake: func(f *netboxfake.FakeNetbox) {
+				d := f.Devices[1]
+				d.Tags = []netbox.Node{{Name: "Lab", Slug: "lab"}}
+				f.Devices[1] = d
+			},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "exclude_tags"
+			}},
+		{name: "tag with a space", req: ImpactRequest{DeviceIDs: []int{1}, Tags: []string{"dc move"}},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "tags"
+			}},
+		{name: "tag listed twice", req: ImpactRequest{DeviceIDs: []int{1}, Tags: []string{"q3", "q3"}},
+			check: func(err error) bool {
+				var verr *netbox.ValidationError
+				return errors.As(err, &verr) && verr.Field == "tags"
+			}},
+		{name: "strict data rejects missing termination", req: ImpactRequest{CircuitIDs: []int{100}, StrictData: true},
+			fake:  func(f *netboxfake.FakeNetbox) { c := f.Circuits[100]; c.TerminationZ = nil; f.Circuits[100] = c },
+			check: func(err error) bool { var dqerr *DataQualityError; return errors.As(err, &dqerr) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := netboxfake.Sample()
+			if tt.fake != nil {
+				tt.fake(fake)
+			}
+			if tt.req.ImpactType == "" {
+				tt.req.ImpactType = PlannedWork
+			}
+			_, err := calculate(context.Background(), tt.req, fake, DefaultWeightConfig())
+			if err == nil || !tt.check(err) {
+				t.Errorf("err = %v (%T)", err, err)
+			}
+		})
+	}
+}
+
+func TestContributionCaps(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     ImpactRequest
+		caps    ContributionCaps
+		total   float64
+		explain string
+	}{
+		{name: "no caps", req: ImpactRequest{CircuitIDs: []int{100, 101}}, total: 12.5},
+		{name: "circuit cap", req: ImpactRequest{CircuitIDs: []int{100, 101}}, caps: ContributionCaps{Circuit: 4}, total: 12,
+			explain: "circuit AMS-RTM-1 scored 4 (weight 3 × bandwidth 1.5), capped at 4 (uncapped 4.5)"},
+		{name: "cap above every object", req: ImpactRequest{CircuitIDs: []int{100, 101}}, caps: ContributionCaps{Circuit: 50}, total: 12.5},
+		{name: "device cap", req: ImpactRequest{DeviceIDs: []int{2}, BlastRadiusDepth: ptr(0)}, caps: ContributionCaps{Device: 6}, total: 6,
+			explain: "device sw-ams01 scored 6 (weight 5 × criticality 2), capped at 6 (uncapped 10)"},
+		{name: "circuit share cap", req: ImpactRequest{CircuitIDs: []int{100, 101}}, caps: ContributionCaps{Shares: map[string]float64{"circuits": 0.5}}, total: 10,
+			explain: "circuits held to 50% of the total: 5 instead of 7.5"},
+		{name: "share cap that does not bite", req: ImpactRequest{CircuitIDs: []int{100, 101}}, caps: ContributionCaps{Shares: map[string]float64{"circuits": 0.7}}, total: 12.5},
+		{name: "share cap on the only class", req: ImpactRequest{DeviceIDs: []int{2}, BlastRadiusDepth: ptr(0)}, caps: ContributionCaps{Shares: map[string]float64{"devices": 0.8}}, total: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights := DefaultWeightConfig()
+			weights.Caps = tt.caps
+			tt.req.ImpactType = PlannedWork
+			tt.req.Explain = true
+			result, err := calculate(context.Background(), tt.req, netboxfake.Sample(), weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approxEqual(result.TotalImpact, tt.total) {
+				t.Errorf("total = %v, want %v", result.TotalImpact, tt.total)
+			}
+			sum := 0.0
+			for _, v := range result.Breakdown.sections() {
+				sum += v
+			}
+			if !approxEqual(sum, result.TotalImpactBeforeMultiplier) {
+				t.Errorf("sections sum to %v, total before multiplier is %v", sum, result.TotalImpactBeforeMultiplier)
+			}
+			if tt.explain != "" && !slices.Contains(result.Explanation, tt.explain) {
+				t.Errorf("explanation lacks %q:\n%s", tt.explain, strings.Join(result.Explanation, "\n"))
+			}
+		})
+	}
+}
+
+func TestShareCapScalesItems(t *testing.T) {
+	weights := DefaultWeightConfig()
+	weights.Caps.Shares = map[string]float64{"circuits": 0.5}
+	req := ImpactRequest{CircuitIDs: []int{100, 101}, ImpactType: PlannedWork}
+	result, err := calculate(context.Background(), req, netboxfake.Sample(), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range result.Breakdown.Circuits.Items {
+		if !approxEqual(c.ShareFactor, 5/7.5) || !approxEqual(c.Impact, c.UncappedImpact*c.ShareFactor) {
+			t.Errorf("circuit %s: impact %v, uncapped %v, share factor %v", c.CID, c.Impact, c.UncappedImpact, c.ShareFactor)
+		}
+	}
+	want := []ShareCap{{Class: "circuits", Share: 0.5, UncappedImpact: 7.5, Impact: 5}}
+	if !reflect.DeepEqual(result.Breakdown.ShareCaps, want) {
+		t.Errorf("share caps = %+v, want %+v", result.Breakdown.ShareCaps, want)
+	}
+}
+
+func TestContributionCapsValidation(t *testing.T) {
+	for _, caps := range []ContributionCaps{
+		{Device: -1},
+		{Shares: map[string]float64{"circuits": 0}},
+		{Shares: map[string]float64{"circuits": 1.5}},
+		{Shares: map[string]float64{"racks": 0.5}},
+	} {
+		weights := DefaultWeightConfig()
+		weights.Caps = caps
+		if err := weights.Validate(); err == nil {
+			t.Errorf("caps %+v accepted", caps)
+		}
+	}
+}
+
+func TestConfigContextHints(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ConfigContextPath = "impact"
+	calc := NewCalculator(opts)
+	fake := func() *netboxfake.FakeNetbox {
+		f := netboxfake.Sample()
+		f.ConfigContexts = map[int]map[string]interface{}{
+			1: {"impact": map[string]interface{}{"weight_multiplier": 2.5, "note": "carries OOB for region"}},
+			3: {"impact": "critical"},
+		}
+		return f
+	}
+	req := ImpactRequest{DeviceIDs: []int{1, 3, 4}, ImpactType: PlannedWork, BlastRadiusDepth: ptr(0), ExpandVMs: ptr(false), Explain: true}
+	hintWarnings := func(r ImpactResult) []DataWarning {
+		var ws []DataWarning
+		for _, w := range r.Warnings {
+			if w.Field == "config_context" {
+				ws = append(ws, w)
+			}
+		}
+		return ws
+	}
+
+	result, err := calc.Calculate(context.Background(), req, fake(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approxEqual(result.TotalImpact, 5*2.5+1+5) {
+		t.Errorf("total = %v, want %v", result.TotalImpact, 5*2.5+1+5)
+	}
+	if d := result.Breakdown.Devices.Items[0]; d.HintFactor != 2.5 || d.HintNote != "carries OOB for region" {
+		t.Errorf("device 1 = %+v", d)
+	}
+	if ws := hintWarnings(result); len(ws) != 1 || ws[0].ID != 3 {
+		t.Errorf("warnings = %+v, want one for the malformed hint of device 3", ws)
+	}
+	if !slices.Contains(result.Explanation, "device core-ams01 scored 12.5 (weight 5 × config context hint 2.5): carries OOB for region") {
+		t.Errorf("explanation lacks the hint:\n%s", strings.Join(result.Explanation, "\n"))
+	}
+
+	broken := fake()
+	broken.Errors = map[string]error{"FetchConfigContext": &netbox.StatusError{StatusCode: http.StatusBadGateway}}
+	result, err = calc.Calculate(context.Background(), req, broken, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approxEqual(result.TotalImpact, 5+1+5) || len(hintWarnings(result)) != 3 {
+		t.Errorf("failed lookups: total %v, warnings %+v", result.TotalImpact, hintWarnings(result))
+	}
+
+	calc.ConfigContextMaxDevices = 1
+	result, err = calc.Calculate(context.Background(), req, fake(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approxEqual(result.TotalImpact, 5*2.5+1+5) || len(hintWarnings(result)) != 1 {
+		t.Errorf("limited lookups: total %v, warnings %+v", result.TotalImpact, hintWarnings(result))
+	}
+}
+
+func TestHTTPEnricher(t *testing.T) {
+	var mu sync.Mutex
+	var response string
+	var delay time.Duration
+	var sent map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		err := json.NewDecoder(r.Body).Decode(&sent)
+		response, delay := response, delay
+		mu.Unlock()
+		if err != nil {
+			t.Errorf("enricher request: %v", err)
+		}
+		time.Sleep(delay)
+		if response == "" {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	defer srv.Close()
+	enricher, err := NewHTTPEnricher(json.RawMessage(fmt.Sprintf(`{"url": %q, "timeout": "50ms"}`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	req := ImpactRequest{DeviceIDs: []int{1}, CircuitIDs: []int{100}, ImpactType: PlannedWork, BlastRadiusDepth: ptr(0), ExpandVMs: ptr(false), Explain: true}
+	baseline, err := NewCalculator(opts).Calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Enrichers = []NamedEnricher{{Name: "capacity-db", Kind: "http", Enricher: enricher}}
+	calc := NewCalculator(opts)
+
+	tests := []struct {
+		name     string
+		response string
+		delay    time.Duration
+		warning  string
+	}{
+		{"applied", `{"objects": [{"object_type": "circuit", "id": 100, "weight_multiplier": 3, "note": "1200 customers"}, {"object_type": "device", "id": 1, "note": "billing core"}]}`, 0, ""},
+		{"unavailable", "", 0, "503 Service Unavailable"},
+		{"slow", `{"objects": []}`, 200 * time.Millisecond, "Client.Timeout"},
+		{"malformed", `{"objects": [`, 0, "invalid response"},
+		{"unknown field", `{"objects": [{"object_type": "circuit", "id": 100, "factor": 3}]}`, 0, `unknown field "factor"`},
+		{"object not sent", `{"objects": [{"object_type": "circuit", "id": 100, "weight_multiplier": 3}, {"object_type": "circuit", "id": 101, "weight_multiplier": 2}]}`, 0, "circuit 101 was not sent"},
+		{"negative multiplier", `{"objects": [{"object_type": "device", "id": 1, "weight_multiplier": -1}]}`, 0, "must be positive"},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		response, delay = tt.response, tt.delay
+		mu.Unlock()
+		result, err := calc.Calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		mu.Lock()
+		sent := sent
+		mu.Unlock()
+		if !reflect.DeepEqual(sent["circuit_ids"], []interface{}{100.0}) || !reflect.DeepEqual(sent["device_ids"], []interface{}{1.0}) {
+			t.Errorf("%s: sent %v", tt.name, sent)
+		}
+		var warnings []string
+		for _, w := range result.Warnings {
+			if w.Field == "enrichers" {
+				warnings = append(warnings, w.Message)
+			}
+		}
+		if tt.warning != "" {
+			if len(warnings) != 1 || !strings.Contains(warnings[0], tt.warning) || !strings.HasPrefix(warnings[0], "enricher capacity-db failed") {
+				t.Errorf("%s: warnings %q, want one with %q", tt.name, warnings, tt.warning)
+			}
+			if result.TotalImpact != baseline.TotalImpact || result.Breakdown.Circuits.Items[0].Enrichments != nil {
+				t.Errorf("%s: a failed enricher changed the result: %v, want %v", tt.name, result.TotalImpact, baseline.TotalImpact)
+			}
+			continue
+		}
+		if len(warnings) > 0 {
+			t.Errorf("%s: warnings %q", tt.name, warnings)
+		}
+		circuit := result.Breakdown.Circuits.Items[0]
+		if want := []Enrichment{{Source: "capacity-db", Factor: 3, Note: "1200 customers"}}; !reflect.DeepEqual(circuit.Enrichments, want) {
+			t.Errorf("circuit enrichments = %+v, want %+v", circuit.Enrichments, want)
+		}
+		if want := baseline.Breakdown.Circuits.Items[0].Impact * 3; !approxEqual(circuit.Impact, want) {
+			t.Errorf("circuit impact = %v, want %v", circuit.Impact, want)
+		}
+		device := result.Breakdown.Devices.Items[0]
+		if want := []Enrichment{{Source: "capacity-db", Factor: 1, Note: "billing core"}}; !reflect.DeepEqual(device.Enrichments, want) || device.Impact != baseline.Breakdown.Devices.Items[0].Impact {
+			t.Errorf("device = %+v", device)
+		}
+		explanation := strings.Join(result.Explanation, "\n")
+		for _, want := range []string{"× enricher capacity-db 3), parallel to AMS-RTM-2; capacity-db: 1200 customers", "(weight 5); capacity-db: billing core"} {
+			if !strings.Contains(explanation, want) {
+				t.Errorf("explanation lacks %q:\n%s", want, explanation)
+			}
+		}
+	}
+}
+
+func TestLoadEnrichersFile(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{`[{"name": "capacity-db", "kind": "http", "config": {"url": "https://capacity.example.com/enrich", "timeout": "2s", "headers": {"Authorization": "Bearer x"}}}]`, ""},
+		{`[{"name": "capacity-db", "kind": "ldap", "config": {}}]`, `unknown kind "ldap"`},
+		{`[{"name": "capacity-db", "kind": "http", "config": {"url": "capacity.example.com"}}]`, "is not an http(s) URL"},
+		{`[{"name": "capacity-db", "kind": "http", "config": {"url": "https://capacity.example.com", "timeout": "soon"}}]`, "not a positive duration"},
+		{`[{"name": "a", "kind": "http", "config": {"url": "https://a.example.com"}}, {"name": "a", "kind": "http", "config": {"url": "https://b.example.com"}}]`, `"a" defined twice`},
+		{`[{"kind": "http", "config": {"url": "https://a.example.com"}}]`, "has no name"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "enrichers.json")
+		if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		enrichers, err := LoadEnrichersFile(path)
+		if tt.want == "" {
+			if err != nil || len(enrichers) != 1 || enrichers[0].Name != "capacity-db" || enrichers[0].Enricher.(*HTTPEnricher).Client.Timeout != 2*time.Second {
+				t.Errorf("%s: %+v, %v", tt.file, enrichers, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestExclusionsAfterExpansion(t *testing.T) {
+	fake := netboxfake.Sample()
+	d := fake.Devices[3]
+	d.Tags = []netbox.Node{{Name: "Decommissioning", Slug: "decommissioning"}}
+	fake.Devices[3] = d
+	req := ImpactRequest{SiteIDs: []int{2}, ImpactType: PlannedWork, ExcludeDeviceIDs: []int{4}, ExcludeTags: []string{"decommissioning"}}
+	result, err := calculate(context.Background(), req, fake, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalImpact != 0 {
+		t.Errorf("total = %v, want 0 with both site devices excluded", result.TotalImpact)
+	}
+	want := []Exclusion{
+		{Type: "device", ID: 3, Name: "core-rtm01", Rule: "exclude_tags: decommissioning", Source: "site RTM01"},
+		{Type: "device", ID: 4, Name: "host-rtm01", Rule: "exclude_device_ids", Source: "site RTM01"},
+	}
+	if !reflect.DeepEqual(result.Exclusions, want) {
+		t.Errorf("exclusions = %+v, want %+v", result.Exclusions, want)
+	}
+
+	req = ImpactRequest{CircuitIDs: []int{100}, ImpactType: PlannedWork, ExcludeCircuitIDs: []int{101}}
+	if _, err := calculate(context.Background(), req, fake, DefaultWeightConfig()); err != nil {
+		t.Fatalf("excluding an unrelated circuit: %v", err)
+	}
+}
+
+func TestConsoleAndPowerCablesNotScored(t *testing.T) {
+	fake := netboxfake.Sample()
+	fake.Cables[52] = netbox.Cable{ID: 52, Label: "CON-52",
+		ATerminations: []netbox.CableTermination{{ObjectType: "dcim.consoleport", ObjectID: 70, Object: netbox.CableEndpoint{ID: 70, Device: &netbox.Node{ID: 1}}}},
+		BTerminations: []netbox.CableTermination{{ObjectType: "dcim.consoleserverport", ObjectID: 71, Object: netbox.CableEndpoint{ID: 71, Device: &netbox.Node{ID: 2}}}}}
+	fake.Cables[53] = netbox.Cable{ID: 53, Label: "PWR-53",
+		ATerminations: []netbox.CableTermination{{ObjectType: "dcim.powerport", ObjectID: 72, Object: netbox.CableEndpoint{ID: 72, Device: &netbox.Node{ID: 4}}}},
+		BTerminations: []netbox.CableTermination{{ObjectType: "dcim.powerfeed", ObjectID: 30}}}
+	req := ImpactRequest{CableIDs: []int{50, 52, 53}, ImpactType: PlannedWork}
+	result, err := calculate(context.Background(), req, fake, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alone, err := calculate(context.Background(), ImpactRequest{CableIDs: []int{50}, ImpactType: PlannedWork}, fake, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalImpact != alone.TotalImpact {
+		t.Errorf("total = %v, want %v from the data cable alone", result.TotalImpact, alone.TotalImpact)
+	}
+	if len(result.Breakdown.Cables) != 3 {
+		t.Fatalf("got %d cables, want 3", len(result.Breakdown.Cables))
+	}
+	for _, c := range result.Breakdown.Cables {
+		if (c.Kind == "data") != (c.NotScored == "") {
+			t.Errorf("cable %s: kind %q with not_scored %q", c.Label, c.Kind, c.NotScored)
+		}
+	}
+}
+
+func TestInclusionReasons(t *testing.T) {
+	req := ImpactRequest{DeviceIDs: []int{1, 4}, RackIDs: []int{10, 20}, SiteIDs: []int{2}, PowerFeedIDs: []int{30, 31},
+		CircuitIDs: []int{100, 101, 102}, InterfaceIDs: []int{200, 202}, CableIDs: []int{50, 51}, ImpactType: PlannedWork, Explain: true}
+	result, err := calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string][]string)
+	for _, d := range result.Breakdown.Devices.Items {
+		reasons[fmt.Sprintf("device:%d", d.ID)] = append([]string{d.Reason}, d.OtherReasons...)
+	}
+	for _, c := range result.Breakdown.Circuits.Items {
+		reasons[fmt.Sprintf("circuit:%d", c.ID)] = append([]string{c.Reason}, c.OtherReasons...)
+	}
+	for _, i := range result.Breakdown.Interfaces.Items {
+		reasons[fmt.Sprintf("interface:%d", i.ID)] = append([]string{i.Reason}, i.OtherReasons...)
+	}
+	want := map[string][]string{
+		"device:1":      {"explicit", "rack R10"},
+		"device:2":      {"rack R10"},
+		"device:3":      {"rack R20", "site RTM01", "power_feed RTM01-A", "power_feed RTM01-B", "blast_radius"},
+		"device:4":      {"explicit", "rack R20", "site RTM01", "power_feed RTM01-A", "power_feed RTM01-B"},
+		"circuit:100":   {"explicit"},
+		"circuit:101":   {"explicit", "cable X-51"},
+		"circuit:102":   {"explicit"},
+		"interface:200": {"explicit", "cable X-50", "cable X-51"},
+		"interface:202": {"explicit"},
+		"interface:203": {"cable X-50"},
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("reasons = %v, want %v", reasons, want)
+	}
+	b := result.Breakdown
+	if b.SiteExpandedDevices.Count != 0 || b.PowerFeeds[0].DeviceCount != 0 || b.BlastRadius.Count != 0 {
+		t.Errorf("devices counted twice: %d site, %d power feed, %d blast radius", b.SiteExpandedDevices.Count, b.PowerFeeds[0].DeviceCount, b.BlastRadius.Count)
+	}
+	if b.Racks[0].DeviceCount != 1 || b.Racks[1].DeviceCount != 1 {
+		t.Errorf("rack device counts = %d, %d, want 1 each", b.Racks[0].DeviceCount, b.Racks[1].DeviceCount)
+	}
+	line := "device core-rtm01 counted once, via rack R20 (also reached via site RTM01, power_feed RTM01-A, power_feed RTM01-B, blast_radius)"
+	if !slices.Contains(result.Explanation, line) {
+		t.Errorf("explanation lacks %q:\n%s", line, strings.Join(result.Explanation, "\n"))
+	}
+
+	paths := func(r ImpactResult) []string {
+		var all []string
+		for _, c := range contributors(r.Breakdown) {
+			all = append(all, fmt.Sprintf("%s:%d:%s", c.Type, c.ID, c.Reason))
+		}
+		slices.Sort(all)
+		return all
+	}
+	reordered := func(seed int64) bool {
+		rng := mrand.New(mrand.NewSource(seed))
+		shuffled := req
+		for _, ids := range []*[]int{&shuffled.DeviceIDs, &shuffled.RackIDs, &shuffled.PowerFeedIDs, &shuffled.CircuitIDs, &shuffled.InterfaceIDs, &shuffled.CableIDs} {
+			*ids = slices.Clone(*ids)
+			rng.Shuffle(len(*ids), func(i, j int) { (*ids)[i], (*ids)[j] = (*ids)[j], (*ids)[i] })
+		}
+		got, err := calculate(context.Background(), shuffled, netboxfake.Sample(), DefaultWeightConfig())
+		return err == nil && got.TotalImpact == result.TotalImpact && slices.Equal(paths(got), paths(result))
+	}
+	if err := quick.Check(reordered, &quick.Config{MaxCount: 50}); err != nil {
+		t.Errorf("reordering the request changed the result: %v", err)
+	}
+}
+
+func TestCalculateImpactCancelled(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(slowServer.Close)
+	slowFake := netboxfake.Sample()
+	slowFake.Latency = 5 * time.Second
+	for _, tt := range []struct {
+		name   string
+		client netbox.NetboxAPI
+	}{
+		{"fake", slowFake},
+		{"http", netbox.NewNetboxClient(slowServer.URL, "token")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			start := time.Now()
+			req := ImpactRequest{DeviceIDs: []int{1, 2}, CircuitIDs: []int{100}, ImpactType: PlannedWork}
+			_, err := calculate(ctx, req, tt.client, DefaultWeightConfig())
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v, want context.Canceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("returned after %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestCompareImpactPrefetches(t *testing.T) {
+	req := CompareRequest{
+		A: ImpactRequest{DeviceIDs: []int{1}, CircuitIDs: []int{100}, ImpactType: PlannedWork},
+		B: ImpactRequest{DeviceIDs: []int{1, 3}, CircuitIDs: []int{100, 101}, ImpactType: PlannedWork},
+	}
+	weights := DefaultWeightConfig()
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	client := srv.Client()
+	client.SetCacheTTL(0)
+	result, err := NewCalculator(DefaultOptions()).Compare(context.Background(), req, netboxfake.Instances(t, client), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/dcim/devices/1/", "/api/dcim/devices/3/"} {
+		if got := srv.Count(path); got != 1 {
+			t.Errorf("%s requested %d times, want 1", path, got)
+		}
+	}
+	if got := srv.Lookups(100); got != 1 {
+		t.Errorf("circuit 100 looked up %d times, want 1", got)
+	}
+
+	// The fake has no cache; the sides must still score as they do alone.
+	fake := netboxfake.Sample()
+	offline, err := NewCalculator(DefaultOptions()).Compare(context.Background(), req, netboxfake.Instances(t, fake), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, side := range []ImpactRequest{req.A, req.B} {
+		alone, err := calculate(context.Background(), side, fake, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []ImpactResult{offline.A, offline.B}[i]
+		if got.TotalImpact != alone.TotalImpact || got.TotalImpact != []ImpactResult{result.A, result.B}[i].TotalImpact {
+			t.Errorf("side %d total = %v, want %v", i, got.TotalImpact, alone.TotalImpact)
+		}
+	}
+
+	req.B.DeviceIDs = []int{1, 999}
+	_, err = NewCalculator(DefaultOptions()).Compare(context.Background(), req, netboxfake.Instances(t, fake), weights)
+	if err == nil || !strings.HasPrefix(err.Error(), "request b: ") || !strings.Contains(err.Error(), "device_ids 999") {
+		t.Errorf("err = %v, want request b's unknown device", err)
+	}
+}
+
+func TestMostSevereWarnings(t *testing.T) {
+	warnings := []DataWarning{
+		{Field: "label", Severity: SeverityLow, Message: "no label"},
+		{Field: "termination_a", Severity: SeverityMedium, Message: "no termination_a"},
+		{Field: "label", Severity: SeverityLow, Message: "no label either"},
+		{Field: "netbox_calls", Severity: SeverityHigh, Message: "budget exhausted"},
+		{Field: "termination_z", Severity: SeverityMedium, Message: "no termination_z"},
+		{Field: "no_recovery_path", Severity: SeverityCritical, Message: "NO RECOVERY PATH"},
+	}
+	var got []string
+	for _, w := range MostSevere(warnings, 3) {
+		got = append(got, w.Message)
+	}
+	if want := []string{"NO RECOVERY PATH", "budget exhausted", "no termination_a"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := MostSevere(warnings[:1], 3); len(got) != 1 {
+		t.Errorf("got %d warnings from 1, want 1", len(got))
+	}
+	if warnings[0].Message != "no label" {
+		t.Error("mostSevere reordered its argument")
+	}
+}
+
+func TestCalculateImpactReportsUnknownCircuits(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	req := ImpactRequest{CircuitIDs: []int{100, 998, 101, 999}, ImpactType: PlannedWork}
+	_, err := calculate(context.Background(), req, srv.Client(), DefaultWeightConfig())
+	var verr *netbox.ValidationError
+	if !errors.As(err, &verr) || verr.Field != "circuit_ids" || !strings.Contains(verr.Message, "998,999") {
+		t.Errorf("err = %v, want a circuit_ids error naming 998 and 999", err)
+	}
+	if got := srv.Count("/api/circuits/circuits/"); got != 1 {
+		t.Errorf("made %d circuit requests, want 1", got)
+	}
+}
+
+func TestObjectCacheServesRepeatedCalculations(t *testing.T) {
+	req := ImpactRequest{CircuitIDs: []int{100}, ImpactType: PlannedWork}
+	for _, tt := range []struct {
+		name   string
+		ttl    time.Duration
+		second int
+	}{
+		{"enabled", netbox.DefaultCacheTTL, 0},
+		{"disabled", 0, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := netboxfake.NewServer(t, netboxfake.Sample())
+			client := srv.Client()
+			client.SetCacheTTL(tt.ttl)
+			first, err := calculate(context.Background(), req, client, DefaultWeightConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := srv.Total()
+			second, err := calculate(context.Background(), req, client, DefaultWeightConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.Total() - before; got != tt.second {
+				t.Errorf("second calculation made %d requests, want %d", got, tt.second)
+			}
+			if got, want := srv.Lookups(100), 1+min(tt.second, 1); got != want {
+				t.Errorf("circuit 100 was fetched %d times, want %d", got, want)
+			}
+			if first.TotalImpact != second.TotalImpact {
+				t.Errorf("totals differ: %v and %v", first.TotalImpact, second.TotalImpact)
+			}
+		})
+	}
+}
+
+// chainNetbox cables devices 1..n into a chain, so every blast radius hop
+// costs a cable lookup.
+func chainNetbox(n int) *netboxfake.FakeNetbox {
+	f := &netboxfake.FakeNetbox{URL: "https://netbox.example.com", Devices: make(map[int]netbox.Device), Cables: make(map[int]netbox.Cable)}
+	site := &netbox.Node{ID: 1, Name: "AMS01"}
+	for id := 1; id <= n; id++ {
+		f.Devices[id] = netbox.Device{ID: id, Name: fmt.Sprintf("sw-%d", id), Site: site}
+		if id < n {
+			f.Cables[id] = netbox.Cable{ID: id,
+				ATerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", Object: netbox.CableEndpoint{Device: &netbox.Node{ID: id}}}},
+				BTerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", Object: netbox.CableEndpoint{Device: &netbox.Node{ID: id + 1}}}}}
+		}
+	}
+	return f
+}
+
+func TestCallBudgetStopsExpansion(t *testing.T) {
+	req := ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: ptr(99), ExpandVMs: ptr(false), ImpactType: PlannedWork}
+	srv := netboxfake.NewServer(t, chainNetbox(100))
+	exhausted := CallBudgetExhaustions.Load()
+	result, err := calculate(netbox.WithCallBudget(context.Background(), 10), req, srv.Client(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Partial || result.Breakdown.BlastRadius != nil {
+		t.Errorf("partial = %v, blast radius = %+v; want a partial result without the blast radius", result.Partial, result.Breakdown.BlastRadius)
+	}
+	if result.Metadata.NetboxCalls != 10 || srv.Total() != 10 {
+		t.Errorf("netbox_calls = %d with %d requests served, want 10", result.Metadata.NetboxCalls, srv.Total())
+	}
+	if n := len(result.Warnings); n == 0 || !strings.Contains(result.Warnings[n-1].Message, "netbox call budget exhausted after 10 calls; not fully expanded: blast radius") {
+		t.Errorf("warnings = %+v", result.Warnings)
+	}
+	if got := CallBudgetExhaustions.Load() - exhausted; got != 1 {
+		t.Errorf("budget exhaustions metric grew by %d, want 1", got)
+	}
+	if result.Breakdown.Devices.Count != 1 {
+		t.Errorf("explicit devices = %d, want 1", result.Breakdown.Devices.Count)
+	}
+
+	unlimited, err := calculate(netbox.WithCallBudget(context.Background(), 0), req, netboxfake.NewServer(t, chainNetbox(100)).Client(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlimited.Partial || unlimited.Breakdown.BlastRadius == nil || unlimited.Breakdown.BlastRadius.Count != 99 {
+		t.Errorf("unlimited budget: partial = %v, blast radius = %+v", unlimited.Partial, unlimited.Breakdown.BlastRadius)
+	}
+
+	req.Strict = ptr(true)
+	_, err = calculate(netbox.WithCallBudget(context.Background(), 10), req, netboxfake.NewServer(t, chainNetbox(100)).Client(), DefaultWeightConfig())
+	if !errors.Is(err, netbox.ErrCallBudgetExhausted) {
+		t.Errorf("strict mode: err = %v, want the budget error", err)
+	}
+}
+
+func TestObjectCacheConcurrentUse(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	client := srv.Client()
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := ImpactRequest{DeviceIDs: []int{1, 2}, CircuitIDs: []int{100, 101}, ImpactType: PlannedWork}
+			if _, err := calculate(context.Background(), req, client, DefaultWeightConfig()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if purged := client.PurgeCache(); purged == 0 {
+		t.Error("nothing was cached")
+	}
+}
+
+func TestOfflineMatchesOnline(t *testing.T) {
+	offline, err := netboxfake.LoadOfflineData("../examples/offline", "https://netbox.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	online := netboxfake.NewServer(t, offline).Client()
+	requests := []ImpactRequest{
+		{DeviceIDs: []int{1, 2}, ImpactType: PlannedWork},
+		{CircuitIDs: []int{100}, ImpactType: FiberWorks},
+		{CircuitIDs: []int{100, 101, 102}, InterfaceIDs: []int{500, 502}, ImpactType: IncidentWork},
+		{SiteIDs: []int{2}, CircuitIDs: []int{102}, IncludeTenants: true, IncludeAffectedTenants: true, ImpactType: ElectricalWork},
+	}
+	render := func(client netbox.NetboxAPI, req ImpactRequest) string {
+		result, err := calculate(context.Background(), req, client, DefaultWeightConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result.Metadata.TimingsMs = nil
+		result.Metadata.NetboxCalls = 0
+		data, _ := json.MarshalIndent(result, "", "  ")
+		return string(data)
+	}
+	for _, req := range requests {
+		if got, want := render(offline, req), render(online, req); got != want {
+			t.Errorf("offline result differs from online for %+v:\noffline: %s\nonline: %s", req, got, want)
+		}
+	}
+
+	_, offlineErr := calculate(context.Background(), ImpactRequest{CircuitIDs: []int{999}, ImpactType: PlannedWork}, offline, DefaultWeightConfig())
+	_, onlineErr := calculate(context.Background(), ImpactRequest{CircuitIDs: []int{999}, ImpactType: PlannedWork}, online, DefaultWeightConfig())
+	if offlineErr == nil || onlineErr == nil || offlineErr.Error() != onlineErr.Error() {
+		t.Errorf("unknown circuit: offline error %v, online error %v", offlineErr, onlineErr)
+	}
+}
+
+func TestNormalizedScoreProperties(t *testing.T) {
+	for _, k := range []float64{1, 25, 100, 1e4} {
+		w := DefaultWeightConfig()
+		w.NormalizationK = k
+		monotonic := func(a, b float64) bool {
+			a, b = math.Abs(a), math.Abs(b)
+			if a > b {
+				a, b = b, a
+			}
+			return w.NormalizedScore(a) <= w.NormalizedScore(b)
+		}
+		if err := quick.Check(monotonic, nil); err != nil {
+			t.Errorf("k=%v: more impact lowered the score: %v", k, err)
+		}
+		bounded := func(total float64) bool {
+			score := w.NormalizedScore(math.Abs(total))
+			return score >= 0 && score <= 100
+		}
+		if err := quick.Check(bounded, nil); err != nil {
+			t.Errorf("k=%v: score outside 0-100: %v", k, err)
+		}
+		if got := w.NormalizedScore(0); got != 0 {
+			t.Errorf("k=%v: score of 0 = %v, want 0", k, got)
+		}
+		if got := w.NormalizedScore(-5); got != 0 {
+			t.Errorf("k=%v: score of -5 = %v, want 0", k, got)
+		}
+		if got := w.NormalizedScore(k); got != 50 {
+			t.Errorf("k=%v: score of k = %v, want 50", k, got)
+		}
+		if got := w.NormalizedScore(1e6 * k); got <= 99.99 || got >= 100 {
+			t.Errorf("k=%v: score of 1e6*k = %v, want just below 100", k, got)
+		}
+		for _, huge := range []float64{math.MaxFloat64, math.Inf(1)} {
+			if got := w.NormalizedScore(huge); got != 100 {
+				t.Errorf("k=%v: score of %v = %v, want 100", k, huge, got)
+			}
+		}
+	}
+}
+
+func TestScoreSeverity(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  Severity
+	}{
+		{0, SeverityLow},
+		{24.99, SeverityLow},
+		{25, SeverityMedium},
+		{50, SeverityHigh},
+		{74.9, SeverityHigh},
+		{75, SeverityCritical},
+		{100, SeverityCritical},
+	}
+	for _, tt := range tests {
+		if got := ScoreSeverity(tt.score); got != tt.want {
+			t.Errorf("ScoreSeverity(%v) = %s, want %s", tt.score, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizedScoreInResult(t *testing.T) {
+	weights := DefaultWeightConfig()
+	weights.NormalizationK = 20
+	result, err := calculate(context.Background(), ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: ptr(0), ImpactType: PlannedWork}, netboxfake.Sample(), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NormalizedScore != 20 || result.Metadata.Weights.NormalizationK != 20 {
+		t.Errorf("normalized score %v with k %v, want 20 with k 20", result.NormalizedScore, result.Metadata.Weights.NormalizationK)
+	}
+}
+
+func TestStrictModeIgnoresSkipValidation(t *testing.T) {
+	req := ImpactRequest{DeviceIDs: []int{1, 99}, ImpactType: PlannedWork, SkipValidation: true, Strict: ptr(true)}
+	_, err := calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+	var unknown *UnknownObjectsError
+	if !errors.As(err, &unknown) || !slices.Equal(unknown.Missing["device_ids"], []int{99}) {
+		t.Fatalf("got %v, want device 99 reported as unknown", err)
+	}
+}
+
+func TestValidationSharesSanityLookups(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	req := ImpactRequest{DeviceIDs: []int{1, 2}, InterfaceIDs: []int{200}, BlastRadiusDepth: ptr(0), ImpactType: PlannedWork, Strict: ptr(true)}
+	if _, err := calculate(context.Background(), req, srv.Client(), DefaultWeightConfig()); err != nil {
+		t.Fatal(err)
+	}
+	// Validation looks names up with brief=1; scoring fetches full objects.
+	validated := make(map[int]int)
+	for _, q := range srv.Queries() {
+		if q.Get("brief") == "1" {
+			for _, id := range netbox.ParseIDs(q.Get("id__in")) {
+				validated[id]++
+			}
+		}
+	}
+	for _, id := range []int{1, 2, 200} {
+		if validated[id] != 1 {
+			t.Errorf("ID %d validated %d times, want once", id, validated[id])
+		}
+	}
+}
+
+func TestStrictPrecedence(t *testing.T) {
+	tests := []struct {
+		name          string
+		server        bool
+		request       bool
+		skip          bool
+		wantStrict    bool
+		wantValidated bool
+	}{
+		{"permissive", false, false, false, false, true},
+		{"permissive skip", false, false, true, false, false},
+		{"request tightens", false, true, true, true, true},
+		{"server strict", true, false, false, true, true},
+		{"request cannot loosen", true, false, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Strict = tt.server
+			req := ImpactRequest{DeviceIDs: []int{1, 99}, ImpactType: PlannedWork, Strict: ptr(tt.request), SkipValidation: tt.skip}
+			result, err := NewCalculator(opts).Calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+			var unknown *UnknownObjectsError
+			if validated := errors.As(err, &unknown); validated != tt.wantValidated {
+				t.Errorf("validated = %v (err %v), want %v", validated, err, tt.wantValidated)
+			}
+			if err == nil && result.Metadata.Strict != tt.wantStrict {
+				t.Errorf("strict = %v, want %v", result.Metadata.Strict, tt.wantStrict)
+			}
+			var gerr *GuardError
+			if tt.wantValidated && (!errors.As(err, &gerr) || gerr.Guard != "id_validation") {
+				t.Errorf("got %v, want the id_validation guard to fire", err)
+			}
+		})
+	}
+}
+
+func TestCompatSkipsDefaultGuards(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SanityMismatchFraction = 0.5
+	// Interface IDs in device_ids trip the sanity check unless -compat is set.
+	req := ImpactRequest{DeviceIDs: []int{200, 201}, ImpactType: PlannedWork}
+	for _, tt := range []struct {
+		compat, strict bool
+		guard          string
+	}{
+		{false, false, "sanity_checks"},
+		{true, false, ""},
+		{true, true, "sanity_checks"},
+	} {
+		opts.Compat = tt.compat
+		req.Strict = ptr(tt.strict)
+		_, err := NewCalculator(opts).Calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+		var gerr *GuardError
+		guard := ""
+		if errors.As(err, &gerr) {
+			guard = gerr.Guard
+		}
+		if guard != tt.guard {
+			t.Errorf("compat %v, strict %v: got %v, want guard %q", tt.compat, tt.strict, err, tt.guard)
+		}
+	}
+}
+
+func TestToMilliPoints(t *testing.T) {
+	for v, want := range map[float64]int64{
+		187.5:              187500,
+		2.4000000000000004: 2400,
+		0.0005:             1,
+		-0.0005:            -1,
+		0.0004999:          0,
+		1e9:                1e12,
+	} {
+		if got := ToMilliPoints(v); got != want {
+			t.Errorf("ToMilliPoints(%v) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestMilliPointsAddUp(t *testing.T) {
+	req := ImpactRequest{DeviceIDs: []int{1, 2, 3, 4}, CircuitIDs: []int{100, 101, 102, 103}, InterfaceIDs: []int{200, 201, 202, 203}, ImpactType: FiberWorks, DurationMinutes: ptr(37.0)}
+	result, err := calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := result.MilliPoints()
+	var sum int64
+	for _, v := range m.BreakdownMpts {
+		sum += v
+	}
+	if sum != m.TotalImpactBeforeMultiplierMpts {
+		t.Errorf("sections add up to %d, want %d", sum, m.TotalImpactBeforeMultiplierMpts)
+	}
+	if ToMilliPoints(result.TotalImpact) != m.TotalImpactMpts || ToMilliPoints(result.TotalImpactBeforeMultiplier) != m.TotalImpactBeforeMultiplierMpts {
+		t.Errorf("float totals %v/%v disagree with %d/%d mpts", result.TotalImpact, result.TotalImpactBeforeMultiplier, m.TotalImpactMpts, m.TotalImpactBeforeMultiplierMpts)
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weights.json")
+	data := `{
+  "impact_types": {"cable-move": 1.2},
+  "policies": {
+    "incident-work": {"allow_partial": true, "expand_vms": true, "blast_radius_depth": 2},
+    "planned-work": {"strict": true},
+    "cable-move": {"expand_vms": false, "strict": false}
+  }
+}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	weights, _, err := LoadWeightsFile(path, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		req         ImpactRequest
+		wantApplied []string
+		wantStrict  bool
+		wantPartial bool
+		wantVMs     *bool
+		wantDepth   *int
+	}{
+		{name: "incident defaults", req: ImpactRequest{ImpactType: IncidentWork},
+			wantApplied: []string{"blast_radius_depth", "expand_vms", "allow_partial"}, wantPartial: true, wantVMs: ptr(true), wantDepth: ptr(2)},
+		{name: "incident explicit values win", req: ImpactRequest{ImpactType: IncidentWork, AllowPartial: ptr(false), ExpandVMs: ptr(false), BlastRadiusDepth: ptr(0)},
+			wantVMs: ptr(false), wantDepth: ptr(0)},
+		{name: "incident strict request drops partial", req: ImpactRequest{ImpactType: IncidentWork, Strict: ptr(true)},
+			wantApplied: []string{"blast_radius_depth", "expand_vms"}, wantStrict: true, wantVMs: ptr(true), wantDepth: ptr(2)},
+		{name: "planned defaults to strict", req: ImpactRequest{ImpactType: PlannedWork},
+			wantApplied: []string{"strict"}, wantStrict: true},
+		{name: "planned explicit non-strict", req: ImpactRequest{ImpactType: PlannedWork, Strict: ptr(false)}},
+		{name: "planned partial request drops strict", req: ImpactRequest{ImpactType: PlannedWork, AllowPartial: ptr(true)},
+			wantPartial: true},
+		{name: "fiber works has no policy", req: ImpactRequest{ImpactType: FiberWorks}},
+		{name: "electrical work has no policy", req: ImpactRequest{ImpactType: ElectricalWork, ExpandVMs: ptr(true)},
+			wantVMs: ptr(true)},
+		{name: "custom type", req: ImpactRequest{ImpactType: "cable-move"},
+			wantApplied: []string{"expand_vms", "strict"}, wantVMs: ptr(false)},
+	}
+	calc := NewCalculator(DefaultOptions())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, applied := calc.ApplyPolicy(weights, tt.req)
+			if !slices.Equal(applied, tt.wantApplied) {
+				t.Errorf("applied = %q, want %q", applied, tt.wantApplied)
+			}
+			if calc.isStrict(got) != tt.wantStrict || isPartial(got) != tt.wantPartial {
+				t.Errorf("strict %v, partial %v; want %v, %v", calc.isStrict(got), isPartial(got), tt.wantStrict, tt.wantPartial)
+			}
+			if !reflect.DeepEqual(got.ExpandVMs, tt.wantVMs) || !reflect.DeepEqual(got.BlastRadiusDepth, tt.wantDepth) {
+				t.Errorf("expand_vms %v, blast_radius_depth %v", got.ExpandVMs, got.BlastRadiusDepth)
+			}
+		})
+	}
+
+	result, err := calculate(context.Background(), ImpactRequest{DeviceIDs: []int{1}, ImpactType: PlannedWork}, netboxfake.Sample(), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := result.Metadata; m.Policy != PlannedWork || !slices.Equal(m.PolicyDefaults, []string{"strict"}) || !m.Strict {
+		t.Errorf("metadata policy %q, defaults %q, strict %v", m.Policy, m.PolicyDefaults, m.Strict)
+	}
+
+	weights.Policies["unknown-work"] = RequestPolicy{}
+	if err := weights.Validate(); err == nil || !strings.Contains(err.Error(), "policies.unknown-work") {
+		t.Errorf("Validate() = %v, want an error about policies.unknown-work", err)
+	}
+}
+
+func TestRecoveryPathCheck(t *testing.T) {
+	f := netboxfake.Sample()
+	f.Devices[5] = netbox.Device{ID: 5, Name: "cs-ams01", Role: &netbox.Node{ID: 9, Name: "Console Server", Slug: "console-server"}, Status: &netbox.Choice{Value: "active"}}
+	f.ConsoleServerPorts = map[int]netbox.ConsoleServerPort{
+		1: {ID: 1, Name: "port1", Device: &netbox.Node{ID: 5}, ConnectedEndpoints: []netbox.CableEndpoint{{ID: 11, Device: &netbox.Node{ID: 1, Name: "core-ams01"}}}},
+		2: {ID: 2, Name: "port2", Device: &netbox.Node{ID: 5}, ConnectedEndpoints: []netbox.CableEndpoint{{ID: 13, Device: &netbox.Node{ID: 3, Name: "core-rtm01"}}}},
+	}
+	f.Errors = map[string]error{"FetchConsoleServerPorts": errors.New("not modelled")}
+	req := ImpactRequest{DeviceIDs: []int{1, 5}, ImpactType: PlannedWork, BlastRadiusDepth: ptr(0), Explain: true}
+	weights := DefaultWeightConfig()
+	before, err := calculate(context.Background(), req, f, weights)
+	if err != nil {
+		t.Fatalf("check without oob_roles: %v", err)
+	}
+
+	delete(f.Errors, "FetchConsoleServerPorts")
+	weights.OOBRoles = []string{"console-server"}
+	after, err := calculate(context.Background(), req, f, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make(map[int]DeviceImpactDetail)
+	for _, d := range after.Breakdown.Devices.Items {
+		items[d.ID] = d
+	}
+	core, cs := items[1], items[5]
+	if core.NoRecoveryPathFactor != 2 || !slices.Equal(core.OOBVia, []string{"cs-ams01"}) || !approxEqual(core.Impact, 2*before.Breakdown.Devices.Items[0].Impact) {
+		t.Errorf("core-ams01 = %+v", core)
+	}
+	if cs.NoRecoveryPathFactor != 0 || len(cs.OOBVia) > 0 {
+		t.Errorf("cs-ams01 = %+v, want no recovery path factor", cs)
+	}
+	if !approxEqual(after.Breakdown.Devices.Impact, core.Impact+cs.Impact) {
+		t.Errorf("devices impact %v, want %v", after.Breakdown.Devices.Impact, core.Impact+cs.Impact)
+	}
+	want := "NO RECOVERY PATH: 1 devices lose their production path and their out-of-band access in this request: core-ams01 (console via cs-ams01)"
+	if len(after.Warnings) == 0 || after.Warnings[0].Field != "no_recovery_path" || after.Warnings[0].Message != want {
+		t.Errorf("warnings = %+v", after.Warnings)
+	}
+	if !strings.Contains(strings.Join(after.Explanation, "\n"), "no recovery path, its console server cs-ams01 is affected too") {
+		t.Errorf("explanation lacks the recovery path:\n%s", strings.Join(after.Explanation, "\n"))
+	}
+}
+
+func TestCompositeReasons(t *testing.T) {
+	calc := NewCalculator(DefaultOptions())
+	for _, c := range []Composite{
+		{Name: "core-pair", DeviceIDs: []int{1, 2}, CircuitIDs: []int{100}},
+		{Name: "ams", DeviceIDs: []int{1}},
+	} {
+		if err := calc.Composites.Put(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := ImpactRequest{DeviceIDs: []int{2}, Composites: []string{"core-pair", "ams"}, ImpactType: PlannedWork, BlastRadiusDepth: ptr(0)}
+	result, err := calc.Calculate(context.Background(), req, netboxfake.Sample(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, d := range result.Breakdown.Devices.Items {
+		got[fmt.Sprintf("device %d", d.ID)] = append([]string{d.Reason}, d.OtherReasons...)
+	}
+	for _, c := range result.Breakdown.Circuits.Items {
+		got[fmt.Sprintf("circuit %d", c.ID)] = append([]string{c.Reason}, c.OtherReasons...)
+	}
+	want := map[string][]string{
+		"device 1":    {"composite ams", "composite core-pair"},
+		"device 2":    {"explicit", "composite core-pair"},
+		"circuit 100": {"composite core-pair"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reasons = %v, want %v", got, want)
+	}
+}
+
+func TestTenantTiersFetchScoredTenants(t *testing.T) {
+	fake := netboxfake.Sample()
+	for id := 3; id <= 120; id++ {
+		fake.Tenants[id] = netbox.Tenant{ID: id, Name: fmt.Sprintf("tenant-%d", id), CustomFields: map[string]interface{}{"sla": "gold"}}
+	}
+	fake.Tenants[1] = netbox.Tenant{ID: 1, Name: "Acme", Slug: "acme", CustomFields: map[string]interface{}{"sla": "gold"}}
+	srv := netboxfake.NewServer(t, fake)
+	weights := DefaultWeightConfig()
+	weights.TierField = "sla"
+	client := srv.Client()
+	client.AllowFeatures(weights.NetboxFeatures())
+	req := ImpactRequest{DeviceIDs: []int{4}, CircuitIDs: []int{103}, BlastRadiusDepth: ptr(0), ExpandVMs: ptr(false), ImpactType: PlannedWork}
+	result, err := calculate(context.Background(), req, client, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := result.Breakdown.Devices.Items[0]; d.Tier != "platinum" || d.Impact != 10 {
+		t.Errorf("device tier = %q with impact %v, want platinum with 10", d.Tier, d.Impact)
+	}
+	if c := result.Breakdown.Circuits.Items[0]; c.Tier != "gold" || c.TierFactor != 1.5 {
+		t.Errorf("circuit tier = %q ×%v, want gold ×1.5", c.Tier, c.TierFactor)
+	}
+	// One id__in listing for the circuit's tenant and one for the device's,
+	// not the 3 pages of all 120 tenants.
+	if got := srv.Count("/api/tenancy/tenants/"); got != 2 {
+		t.Errorf("made %d tenant requests, want 2", got)
+	}
+	if _, err := calculate(context.Background(), req, client, weights); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Count("/api/tenancy/tenants/"); got != 2 {
+		t.Errorf("made %d tenant requests after a cached run, want 2", got)
+	}
+}
+
+func TestImplicitDeviceTenantFromTerminationSite(t *testing.T) {
+	fake := netboxfake.Sample()
+	fake.Circuits[105] = netbox.Circuit{ID: 105, CID: "RTM-TRANSIT", Status: &netbox.Choice{Value: "active", Label: "Active"},
+		TerminationA: &netbox.CircuitTermination{ID: 1050, TermSide: "A", TerminationType: "dcim.site", Termination: &netbox.Node{ID: 2, Name: "RTM01"}},
+		TerminationZ: &netbox.CircuitTermination{ID: 1051, TermSide: "Z", TerminationType: "circuits.providernetwork", Termination: &netbox.Node{ID: 5, Name: "Transit-Net"}}}
+	req := ImpactRequest{CircuitIDs: []int{105}, ImpactType: PlannedWork, IncludeTenants: true}
+	result, err := calculate(context.Background(), req, fake, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := make(map[string]int)
+	for _, tenant := range result.Breakdown.Tenants {
+		objects[tenant.Name] = tenant.Objects
+	}
+	// The circuit and the provider network end are untenanted, the RTM01 end
+	// belongs to the site's tenant.
+	if want := map[string]int{"Globex": 1, untenanted: 2}; !reflect.DeepEqual(objects, want) {
+		t.Errorf("tenant objects = %v, want %v", objects, want)
+	}
+}
+
+func TestTenantViewsAgree(t *testing.T) {
+	weights := DefaultWeightConfig()
+	weights.TimeBands = []TimeBand{{Name: "always", Start: "00:00", End: "24:00", Multiplier: 1.5}}
+	start := time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+	req := ImpactRequest{DeviceIDs: []int{1, 2, 4}, CircuitIDs: []int{101, 103}, ImpactType: ElectricalWork, StartTime: &start,
+		BlastRadiusDepth: ptr(0), IncludeTenants: true, IncludeAffectedTenants: true}
+	result, err := calculate(context.Background(), req, netboxfake.Sample(), weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factor := result.Multiplier * result.TimeMultiplier
+	if factor == result.Multiplier {
+		t.Fatal("time band did not apply")
+	}
+	if len(result.Breakdown.Tenants) != len(result.AffectedTenants) {
+		t.Fatalf("breakdown.tenants %+v, affected_tenants %+v", result.Breakdown.Tenants, result.AffectedTenants)
+	}
+	var sum float64
+	for i, tenant := range result.Breakdown.Tenants {
+		affected := result.AffectedTenants[i]
+		objects := 0
+		for _, n := range affected.Objects {
+			objects += n
+		}
+		if tenant.Name != affected.Name || tenant.Objects != objects || !approxEqual(tenant.Impact, affected.Impact) {
+			t.Errorf("tenant %d: breakdown %+v, affected %+v", i, tenant, affected)
+		}
+		if !approxEqual(tenant.Impact, tenant.Share*result.TotalImpactBeforeMultiplier*factor) {
+			t.Errorf("%s: impact %v is not share %v of the total after the multiplier chain", tenant.Name, tenant.Impact, tenant.Share)
+		}
+		sum += tenant.Impact
+	}
+	if !slices.ContainsFunc(result.AffectedTenants, func(s TenantSummary) bool { return s.Name == untenanted }) {
+		t.Errorf("affected_tenants %+v lack %q", result.AffectedTenants, untenanted)
+	}
+	if sum > result.TotalImpact+1e-9 {
+		t.Errorf("tenant impacts add up to %v, more than the total %v", sum, result.TotalImpact)
+	}
+}
+
+func TestLoopedCircuitOnExplicitDevice(t *testing.T) {
+	f := netboxfake.Sample()
+	req := ImpactRequest{DeviceIDs: []int{1, 1}, CircuitIDs: []int{102}, ImpactType: PlannedWork, BlastRadiusDepth: ptr(0)}
+	before, err := calculate(context.Background(), req, f, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Breakdown.ImplicitDevices.Count != 1 {
+		t.Fatalf("without link peers: %d implicit devices, want 1", before.Breakdown.ImplicitDevices.Count)
+	}
+
+	// Both ends of AMS-LOCAL are cabled to core-ams01.
+	peer := []netbox.CableEndpoint{{ID: 11, Device: &netbox.Node{ID: 1, Name: "core-ams01"}}}
+	f.CircuitTerminations = map[int]netbox.CircuitTermination{
+		1004: {ID: 1004, Circuit: &netbox.Node{ID: 102}, LinkPeers: peer},
+		1005: {ID: 1005, Circuit: &netbox.Node{ID: 102}, LinkPeers: peer},
+	}
+	server := netboxfake.NewServer(t, f)
+	result, err := calculate(context.Background(), req, server.Client(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := result.Breakdown
+	if b.ImplicitDevices.Count != 0 || b.Devices.Count != 1 || b.Devices.Items[0].Reason != "explicit" {
+		t.Errorf("%d implicit devices, %d devices %+v; want device 1 once, explicit", b.ImplicitDevices.Count, b.Devices.Count, b.Devices.Items)
+	}
+	if want := b.Devices.Impact + b.Circuits.TotalImpact; !approxEqual(result.TotalImpactBeforeMultiplier, want) {
+		t.Errorf("total before multiplier = %v, want the de-duplicated sum %v", result.TotalImpactBeforeMultiplier, want)
+	}
+	if n := server.Count("/api/circuits/circuit-terminations/"); n != 1 {
+		t.Errorf("%d circuit termination listings, want 1", n)
+	}
+}
+
+func TestLoadWeightsFileKnownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	data := `{"device": 7, "calendar": [{"name": "Christmas", "start": "2026-12-24", "end": "2026-12-27", "multiplier": 3}], "tenant_tiers": {"acme": "gold"}, "devcie": 9}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, warnings, err := LoadWeightsFile(path, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{path + `: unknown key "devcie" ignored (did you mean "device"?)`}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+	if w.Device != 7 || len(w.Calendar) != 1 || w.Name != "maintenance" {
+		t.Errorf("loaded device %v, %d calendar entries, name %q", w.Device, len(w.Calendar), w.Name)
+	}
+}
+
+func TestMaintenanceWindowAcrossDST(t *testing.T) {
+	weights := DefaultWeightConfig()
+	weights.Timezone = "Europe/Amsterdam"
+	weights.TimeBands = []TimeBand{
+		{Name: "night", Start: "01:00", End: "03:00", Multiplier: 0.5},
+		{Name: "early", Start: "03:00", End: "06:00", Multiplier: 1.2},
+	}
+	weights.Calendar = []CalendarEntry{{Name: "easter-freeze", Start: "2026-03-29", Multiplier: 2}}
+	tests := []struct {
+		name       string
+		start      string
+		minutes    float64
+		timezone   string
+		localStart string
+		localEnd   string
+		periods    []string
+		band       string
+		calendar   []string
+	}{
+		// 02:00-03:00 does not exist on 29 March: 30 minutes from 01:30
+		// end at 03:00 summer time, still inside the night band.
+		{"spring skip", "2026-03-29T01:30:00+01:00", 30, "", "2026-03-29T01:30:00+01:00", "2026-03-29T03:00:00+02:00", []string{"night"}, "night", []string{"easter-freeze"}},
+		{"spring across", "2026-03-29T00:30:00Z", 60, "", "2026-03-29T01:30:00+01:00", "2026-03-29T03:30:00+02:00", []string{"night", "early"}, "early", []string{"easter-freeze"}},
+		// 02:00-03:00 happens twice on 25 October: an hour from the first
+		// 02:30 ends at the second.
+		{"autumn repeat", "2026-10-25T00:30:00Z", 60, "", "2026-10-25T02:30:00+02:00", "2026-10-25T02:30:00+01:00", []string{"night"}, "night", nil},
+		// The same window read in UTC ends before the night band starts.
+		{"request timezone", "2026-03-28T23:30:00Z", 60, "UTC", "2026-03-28T23:30:00Z", "2026-03-29T00:30:00Z", []string{"none"}, "", []string{"easter-freeze"}},
+		{"request timezone before freeze", "2026-03-28T22:30:00Z", 60, "UTC", "2026-03-28T22:30:00Z", "2026-03-28T23:30:00Z", []string{"none"}, "", nil},
+		{"weight set timezone", "2026-03-28T23:30:00Z", 60, "", "2026-03-29T00:30:00+01:00", "2026-03-29T01:30:00+01:00", []string{"none", "night"}, "", []string{"easter-freeze"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, err := time.Parse(time.RFC3339, tt.start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := ImpactRequest{DeviceIDs: []int{1}, BlastRadiusDepth: ptr(0), ImpactType: PlannedWork, StartTime: &start, DurationMinutes: ptr(tt.minutes), Timezone: tt.timezone}
+			result, err := calculate(context.Background(), req, netboxfake.Sample(), weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := result.Window
+			if w == nil {
+				t.Fatal("no window in the result")
+			}
+			if !w.StartUTC.Equal(start) || w.EndUTC == nil || w.EndUTC.Sub(w.StartUTC) != time.Duration(tt.minutes)*time.Minute || w.StartUTC.Location() != time.UTC {
+				t.Errorf("UTC window %v to %v, want %v for %v minutes", w.StartUTC, w.EndUTC, start.UTC(), tt.minutes)
+			}
+			if w.LocalStart != tt.localStart || w.LocalEnd != tt.localEnd {
+				t.Errorf("local window %s to %s, want %s to %s", w.LocalStart, w.LocalEnd, tt.localStart, tt.localEnd)
+			}
+			if !slices.Equal(w.Periods, tt.periods) || result.TimeBand != tt.band {
+				t.Errorf("periods %q, band %q; want %q, %q", w.Periods, result.TimeBand, tt.periods, tt.band)
+			}
+			if !slices.Equal(w.Calendar, tt.calendar) {
+				t.Errorf("calendar %q, want %q", w.Calendar, tt.calendar)
+			}
+			if result.DurationMinutes != tt.minutes {
+				t.Errorf("duration %v minutes, want %v", result.DurationMinutes, tt.minutes)
+			}
+		})
+	}
+
+	req := ImpactRequest{DeviceIDs: []int{1}, ImpactType: PlannedWork, Timezone: "Mars/Olympus_Mons"}
+	var verr *netbox.ValidationError
+	if _, err := calculate(context.Background(), req, netboxfake.Sample(), weights); !errors.As(err, &verr) || verr.Field != "timezone" {
+		t.Errorf("unknown timezone: got %v, want a timezone validation error", err)
+	}
+}
+
+// Clients switch on these values: a failure here means a breaking API
+// change, not a test to update.
+func TestSeverityValuesAreStable(t *testing.T) {
+	var got []string
+	for _, s := range Severities {
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	if want := []string{`"critical"`, `"high"`, `"medium"`, `"low"`}; !slices.Equal(got, want) {
+		t.Errorf("severities = %v, want %v", got, want)
+	}
+	var w DataWarning
+	if err := json.Unmarshal([]byte(`{"severity": "high"}`), &w); err != nil || w.Severity != SeverityHigh {
+		t.Errorf("severity = %q, err = %v", w.Severity, err)
+	}
+	for _, bad := range []string{`"urgent"`, `"High"`, `""`, `3`} {
+		var s Severity
+		if err := json.Unmarshal([]byte(bad), &s); err == nil {
+			t.Errorf("severity %s accepted", bad)
+		}
+	}
+}
+
+func TestLabelsCoverEveryLanguage(t *testing.T) {
+	if !slices.Contains(Langs(), DefaultLang) {
+		t.Fatalf("no labels for the default language %q", DefaultLang)
+	}
+	for _, lang := range Langs() {
+		for _, s := range Severities {
+			if labels[lang].severities[s] == "" {
+				t.Errorf("%s: severity %q has no label", lang, s)
+			}
+		}
+		for typ := range DefaultWeightConfig().ImpactTypes {
+			if labels[lang].impactTypes[typ] == "" {
+				t.Errorf("%s: impact type %q has no label", lang, typ)
+			}
+		}
+	}
+	if err := CheckLang("xx"); err == nil {
+		t.Error("unknown language accepted")
+	}
+	if got := ImpactTypeLabel("custom-work", "nl"); got != "custom-work" {
+		t.Errorf("label of a weights file impact type = %q", got)
+	}
+}
+
+func TestResultLabelsFollowLang(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Lang = "nl"
+	f := netboxfake.Sample()
+	f.Circuits[104] = netbox.Circuit{ID: 104, CID: "HALF"}
+	req := ImpactRequest{CircuitIDs: []int{104}, ImpactType: IncidentWork}
+	result, err := NewCalculator(opts).Calculate(context.Background(), req, f, DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImpactType != IncidentWork || result.ImpactTypeLabel != "Storing" {
+		t.Errorf("impact type = %q (%q)", result.ImpactType, result.ImpactTypeLabel)
+	}
+	if len(result.Warnings) == 0 {
+		t.Fatal("no warnings")
+	}
+	for _, w := range result.Warnings {
+		if w.SeverityLabel != labels["nl"].severities[w.Severity] {
+			t.Errorf("warning %q: severity label %q", w.Message, w.SeverityLabel)
+		}
+	}
+}
+
+func TestNormalizeMatchesCalculate(t *testing.T) {
+	req := ImpactRequest{
+		DeviceIDs:        []int{1, 1},
+		CableIDs:         []int{51},
+		RackIDs:          []int{20},
+		SiteIDs:          []int{1},
+		ExcludeDeviceIDs: []int{4},
+		ImpactType:       PlannedWork,
+	}
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	req.ObjectURLs = []string{srv.URL + "/dcim/devices/2/"}
+	calc := NewCalculator(DefaultOptions())
+	calculations := CalculationsTotal.Load()
+	n, err := calc.Normalize(context.Background(), req, srv.Client(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := CalculationsTotal.Load() - calculations; got != 0 {
+		t.Errorf("Normalize counted %d calculations", got)
+	}
+	if len(n.Errors) != 0 {
+		t.Fatalf("errors = %+v", n.Errors)
+	}
+	if !slices.Equal(n.Request.DeviceIDs, []int{1, 2}) || !slices.Equal(n.Request.CircuitIDs, []int{101}) || len(n.Request.ObjectURLs) != 0 {
+		t.Errorf("request = %+v", n.Request)
+	}
+	want := map[string]SectionEstimate{
+		"devices":               {Count: 2},
+		"rack_devices":          {Count: 1, Preview: []int{3}},
+		"site_expanded_devices": {Count: 0},
+		"circuits":              {Count: 1},
+		"interfaces":            {Count: 1},
+		"cables":                {Count: 1},
+		"power_feeds":           {Count: 0},
+	}
+	if !reflect.DeepEqual(n.Sections, want) {
+		t.Errorf("sections = %+v, want %+v", n.Sections, want)
+	}
+
+	result, err := calc.Calculate(context.Background(), req, srv.Client(), DefaultWeightConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Sections["devices"].Count + n.Sections["rack_devices"].Count; got != result.Breakdown.Devices.Count {
+		t.Errorf("estimated %d devices, calculation scored %d", got, result.Breakdown.Devices.Count)
+	}
+	if n.Sections["site_expanded_devices"].Count != result.Breakdown.SiteExpandedDevices.Count || n.Sections["circuits"].Count != len(result.Breakdown.Circuits.Items) ||
+		n.Sections["interfaces"].Count != result.Breakdown.Interfaces.Count {
+		t.Errorf("sections = %+v, breakdown = %+v", n.Sections, result.Breakdown)
+	}
+}
+
+func TestNormalizeReportsErrors(t *testing.T) {
+	calc := NewCalculator(DefaultOptions())
+	for i, tt := range []struct {
+		req   ImpactRequest
+		field string
+		msg   string
+	}{
+		{ImpactRequest{DeviceIDs: []int{99}, ImpactType: PlannedWork}, "", "device_ids 99"},
+		{ImpactRequest{DeviceIDs: []int{1}, Timezone: "Mars/Olympus", ImpactType: PlannedWork}, "timezone", `unknown timezone "Mars/Olympus"`},
+		{ImpactRequest{DeviceIDs: []int{1}, RackIDs: []int{99}, ImpactType: PlannedWork}, "rack_ids", "racks not found in NetBox: 99"},
+		{ImpactRequest{ImpactType: "moon-work"}, "impact_type", "moon-work"},
+	} {
+		n, err := calc.Normalize(context.Background(), tt.req, netboxfake.Sample(), DefaultWeightConfig())
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if len(n.Errors) != 1 || n.Errors[0].Field != tt.field || !strings.Contains(n.Errors[0].Message, tt.msg) {
+			t.Errorf("%d: errors = %+v, want %s %q", i, n.Errors, tt.field, tt.msg)
+		}
+	}
+	fake := netboxfake.Sample()
+	fake.Errors = map[string]error{"FetchNamesByIDs": errors.New("netbox unavailable")}
+	if _, err := calc.Normalize(context.Background(), ImpactRequest{DeviceIDs: []int{1}, ImpactType: PlannedWork}, fake, DefaultWeightConfig()); err == nil {
+		t.Error("NetBox failure reported as a request error")
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	tests := []struct {
+		spec   string
+		active []string
+		err    string
+	}{
+		{"", nil, ""},
+		{"strict_multiplier_validation", []string{StrictMultiplierValidation}, ""},
+		{" strict_multiplier_validation=true ,", []string{StrictMultiplierValidation}, ""},
+		{"strict_multiplier_validation=false", nil, ""},
+		{"strict_multiplier_validation=maybe", nil, "not true or false"},
+		{"v1_response_shape", nil, "unknown feature"},
+	}
+	for _, tt := range tests {
+		flags, err := ParseFeatureFlags(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseFeatureFlags(%q) error = %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(flags.Active(), tt.active) {
+			t.Errorf("ParseFeatureFlags(%q) = %v, %v; want %v active", tt.spec, flags.Active(), err, tt.active)
+		}
+	}
+
+	w := DefaultWeightConfig()
+	if got := (FeatureFlags{}).Deprecations(w); len(got) != 0 {
+		t.Errorf("deprecations with the defaults = %q", got)
+	}
+	w.ImpactTypes = map[ImpactType]float64{PlannedWork: 1, "drill": 0}
+	for _, tt := range []struct {
+		flags FeatureFlags
+		want  string
+	}{
+		{FeatureFlags{}, "multiplier 0 (drill)"},
+		{FeatureFlags{StrictMultiplierValidation: false}, "strict_multiplier_validation=false is deprecated"},
+		{FeatureFlags{StrictMultiplierValidation: true}, ""},
+	} {
+		got := tt.flags.Deprecations(w)
+		if tt.want == "" && len(got) != 0 || tt.want != "" && (len(got) != 1 || !strings.Contains(got[0], tt.want)) {
+			t.Errorf("Deprecations with %v = %q, want %q", tt.flags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package impact
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// DefaultLang is the language of labels unless -lang picks another.
+const DefaultLang = "en"
+
+type labelSet struct {
+	severities  map[Severity]string
+	impactTypes map[ImpactType]string
+}
+
+// labels holds the display names per language. Every language labels every
+// Severity and built-in ImpactType.
+var labels = map[string]labelSet{
+	"en": {
+		severities: map[Severity]string{
+			SeverityCritical: "Critical",
+			SeverityHigh:     "High",
+			SeverityMedium:   "Medium",
+			SeverityLow:      "Low",
+		},
+		impactTypes: map[ImpactType]string{
+			PlannedWork:    "Planned work",
+			FiberWorks:     "Fiber works",
+			ElectricalWork: "Electrical work",
+			IncidentWork:   "Incident",
+		},
+	},
+	"nl": {
+		severities: map[Severity]string{
+			SeverityCritical: "Kritiek",
+			SeverityHigh:     "Hoog",
+			SeverityMedium:   "Middel",
+			SeverityLow:      "Laag",
+		},
+		impactTypes: map[ImpactType]string{
+			PlannedWork:    "Gepland werk",
+			FiberWorks:     "Glasvezelwerkzaamheden",
+			ElectricalWork: "Elektrisch werk",
+			IncidentWork:   "Storing",
+		},
+	},
+}
+
+// Langs returns the languages labels are available in.
+func Langs() []string {
+	return slices.Sorted(maps.Keys(labels))
+}
+
+// CheckLang rejects a language without labels.
+func CheckLang(lang string) error {
+	if _, ok := labels[lang]; !ok {
+		return fmt.Errorf("unknown language %q (expected one of %v)", lang, Langs())
+	}
+	return nil
+}
+
+// SeverityLabel returns the display name of s in lang, falling back to
+// DefaultLang and then to s itself.
+func SeverityLabel(s Severity, lang string) string {
+	if label, ok := labels[lang].severities[s]; ok {
+		return label
+	}
+	if label, ok := labels[DefaultLang].severities[s]; ok {
+		return label
+	}
+	return string(s)
+}
+
+// ImpactTypeLabel returns the display name of t in lang. Impact types only
+// a weights file defines have no translations and show as themselves.
+func ImpactTypeLabel(t ImpactType, lang string) string {
+	if label, ok := labels[lang].impactTypes[t]; ok {
+		return label
+	}
+	if label, ok := labels[DefaultLang].impactTypes[t]; ok {
+		return label
+	}
+	return string(t)
+}
+
+// labelWarnings sets the SeverityLabel of every warning.
+func labelWarnings(warnings []DataWarning, lang string) {
+	for i := range warnings {
+		warnings[i].SeverityLabel = SeverityLabel(warnings[i].Severity, lang)
+	}
+}
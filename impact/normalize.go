@@ -0,0 +1,154 @@
+package impact
+
+import (
+	"context"
+	"errors"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// NormalizePreviewLimit is how many of the devices a site or rack selector
+// expands to Normalize lists.
+const NormalizePreviewLimit = 50
+
+// Normalization is a request as Calculate would score it, without the
+// scoring.
+type Normalization struct {
+	// Request has object URLs, composites and cables resolved to IDs,
+	// exclusions and duplicates dropped and the policy defaults applied.
+	Request  ImpactRequest `json:"request"`
+	Warnings []DataWarning `json:"warnings"`
+	// Errors holds what Calculate would reject the request for; Request is
+	// only normalized up to the first of them.
+	Errors []NormalizationError `json:"errors"`
+	// Sections estimates the objects each part of the breakdown holds,
+	// keyed "devices", "rack_devices", "site_expanded_devices", "circuits",
+	// "interfaces", "cables" and "power_feeds". The blast radius, VMs and
+	// implicit devices are found while scoring and are not estimated.
+	Sections map[string]SectionEstimate `json:"sections"`
+}
+
+type NormalizationError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type SectionEstimate struct {
+	Count int `json:"count"`
+	// Estimated is set when the call budget ran out before the selector
+	// was expanded, so Count is a lower bound.
+	Estimated bool `json:"estimated,omitempty"`
+	// Preview lists the first NormalizePreviewLimit devices a selector
+	// expands to.
+	Preview []int `json:"preview,omitempty"`
+}
+
+// requestError turns an error Calculate rejects a request with into a
+// NormalizationError; other errors, such as NetBox failing, are not the
+// request's fault.
+func requestError(err error) (NormalizationError, bool) {
+	var verr *netbox.ValidationError
+	var gerr *GuardError
+	var rerr *RangeError
+	var uerr *UnknownObjectsError
+	switch {
+	case errors.As(err, &verr):
+		return NormalizationError{Field: verr.Field, Message: verr.Message}, true
+	case errors.As(err, &rerr):
+		return NormalizationError{Field: rerr.Field, Message: err.Error()}, true
+	case errors.As(err, &gerr), errors.As(err, &uerr):
+		return NormalizationError{Message: err.Error()}, true
+	}
+	return NormalizationError{}, false
+}
+
+// Normalize runs the steps of Calculate that resolve and validate req and
+// expands its site and rack selectors, but scores nothing. It shares the
+// call budget and object cache of a calculation.
+func (c *Calculator) Normalize(ctx context.Context, req ImpactRequest, client netbox.NetboxAPI, weights WeightConfig) (Normalization, error) {
+	ctx, budget := netbox.NewCallBudget(ctx, c.CallBudget)
+	expandCtx := netbox.Expanding(ctx)
+	n := Normalization{Request: req, Warnings: []DataWarning{}, Errors: []NormalizationError{}, Sections: make(map[string]SectionEstimate)}
+	p, err := c.prepare(ctx, req, client, weights, newPhaseTimer(c.Debug))
+	if err != nil {
+		nerr, ok := requestError(err)
+		if !ok {
+			return Normalization{}, err
+		}
+		n.Errors = append(n.Errors, nerr)
+		return n, nil
+	}
+	req = p.req
+	n.Request = req
+	n.Warnings = append(n.Warnings, p.warnings...)
+	n.Sections["devices"] = SectionEstimate{Count: len(req.DeviceIDs)}
+	n.Sections["circuits"] = SectionEstimate{Count: len(req.CircuitIDs)}
+	n.Sections["interfaces"] = SectionEstimate{Count: len(req.InterfaceIDs)}
+	n.Sections["cables"] = SectionEstimate{Count: len(p.cables)}
+	n.Sections["power_feeds"] = SectionEstimate{Count: len(req.PowerFeedIDs)}
+
+	// preview counts the devices a selector expands to that the request
+	// does not exclude, each once: like the breakdown, a device an earlier
+	// section holds is not counted again.
+	seen := make(map[int]bool)
+	for _, id := range req.DeviceIDs {
+		seen[id] = true
+	}
+	preview := func(section string, devices []netbox.Device, reason func(d *netbox.Device) string, err error) error {
+		estimate := SectionEstimate{}
+		switch {
+		case errors.Is(err, netbox.ErrCallBudgetExhausted) && !p.strict:
+			estimate.Estimated = true
+		case err != nil:
+			nerr, ok := requestError(err)
+			if !ok {
+				return err
+			}
+			n.Errors = append(n.Errors, nerr)
+		}
+		for i := range devices {
+			if excluded, err := p.ex.device(&devices[i], reason(&devices[i])); err != nil {
+				return err
+			} else if excluded || seen[devices[i].ID] {
+				continue
+			}
+			seen[devices[i].ID] = true
+			estimate.Count++
+			if len(estimate.Preview) < NormalizePreviewLimit {
+				estimate.Preview = append(estimate.Preview, devices[i].ID)
+			}
+		}
+		n.Sections[section] = estimate
+		return nil
+	}
+	if len(req.RackIDs) > 0 {
+		racks, rackDevices, err := expandRacks(expandCtx, client, req.RackIDs)
+		var devices []netbox.Device
+		rackOf := make(map[int]string)
+		for i := range racks {
+			for _, d := range rackDevices[i] {
+				devices = append(devices, d)
+				rackOf[d.ID] = racks[i].Name
+			}
+		}
+		if err := preview("rack_devices", devices, func(d *netbox.Device) string { return "rack " + rackOf[d.ID] }, err); err != nil {
+			return Normalization{}, err
+		}
+	}
+	if len(req.SiteIDs) > 0 {
+		devices, err := expandSites(expandCtx, client, req.SiteIDs)
+		if err := preview("site_expanded_devices", devices, func(d *netbox.Device) string { return "site " + d.Site.NameOrEmpty() }, err); err != nil {
+			return Normalization{}, err
+		}
+	}
+	if budget.Exhausted() {
+		n.Warnings = append(n.Warnings, DataWarning{
+			ObjectType: "request",
+			Field:      "netbox_calls",
+			Severity:   SeverityHigh,
+			Message:    "netbox call budget exhausted while expanding selectors; the estimates are lower bounds",
+		})
+	}
+	labelWarnings(n.Warnings, c.Lang)
+	return n, nil
+}
@@ -0,0 +1,140 @@
+package impact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Redactor replaces tenant names, and any text matching Patterns, with
+// pseudonyms such as "tenant-7f3a09c1" derived from an HMAC under Key, so a
+// name maps to the same pseudonym wherever it appears. IDs and scores are
+// left alone.
+type Redactor struct {
+	Key      []byte
+	Patterns []*regexp.Regexp
+}
+
+func (rd *Redactor) Pseudonym(kind, name string) string {
+	mac := hmac.New(sha256.New, rd.Key)
+	mac.Write([]byte(kind + ":" + name))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// Redact sanitizes the result v points to in place. It is the single
+// sanitizer for every output: JSON responses and CLI text are rendered
+// from the redacted value. Strings under a "tenant" key, tenant names in
+// tenant rollups and the keys of tenant_tiers are replaced outright; every
+// other string has the tenant names found and the pattern matches within
+// it replaced.
+func (rd *Redactor) Redact(v interface{}) {
+	rd.redact(v, nil, true)
+}
+
+// RedactTenantsExcept is Redact for the tenant names other than keep,
+// which stay readable, leaving pattern matches alone: the view of a
+// caller limited to the tenants in keep.
+func (rd *Redactor) RedactTenantsExcept(v interface{}, keep []string) {
+	rd.redact(v, keep, false)
+}
+
+func (rd *Redactor) redact(v interface{}, keep []string, patterns bool) {
+	redacted := func(s string) bool {
+		return s != "" && s != untenanted && !slices.Contains(keep, s)
+	}
+	tenants := make(map[string]bool)
+	rd.walk(reflect.ValueOf(v), false, func(s string, tenant bool) string {
+		if tenant && redacted(s) {
+			tenants[s] = true
+		}
+		return s
+	})
+	names := slices.Collect(maps.Keys(tenants))
+	// Replace longer names first so "Acme Europe" is not left as
+	// "tenant-…  Europe".
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	rd.walk(reflect.ValueOf(v), false, func(s string, tenant bool) string {
+		if tenant {
+			if !redacted(s) {
+				return s
+			}
+			return rd.Pseudonym("tenant", s)
+		}
+		for _, name := range names {
+			s = strings.ReplaceAll(s, name, rd.Pseudonym("tenant", name))
+		}
+		if patterns {
+			for _, re := range rd.Patterns {
+				s = re.ReplaceAllStringFunc(s, func(match string) string { return rd.Pseudonym("name", match) })
+			}
+		}
+		return s
+	})
+}
+
+// walk calls visit on every string reachable from v and stores what it
+// returns. Slices, maps and pointers are copied before they are written,
+// as results share them with the weight configuration.
+func (rd *Redactor) walk(v reflect.Value, tenant bool, visit func(s string, tenant bool) string) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(visit(v.String(), tenant))
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if !v.CanSet() {
+			rd.walk(v.Elem(), tenant, visit)
+			return
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(v.Elem())
+		rd.walk(c.Elem(), tenant, visit)
+		v.Set(c)
+	case reflect.Struct:
+		t := v.Type()
+		tenantRollup := t == reflect.TypeFor[TenantImpact]() || t == reflect.TypeFor[TenantSummary]()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			rd.walk(v.Field(i), name == "tenant" || name == "tenant_tiers" || (tenantRollup && name == "name"), visit)
+		}
+	case reflect.Slice:
+		if v.IsNil() || !v.CanSet() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			rd.walk(c.Index(i), tenant, visit)
+		}
+		v.Set(c)
+	case reflect.Map:
+		if v.IsNil() || !v.CanSet() {
+			return
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := reflect.New(v.Type().Key()).Elem()
+			key.Set(iter.Key())
+			rd.walk(key, tenant, visit)
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			rd.walk(value, false, visit)
+			c.SetMapIndex(key, value)
+		}
+		v.Set(c)
+	}
+}
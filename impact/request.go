@@ -0,0 +1,331 @@
+package impact
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+type ImpactRequest struct {
+	DeviceIDs    []int      `json:"device_ids"`
+	CircuitIDs   []int      `json:"circuit_ids"`
+	InterfaceIDs []int      `json:"interface_ids"`
+	SiteIDs      []int      `json:"site_ids,omitempty"`
+	RackIDs      []int      `json:"rack_ids,omitempty"`
+	PowerFeedIDs []int      `json:"power_feed_ids,omitempty"`
+	ImpactType   ImpactType `json:"impact_type"`
+	// StartTime and EndTime (RFC3339) bound the maintenance window scored
+	// against the time bands; without StartTime no band applies.
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	// Timezone (IANA) replaces the weight set's timezone, in which the time
+	// bands and calendar are read, for this request.
+	Timezone string `json:"timezone,omitempty"`
+	// DurationMinutes sets the window length directly; with a start_time
+	// and no end_time it also sets the window's end.
+	DurationMinutes *float64 `json:"duration_minutes,omitempty"`
+	// Instance names the NetBox instance the IDs belong to; empty means the
+	// first configured one.
+	Instance string `json:"instance,omitempty"`
+	// Reference identifies the change, e.g. a ticket number; history keeps
+	// and trends calculations by it.
+	Reference string `json:"reference,omitempty"`
+	// Tags label the calculation with scenarios, e.g. "ring-west-upgrade";
+	// history can be searched and trended by them. See CheckTags.
+	Tags       []string `json:"tags,omitempty"`
+	CableIDs   []int    `json:"cable_ids,omitempty"`
+	Composites []string `json:"composites,omitempty"`
+	ObjectURLs []string `json:"object_urls,omitempty"`
+
+	// BlastRadiusDepth overrides the server's -blast-radius-depth; 0 turns
+	// the topology walk off.
+	BlastRadiusDepth *int `json:"blast_radius_depth,omitempty"`
+	// ExpandVMs overrides the server's -expand-vms.
+	ExpandVMs *bool `json:"expand_vms,omitempty"`
+
+	IncludeTenants   bool `json:"include_tenants,omitempty"`
+	SkipSanityChecks bool `json:"skip_sanity_checks,omitempty"`
+	SkipValidation   bool `json:"skip_validation,omitempty"`
+	// Overrides supersedes the configured weights for this request only.
+	Overrides  *WeightOverrides `json:"overrides,omitempty"`
+	StrictData bool             `json:"strict_data,omitempty"`
+	Strict     *bool            `json:"strict,omitempty"`
+
+	// TopContributors sets how many items the result's top_contributors
+	// lists; nil means DefaultTopContributors and 0 none.
+	TopContributors *int `json:"top_contributors,omitempty"`
+
+	// Explain adds a plain-English account of the score to the result.
+	Explain bool `json:"explain,omitempty"`
+
+	// AllowPartial scores devices and circuits NetBox fails to return at
+	// their base weight instead of failing the calculation.
+	AllowPartial *bool `json:"allow_partial,omitempty"`
+
+	// IncludeAffectedTenants lists the tenants of the affected devices,
+	// circuits and circuit endpoint sites; the sites cost extra lookups.
+	IncludeAffectedTenants bool `json:"include_affected_tenants,omitempty"`
+
+	// ExcludeDeviceIDs, ExcludeCircuitIDs and ExcludeTags (tag slugs or
+	// names) drop objects the expansions pulled in before they are scored.
+	ExcludeDeviceIDs  []int    `json:"exclude_device_ids,omitempty"`
+	ExcludeCircuitIDs []int    `json:"exclude_circuit_ids,omitempty"`
+	ExcludeTags       []string `json:"exclude_tags,omitempty"`
+
+	// Redact replaces tenant names and names matching the server's
+	// -redact-pattern list with pseudonyms in the result.
+	Redact bool `json:"redact,omitempty"`
+}
+
+// Options are the server-wide calculation settings, set from the command
+// line. Requests can override some of them; DefaultOptions matches the flag
+// defaults.
+type Options struct {
+	// Strict (-strict) enables strict mode for every request; a request can
+	// enable strict mode but never disable it when this is on.
+	Strict bool
+	// Compat (-compat) turns off the guards that are otherwise on by
+	// default, ID validation and sanity checks, for requests that are not
+	// strict. A request can still opt into strict mode.
+	Compat bool
+	// SanityMismatchFraction is the fraction of device_ids/interface_ids
+	// that may resolve as the other object type before the request is
+	// rejected as a likely field mix-up (0 disables).
+	SanityMismatchFraction float64
+	// MaxWeightOverride is the upper bound for each value in a request's
+	// overrides block.
+	MaxWeightOverride float64
+	// CallBudget is the number of NetBox requests one calculation may send
+	// before it stops expanding (0 = no limit).
+	CallBudget int
+	// FetchConcurrency is the maximum number of objects of one type fetched
+	// from NetBox in parallel per calculation.
+	FetchConcurrency int
+	// BlastRadiusDepth is the default number of cable hops walked from each
+	// explicit device.
+	BlastRadiusDepth int
+	ExpandVMs        bool
+	// ConfigContextPath is the dotted path of the impact hint in a device's
+	// rendered config context, e.g. "impact"; empty turns hints off. A hint
+	// is an object with an optional "weight_multiplier" and "note".
+	ConfigContextPath string
+	// ConfigContextMaxDevices limits the config context lookups of one
+	// calculation to that many devices, highest impact first; 0 means all.
+	ConfigContextMaxDevices int
+	// HostAliases are hostnames accepted in object_urls besides the
+	// NetBox instance's own.
+	HostAliases []string
+	// Debug logs the duration of every calculation phase.
+	Debug bool
+	// Composites holds the composites requests can name.
+	Composites *CompositeStore
+	// Redactor redacts the results of requests that ask for it, and every
+	// result when RedactAll (-redact) is set. main sets it up; its key is
+	// random unless -redact-key-file gives one, so pseudonyms change across
+	// restarts.
+	Redactor  *Redactor
+	RedactAll bool
+	// Lang (-lang) is the language of the labels in results; see Langs.
+	Lang string
+	// Enrichers (-enrichers-file) run over every calculation in order.
+	Enrichers []NamedEnricher
+	// Features (-features) switches the behaviours being phased in or out.
+	Features FeatureFlags
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxWeightOverride: 1000,
+		CallBudget:        2000,
+		FetchConcurrency:  netbox.DefaultFetchConcurrency,
+		BlastRadiusDepth:  1,
+		ExpandVMs:         true,
+		Composites:        NewCompositeStore(),
+		Redactor:          &Redactor{},
+		Lang:              DefaultLang,
+	}
+}
+
+// Calculator runs impact calculations with one set of Options.
+type Calculator struct {
+	Options
+}
+
+func NewCalculator(opts Options) *Calculator {
+	return &Calculator{Options: opts}
+}
+
+const strictSanityMismatchFraction = 0.5
+
+func (c *Calculator) isStrict(req ImpactRequest) bool {
+	return c.Strict || (req.Strict != nil && *req.Strict)
+}
+
+// StrictFor is isStrict after w's request policy has been applied, for the
+// strict JSON check the handlers make before calculating.
+func (c *Calculator) StrictFor(w WeightConfig, req ImpactRequest) bool {
+	req, _ = c.ApplyPolicy(w, req)
+	return c.isStrict(req)
+}
+
+// Redact redacts result, an ImpactResult or CompareResult, when the request
+// asked for it or RedactAll is set.
+func (c *Calculator) Redact(result interface{}, requested bool) {
+	if c.RedactAll || requested {
+		c.Redactor.Redact(result)
+	}
+}
+
+func isPartial(req ImpactRequest) bool {
+	return req.AllowPartial != nil && *req.AllowPartial
+}
+
+// GuardReport says what one strict-mode guard did for a request: "passed"
+// when it checked something and found nothing wrong, "skipped" when the
+// request gave it nothing to check.
+type GuardReport struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// GuardError is returned when a guard fires; Guard names it and the HTTP
+// handlers send it in the X-Strict-Guard header.
+type GuardError struct {
+	Guard string
+	Err   error
+}
+
+func (e *GuardError) Error() string { return e.Err.Error() }
+
+func (e *GuardError) Unwrap() error { return e.Err }
+
+// guardReports records which guards ran for one request.
+type guardReports []GuardReport
+
+func (g *guardReports) add(name string, ran bool) {
+	status := "skipped"
+	if ran {
+		status = "passed"
+	}
+	*g = append(*g, GuardReport{Name: name, Status: status})
+}
+
+type DataWarning struct {
+	ObjectType string   `json:"object_type"`
+	ID         int      `json:"id"`
+	Field      string   `json:"field"`
+	Severity   Severity `json:"severity"`
+	// SeverityLabel is Severity's display name in the -lang language.
+	SeverityLabel string `json:"severity_label,omitempty"`
+	Message       string `json:"message"`
+	URL           string `json:"url,omitempty"`
+}
+
+// Severity is how serious a DataWarning is. Clients switch on the values,
+// so they never change; new ones are only added.
+type Severity string
+
+// Warning severities, most severe first: critical flags a risk the score
+// alone understates, high an object or expansion left out or scored blind,
+// medium a factor that could not be determined and low NetBox data hygiene.
+const (
+	SeverityCritical Severity = "critical"
+	SeverityHigh     Severity = "high"
+	SeverityMedium   Severity = "medium"
+	SeverityLow      Severity = "low"
+)
+
+// Severities lists every Severity, most severe first.
+var Severities = []Severity{SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow}
+
+// UnmarshalJSON rejects values that are not in Severities.
+func (s *Severity) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if !slices.Contains(Severities, Severity(v)) {
+		return fmt.Errorf("unknown severity %q (expected one of %v)", v, Severities)
+	}
+	*s = Severity(v)
+	return nil
+}
+
+// MostSevere returns up to n warnings, most severe first and otherwise in
+// their order in warnings.
+func MostSevere(warnings []DataWarning, n int) []DataWarning {
+	rank := func(w DataWarning) int {
+		if i := slices.Index(Severities, w.Severity); i >= 0 {
+			return i
+		}
+		return len(Severities)
+	}
+	sorted := slices.Clone(warnings)
+	slices.SortStableFunc(sorted, func(a, b DataWarning) int { return cmp.Compare(rank(a), rank(b)) })
+	return sorted[:min(n, len(sorted))]
+}
+
+type DataQualityError struct {
+	Warnings []DataWarning
+}
+
+func (e *DataQualityError) Error() string {
+	return fmt.Sprintf("%d circuit data problems must be fixed in NetBox", len(e.Warnings))
+}
+
+// RangeError reports a well-formed request value outside its allowed range.
+type RangeError struct {
+	Field string
+	Value float64
+	Max   float64
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s: %g is out of range (0 to %g)", e.Field, e.Value, e.Max)
+}
+
+// UnknownObjectsError lists requested IDs that do not exist in NetBox,
+// keyed by request field.
+type UnknownObjectsError struct {
+	Missing map[string][]int
+}
+
+func (e *UnknownObjectsError) Error() string {
+	var parts []string
+	for _, field := range slices.Sorted(maps.Keys(e.Missing)) {
+		parts = append(parts, field+" "+netbox.IDList(e.Missing[field]))
+	}
+	return "objects not found in NetBox: " + strings.Join(parts, "; ")
+}
+
+// MaxTags and MaxTagLength bound a request's tags.
+const (
+	MaxTags      = 16
+	MaxTagLength = 64
+)
+
+// CheckTags rejects more than MaxTags tags, a tag repeated, and tags that
+// are empty, longer than MaxTagLength or use characters other than
+// letters, digits, '-', '_' and '.'.
+func CheckTags(tags []string) error {
+	if len(tags) > MaxTags {
+		return &netbox.ValidationError{Field: "tags", Message: fmt.Sprintf("at most %d tags, got %d", MaxTags, len(tags))}
+	}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > MaxTagLength || strings.Trim(tag, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+			return &netbox.ValidationError{Field: "tags", Message: fmt.Sprintf("tag %q must be 1 to %d letters, digits, '-', '_' or '.'", tag, MaxTagLength)}
+		}
+		if seen[tag] {
+			return &netbox.ValidationError{Field: "tags", Message: fmt.Sprintf("tag %q is listed twice", tag)}
+		}
+		seen[tag] = true
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package impact
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// idLookup resolves IDs with FetchNamesByIDs and remembers the answers, so
+// the sanity check and the existence check share one id__in query per
+// endpoint and ID.
+type idLookup struct {
+	client  netbox.NetboxAPI
+	checked map[string]map[int]bool
+	names   map[string]map[int]string
+}
+
+func newIDLookup(client netbox.NetboxAPI) *idLookup {
+	return &idLookup{client: client, checked: make(map[string]map[int]bool), names: make(map[string]map[int]string)}
+}
+
+// FetchNamesByIDs returns the names of the ids found under endpoint,
+// querying NetBox only for IDs not looked up before.
+func (l *idLookup) FetchNamesByIDs(ctx context.Context, endpoint string, ids []int) (map[int]string, error) {
+	if l.checked[endpoint] == nil {
+		l.checked[endpoint] = make(map[int]bool)
+		l.names[endpoint] = make(map[int]string)
+	}
+	var unchecked []int
+	for _, id := range ids {
+		if !l.checked[endpoint][id] {
+			unchecked = append(unchecked, id)
+		}
+	}
+	if len(unchecked) > 0 {
+		found, err := l.client.FetchNamesByIDs(ctx, endpoint, unchecked)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range unchecked {
+			l.checked[endpoint][id] = true
+		}
+		for id, name := range found {
+			l.names[endpoint][id] = name
+		}
+	}
+	found := make(map[int]string)
+	for _, id := range ids {
+		if name, ok := l.names[endpoint][id]; ok {
+			found[id] = name
+		}
+	}
+	return found, nil
+}
+
+func checkFieldMixup(ctx context.Context, client *idLookup, fraction float64, field string, ids []int, endpoint, otherField, otherEndpoint, otherType string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	found, err := client.FetchNamesByIDs(ctx, endpoint, ids)
+	if err != nil {
+		return fmt.Errorf("sanity check on %s: %w", field, err)
+	}
+	var missing []int
+	for _, id := range ids {
+		if _, ok := found[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if float64(len(missing)) <= fraction*float64(len(ids)) {
+		return nil
+	}
+	other, err := client.FetchNamesByIDs(ctx, otherEndpoint, missing)
+	if err != nil {
+		return fmt.Errorf("sanity check on %s: %w", field, err)
+	}
+	var mixed []int
+	for _, id := range missing {
+		if _, ok := other[id]; ok {
+			mixed = append(mixed, id)
+		}
+	}
+	if float64(len(mixed)) <= fraction*float64(len(ids)) {
+		return nil
+	}
+	var examples []string
+	for i, id := range mixed {
+		if i == 3 {
+			break
+		}
+		examples = append(examples, fmt.Sprintf("%d is %s %q", id, otherType, other[id]))
+	}
+	return &GuardError{Guard: "sanity_checks", Err: &netbox.ValidationError{
+		Field: field,
+		Message: fmt.Sprintf("%d of %d IDs resolve as %ss, not as the expected type (%s); did you mean %s? Set skip_sanity_checks to override",
+			len(mixed), len(ids), otherType, strings.Join(examples, ", "), otherField),
+	}}
+}
+
+func (c *Calculator) sanityCheckRequest(ctx context.Context, req ImpactRequest, client *idLookup) error {
+	fraction := c.SanityMismatchFraction
+	if c.isStrict(req) {
+		if fraction <= 0 {
+			fraction = strictSanityMismatchFraction
+		}
+	} else if fraction <= 0 || req.SkipSanityChecks || c.Compat {
+		return nil
+	}
+	if err := checkFieldMixup(ctx, client, fraction, "device_ids", req.DeviceIDs, "/api/dcim/devices/", "interface_ids", "/api/dcim/interfaces/", "interface"); err != nil {
+		return err
+	}
+	return checkFieldMixup(ctx, client, fraction, "interface_ids", req.InterfaceIDs, "/api/dcim/interfaces/", "device_ids", "/api/dcim/devices/", "device")
+}
+
+func parseObjectURL(raw, netboxURL string, aliases []string) (string, int, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", 0, fmt.Errorf("not an absolute http(s) URL")
+	}
+	allowed := false
+	if base, err := url.Parse(netboxURL); err == nil && strings.EqualFold(u.Host, base.Host) {
+		allowed = true
+	}
+	for _, alias := range aliases {
+		if strings.EqualFold(u.Host, alias) || strings.EqualFold(u.Hostname(), alias) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", 0, fmt.Errorf("host %q is not the configured NetBox instance", u.Host)
+	}
+	objectType, id, err := objectFromPath(u.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	switch objectType {
+	case "dcim/devices", "circuits/circuits", "dcim/interfaces", "dcim/cables":
+		return objectType, id, nil
+	}
+	return "", 0, fmt.Errorf("unsupported object type %q", objectType)
+}
+
+func objectFromPath(path string) (string, int, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 3 {
+		return "", 0, fmt.Errorf("path %q does not point at a NetBox object", path)
+	}
+	n := len(segments)
+	id, err := strconv.Atoi(segments[n-1])
+	if err != nil || id <= 0 {
+		return "", 0, fmt.Errorf("path %q does not end in an object ID", path)
+	}
+	return segments[n-3] + "/" + segments[n-2], id, nil
+}
+
+func (c *Calculator) expandObjectURLs(req ImpactRequest, netboxURL string) (ImpactRequest, error) {
+	for i, raw := range req.ObjectURLs {
+		objectType, id, err := parseObjectURL(raw, netboxURL, c.HostAliases)
+		if err != nil {
+			return req, &netbox.ValidationError{
+				Field:   fmt.Sprintf("object_urls[%d]", i),
+				Message: fmt.Sprintf("%q: %v", raw, err),
+			}
+		}
+		switch objectType {
+		case "dcim/devices":
+			req.DeviceIDs = append(req.DeviceIDs, id)
+		case "circuits/circuits":
+			req.CircuitIDs = append(req.CircuitIDs, id)
+		case "dcim/interfaces":
+			req.InterfaceIDs = append(req.InterfaceIDs, id)
+		case "dcim/cables":
+			req.CableIDs = append(req.CableIDs, id)
+		}
+	}
+	req.ObjectURLs = nil
+	return req, nil
+}
+
+func cableKind(objectType string) string {
+	switch objectType {
+	case "dcim.consoleport", "dcim.consoleserverport":
+		return "console"
+	case "dcim.powerport", "dcim.poweroutlet", "dcim.powerfeed":
+		return "power"
+	}
+	return "data"
+}
+
+func resolveCable(ctx context.Context, client netbox.NetboxAPI, id int) (CableImpactDetail, []DataWarning, error) {
+	cable, err := client.FetchCableByID(ctx, id)
+	if err != nil {
+		return CableImpactDetail{}, nil, err
+	}
+	detail := CableImpactDetail{ID: cable.ID, Label: cable.Label, Kind: "data"}
+	cableURL := fmt.Sprintf("%s/dcim/cables/%d/", strings.TrimRight(client.BaseURL(), "/"), cable.ID)
+	var warnings []DataWarning
+	if cable.Label == "" {
+		warnings = append(warnings, DataWarning{
+			ObjectType: "cable",
+			ID:         cable.ID,
+			Field:      "label",
+			Severity:   SeverityLow,
+			Message:    fmt.Sprintf("cable %d has no label", cable.ID),
+			URL:        cableURL,
+		})
+	}
+	for side, terms := range map[string][]netbox.CableTermination{"a_terminations": cable.ATerminations, "b_terminations": cable.BTerminations} {
+		if len(terms) == 0 {
+			warnings = append(warnings, DataWarning{
+				ObjectType: "cable",
+				ID:         cable.ID,
+				Field:      side,
+				Severity:   SeverityHigh,
+				Message:    fmt.Sprintf("cable %d is dangling: no %s", cable.ID, side),
+				URL:        cableURL,
+			})
+		}
+	}
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i].Field < warnings[j].Field })
+
+	seenInterfaces := make(map[int]bool)
+	seenCircuits := make(map[int]bool)
+	addEndpoint := func(e netbox.CableEndpoint) {
+		objectType, objectID, err := objectFromPath(e.URL)
+		if err != nil {
+			return
+		}
+		switch objectType {
+		case "dcim/interfaces":
+			if !seenInterfaces[objectID] {
+				seenInterfaces[objectID] = true
+				detail.InterfaceIDs = append(detail.InterfaceIDs, objectID)
+			}
+		case "circuits/circuit-terminations":
+			if e.Circuit != nil && !seenCircuits[e.Circuit.ID] {
+				seenCircuits[e.Circuit.ID] = true
+				detail.CircuitIDs = append(detail.CircuitIDs, e.Circuit.ID)
+			}
+		}
+	}
+	for _, t := range append(append([]netbox.CableTermination(nil), cable.ATerminations...), cable.BTerminations...) {
+		if kind := cableKind(t.ObjectType); kind != "data" {
+			detail.Kind = kind
+			continue
+		}
+		switch t.ObjectType {
+		case "dcim.interface":
+			addEndpoint(netbox.CableEndpoint{URL: fmt.Sprintf("/api/dcim/interfaces/%d/", t.ObjectID)})
+		case "circuits.circuittermination":
+			addEndpoint(netbox.CableEndpoint{URL: fmt.Sprintf("/api/circuits/circuit-terminations/%d/", t.ObjectID), Circuit: t.Object.Circuit})
+		case "dcim.frontport", "dcim.rearport":
+			portType := "front-ports"
+			if t.ObjectType == "dcim.rearport" {
+				portType = "rear-ports"
+			}
+			endpoints, err := client.FetchPortPathEndpoints(ctx, portType, t.ObjectID)
+			if err != nil {
+				return CableImpactDetail{}, nil, fmt.Errorf("failed to trace %s %d: %w", portType, t.ObjectID, err)
+			}
+			for _, e := range endpoints {
+				addEndpoint(e)
+			}
+		}
+	}
+	switch detail.Kind {
+	case "console":
+		detail.NotScored = "console cables carry no production traffic and are not scored"
+	case "power":
+		detail.NotScored = "power cables are not scored; list the power feed in power_feed_ids to score the devices it powers"
+	}
+	return detail, warnings, nil
+}
+
+func cableName(c CableImpactDetail) string {
+	if c.Label != "" {
+		return c.Label
+	}
+	return fmt.Sprintf("#%d", c.ID)
+}
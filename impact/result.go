@@ -0,0 +1,1097 @@
+package impact
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// DeviceImpact scores a group of devices. WeightPerDevice applies to devices
+// whose role has no weight of its own; Roles breaks the group down by role.
+type DeviceImpact struct {
+	Count           int                  `json:"count"`
+	WeightPerDevice float64              `json:"weight_per_device"`
+	Impact          float64              `json:"impact"`
+	Roles           []RoleImpact         `json:"roles,omitempty"`
+	Items           []DeviceImpactDetail `json:"items,omitempty"`
+}
+
+type RoleImpact struct {
+	Role   string  `json:"role"`
+	Count  int     `json:"count"`
+	Weight float64 `json:"weight"`
+	Impact float64 `json:"impact"`
+}
+
+// parallelCircuit returns the CID of an active circuit outside affected that
+// runs between the same two endpoints as c, or "" when there is none.
+// byEndpoint caches the circuit searches of one calculation.
+func parallelCircuit(ctx context.Context, client netbox.NetboxAPI, c netbox.Circuit, affected map[int]bool, byEndpoint map[string][]netbox.Circuit) (string, error) {
+	a, b := c.TerminationA.Endpoint(), c.TerminationZ.Endpoint()
+	if a == "" || b == "" {
+		return "", nil
+	}
+	candidates, ok := byEndpoint[a]
+	if !ok {
+		var err error
+		if candidates, err = client.FetchCircuitsByEndpoint(ctx, a); err != nil {
+			return "", fmt.Errorf("failed to search circuits at %s: %w", a, err)
+		}
+		byEndpoint[a] = candidates
+	}
+	for _, other := range candidates {
+		if affected[other.ID] {
+			continue
+		}
+		x, y := other.TerminationA.Endpoint(), other.TerminationZ.Endpoint()
+		if (x == a && y == b) || (x == b && y == a) {
+			return other.CID, nil
+		}
+	}
+	return "", nil
+}
+
+// Role reported for devices without one in NetBox.
+const noRole = "none"
+
+// newDeviceImpact totals scored devices and groups them by role, in the
+// order each role is first seen.
+func newDeviceImpact(items []DeviceImpactDetail, fallbackWeight float64) DeviceImpact {
+	impact := DeviceImpact{Count: len(items), WeightPerDevice: fallbackWeight, Items: items}
+	index := make(map[string]int)
+	for _, d := range items {
+		role := d.Role
+		if role == "" {
+			role = noRole
+		}
+		i, ok := index[role]
+		if !ok {
+			i = len(impact.Roles)
+			index[role] = i
+			impact.Roles = append(impact.Roles, RoleImpact{Role: role, Weight: d.Weight})
+		}
+		impact.Roles[i].Count++
+		impact.Roles[i].Impact += d.Impact
+		impact.Impact += d.Impact
+	}
+	return impact
+}
+
+type DeviceImpactDetail struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Role   string  `json:"role,omitempty"`
+	Site   string  `json:"site,omitempty"`
+	Status string  `json:"status,omitempty"`
+	Tenant string  `json:"tenant,omitempty"`
+	Weight float64 `json:"weight"`
+	// Criticality is the level that set CriticalityFactor; empty when the
+	// device has none.
+	Criticality       string  `json:"criticality,omitempty"`
+	CriticalityFactor float64 `json:"criticality_factor"`
+	StatusFactor      float64 `json:"status_factor"`
+	Tier              string  `json:"tier,omitempty"`
+	TierFactor        float64 `json:"tier_factor"`
+	Impact            float64 `json:"impact"`
+	// UncappedImpact and Cap are set when a point cap held Impact down;
+	// ShareFactor when a class share cap scaled it.
+	UncappedImpact float64 `json:"uncapped_impact,omitempty"`
+	Cap            float64 `json:"cap,omitempty"`
+	ShareFactor    float64 `json:"share_factor,omitempty"`
+	// HintFactor and HintNote come from the device's config context hint.
+	HintFactor float64 `json:"hint_factor,omitempty"`
+	HintNote   string  `json:"hint_note,omitempty"`
+	// NoRecoveryPathFactor is set when the request also takes down the
+	// out-of-band devices (OOBVia) the device is reached through.
+	NoRecoveryPathFactor float64  `json:"no_recovery_path_factor,omitempty"`
+	OOBVia               []string `json:"oob_via,omitempty"`
+	// Enrichments are the factors and notes enrichers applied.
+	Enrichments []Enrichment `json:"enrichments,omitempty"`
+
+	DiscoveredVia int `json:"discovered_via,omitempty"`
+	Hops          int `json:"hops,omitempty"`
+	// Reason is the path the device was scored through; OtherReasons the
+	// other paths that reached it.
+	Reason       string   `json:"reason"`
+	OtherReasons []string `json:"other_reasons,omitempty"`
+	// Unavailable marks a device NetBox failed to return (allow_partial).
+	Unavailable bool `json:"unavailable,omitempty"`
+
+	roleSlug string
+	tenant   *netbox.Node
+}
+
+// scoreDevice weighs d by its role scaled by factor (e.g. the blast radius
+// factor), then applies its criticality, status and tenant tier.
+func (w WeightConfig) scoreDevice(d *netbox.Device, factor float64) DeviceImpactDetail {
+	detail := DeviceImpactDetail{
+		ID:     d.ID,
+		Name:   d.Name,
+		Role:   d.Role.NameOrEmpty(),
+		Site:   d.Site.NameOrEmpty(),
+		Tenant: d.Tenant.NameOrEmpty(),
+		Weight: w.DeviceWeight(d) * factor,
+		tenant: d.Tenant,
+	}
+	if d.Role != nil {
+		detail.roleSlug = d.Role.Slug
+	}
+	detail.Criticality, detail.CriticalityFactor = w.CriticalityOf(d.CustomFields)
+	detail.StatusFactor = w.StatusFactorOf(d.Status)
+	detail.Tier, detail.TierFactor = w.TierOf(d.Tenant)
+	detail.Impact, detail.UncappedImpact, detail.Cap = capImpact(detail.Weight*detail.CriticalityFactor*detail.StatusFactor*detail.TierFactor, w.Caps.Device)
+	if d.Status != nil {
+		detail.Status = d.Status.Value
+	}
+	return detail
+}
+
+// inclusionRanks breaks ties between paths of the same weight: explicit
+// wins, then composites, then the more specific expansions.
+var inclusionRanks = []string{"explicit", "composite", "cable", "rack", "site", "power_feed", "blast_radius"}
+
+// inclusion is one path that brought an object into the calculation, e.g.
+// "explicit", "rack R10" or "blast_radius", with the factor it scores at.
+type inclusion struct {
+	reason string
+	factor float64
+}
+
+func (i inclusion) rank() int {
+	kind, _, _ := strings.Cut(i.reason, " ")
+	return slices.Index(inclusionRanks, kind)
+}
+
+// inclusions records every path that reached each object of one type. An
+// object is scored once, through its highest-factor path, whatever the
+// order of the request's lists.
+type inclusions map[int][]inclusion
+
+func (in inclusions) add(id int, reason string, factor float64) {
+	for _, i := range in[id] {
+		if i.reason == reason {
+			return
+		}
+	}
+	in[id] = append(in[id], inclusion{reason, factor})
+	slices.SortStableFunc(in[id], func(a, b inclusion) int {
+		if a.factor != b.factor {
+			return cmp.Compare(b.factor, a.factor)
+		}
+		if a.rank() != b.rank() {
+			return cmp.Compare(a.rank(), b.rank())
+		}
+		return strings.Compare(a.reason, b.reason)
+	})
+}
+
+// reasons returns the chosen path of id and the others.
+func (in inclusions) reasons(id int) (string, []string) {
+	paths := in[id]
+	if len(paths) == 0 {
+		return "", nil
+	}
+	var others []string
+	for _, i := range paths[1:] {
+		others = append(others, i.reason)
+	}
+	return paths[0].reason, others
+}
+
+// keep returns the items scored through their own path, filling in the
+// other paths that reached them.
+func (in inclusions) keep(items []DeviceImpactDetail) []DeviceImpactDetail {
+	var kept []DeviceImpactDetail
+	for _, d := range items {
+		reason, others := in.reasons(d.ID)
+		if reason != d.Reason {
+			continue
+		}
+		d.OtherReasons = others
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+type VirtualMachineImpact struct {
+	Count       int                          `json:"count"`
+	WeightPerVM float64                      `json:"weight_per_vm"`
+	Impact      float64                      `json:"impact"`
+	Items       []VirtualMachineImpactDetail `json:"items"`
+}
+
+type VirtualMachineImpactDetail struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Host    string  `json:"host"`
+	Cluster string  `json:"cluster,omitempty"`
+	Status  string  `json:"status,omitempty"`
+	Impact  float64 `json:"impact"`
+}
+
+type PowerFeedImpactDetail struct {
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	Rack             string  `json:"rack,omitempty"`
+	RedundancyFactor float64 `json:"redundancy_factor"`
+	DeviceCount      int     `json:"device_count"`
+	DeviceIDs        []int   `json:"device_ids,omitempty"`
+	Impact           float64 `json:"impact"`
+
+	devices []DeviceImpactDetail
+}
+
+// sumDevices sets f.Impact to the total of its scored devices.
+func (f *PowerFeedImpactDetail) sumDevices() {
+	f.Impact, f.DeviceIDs = 0, nil
+	for _, d := range f.devices {
+		f.Impact += d.Impact
+		f.DeviceIDs = append(f.DeviceIDs, d.ID)
+	}
+	f.DeviceCount = len(f.devices)
+}
+
+type TierImpact struct {
+	Tier   string  `json:"tier"`
+	Count  int     `json:"count"`
+	Impact float64 `json:"impact"`
+}
+
+// Tier reported for objects without a tenant SLA tier.
+const noTier = "none"
+
+// tierRollup totals the devices and circuits of b per tenant SLA tier,
+// highest impact first; it is empty when no object has a tier.
+func tierRollup(b ImpactBreakdown) []TierImpact {
+	totals := make(map[string]*TierImpact)
+	anyTier := false
+	add := func(tier string, impact float64) {
+		if tier == "" {
+			tier = noTier
+		} else {
+			anyTier = true
+		}
+		if totals[tier] == nil {
+			totals[tier] = &TierImpact{Tier: tier}
+		}
+		totals[tier].Count++
+		totals[tier].Impact += impact
+	}
+	addDevices := func(items []DeviceImpactDetail) {
+		for _, d := range items {
+			add(d.Tier, d.Impact)
+		}
+	}
+	addDevices(b.Devices.Items)
+	addDevices(b.SiteExpandedDevices.Items)
+	if b.BlastRadius != nil {
+		addDevices(b.BlastRadius.Items)
+	}
+	for _, f := range b.PowerFeeds {
+		addDevices(f.devices)
+	}
+	for _, c := range b.Circuits.Items {
+		add(c.Tier, c.Impact)
+	}
+	if !anyTier {
+		return nil
+	}
+	tiers := make([]TierImpact, 0, len(totals))
+	for _, t := range totals {
+		tiers = append(tiers, *t)
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		if tiers[i].Impact != tiers[j].Impact {
+			return tiers[i].Impact > tiers[j].Impact
+		}
+		return tiers[i].Tier < tiers[j].Tier
+	})
+	return tiers
+}
+
+type TenantImpact struct {
+	Name    string  `json:"name"`
+	Objects int     `json:"objects"`
+	Impact  float64 `json:"impact"`
+	Share   float64 `json:"share"`
+}
+
+const untenanted = "untenanted"
+
+// TenantSummary is a tenant touched by the change, with the number of its
+// affected objects per type and their impact after the multiplier chain.
+type TenantSummary struct {
+	Name    string         `json:"name"`
+	Objects map[string]int `json:"objects"`
+	Impact  float64        `json:"impact"`
+}
+
+// tenantTotal is one tenant's share of the score before the multiplier
+// chain.
+type tenantTotal struct {
+	name    string
+	objects map[string]int
+	impact  float64
+}
+
+// tenantTotals groups the scored devices, circuits and implicit devices of
+// b by tenant, highest impact first; objects without a tenant are grouped
+// under "untenanted". siteTenants maps the site IDs of implicit device
+// endpoints to their tenant name. breakdown.tenants and affected_tenants
+// are both views of it.
+// siteNames lists the sites of the devices b scores, sorted.
+func siteNames(b ImpactBreakdown) []string {
+	var sites []string
+	addDevices := func(items []DeviceImpactDetail) {
+		for _, d := range items {
+			if d.Site != "" {
+				sites = append(sites, d.Site)
+			}
+		}
+	}
+	addDevices(b.Devices.Items)
+	addDevices(b.SiteExpandedDevices.Items)
+	if b.BlastRadius != nil {
+		addDevices(b.BlastRadius.Items)
+	}
+	for _, f := range b.PowerFeeds {
+		addDevices(f.devices)
+	}
+	slices.Sort(sites)
+	return slices.Compact(sites)
+}
+
+func tenantTotals(b ImpactBreakdown, siteTenants map[int]string) []tenantTotal {
+	byName := make(map[string]*tenantTotal)
+	add := func(tenant, objectType string, impact float64) {
+		tenant = cmp.Or(tenant, untenanted)
+		if byName[tenant] == nil {
+			byName[tenant] = &tenantTotal{name: tenant, objects: make(map[string]int)}
+		}
+		byName[tenant].objects[objectType]++
+		byName[tenant].impact += impact
+	}
+	addDevices := func(items []DeviceImpactDetail) {
+		for _, d := range items {
+			add(d.Tenant, "device", d.Impact)
+		}
+	}
+	addDevices(b.Devices.Items)
+	addDevices(b.SiteExpandedDevices.Items)
+	if b.BlastRadius != nil {
+		addDevices(b.BlastRadius.Items)
+	}
+	for _, f := range b.PowerFeeds {
+		addDevices(f.devices)
+	}
+	for _, c := range b.Circuits.Items {
+		add(c.Tenant, "circuit", c.Impact)
+	}
+	for _, d := range b.ImplicitDevices.Items {
+		add(siteTenants[d.siteID], "implicit_device", d.Impact)
+	}
+	tenants := make([]tenantTotal, 0, len(byName))
+	for _, t := range byName {
+		tenants = append(tenants, *t)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].impact != tenants[j].impact {
+			return tenants[i].impact > tenants[j].impact
+		}
+		return tenants[i].name < tenants[j].name
+	})
+	return tenants
+}
+
+// tenantImpacts is the breakdown.tenants view of totals: impact after the
+// multiplier chain factor and share of the total before it.
+func tenantImpacts(totals []tenantTotal, factor, totalBeforeMultiplier float64) []TenantImpact {
+	tenants := make([]TenantImpact, 0, len(totals))
+	for _, t := range totals {
+		tenant := TenantImpact{Name: t.name, Impact: t.impact * factor}
+		for _, n := range t.objects {
+			tenant.Objects += n
+		}
+		if totalBeforeMultiplier > 0 {
+			tenant.Share = t.impact / totalBeforeMultiplier
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// tenantSummaries is the affected_tenants view of totals.
+func tenantSummaries(totals []tenantTotal, factor float64) []TenantSummary {
+	tenants := make([]TenantSummary, 0, len(totals))
+	for _, t := range totals {
+		tenants = append(tenants, TenantSummary{Name: t.name, Objects: t.objects, Impact: t.impact * factor})
+	}
+	return tenants
+}
+
+type RackImpactDetail struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	DeviceCount int    `json:"device_count"`
+}
+
+type CircuitImpactDetail struct {
+	ID               int     `json:"id"`
+	CID              string  `json:"cid"`
+	RedundancyFactor float64 `json:"redundancy_factor"`
+	// RedundantVia is the CID of an unaffected parallel circuit.
+	RedundantVia      string  `json:"redundant_via,omitempty"`
+	Criticality       string  `json:"criticality,omitempty"`
+	CriticalityFactor float64 `json:"criticality_factor"`
+	Status            string  `json:"status,omitempty"`
+	StatusFactor      float64 `json:"status_factor"`
+	CommitRateKbps    *int    `json:"commit_rate_kbps,omitempty"`
+	BandwidthFactor   float64 `json:"bandwidth_factor"`
+	Provider          string  `json:"provider,omitempty"`
+	ProviderFactor    float64 `json:"provider_factor"`
+	Tenant            string  `json:"tenant,omitempty"`
+	Tier              string  `json:"tier,omitempty"`
+	TierFactor        float64 `json:"tier_factor"`
+	Weight            float64 `json:"weight"`
+	Impact            float64 `json:"impact"`
+	// UncappedImpact and Cap are set when a point cap held Impact down;
+	// ShareFactor when a class share cap scaled it.
+	UncappedImpact float64 `json:"uncapped_impact,omitempty"`
+	Cap            float64 `json:"cap,omitempty"`
+	ShareFactor    float64 `json:"share_factor,omitempty"`
+	Cable          string  `json:"cable,omitempty"`
+	// Enrichments are the factors and notes enrichers applied.
+	Enrichments []Enrichment `json:"enrichments,omitempty"`
+	// Reason is "explicit", "composite NAME" or the cable that brought the
+	// circuit in; OtherReasons the other paths that reached it.
+	Reason       string   `json:"reason"`
+	OtherReasons []string `json:"other_reasons,omitempty"`
+	Unavailable  bool     `json:"unavailable,omitempty"`
+}
+
+type CableImpactDetail struct {
+	ID           int    `json:"id"`
+	Label        string `json:"label"`
+	Kind         string `json:"kind"`
+	InterfaceIDs []int  `json:"interface_ids,omitempty"`
+	CircuitIDs   []int  `json:"circuit_ids,omitempty"`
+	// NotScored says why a console or power cable adds nothing to the
+	// impact.
+	NotScored string `json:"not_scored,omitempty"`
+}
+
+type CircuitImpact struct {
+	Items       []CircuitImpactDetail `json:"items"`
+	Providers   []ProviderImpact      `json:"providers,omitempty"`
+	TotalImpact float64               `json:"total_impact"`
+}
+
+type ProviderImpact struct {
+	Provider string  `json:"provider"`
+	Count    int     `json:"count"`
+	Impact   float64 `json:"impact"`
+}
+
+// Provider reported for circuits without one in NetBox.
+const noProvider = "none"
+
+func newCircuitImpact(items []CircuitImpactDetail) CircuitImpact {
+	impact := CircuitImpact{Items: items}
+	index := make(map[string]int)
+	for _, c := range items {
+		provider := c.Provider
+		if provider == "" {
+			provider = noProvider
+		}
+		i, ok := index[provider]
+		if !ok {
+			i = len(impact.Providers)
+			index[provider] = i
+			impact.Providers = append(impact.Providers, ProviderImpact{Provider: provider})
+		}
+		impact.Providers[i].Count++
+		impact.Providers[i].Impact += c.Impact
+		impact.TotalImpact += c.Impact
+	}
+	return impact
+}
+
+type InterfaceImpact struct {
+	Count              int                     `json:"count"`
+	CableDerived       int                     `json:"cable_derived,omitempty"`
+	WeightPerInterface float64                 `json:"weight_per_interface"`
+	Impact             float64                 `json:"impact"`
+	Items              []InterfaceImpactDetail `json:"items"`
+}
+
+type InterfaceImpactDetail struct {
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	Device          string  `json:"device,omitempty"`
+	Type            string  `json:"type,omitempty"`
+	SpeedKbps       *int    `json:"speed_kbps,omitempty"`
+	Enabled         bool    `json:"enabled"`
+	Connected       bool    `json:"connected"`
+	SpeedFactor     float64 `json:"speed_factor"`
+	DisabledFactor  float64 `json:"disabled_factor"`
+	ConnectedFactor float64 `json:"connected_factor"`
+	Weight          float64 `json:"weight"`
+	Impact          float64 `json:"impact"`
+	// UncappedImpact and Cap are set when a point cap held Impact down;
+	// ShareFactor when a class share cap scaled it.
+	UncappedImpact float64 `json:"uncapped_impact,omitempty"`
+	Cap            float64 `json:"cap,omitempty"`
+	ShareFactor    float64 `json:"share_factor,omitempty"`
+	// Enrichments are the factors and notes enrichers applied.
+	Enrichments []Enrichment `json:"enrichments,omitempty"`
+	// Reason is "explicit", "composite NAME" or the cable that brought the
+	// interface in; OtherReasons the other paths that reached it.
+	Reason       string   `json:"reason"`
+	OtherReasons []string `json:"other_reasons,omitempty"`
+	Unavailable  bool     `json:"unavailable,omitempty"`
+}
+
+// scoreInterface weighs i by its speed, admin state and whether it has a
+// connected peer.
+func (w WeightConfig) scoreInterface(i netbox.Interface) InterfaceImpactDetail {
+	detail := InterfaceImpactDetail{
+		ID:              i.ID,
+		Name:            i.Name,
+		Device:          i.DeviceName(),
+		SpeedKbps:       i.Speed,
+		Enabled:         i.IsEnabled(),
+		Connected:       len(i.ConnectedEndpoints) > 0,
+		SpeedFactor:     w.InterfaceSpeedFactorOf(i.Speed),
+		DisabledFactor:  1,
+		ConnectedFactor: 1,
+		Weight:          w.Interface,
+	}
+	if i.Type != nil {
+		detail.Type = i.Type.Value
+	}
+	if !detail.Enabled {
+		detail.DisabledFactor = w.DisabledInterfaceFactor
+	}
+	if detail.Connected {
+		detail.ConnectedFactor = w.ConnectedInterfaceFactor
+	}
+	detail.Impact, detail.UncappedImpact, detail.Cap = capImpact(detail.Weight*detail.SpeedFactor*detail.DisabledFactor*detail.ConnectedFactor, w.Caps.Interface)
+	return detail
+}
+
+type CompositeRollup struct {
+	Name            string `json:"name"`
+	Requested       bool   `json:"requested"`
+	Status          string `json:"status"`
+	Members         int    `json:"members"`
+	AffectedMembers int    `json:"affected_members"`
+	Notes           string `json:"notes,omitempty"`
+}
+
+// ImplicitDeviceImpact scores the equipment at circuit termination
+// endpoints, each endpoint once however many affected circuits land on it.
+type ImplicitDeviceImpact struct {
+	Count           int                    `json:"count"`
+	WeightPerDevice float64                `json:"weight_per_device"`
+	Impact          float64                `json:"impact"`
+	Items           []ImplicitDeviceDetail `json:"items,omitempty"`
+}
+
+type ImplicitDeviceDetail struct {
+	// Endpoint is the termination's site or provider network, e.g. "site:12".
+	Endpoint string `json:"endpoint"`
+	Name     string `json:"name,omitempty"`
+	// Circuits lists the CIDs of the affected circuits terminating here.
+	Circuits []string `json:"circuits"`
+	Impact   float64  `json:"impact"`
+
+	// siteID is the endpoint's site, 0 for a provider network.
+	siteID int
+}
+
+type ImpactBreakdown struct {
+	Devices             DeviceImpact            `json:"devices"`
+	SiteExpandedDevices DeviceImpact            `json:"site_expanded_devices"`
+	BlastRadius         *DeviceImpact           `json:"blast_radius,omitempty"`
+	VirtualMachines     *VirtualMachineImpact   `json:"virtual_machines,omitempty"`
+	PowerFeeds          []PowerFeedImpactDetail `json:"power_feeds,omitempty"`
+	Racks               []RackImpactDetail      `json:"racks,omitempty"`
+	Tenants             []TenantImpact          `json:"tenants,omitempty"`
+	Tiers               []TierImpact            `json:"tiers,omitempty"`
+	ImplicitDevices     ImplicitDeviceImpact    `json:"implicit_devices"`
+	Circuits            CircuitImpact           `json:"circuits"`
+	Interfaces          InterfaceImpact         `json:"interfaces"`
+	Cables              []CableImpactDetail     `json:"cables,omitempty"`
+	Composites          []CompositeRollup       `json:"composites,omitempty"`
+	ShareCaps           []ShareCap              `json:"share_caps,omitempty"`
+}
+
+// ShareCap is a class share cap that bit: the class was scaled from
+// UncappedImpact down to Impact, Share of the total before multiplier.
+type ShareCap struct {
+	Class          string  `json:"class"`
+	Share          float64 `json:"share"`
+	UncappedImpact float64 `json:"uncapped_impact"`
+	Impact         float64 `json:"impact"`
+}
+
+// sections returns the impact of each part of b, keyed as in milli-point
+// breakdowns.
+func (b ImpactBreakdown) sections() map[string]float64 {
+	sections := map[string]float64{
+		"devices":               b.Devices.Impact,
+		"site_expanded_devices": b.SiteExpandedDevices.Impact,
+		"power_feeds":           0,
+		"blast_radius":          0,
+		"virtual_machines":      0,
+		"implicit_devices":      b.ImplicitDevices.Impact,
+		"circuits":              b.Circuits.TotalImpact,
+		"interfaces":            b.Interfaces.Impact,
+	}
+	for _, f := range b.PowerFeeds {
+		sections["power_feeds"] += f.Impact
+	}
+	if b.BlastRadius != nil {
+		sections["blast_radius"] = b.BlastRadius.Impact
+	}
+	if b.VirtualMachines != nil {
+		sections["virtual_machines"] = b.VirtualMachines.Impact
+	}
+	return sections
+}
+
+// classImpact sums the sections making up a share cap class.
+func classImpact(sections map[string]float64, class string) float64 {
+	if class == "devices" {
+		return sections["devices"] + sections["site_expanded_devices"] + sections["power_feeds"] + sections["blast_radius"]
+	}
+	return sections[class]
+}
+
+// applyShareCaps scales the items of each class in shares down until the
+// class makes up at most its share of the total, in shareCapClasses order.
+// A class that is the only one scoring anything is left alone: there is
+// nothing to hold it against. Items are scaled in place, so slices shared
+// with b see the new impacts.
+func (b *ImpactBreakdown) applyShareCaps(shares map[string]float64) []ShareCap {
+	var applied []ShareCap
+	for _, class := range shareCapClasses {
+		share, ok := shares[class]
+		if !ok || share >= 1 {
+			continue
+		}
+		sections := b.sections()
+		total := 0.0
+		for _, v := range sections {
+			total += v
+		}
+		impact := classImpact(sections, class)
+		if total-impact == 0 {
+			continue
+		}
+		limit := share / (1 - share) * (total - impact)
+		if impact <= limit {
+			continue
+		}
+		b.scaleClass(class, limit/impact)
+		applied = append(applied, ShareCap{Class: class, Share: share, UncappedImpact: impact, Impact: limit})
+	}
+	return applied
+}
+
+func (b *ImpactBreakdown) scaleClass(class string, factor float64) {
+	scale := func(impact, uncapped, shareFactor *float64) {
+		if *uncapped == 0 {
+			*uncapped = *impact
+		}
+		*shareFactor = factor
+		*impact *= factor
+	}
+	scaleDevices := func(items []DeviceImpactDetail) {
+		for i := range items {
+			scale(&items[i].Impact, &items[i].UncappedImpact, &items[i].ShareFactor)
+		}
+	}
+	switch class {
+	case "devices":
+		for _, section := range []*DeviceImpact{&b.Devices, &b.SiteExpandedDevices, b.BlastRadius} {
+			if section != nil {
+				scaleDevices(section.Items)
+				*section = newDeviceImpact(section.Items, section.WeightPerDevice)
+			}
+		}
+		for i := range b.PowerFeeds {
+			f := &b.PowerFeeds[i]
+			scaleDevices(f.devices)
+			f.sumDevices()
+		}
+	case "circuits":
+		for i := range b.Circuits.Items {
+			c := &b.Circuits.Items[i]
+			scale(&c.Impact, &c.UncappedImpact, &c.ShareFactor)
+		}
+		b.Circuits = newCircuitImpact(b.Circuits.Items)
+	case "interfaces":
+		b.Interfaces.Impact = 0
+		for i := range b.Interfaces.Items {
+			iface := &b.Interfaces.Items[i]
+			scale(&iface.Impact, &iface.UncappedImpact, &iface.ShareFactor)
+			b.Interfaces.Impact += iface.Impact
+		}
+	}
+}
+
+type ImpactResult struct {
+	// ImpactType is the request's impact type and ImpactTypeLabel its
+	// display name in the -lang language.
+	ImpactType                  ImpactType `json:"impact_type"`
+	ImpactTypeLabel             string     `json:"impact_type_label"`
+	TotalImpact                 float64    `json:"total_impact"`
+	TotalImpactBeforeMultiplier float64    `json:"total_impact_before_multiplier"`
+	Multiplier                  float64    `json:"multiplier"`
+	// TimeMultiplier is the time band multiplier, set when the request has
+	// a start_time.
+	TimeMultiplier float64 `json:"time_multiplier,omitempty"`
+	TimeBand       string  `json:"time_band,omitempty"`
+	// DurationFactor scales the total by the window length, set when the
+	// request gives one.
+	DurationMinutes float64 `json:"duration_minutes,omitempty"`
+	DurationFactor  float64 `json:"duration_factor,omitempty"`
+	// FreezeWindow names the calendar entry (holiday or change freeze) the
+	// window overlaps, whose multiplier CalendarMultiplier was applied.
+	FreezeWindow       string  `json:"freeze_window,omitempty"`
+	CalendarMultiplier float64 `json:"calendar_multiplier,omitempty"`
+	// Exclusions lists the objects the request's exclude rules kept out.
+	Exclusions []Exclusion `json:"exclusions,omitempty"`
+	// Window is set when the request has a start_time.
+	Window *MaintenanceWindow `json:"window,omitempty"`
+	// NormalizedScore is TotalImpact on a 0-100 scale, comparable across
+	// requests of different sizes.
+	NormalizedScore float64         `json:"normalized_score"`
+	Breakdown       ImpactBreakdown `json:"breakdown"`
+	Warnings        []DataWarning   `json:"warnings,omitempty"`
+	// Partial is set when objects NetBox failed to return were scored
+	// without their details, a lookup the score depends on failed
+	// (allow_partial) or the call budget ran out; the warnings say which.
+	Partial bool `json:"partial"`
+	// OverridesApplied echoes the request's overrides block; the score did
+	// not use the standard weights when it is set.
+	OverridesApplied *WeightOverrides `json:"overrides_applied,omitempty"`
+	TopContributors  []Contributor    `json:"top_contributors,omitempty"`
+	// AffectedTenants is set when the request asks for
+	// include_affected_tenants.
+	AffectedTenants []TenantSummary `json:"affected_tenants,omitempty"`
+	Explanation     []string        `json:"explanation,omitempty"`
+	Metadata        ResultMetadata  `json:"metadata"`
+
+	mpts    milliPointTotals
+	tenants []string
+	sites   []string
+}
+
+// Sites names the sites of the devices r scores, for aggregate
+// statistics. Like Tenants it is not encoded.
+func (r ImpactResult) Sites() []string {
+	return r.sites
+}
+
+// Tenants names the tenants of the objects r scores, for indexing; the
+// devices implied by circuit endpoints count only when the request asked
+// for tenants. It is not encoded, so a result read back has none.
+func (r ImpactResult) Tenants() []string {
+	return r.tenants
+}
+
+const DefaultTopContributors = 10
+
+// Contributor is one breakdown item; Impact is before the impact type
+// multiplier, as in the breakdown.
+type Contributor struct {
+	Type   string  `json:"type"`
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Impact float64 `json:"impact"`
+	// Reason is the path the object was scored through.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ExplainNumber rounds v to two decimals for display.
+func ExplainNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+type explainFactor struct {
+	name  string
+	value float64
+}
+
+// explainFactors renders "weight 3 × redundancy 0.8", leaving out factors
+// of 1.
+func explainFactors(weight float64, factors ...explainFactor) string {
+	parts := []string{"weight " + ExplainNumber(weight)}
+	for _, f := range factors {
+		if f.value != 1 {
+			parts = append(parts, f.name+" "+ExplainNumber(f.value))
+		}
+	}
+	return strings.Join(parts, " × ")
+}
+
+// explainCaps describes the caps that held an item's impact down, or "".
+func explainCaps(uncapped, limit, shareFactor float64) string {
+	var notes []string
+	if limit > 0 {
+		notes = append(notes, "capped at "+ExplainNumber(limit))
+	}
+	if shareFactor > 0 {
+		notes = append(notes, "scaled ×"+ExplainNumber(shareFactor)+" by the class share cap")
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %s (uncapped %s)", strings.Join(notes, ", then "), ExplainNumber(uncapped))
+}
+
+// explainReasons notes an object that several paths reached and the one it
+// was scored through.
+func explainReasons(kind, name, reason string, others []string) []string {
+	if len(others) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s %s counted once, via %s (also reached via %s)", kind, name, reason, strings.Join(others, ", "))}
+}
+
+func explainDeviceReasons(items []DeviceImpactDetail) []string {
+	var lines []string
+	for _, d := range items {
+		lines = append(lines, explainReasons("device", cmp.Or(d.Name, strconv.Itoa(d.ID)), d.Reason, d.OtherReasons)...)
+	}
+	return lines
+}
+
+func explainDevices(label string, section DeviceImpact) []string {
+	if len(section.Items) == 0 {
+		return nil
+	}
+	uniform := true
+	for _, d := range section.Items {
+		if d.Impact != section.Items[0].Impact || d.Impact != d.Weight || d.HintNote != "" || len(d.OOBVia) > 0 || len(d.Enrichments) > 0 {
+			uniform = false
+		}
+	}
+	if uniform {
+		line := fmt.Sprintf("%d %s × %s = %s", len(section.Items), label, ExplainNumber(section.Items[0].Weight), ExplainNumber(section.Impact))
+		return append([]string{line}, explainDeviceReasons(section.Items)...)
+	}
+	lines := []string{fmt.Sprintf("%d %s scored %s:", len(section.Items), label, ExplainNumber(section.Impact))}
+	for _, d := range section.Items {
+		enrichers, enricherNotes := explainEnrichments(d.Enrichments)
+		factors := append([]explainFactor{{"criticality", d.CriticalityFactor}, {"status", d.StatusFactor}, {"tier", d.TierFactor},
+			{"config context hint", cmp.Or(d.HintFactor, 1)}, {"no recovery path", cmp.Or(d.NoRecoveryPathFactor, 1)}}, enrichers...)
+		line := fmt.Sprintf("device %s scored %s (%s)%s", cmp.Or(d.Name, strconv.Itoa(d.ID)), ExplainNumber(d.Impact),
+			explainFactors(d.Weight, factors...), explainCaps(d.UncappedImpact, d.Cap, d.ShareFactor))
+		if d.HintNote != "" {
+			line += ": " + d.HintNote
+		}
+		if len(d.OOBVia) > 0 {
+			line += fmt.Sprintf("; no recovery path, its console server %s is affected too", strings.Join(d.OOBVia, ", "))
+		}
+		line += enricherNotes
+		lines = append(lines, line)
+	}
+	return append(lines, explainDeviceReasons(section.Items)...)
+}
+
+// explainResult describes how r was scored, using only the numbers already
+// in r so the two cannot disagree.
+func explainResult(r ImpactResult, impactType ImpactType) []string {
+	b := r.Breakdown
+	var lines []string
+	lines = append(lines, explainDevices("devices", b.Devices)...)
+	lines = append(lines, explainDevices("site devices", b.SiteExpandedDevices)...)
+	for _, f := range b.PowerFeeds {
+		lines = append(lines, fmt.Sprintf("power feed %s: %d devices scored %s (redundancy %s)", f.Name, f.DeviceCount, ExplainNumber(f.Impact), ExplainNumber(f.RedundancyFactor)))
+		lines = append(lines, explainDeviceReasons(f.devices)...)
+	}
+	if b.BlastRadius != nil {
+		lines = append(lines, explainDevices("blast radius devices", *b.BlastRadius)...)
+	}
+	if vms := b.VirtualMachines; vms != nil && vms.Count > 0 {
+		lines = append(lines, fmt.Sprintf("%d virtual machines × %s = %s", vms.Count, ExplainNumber(vms.WeightPerVM), ExplainNumber(vms.Impact)))
+	}
+	if implicit := b.ImplicitDevices; implicit.Count > 0 {
+		lines = append(lines, fmt.Sprintf("%d implicit devices at circuit endpoints × %s = %s", implicit.Count, ExplainNumber(implicit.WeightPerDevice), ExplainNumber(implicit.Impact)))
+	}
+	for _, c := range b.Circuits.Items {
+		enrichers, enricherNotes := explainEnrichments(c.Enrichments)
+		factors := append([]explainFactor{{"redundancy", c.RedundancyFactor}, {"criticality", c.CriticalityFactor},
+			{"status", c.StatusFactor}, {"bandwidth", c.BandwidthFactor}, {"provider", c.ProviderFactor}, {"tier", c.TierFactor}}, enrichers...)
+		line := fmt.Sprintf("circuit %s scored %s (%s)", cmp.Or(c.CID, strconv.Itoa(c.ID)), ExplainNumber(c.Impact), explainFactors(c.Weight, factors...))
+		if c.RedundantVia != "" {
+			line += ", parallel to " + c.RedundantVia
+		}
+		lines = append(lines, line+explainCaps(c.UncappedImpact, c.Cap, c.ShareFactor)+enricherNotes)
+		lines = append(lines, explainReasons("circuit", cmp.Or(c.CID, strconv.Itoa(c.ID)), c.Reason, c.OtherReasons)...)
+	}
+	if ifaces := b.Interfaces; ifaces.Count > 0 {
+		uniform := true
+		for _, i := range ifaces.Items {
+			if i.Impact != i.Weight || len(i.Enrichments) > 0 {
+				uniform = false
+			}
+		}
+		if uniform {
+			lines = append(lines, fmt.Sprintf("%d interfaces × %s = %s", ifaces.Count, ExplainNumber(ifaces.WeightPerInterface), ExplainNumber(ifaces.Impact)))
+		} else {
+			for _, i := range ifaces.Items {
+				enrichers, enricherNotes := explainEnrichments(i.Enrichments)
+				factors := append([]explainFactor{{"speed", i.SpeedFactor}, {"disabled", i.DisabledFactor}, {"connected", i.ConnectedFactor}}, enrichers...)
+				lines = append(lines, fmt.Sprintf("interface %s scored %s (%s)%s%s", cmp.Or(i.Name, strconv.Itoa(i.ID)), ExplainNumber(i.Impact),
+					explainFactors(i.Weight, factors...), explainCaps(i.UncappedImpact, i.Cap, i.ShareFactor), enricherNotes))
+			}
+		}
+		for _, i := range ifaces.Items {
+			lines = append(lines, explainReasons("interface", cmp.Or(i.Name, strconv.Itoa(i.ID)), i.Reason, i.OtherReasons)...)
+		}
+	}
+	for _, c := range b.ShareCaps {
+		lines = append(lines, fmt.Sprintf("%s held to %s%% of the total: %s instead of %s", c.Class, ExplainNumber(c.Share*100), ExplainNumber(c.Impact), ExplainNumber(c.UncappedImpact)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("sum before multiplier: %s", ExplainNumber(r.TotalImpactBeforeMultiplier)),
+		fmt.Sprintf("%s multiplier ×%s applied", impactType, ExplainNumber(r.Multiplier)),
+	)
+	if r.TimeMultiplier != 0 || r.TimeBand != "" {
+		lines = append(lines, fmt.Sprintf("time window multiplier ×%s applied (%s)", ExplainNumber(r.TimeMultiplier), cmp.Or(r.TimeBand, "no band")))
+	}
+	if r.FreezeWindow != "" {
+		lines = append(lines, fmt.Sprintf("%s multiplier ×%s applied", r.FreezeWindow, ExplainNumber(r.CalendarMultiplier)))
+	}
+	if r.DurationMinutes > 0 {
+		lines = append(lines, fmt.Sprintf("duration factor ×%s applied for %s minutes", ExplainNumber(r.DurationFactor), ExplainNumber(r.DurationMinutes)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("total impact %s (normalized score %s)", ExplainNumber(r.TotalImpact), ExplainNumber(r.NormalizedScore)),
+	)
+	return lines
+}
+
+// topContributors returns the n items of b with the highest impact, ties
+// ordered by type and ID.
+func topContributors(b ImpactBreakdown, n int) []Contributor {
+	all := contributors(b)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Impact != all[j].Impact {
+			return all[i].Impact > all[j].Impact
+		}
+		if all[i].Type != all[j].Type {
+			return all[i].Type < all[j].Type
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all[:min(n, len(all))]
+}
+
+// contributors lists every scored device, virtual machine, circuit and
+// interface in b.
+func contributors(b ImpactBreakdown) []Contributor {
+	var all []Contributor
+	addDevices := func(items []DeviceImpactDetail) {
+		for _, d := range items {
+			all = append(all, Contributor{Type: "device", ID: d.ID, Name: d.Name, Impact: d.Impact, Reason: d.Reason})
+		}
+	}
+	addDevices(b.Devices.Items)
+	addDevices(b.SiteExpandedDevices.Items)
+	if b.BlastRadius != nil {
+		addDevices(b.BlastRadius.Items)
+	}
+	for _, f := range b.PowerFeeds {
+		addDevices(f.devices)
+	}
+	if b.VirtualMachines != nil {
+		for _, vm := range b.VirtualMachines.Items {
+			all = append(all, Contributor{Type: "virtual_machine", ID: vm.ID, Name: vm.Name, Impact: vm.Impact})
+		}
+	}
+	for _, c := range b.Circuits.Items {
+		all = append(all, Contributor{Type: "circuit", ID: c.ID, Name: c.CID, Impact: c.Impact, Reason: c.Reason})
+	}
+	for _, i := range b.Interfaces.Items {
+		all = append(all, Contributor{Type: "interface", ID: i.ID, Name: i.Name, Impact: i.Impact, Reason: i.Reason})
+	}
+	return all
+}
+
+// ToMilliPoints converts an impact value to integer milli-points, rounding
+// half away from zero: 187.5 -> 187500, 2.4000000000000004 -> 2400.
+func ToMilliPoints(v float64) int64 {
+	return int64(math.Round(v * 1000))
+}
+
+// milliPointTotals is the fixed-point accumulator a calculation sums in.
+// Each breakdown section is converted to milli-points once, the
+// before-multiplier total is their exact sum and the total is rounded once
+// after the whole multiplier chain. The float totals are derived from it.
+type milliPointTotals struct {
+	sections         map[string]int64
+	beforeMultiplier int64
+	total            int64
+}
+
+func newMilliPointTotals(sections map[string]float64, factor float64) milliPointTotals {
+	m := milliPointTotals{sections: make(map[string]int64, len(sections))}
+	for name, impact := range sections {
+		m.sections[name] = ToMilliPoints(impact)
+		m.beforeMultiplier += m.sections[name]
+	}
+	m.total = int64(math.Round(float64(m.beforeMultiplier) * factor))
+	return m
+}
+
+// MilliPointResult is the ?units=millipoints form of a result: the float
+// result plus its totals and breakdown sections in integer milli-points.
+// The sections add up to total_impact_before_multiplier_mpts exactly.
+type MilliPointResult struct {
+	ImpactResult
+	TotalImpactMpts                 int64            `json:"total_impact_mpts"`
+	TotalImpactBeforeMultiplierMpts int64            `json:"total_impact_before_multiplier_mpts"`
+	BreakdownMpts                   map[string]int64 `json:"breakdown_mpts"`
+}
+
+func (r ImpactResult) MilliPoints() MilliPointResult {
+	return MilliPointResult{
+		ImpactResult:                    r,
+		TotalImpactMpts:                 r.mpts.total,
+		TotalImpactBeforeMultiplierMpts: r.mpts.beforeMultiplier,
+		BreakdownMpts:                   r.mpts.sections,
+	}
+}
+
+type ResultMetadata struct {
+	TimingsMs map[string]float64 `json:"timings_ms"`
+	Strict    bool               `json:"strict"`
+	// Guards lists what each strict-mode guard did; the HTTP handlers add
+	// strict_json.
+	Guards []GuardReport `json:"guards,omitempty"`
+	// Weights is the weight set the score was computed with.
+	Weights WeightConfig `json:"weights"`
+	// NetboxCalls counts the requests sent to NetBox; cache hits and
+	// offline data cost none.
+	NetboxCalls int64 `json:"netbox_calls"`
+	// Policy names the impact type whose request policy applied, and
+	// PolicyDefaults the settings it filled in.
+	Policy         ImpactType `json:"policy,omitempty"`
+	PolicyDefaults []string   `json:"policy_defaults,omitempty"`
+	// HistoryID is the history record the server saved the result as.
+	HistoryID int64 `json:"history_id,omitempty"`
+	// Features are the features (-features) that were on.
+	Features []string `json:"features,omitempty"`
+}
@@ -0,0 +1,1107 @@
+package impact
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+type ImpactType string
+
+// Weight points voor het impact_type
+const (
+	PlannedWork    ImpactType = "planned-work"
+	FiberWorks     ImpactType = "fiber-works"
+	ElectricalWork ImpactType = "electrical-work"
+	IncidentWork   ImpactType = "incident-work"
+)
+
+// WeightConfig holds every weight the impact score is built from.
+// DefaultWeightConfig has the built-in values; -weights-file overrides them.
+type WeightConfig struct {
+	// Name identifies the weight set in results.
+	Name           string  `json:"name"`
+	Device         float64 `json:"device"`
+	Circuit        float64 `json:"circuit"`
+	Interface      float64 `json:"interface"`
+	VirtualMachine float64 `json:"virtual_machine"`
+	// BlastRadiusFactor scales the device weight for devices found by the
+	// cable walk.
+	BlastRadiusFactor float64 `json:"blast_radius_factor"`
+	// ImplicitDeviceFactor scales the device weight for the equipment at
+	// each termination endpoint of an affected circuit.
+	ImplicitDeviceFactor float64 `json:"implicit_device_factor"`
+	// CircuitRedundancyFactor applies to circuits whose two ends land on the
+	// same site or provider network.
+	CircuitRedundancyFactor float64 `json:"circuit_redundancy_factor"`
+	// ParallelCircuitFactor applies to circuits with an unaffected active
+	// circuit between the same two endpoints.
+	ParallelCircuitFactor float64 `json:"parallel_circuit_factor"`
+	// PowerFeedRedundancyFactor applies to racks that keep another active
+	// power feed.
+	PowerFeedRedundancyFactor float64                `json:"power_feed_redundancy_factor"`
+	ImpactTypes               map[ImpactType]float64 `json:"impact_types"`
+	// Roles maps a device role slug to its weight; devices with other or
+	// no roles weigh Device.
+	Roles map[string]float64 `json:"roles"`
+	// CriticalityField names the device and circuit custom field whose
+	// value selects a multiplier from Criticality; absent or unknown values
+	// multiply by 1.
+	CriticalityField string             `json:"criticality_field"`
+	Criticality      map[string]float64 `json:"criticality"`
+	// StatusFactors scales devices and circuits by their NetBox status
+	// value; statuses not listed count in full.
+	StatusFactors map[string]float64 `json:"status_factors"`
+	// BandwidthFactors scales circuits by commit rate: a circuit takes the
+	// factor of the highest step at or below its rate.
+	BandwidthFactors []BandwidthStep `json:"bandwidth_factors"`
+	// Providers maps a circuit provider slug or name (case-insensitive) to
+	// a multiplier; unlisted providers count 1.
+	Providers map[string]float64 `json:"providers"`
+	// InterfaceSpeedFactors scales interfaces by speed like
+	// BandwidthFactors does circuits. Admin-disabled interfaces are further
+	// multiplied by DisabledInterfaceFactor, ones with a connected peer by
+	// ConnectedInterfaceFactor.
+	InterfaceSpeedFactors    []BandwidthStep `json:"interface_speed_factors"`
+	DisabledInterfaceFactor  float64         `json:"disabled_interface_factor"`
+	ConnectedInterfaceFactor float64         `json:"connected_interface_factor"`
+	// Caps limits what one object or one class of objects may contribute;
+	// all caps are disabled by default.
+	Caps ContributionCaps `json:"caps"`
+	// NormalizationK is the total impact that normalizes to 50; see
+	// NormalizedScore.
+	NormalizationK float64 `json:"normalization_k"`
+	// TimeBands multiply requests with a start_time by the highest band
+	// their window touches, in Timezone. Bands are tried in order; times no
+	// band covers count 1.
+	Timezone  string     `json:"timezone"`
+	TimeBands []TimeBand `json:"time_bands"`
+	// DurationFactors is a curve through (minutes, factor) points, in
+	// ascending order of minutes, interpolated linearly and flat beyond its
+	// ends.
+	DurationFactors []DurationPoint `json:"duration_factors"`
+	// Calendar lists holidays and change freezes; a window overlapping one
+	// is multiplied by the highest such entry's multiplier.
+	Calendar []CalendarEntry `json:"calendar,omitempty"`
+	// Tiers maps a tenant SLA tier to its multiplier. A tenant's tier comes
+	// from TenantTiers (keyed by tenant slug or name) or else from its
+	// TierField custom field in NetBox; an empty TierField skips the lookup.
+	Tiers       map[string]float64 `json:"tiers"`
+	TenantTiers map[string]string  `json:"tenant_tiers"`
+	TierField   string             `json:"tier_field"`
+	// OOBRoles are the device role slugs of out-of-band infrastructure
+	// such as console servers; empty skips the recovery path check. A
+	// device that loses its production path and the console server cabled
+	// to it in the same request is multiplied by NoRecoveryPathFactor.
+	OOBRoles             []string `json:"oob_roles,omitempty"`
+	NoRecoveryPathFactor float64  `json:"no_recovery_path_factor"`
+	// Policies holds per impact type defaults for the request settings a
+	// request leaves unset; see Calculator.ApplyPolicy.
+	Policies map[ImpactType]RequestPolicy `json:"policies,omitempty"`
+}
+
+// ContributionCaps limit the points before the impact type multiplier. A
+// device, circuit or interface scores at most Device, Circuit or Interface
+// points, and a class in Shares ("devices", "circuits" or "interfaces")
+// makes up at most that fraction of the total. Zero disables a point cap.
+type ContributionCaps struct {
+	Device    float64            `json:"device,omitempty"`
+	Circuit   float64            `json:"circuit,omitempty"`
+	Interface float64            `json:"interface,omitempty"`
+	Shares    map[string]float64 `json:"shares,omitempty"`
+}
+
+// Classes a share cap can apply to, in the order the caps are applied.
+var shareCapClasses = []string{"devices", "circuits", "interfaces"}
+
+// capImpact holds impact to limit. When the cap bites it also returns the
+// uncapped impact and the cap; otherwise both are 0.
+func capImpact(impact, limit float64) (capped, uncapped, applied float64) {
+	if limit > 0 && impact > limit {
+		return limit, impact, limit
+	}
+	return impact, 0, 0
+}
+
+// TierOf returns the SLA tier TenantTiers gives tenant and its multiplier,
+// or "" and 1 for objects without a tenant or tier.
+func (w WeightConfig) TierOf(tenant *netbox.Node) (string, float64) {
+	if tenant == nil {
+		return "", 1.0
+	}
+	tier, ok := w.TenantTiers[tenant.Slug]
+	if !ok {
+		tier = w.TenantTiers[tenant.Name]
+	}
+	return w.tierFactor(tier)
+}
+
+func (w WeightConfig) tierFactor(tier string) (string, float64) {
+	tier = strings.ToLower(tier)
+	if factor, ok := w.Tiers[tier]; ok {
+		return tier, factor
+	}
+	return tier, 1.0
+}
+
+// tenantTiers is the tier lookup of one calculation: TenantTiers first, then
+// the TierField of the NetBox tenants loaded for the objects it scores.
+type tenantTiers struct {
+	weights WeightConfig
+	fields  map[int]string
+}
+
+func newTenantTiers(w WeightConfig) *tenantTiers {
+	return &tenantTiers{weights: w, fields: make(map[int]string)}
+}
+
+// load fetches the tenants TenantTiers does not cover and that are not
+// loaded yet. Nothing is fetched without a TierField.
+func (t *tenantTiers) load(ctx context.Context, client netbox.NetboxAPI, tenants []*netbox.Node) error {
+	if t.weights.TierField == "" {
+		return nil
+	}
+	var ids []int
+	for _, tenant := range tenants {
+		if tenant == nil {
+			continue
+		}
+		if _, seen := t.fields[tenant.ID]; seen {
+			continue
+		}
+		if tier, _ := t.weights.TierOf(tenant); tier == "" {
+			t.fields[tenant.ID] = ""
+			ids = append(ids, tenant.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	found, err := client.FetchTenants(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("failed to fetch tenant tiers: %w", err)
+	}
+	for _, tenant := range found {
+		if tier, ok := tenant.CustomFields[t.weights.TierField].(string); ok {
+			t.fields[tenant.ID] = tier
+		}
+	}
+	return nil
+}
+
+// of returns the SLA tier of tenant and its multiplier, or "" and 1 for
+// objects without a tenant or tier.
+func (t *tenantTiers) of(tenant *netbox.Node) (string, float64) {
+	tier, factor := t.weights.TierOf(tenant)
+	if tier != "" || tenant == nil {
+		return tier, factor
+	}
+	return t.weights.tierFactor(t.fields[tenant.ID])
+}
+
+// LoadTenantTiersFile reads a JSON object mapping tenant slugs or names to
+// SLA tiers.
+func LoadTenantTiersFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tiers map[string]string
+	if err := json.Unmarshal(data, &tiers); err != nil {
+		return nil, netbox.JSONErrorAt(path, data, err)
+	}
+	return tiers, nil
+}
+
+// CalendarEntry spans the whole days Start to End ("2006-01-02", End
+// defaulting to Start) in the weight set's timezone.
+type CalendarEntry struct {
+	Name       string  `json:"name"`
+	Start      string  `json:"start"`
+	End        string  `json:"end,omitempty"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// span returns the entry's first instant and the instant after it.
+func (e CalendarEntry) span(loc *time.Location) (time.Time, time.Time, error) {
+	from, err := time.ParseInLocation(time.DateOnly, e.Start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to := from
+	if e.End != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, e.End, loc); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end %s is before start %s", e.End, e.Start)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// CalendarMultiplier returns the highest multiplier, and its entry's name,
+// among the calendar entries the window from start to end (exclusive; nil
+// for the instant start) overlaps. It returns 0 and "" when none does.
+func (w WeightConfig) CalendarMultiplier(start time.Time, end *time.Time) (float64, string, error) {
+	entries, err := w.calendarOverlaps(start, end)
+	if err != nil {
+		return 0, "", err
+	}
+	multiplier, name := 0.0, ""
+	for _, e := range entries {
+		if name == "" || e.Multiplier > multiplier {
+			multiplier, name = e.Multiplier, e.Name
+		}
+	}
+	return multiplier, name, nil
+}
+
+// calendarOverlaps returns the calendar entries the window overlaps, in
+// calendar order.
+func (w WeightConfig) calendarOverlaps(start time.Time, end *time.Time) ([]CalendarEntry, error) {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	var entries []CalendarEntry
+	for _, e := range w.Calendar {
+		from, to, err := e.span(loc)
+		if err != nil {
+			return nil, fmt.Errorf("calendar entry %q: %w", e.Name, err)
+		}
+		overlaps := !start.Before(from) && start.Before(to)
+		if end != nil {
+			overlaps = start.Before(to) && end.After(from)
+		}
+		if overlaps {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// LoadCalendarFile reads a JSON list of calendar entries.
+func LoadCalendarFile(path string) ([]CalendarEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []CalendarEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, netbox.JSONErrorAt(path, data, err)
+	}
+	return entries, nil
+}
+
+type DurationPoint struct {
+	Minutes float64 `json:"minutes"`
+	Factor  float64 `json:"factor"`
+}
+
+// DurationFactorOf reads the duration curve at minutes.
+func (w WeightConfig) DurationFactorOf(minutes float64) float64 {
+	points := w.DurationFactors
+	if len(points) == 0 {
+		return 1.0
+	}
+	if minutes <= points[0].Minutes {
+		return points[0].Factor
+	}
+	for i := 1; i < len(points); i++ {
+		if minutes <= points[i].Minutes {
+			a, b := points[i-1], points[i]
+			return a.Factor + (b.Factor-a.Factor)*(minutes-a.Minutes)/(b.Minutes-a.Minutes)
+		}
+	}
+	return points[len(points)-1].Factor
+}
+
+// TimeBand covers Start (inclusive) to End (exclusive, "24:00" for
+// midnight) on Days ("mon".."sun", empty for every day). A band whose End is
+// not after Start wraps past midnight.
+type TimeBand struct {
+	Name       string   `json:"name"`
+	Days       []string `json:"days,omitempty"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	Multiplier float64  `json:"multiplier"`
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return h*60 + m, nil
+}
+
+func (b TimeBand) covers(t time.Time) bool {
+	if len(b.Days) > 0 && !slices.Contains(b.Days, weekdayNames[t.Weekday()]) {
+		return false
+	}
+	start, _ := parseClock(b.Start)
+	end, _ := parseClock(b.End)
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// requestDuration returns the window length in minutes (0 when the request
+// gives none) and fills in EndTime from StartTime and DurationMinutes.
+func requestDuration(req *ImpactRequest) (float64, error) {
+	if req.EndTime != nil && req.StartTime == nil {
+		return 0, &netbox.ValidationError{Field: "end_time", Message: "needs a start_time"}
+	}
+	var minutes float64
+	if req.EndTime != nil {
+		minutes = req.EndTime.Sub(*req.StartTime).Minutes()
+		if minutes <= 0 {
+			return 0, &netbox.ValidationError{Field: "end_time", Message: "must be after start_time"}
+		}
+	}
+	if req.DurationMinutes == nil {
+		return minutes, nil
+	}
+	if *req.DurationMinutes <= 0 {
+		return 0, &netbox.ValidationError{Field: "duration_minutes", Message: "must be positive"}
+	}
+	if req.EndTime != nil && math.Abs(*req.DurationMinutes-minutes) >= 1 {
+		return 0, &netbox.ValidationError{
+			Field:   "duration_minutes",
+			Message: fmt.Sprintf("is %g but start_time to end_time is %g minutes", *req.DurationMinutes, minutes),
+		}
+	}
+	if req.StartTime != nil && req.EndTime == nil {
+		end := req.StartTime.Add(time.Duration(*req.DurationMinutes * float64(time.Minute)))
+		req.EndTime = &end
+	}
+	return *req.DurationMinutes, nil
+}
+
+// WindowMultiplier returns the highest multiplier, and its band, among the
+// bands touched between start and end (exclusive). A nil or non-positive end
+// scores start alone.
+func (w WeightConfig) WindowMultiplier(start time.Time, end *time.Time) (float64, string, error) {
+	multiplier, band, _, err := w.windowBands(start, end)
+	return multiplier, band, err
+}
+
+// windowBands walks the window minute by minute in absolute time, so a
+// window across a DST change covers the local times that really occur:
+// the skipped hour not at all and the repeated hour twice. Besides the
+// highest multiplier and its band it returns every band touched, in the
+// order first touched, with "none" for times no band covers.
+func (w WeightConfig) windowBands(start time.Time, end *time.Time) (float64, string, []string, error) {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	last := start
+	if end != nil && end.After(start) {
+		// Every band recurs within a week.
+		last = minTime(end.Add(-time.Minute), start.Add(7*24*time.Hour))
+	}
+	multiplier, band := -1.0, ""
+	var touched []string
+	for t := start.In(loc).Truncate(time.Minute); !t.After(last); t = t.Add(time.Minute) {
+		m, name := 1.0, ""
+		for _, b := range w.TimeBands {
+			if b.covers(t) {
+				m, name = b.Multiplier, b.Name
+				break
+			}
+		}
+		if period := cmp.Or(name, "none"); !slices.Contains(touched, period) {
+			touched = append(touched, period)
+		}
+		if m > multiplier {
+			multiplier, band = m, name
+		}
+	}
+	return multiplier, band, touched, nil
+}
+
+// MaintenanceWindow is a request's window resolved to UTC, with the local
+// times, time bands and calendar entries it covers in the timezone the
+// bands were read in.
+type MaintenanceWindow struct {
+	StartUTC   time.Time  `json:"start_utc"`
+	EndUTC     *time.Time `json:"end_utc,omitempty"`
+	Timezone   string     `json:"timezone"`
+	LocalStart string     `json:"local_start"`
+	LocalEnd   string     `json:"local_end,omitempty"`
+	Periods    []string   `json:"periods"`
+	Calendar   []string   `json:"calendar,omitempty"`
+}
+
+func (w WeightConfig) resolveWindow(start time.Time, end *time.Time) (*MaintenanceWindow, error) {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	window := &MaintenanceWindow{
+		StartUTC:   start.UTC(),
+		Timezone:   w.Timezone,
+		LocalStart: start.In(loc).Format(time.RFC3339),
+	}
+	if end != nil {
+		endUTC := end.UTC()
+		window.EndUTC = &endUTC
+		window.LocalEnd = end.In(loc).Format(time.RFC3339)
+	}
+	if _, _, window.Periods, err = w.windowBands(start, end); err != nil {
+		return nil, err
+	}
+	entries, err := w.calendarOverlaps(start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		window.Calendar = append(window.Calendar, e.Name)
+	}
+	return window, nil
+}
+
+// CheckWindowTimes rejects start_time and end_time values that are not
+// RFC3339 with a UTC offset. It runs before decoding, which would only say
+// the payload is invalid; prefix qualifies the field names.
+func CheckWindowTimes(body []byte, prefix string) error {
+	var times struct {
+		StartTime json.RawMessage `json:"start_time"`
+		EndTime   json.RawMessage `json:"end_time"`
+	}
+	if json.Unmarshal(body, &times) != nil {
+		return nil
+	}
+	for _, t := range []struct {
+		field string
+		raw   json.RawMessage
+	}{{"start_time", times.StartTime}, {"end_time", times.EndTime}} {
+		var value string
+		if len(t.raw) == 0 || string(t.raw) == "null" || json.Unmarshal(t.raw, &value) != nil {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return &netbox.ValidationError{
+				Field:   prefix + t.field,
+				Message: fmt.Sprintf("%q is not an RFC3339 time with a UTC offset (e.g. 2026-03-29T02:30:00+01:00 or 2026-03-29T01:30:00Z)", value),
+			}
+		}
+	}
+	return nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// NormalizedScore maps a total impact onto 0-100 as 100 * t / (t + k): 0
+// stays 0, k gives 50, and the score approaches 100 as the total grows.
+func (w WeightConfig) NormalizedScore(total float64) float64 {
+	switch {
+	case total <= 0:
+		return 0
+	case math.IsInf(total, 1):
+		return 100
+	}
+	// Dividing first keeps huge totals from overflowing to +Inf.
+	return 100 * (total / (total + w.NormalizationK))
+}
+
+// ScoreSeverity bands a normalized score: critical from 75, high from 50,
+// medium from 25 and low below.
+func ScoreSeverity(score float64) Severity {
+	switch {
+	case score >= 75:
+		return SeverityCritical
+	case score >= 50:
+		return SeverityHigh
+	case score >= 25:
+		return SeverityMedium
+	default:
+		return SeverityLow
+	}
+}
+
+// ProviderFactorOf returns the multiplier for provider, matching its slug
+// before its name.
+func (w WeightConfig) ProviderFactorOf(provider *netbox.Node) float64 {
+	if provider == nil {
+		return 1.0
+	}
+	for _, key := range []string{provider.Slug, provider.Name} {
+		for name, factor := range w.Providers {
+			if key != "" && strings.EqualFold(name, key) {
+				return factor
+			}
+		}
+	}
+	return 1.0
+}
+
+type BandwidthStep struct {
+	MinKbps int     `json:"min_kbps"`
+	Factor  float64 `json:"factor"`
+}
+
+// BandwidthFactorOf returns the factor for a commit rate in kbps, 1 when the
+// rate is unknown or below every step.
+func (w WeightConfig) BandwidthFactorOf(commitRate *int) float64 {
+	return stepFactor(w.BandwidthFactors, commitRate)
+}
+
+// InterfaceSpeedFactorOf is BandwidthFactorOf for interface speeds.
+func (w WeightConfig) InterfaceSpeedFactorOf(speed *int) float64 {
+	return stepFactor(w.InterfaceSpeedFactors, speed)
+}
+
+func stepFactor(steps []BandwidthStep, kbps *int) float64 {
+	if kbps == nil || *kbps <= 0 {
+		return 1.0
+	}
+	factor, best := 1.0, -1
+	for _, step := range steps {
+		if step.MinKbps <= *kbps && step.MinKbps > best {
+			factor, best = step.Factor, step.MinKbps
+		}
+	}
+	return factor
+}
+
+// StatusFactorOf returns the factor for status, 1 when it has none.
+func (w WeightConfig) StatusFactorOf(status *netbox.Choice) float64 {
+	if status != nil {
+		if factor, ok := w.StatusFactors[status.Value]; ok {
+			return factor
+		}
+	}
+	return 1.0
+}
+
+// CriticalityOf returns the criticality level set in customFields and its
+// multiplier, or "" and 1 when the field is absent or has an unknown value.
+func (w WeightConfig) CriticalityOf(customFields map[string]interface{}) (string, float64) {
+	level, _ := customFields[w.CriticalityField].(string)
+	level = strings.ToLower(level)
+	if factor, ok := w.Criticality[level]; ok {
+		return level, factor
+	}
+	return "", 1.0
+}
+
+// NetboxFeatures reports the optional NetBox reads the weight set needs:
+// tenants for tier_field, console server ports for oob_roles.
+func (w WeightConfig) NetboxFeatures() netbox.Features {
+	return netbox.Features{Tenants: w.TierField != "", ConsoleServerPorts: len(w.OOBRoles) > 0}
+}
+
+// ImpactTypeNames lists the configured impact types by ascending multiplier.
+func (w WeightConfig) ImpactTypeNames() []string {
+	names := make([]string, 0, len(w.ImpactTypes))
+	for t := range w.ImpactTypes {
+		names = append(names, string(t))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		mi, mj := w.ImpactTypes[ImpactType(names[i])], w.ImpactTypes[ImpactType(names[j])]
+		if mi != mj {
+			return mi < mj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// RequestPolicy defaults the optional behaviour settings of requests of one
+// impact type. Nil fields leave the server default in place.
+type RequestPolicy struct {
+	BlastRadiusDepth *int  `json:"blast_radius_depth,omitempty"`
+	ExpandVMs        *bool `json:"expand_vms,omitempty"`
+	AllowPartial     *bool `json:"allow_partial,omitempty"`
+	Strict           *bool `json:"strict,omitempty"`
+}
+
+// ApplyPolicy fills the settings req leaves unset from w's policy for its
+// impact type and returns the names of the settings it filled. Values the
+// request sets itself always win, including over a policy default that
+// would contradict them: a policy's allow_partial is dropped for a strict
+// request and its strict for one that allows partial results.
+func (c *Calculator) ApplyPolicy(w WeightConfig, req ImpactRequest) (ImpactRequest, []string) {
+	policy, ok := w.Policies[req.ImpactType]
+	if !ok {
+		return req, nil
+	}
+	var applied []string
+	if req.BlastRadiusDepth == nil && policy.BlastRadiusDepth != nil {
+		req.BlastRadiusDepth = policy.BlastRadiusDepth
+		applied = append(applied, "blast_radius_depth")
+	}
+	if req.ExpandVMs == nil && policy.ExpandVMs != nil {
+		req.ExpandVMs = policy.ExpandVMs
+		applied = append(applied, "expand_vms")
+	}
+	if req.AllowPartial == nil && policy.AllowPartial != nil && !(*policy.AllowPartial && c.isStrict(req)) {
+		req.AllowPartial = policy.AllowPartial
+		applied = append(applied, "allow_partial")
+	}
+	if req.Strict == nil && policy.Strict != nil && !(*policy.Strict && isPartial(req)) {
+		req.Strict = policy.Strict
+		applied = append(applied, "strict")
+	}
+	return req, applied
+}
+
+// CheckImpactType rejects impact types without a configured multiplier,
+// listing the allowed ones.
+func (w WeightConfig) CheckImpactType(t ImpactType) error {
+	if _, ok := w.ImpactTypes[t]; ok {
+		return nil
+	}
+	message := fmt.Sprintf("unknown impact type %q", t)
+	if t == "" {
+		message = "impact type is required"
+	}
+	return &netbox.ValidationError{
+		Field:   "impact_type",
+		Message: fmt.Sprintf("%s (allowed: %s)", message, strings.Join(w.ImpactTypeNames(), ", ")),
+	}
+}
+
+// DeviceWeight is the weight of d according to its role.
+func (w WeightConfig) DeviceWeight(d *netbox.Device) float64 {
+	if d.Role != nil {
+		if weight, ok := w.Roles[d.Role.Slug]; ok {
+			return weight
+		}
+	}
+	return w.Device
+}
+
+func DefaultWeightConfig() WeightConfig {
+	return WeightConfig{
+		Name:                      "default",
+		Device:                    5.0,
+		Circuit:                   3.0,
+		Interface:                 1.0,
+		VirtualMachine:            2.0,
+		BlastRadiusFactor:         0.5,
+		ImplicitDeviceFactor:      0.5,
+		CircuitRedundancyFactor:   0.8,
+		ParallelCircuitFactor:     0.4,
+		PowerFeedRedundancyFactor: 0.5,
+		NoRecoveryPathFactor:      2,
+		ImpactTypes: map[ImpactType]float64{
+			PlannedWork:    1.0,
+			FiberWorks:     1.5,
+			ElectricalWork: 2.0,
+			IncidentWork:   10.0,
+		},
+		Roles:            map[string]float64{},
+		CriticalityField: "criticality",
+		Criticality: map[string]float64{
+			"low":      1.0,
+			"medium":   1.0,
+			"high":     2.0,
+			"critical": 3.0,
+		},
+		StatusFactors: map[string]float64{
+			"active":          1.0,
+			"failed":          1.0,
+			"staged":          0.5,
+			"provisioning":    0.5,
+			"planned":         0.2,
+			"decommissioning": 0.2,
+			"deprovisioning":  0.2,
+			"offline":         0.0,
+			"inventory":       0.0,
+			"decommissioned":  0.0,
+		},
+		BandwidthFactors: []BandwidthStep{
+			{MinKbps: 0, Factor: 0.5},
+			{MinKbps: 10_000, Factor: 0.75},
+			{MinKbps: 100_000, Factor: 1.0},
+			{MinKbps: 1_000_000, Factor: 1.25},
+			{MinKbps: 10_000_000, Factor: 1.5},
+			{MinKbps: 100_000_000, Factor: 2.0},
+		},
+		Providers: map[string]float64{},
+		InterfaceSpeedFactors: []BandwidthStep{
+			{MinKbps: 0, Factor: 0.5},
+			{MinKbps: 1_000_000, Factor: 1.0},
+			{MinKbps: 10_000_000, Factor: 1.5},
+			{MinKbps: 100_000_000, Factor: 2.0},
+			{MinKbps: 400_000_000, Factor: 3.0},
+		},
+		DisabledInterfaceFactor:  0.2,
+		ConnectedInterfaceFactor: 1.5,
+		NormalizationK:           100,
+		Timezone:                 "UTC",
+		TimeBands: []TimeBand{
+			{Name: "weekend", Days: []string{"sat", "sun"}, Start: "00:00", End: "24:00", Multiplier: 0.8},
+			{Name: "business", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "18:00", Multiplier: 1.5},
+			{Name: "evening", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "18:00", End: "23:00", Multiplier: 1.0},
+			{Name: "night", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "23:00", End: "06:00", Multiplier: 0.5},
+		},
+		DurationFactors: []DurationPoint{
+			{Minutes: 15, Factor: 0.5},
+			{Minutes: 60, Factor: 1.0},
+			{Minutes: 240, Factor: 2.0},
+			{Minutes: 480, Factor: 2.5},
+			{Minutes: 1440, Factor: 3.0},
+		},
+		Tiers: map[string]float64{
+			"platinum": 2.0,
+			"gold":     1.5,
+			"silver":   1.2,
+		},
+		TenantTiers: map[string]string{},
+	}
+}
+
+func (w WeightConfig) Validate() error {
+	for name, v := range map[string]float64{
+		"device":                       w.Device,
+		"circuit":                      w.Circuit,
+		"interface":                    w.Interface,
+		"virtual_machine":              w.VirtualMachine,
+		"blast_radius_factor":          w.BlastRadiusFactor,
+		"implicit_device_factor":       w.ImplicitDeviceFactor,
+		"circuit_redundancy_factor":    w.CircuitRedundancyFactor,
+		"parallel_circuit_factor":      w.ParallelCircuitFactor,
+		"power_feed_redundancy_factor": w.PowerFeedRedundancyFactor,
+		"disabled_interface_factor":    w.DisabledInterfaceFactor,
+		"connected_interface_factor":   w.ConnectedInterfaceFactor,
+		"no_recovery_path_factor":      w.NoRecoveryPathFactor,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative (got %g)", name, v)
+		}
+	}
+	for name, v := range map[string]float64{
+		"caps.device":    w.Caps.Device,
+		"caps.circuit":   w.Caps.Circuit,
+		"caps.interface": w.Caps.Interface,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative (got %g)", name, v)
+		}
+	}
+	for class, v := range w.Caps.Shares {
+		if !slices.Contains(shareCapClasses, class) {
+			return fmt.Errorf("caps.shares: unknown class %q (use %s)", class, strings.Join(shareCapClasses, ", "))
+		}
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("caps.shares.%s must be above 0 and at most 1 (got %g)", class, v)
+		}
+	}
+	if w.NormalizationK <= 0 {
+		return fmt.Errorf("normalization_k must be positive (got %g)", w.NormalizationK)
+	}
+	for t, v := range w.ImpactTypes {
+		if v < 0 {
+			return fmt.Errorf("impact_types.%s must not be negative (got %g)", t, v)
+		}
+	}
+	for t, p := range w.Policies {
+		if _, ok := w.ImpactTypes[t]; !ok {
+			return fmt.Errorf("policies.%s: impact type has no impact_types entry", t)
+		}
+		if p.BlastRadiusDepth != nil && *p.BlastRadiusDepth < 0 {
+			return fmt.Errorf("policies.%s.blast_radius_depth must not be negative (got %d)", t, *p.BlastRadiusDepth)
+		}
+		if p.AllowPartial != nil && p.Strict != nil && *p.AllowPartial && *p.Strict {
+			return fmt.Errorf("policies.%s: allow_partial and strict cannot both be true", t)
+		}
+	}
+	for role, v := range w.Roles {
+		if v < 0 {
+			return fmt.Errorf("roles.%s must not be negative (got %g)", role, v)
+		}
+	}
+	for level, v := range w.Criticality {
+		if v < 0 {
+			return fmt.Errorf("criticality.%s must not be negative (got %g)", level, v)
+		}
+	}
+	for status, v := range w.StatusFactors {
+		if v < 0 {
+			return fmt.Errorf("status_factors.%s must not be negative (got %g)", status, v)
+		}
+	}
+	for tier, v := range w.Tiers {
+		if v < 0 {
+			return fmt.Errorf("tiers.%s must not be negative (got %g)", tier, v)
+		}
+	}
+	for provider, v := range w.Providers {
+		if v < 0 {
+			return fmt.Errorf("providers.%s must not be negative (got %g)", provider, v)
+		}
+	}
+	for i, step := range w.BandwidthFactors {
+		if step.MinKbps < 0 || step.Factor < 0 {
+			return fmt.Errorf("bandwidth_factors[%d] must not be negative (got %d kbps, %g)", i, step.MinKbps, step.Factor)
+		}
+	}
+	for i, step := range w.InterfaceSpeedFactors {
+		if step.MinKbps < 0 || step.Factor < 0 {
+			return fmt.Errorf("interface_speed_factors[%d] must not be negative (got %d kbps, %g)", i, step.MinKbps, step.Factor)
+		}
+	}
+	for i, p := range w.DurationFactors {
+		if p.Minutes < 0 || p.Factor < 0 {
+			return fmt.Errorf("duration_factors[%d] must not be negative (got %g minutes, %g)", i, p.Minutes, p.Factor)
+		}
+		if i > 0 && p.Minutes <= w.DurationFactors[i-1].Minutes {
+			return fmt.Errorf("duration_factors must be in ascending order of minutes (entry %d)", i)
+		}
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	for i, e := range w.Calendar {
+		if e.Multiplier < 0 {
+			return fmt.Errorf("calendar[%d] multiplier must not be negative (got %g)", i, e.Multiplier)
+		}
+		if _, _, err := e.span(loc); err != nil {
+			return fmt.Errorf("calendar[%d] %q: %w", i, e.Name, err)
+		}
+	}
+	for i, b := range w.TimeBands {
+		if b.Multiplier < 0 {
+			return fmt.Errorf("time_bands[%d] multiplier must not be negative (got %g)", i, b.Multiplier)
+		}
+		for _, clock := range []string{b.Start, b.End} {
+			if _, err := parseClock(clock); err != nil {
+				return fmt.Errorf("time_bands[%d]: %w", i, err)
+			}
+		}
+		for _, day := range b.Days {
+			if !slices.Contains(weekdayNames, day) {
+				return fmt.Errorf("time_bands[%d]: unknown day %q (use %s)", i, day, strings.Join(weekdayNames, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// WeightOverrides replaces configured weights for a single request; nil
+// fields keep the configured value.
+type WeightOverrides struct {
+	DeviceWeight    *float64 `json:"device_weight,omitempty"`
+	CircuitWeight   *float64 `json:"circuit_weight,omitempty"`
+	InterfaceWeight *float64 `json:"interface_weight,omitempty"`
+	Multiplier      *float64 `json:"multiplier,omitempty"`
+}
+
+// WithOverrides returns w with o applied; the multiplier replaces that of
+// impactType. A device weight override also replaces the role weights. Each
+// value must lie between 0 and limit.
+func (w WeightConfig) WithOverrides(o *WeightOverrides, impactType ImpactType, limit float64) (WeightConfig, error) {
+	for _, f := range []struct {
+		field string
+		value *float64
+	}{
+		{"overrides.device_weight", o.DeviceWeight},
+		{"overrides.circuit_weight", o.CircuitWeight},
+		{"overrides.interface_weight", o.InterfaceWeight},
+		{"overrides.multiplier", o.Multiplier},
+	} {
+		if f.value != nil && (*f.value < 0 || *f.value > limit) {
+			return w, &RangeError{Field: f.field, Value: *f.value, Max: limit}
+		}
+	}
+	w.Name += "+overrides"
+	if o.DeviceWeight != nil {
+		w.Device = *o.DeviceWeight
+		w.Roles = map[string]float64{}
+	}
+	if o.CircuitWeight != nil {
+		w.Circuit = *o.CircuitWeight
+	}
+	if o.InterfaceWeight != nil {
+		w.Interface = *o.InterfaceWeight
+	}
+	if o.Multiplier != nil {
+		w.ImpactTypes = maps.Clone(w.ImpactTypes)
+		w.ImpactTypes[impactType] = *o.Multiplier
+	}
+	return w, nil
+}
+
+// jsonFields returns the JSON keys of struct type t's exported fields, taken
+// from their tags so omitempty fields count even when empty.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// unknownKeys lists the keys of raw, and of the objects nested in it, that
+// t does not have, suggesting the closest known key for likely typos.
+func unknownKeys(prefix string, raw json.RawMessage, t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var problems []string
+	switch t.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) == nil {
+			for i, item := range items {
+				problems = append(problems, unknownKeys(fmt.Sprintf("%s[%d]", prefix, i), item, t.Elem())...)
+			}
+		}
+	case reflect.Struct:
+		var keys map[string]json.RawMessage
+		if json.Unmarshal(raw, &keys) != nil {
+			return nil
+		}
+		fields := jsonFields(t)
+		for _, key := range slices.Sorted(maps.Keys(keys)) {
+			path := strings.TrimPrefix(prefix+"."+key, ".")
+			ft, ok := fields[key]
+			if ok {
+				problems = append(problems, unknownKeys(path, keys[key], ft)...)
+				continue
+			}
+			problem := fmt.Sprintf("unknown key %q ignored", path)
+			best, bestDistance := "", 3
+			for name := range fields {
+				if d := levenshtein(key, name); d < bestDistance || (d == bestDistance && name < best) {
+					best, bestDistance = name, d
+				}
+			}
+			if best != "" {
+				problem += fmt.Sprintf(" (did you mean %q?)", best)
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// timeBandOverlaps reports pairs of time bands with different multipliers
+// that cover the same minute; the band listed first wins there.
+func timeBandOverlaps(bands []TimeBand) []string {
+	var problems []string
+	reported := make(map[[2]int]bool)
+	// 2024-01-07 is a Sunday; every band recurs within a week.
+	week := time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)
+	for minute := 0; minute < 7*24*60; minute++ {
+		t := week.Add(time.Duration(minute) * time.Minute)
+		first := -1
+		for i, b := range bands {
+			if !b.covers(t) {
+				continue
+			}
+			if first < 0 {
+				first = i
+				continue
+			}
+			if pair := [2]int{first, i}; !reported[pair] && b.Multiplier != bands[first].Multiplier {
+				reported[pair] = true
+				problems = append(problems, fmt.Sprintf("time_bands[%d] %q overlaps time_bands[%d] %q from %s %s; %q wins there",
+					i, b.Name, first, bands[first].Name, weekdayNames[t.Weekday()], t.Format("15:04"), bands[first].Name))
+			}
+		}
+	}
+	return problems
+}
+
+// LoadWeightsFile reads a JSON weight set on top of base: keys missing from
+// the file keep base's value, and impact_types, roles, criticality,
+// status_factors, providers, tiers and tenant_tiers entries are merged.
+// Unknown keys, at any depth, and time bands shadowed by an earlier band are
+// returned as warnings rather than rejected. Startup and "config validate"
+// both check weights files through it.
+func LoadWeightsFile(path string, base WeightConfig) (WeightConfig, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return WeightConfig{}, nil, err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return WeightConfig{}, nil, netbox.JSONErrorAt(path, data, err)
+	}
+	var warnings []string
+	for _, problem := range unknownKeys("", data, reflect.TypeOf(base)) {
+		warnings = append(warnings, path+": "+problem)
+	}
+
+	cfg := base
+	cfg.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	cfg.ImpactTypes = maps.Clone(base.ImpactTypes)
+	cfg.Roles = maps.Clone(base.Roles)
+	cfg.Criticality = maps.Clone(base.Criticality)
+	cfg.StatusFactors = maps.Clone(base.StatusFactors)
+	cfg.Providers = maps.Clone(base.Providers)
+	cfg.Tiers = maps.Clone(base.Tiers)
+	cfg.TenantTiers = maps.Clone(base.TenantTiers)
+	cfg.Caps.Shares = maps.Clone(base.Caps.Shares)
+	cfg.Policies = maps.Clone(base.Policies)
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return WeightConfig{}, nil, netbox.JSONErrorAt(path, data, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return WeightConfig{}, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, problem := range timeBandOverlaps(cfg.TimeBands) {
+		warnings = append(warnings, path+": "+problem)
+	}
+	return cfg, warnings, nil
+}
@@ -0,0 +1,419 @@
+// Package impactclient calls the netbox-impact HTTP API with the request
+// and result types of the impact and history packages, so callers and the
+// server cannot drift apart.
+package impactclient
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// Client calls one netbox-impact server. Its fields may be changed before
+// the first call.
+type Client struct {
+	// BaseURL is the server's address, e.g. "https://impact.example.com".
+	BaseURL string
+	// Token, when set, is sent as "Authorization: Bearer TOKEN" for a
+	// gateway in front of the service; Header adds any other headers.
+	Token      string
+	Header     http.Header
+	HTTPClient *http.Client
+
+	// MaxRetries is how often a call answered with 429 or 503 is retried,
+	// after the server's Retry-After or an exponential back-off from
+	// RetryBaseDelay, at most MaxRetryDelay.
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	MaxRetryDelay  time.Duration
+
+	// BatchConcurrency is how many requests CalculateBatch sends at once.
+	BatchConcurrency int
+	// PollInterval is how often WaitJob asks for a job's state.
+	PollInterval time.Duration
+}
+
+// New returns a client for the server at baseURL with the default
+// retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:          strings.TrimSuffix(baseURL, "/"),
+		HTTPClient:       &http.Client{Timeout: 5 * time.Minute},
+		MaxRetries:       3,
+		RetryBaseDelay:   500 * time.Millisecond,
+		MaxRetryDelay:    30 * time.Second,
+		BatchConcurrency: 4,
+		PollInterval:     time.Second,
+	}
+}
+
+// ErrNotFound is matched by the StatusError of a 404, such as an unknown
+// history record or job.
+var ErrNotFound = errors.New("not found")
+
+// StatusError is a response other than the one expected. Message is the
+// server's plain-text explanation.
+type StatusError struct {
+	Method, Path string
+	StatusCode   int
+	Message      string
+	Attempts     int
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" (after %d attempts)", e.Attempts)
+	}
+	return msg
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey sets the Idempotency-Key of the calculation or job
+// started with ctx, e.g. a change number and revision, so that a caller
+// restarting and sending it again gets the first history record or job.
+// Without one each call gets a random key, which covers its own retries.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyKey{}).(string); ok && key != "" {
+		return key
+	}
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Calculate scores req with POST /calculateImpact.
+func (c *Client) Calculate(ctx context.Context, req impact.ImpactRequest) (impact.ImpactResult, error) {
+	var result impact.ImpactResult
+	err := c.do(ctx, http.MethodPost, "/calculateImpact", req, idempotencyKey(ctx), &result, http.StatusOK)
+	return result, err
+}
+
+// BatchResult is the outcome of one request of a batch.
+type BatchResult struct {
+	Result impact.ImpactResult
+	Err    error
+}
+
+// CalculateBatch scores every request, BatchConcurrency at a time, and
+// returns their outcomes in the order of reqs. One failing request does
+// not stop the others.
+func (c *Client) CalculateBatch(ctx context.Context, reqs []impact.ImpactRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+	slots := make(chan struct{}, max(c.BatchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+			// A caller's key would be reused for different requests; each
+			// request gets its own.
+			results[i].Result, results[i].Err = c.Calculate(context.WithValue(ctx, idempotencyKeyKey{}, ""), req)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// GetHistory returns a history record with its result.
+func (c *Client) GetHistory(ctx context.Context, id int64) (history.Record, error) {
+	var record history.Record
+	err := c.do(ctx, http.MethodGet, "/history/"+strconv.FormatInt(id, 10), nil, "", &record, http.StatusOK)
+	return record, err
+}
+
+// ListHistory returns the records f selects, newest first, without their
+// results.
+func (c *Client) ListHistory(ctx context.Context, f history.Filter) ([]history.Record, error) {
+	var body struct {
+		Records []history.Record `json:"records"`
+	}
+	err := c.do(ctx, http.MethodGet, "/history?"+filterQuery(f).Encode(), nil, "", &body, http.StatusOK)
+	return body.Records, err
+}
+
+// HistoryTrend returns the daily aggregates of the records f selects.
+func (c *Client) HistoryTrend(ctx context.Context, f history.Filter) ([]history.TrendPoint, error) {
+	var body struct {
+		Points []history.TrendPoint `json:"points"`
+	}
+	err := c.do(ctx, http.MethodGet, "/history/trend?"+filterQuery(f).Encode(), nil, "", &body, http.StatusOK)
+	return body.Points, err
+}
+
+// RecordOutcome records what the change of history record id actually
+// did, replacing an earlier outcome, and returns the record.
+func (c *Client) RecordOutcome(ctx context.Context, id int64, o history.Outcome) (history.Record, error) {
+	var record history.Record
+	err := c.do(ctx, http.MethodPost, "/history/"+strconv.FormatInt(id, 10)+"/outcome", o, "", &record, http.StatusOK)
+	return record, err
+}
+
+// Calibration compares the estimates of the records f selects with their
+// recorded outcomes.
+func (c *Client) Calibration(ctx context.Context, f history.Filter) ([]history.CalibrationRow, error) {
+	var body struct {
+		Calibration []history.CalibrationRow `json:"calibration"`
+	}
+	err := c.do(ctx, http.MethodGet, "/history/calibration?"+filterQuery(f).Encode(), nil, "", &body, http.StatusOK)
+	return body.Calibration, err
+}
+
+// Outcomes returns the records f selects that have an outcome, oldest
+// first, ignoring f's Limit and Offset.
+func (c *Client) Outcomes(ctx context.Context, f history.Filter) ([]history.CalibrationSample, error) {
+	var body struct {
+		Outcomes []history.CalibrationSample `json:"outcomes"`
+	}
+	err := c.do(ctx, http.MethodGet, "/history/outcomes?"+filterQuery(f).Encode(), nil, "", &body, http.StatusOK)
+	return body.Outcomes, err
+}
+
+func filterQuery(f history.Filter) url.Values {
+	q := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	set("reference", f.Reference)
+	set("impact_type", string(f.ImpactType))
+	set("instance", f.Instance)
+	for _, tag := range f.Tags {
+		q.Add("tag", tag)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if f.Offset > 0 {
+		q.Set("offset", strconv.Itoa(f.Offset))
+	}
+	return q
+}
+
+// SubmitJob queues req with POST /jobs. A retry of a submission the
+// server already accepted returns the same job.
+func (c *Client) SubmitJob(ctx context.Context, req impact.ImpactRequest) (history.Job, error) {
+	var job history.Job
+	err := c.do(ctx, http.MethodPost, "/jobs", req, idempotencyKey(ctx), &job, http.StatusAccepted, http.StatusOK)
+	return job, err
+}
+
+func (c *Client) GetJob(ctx context.Context, id int64) (history.Job, error) {
+	var job history.Job
+	err := c.do(ctx, http.MethodGet, "/jobs/"+strconv.FormatInt(id, 10), nil, "", &job, http.StatusOK)
+	return job, err
+}
+
+// ListJobs returns up to limit jobs in state, or in any state for "",
+// newest first.
+func (c *Client) ListJobs(ctx context.Context, state history.JobState, limit int) ([]history.Job, error) {
+	q := url.Values{}
+	if state != "" {
+		q.Set("state", string(state))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var body struct {
+		Jobs []history.Job `json:"jobs"`
+	}
+	err := c.do(ctx, http.MethodGet, "/jobs?"+q.Encode(), nil, "", &body, http.StatusOK)
+	return body.Jobs, err
+}
+
+// WaitJob polls a job every PollInterval until it is done or failed, or
+// ctx ends.
+func (c *Client) WaitJob(ctx context.Context, id int64) (history.Job, error) {
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil || job.State == history.JobDone || job.State == history.JobFailed {
+			return job, err
+		}
+		select {
+		case <-time.After(cmp.Or(c.PollInterval, time.Second)):
+		case <-ctx.Done():
+			return job, ctx.Err()
+		}
+	}
+}
+
+// CalculateJob scores req as a job, for requests too large for one HTTP
+// call: it submits the job, waits for it and returns its result from
+// history.
+func (c *Client) CalculateJob(ctx context.Context, req impact.ImpactRequest) (impact.ImpactResult, error) {
+	job, err := c.SubmitJob(ctx, req)
+	if err != nil {
+		return impact.ImpactResult{}, err
+	}
+	if job, err = c.WaitJob(ctx, job.ID); err != nil {
+		return impact.ImpactResult{}, err
+	}
+	if job.State == history.JobFailed {
+		return impact.ImpactResult{}, fmt.Errorf("job %d failed: %s", job.ID, job.Error)
+	}
+	record, err := c.GetHistory(ctx, job.HistoryID)
+	if err != nil {
+		return impact.ImpactResult{}, err
+	}
+	if record.Result == nil {
+		return impact.ImpactResult{}, fmt.Errorf("history record %d has no result", record.ID)
+	}
+	record.Result.Metadata.HistoryID = record.ID
+	return *record.Result, nil
+}
+
+// do sends one call, retrying 429 and 503 answers, and decodes a response
+// with one of the wanted statuses into v. The idempotency key, when set,
+// is the same on every attempt.
+func (c *Client) do(ctx context.Context, method, path string, in interface{}, key string, v interface{}, want ...int) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := c.doOnce(ctx, method, path, body, key, v, want)
+		if err == nil {
+			return nil
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || (status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable) {
+			return err
+		}
+		statusErr.Attempts = attempt
+		if attempt > c.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(c.retryDelay(attempt, retryAfter)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, body []byte, key string, v interface{}, want []int) (int, time.Duration, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reqBody)
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	req.Header.Set("User-Agent", "netbox-impact-client/"+netbox.Version)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	for _, status := range want {
+		if resp.StatusCode == status {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				return resp.StatusCode, 0, fmt.Errorf("%s %s: decoding the response: %w", method, path, err)
+			}
+			return resp.StatusCode, 0, nil
+		}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), &StatusError{
+		Method:     method,
+		Path:       strings.SplitN(path, "?", 2)[0],
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(msg)),
+		Attempts:   1,
+	}
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryDelay prefers the server's Retry-After and otherwise backs off
+// exponentially from RetryBaseDelay with up to 50% jitter.
+func (c *Client) retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	maxDelay := c.MaxRetryDelay
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	if retryAfter > 0 {
+		return min(retryAfter, maxDelay)
+	}
+	delay := c.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/2+1))
+}
@@ -0,0 +1,230 @@
+package impactclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/history/sqlstore"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/server"
+)
+
+// newServer serves the real handler, with history and a job worker, over
+// the sample NetBox data; wrap, when set, sits in front of it.
+func newServer(t *testing.T, wrap func(http.Handler) http.Handler) (*Client, history.Store) {
+	t.Helper()
+	store, err := sqlstore.Open(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	cfg := server.Config{
+		Calculator:      impact.NewCalculator(impact.DefaultOptions()),
+		Instances:       netboxfake.Instances(t, netboxfake.NewServer(t, netboxfake.Sample()).Client()),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+		History:         store,
+	}
+	worker := server.NewJobWorker(cfg, "test")
+	worker.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	var handler http.Handler = server.New(cfg)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c := New(srv.URL)
+	c.RetryBaseDelay = time.Millisecond
+	c.PollInterval = 10 * time.Millisecond
+	return c, store
+}
+
+func TestClient(t *testing.T) {
+	c, _ := newServer(t, nil)
+	ctx := context.Background()
+	req := impact.ImpactRequest{DeviceIDs: []int{1, 2}, ImpactType: impact.PlannedWork, Reference: "CHG-1"}
+
+	result, err := c.Calculate(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalImpact == 0 || result.ImpactType != impact.PlannedWork || result.Metadata.HistoryID == 0 {
+		t.Errorf("Calculate = %+v", result)
+	}
+	record, err := c.GetHistory(ctx, result.Metadata.HistoryID)
+	if err != nil || record.Reference != "CHG-1" || record.Result == nil || record.Result.TotalImpact != result.TotalImpact {
+		t.Errorf("GetHistory = %+v, %v", record, err)
+	}
+	if _, err := c.GetHistory(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetHistory(9999) error = %v, want ErrNotFound", err)
+	}
+
+	batch := c.CalculateBatch(ctx, []impact.ImpactRequest{
+		{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork, Reference: "CHG-1"},
+		{DeviceIDs: []int{1}, ImpactType: "nope"},
+		{CircuitIDs: []int{100}, ImpactType: impact.FiberWorks, Reference: "CHG-2"},
+	})
+	var statusErr *StatusError
+	if batch[0].Err != nil || batch[2].Err != nil || batch[2].Result.ImpactType != impact.FiberWorks {
+		t.Errorf("batch = %+v", batch)
+	}
+	if !errors.As(batch[1].Err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || !strings.Contains(statusErr.Message, "nope") {
+		t.Errorf("batch request with an unknown impact type: %v", batch[1].Err)
+	}
+
+	records, err := c.ListHistory(ctx, history.Filter{Reference: "CHG-1"})
+	if err != nil || len(records) != 2 || records[0].ID != batch[0].Result.Metadata.HistoryID {
+		t.Errorf("ListHistory = %+v, %v", records, err)
+	}
+	if records, err := c.ListHistory(ctx, history.Filter{Until: time.Now().Add(-time.Hour)}); err != nil || len(records) != 0 {
+		t.Errorf("ListHistory until an hour ago = %+v, %v", records, err)
+	}
+	points, err := c.HistoryTrend(ctx, history.Filter{Reference: "CHG-1"})
+	if err != nil || len(points) != 1 || points[0].Count != 2 {
+		t.Errorf("HistoryTrend = %+v, %v", points, err)
+	}
+
+	job, err := c.SubmitJob(ctx, req)
+	if err != nil || job.ID == 0 {
+		t.Fatalf("SubmitJob = %+v, %v", job, err)
+	}
+	if job, err = c.WaitJob(ctx, job.ID); err != nil || job.State != history.JobDone || job.HistoryID == 0 {
+		t.Errorf("WaitJob = %+v, %v", job, err)
+	}
+	if jobs, err := c.ListJobs(ctx, history.JobDone, 10); err != nil || len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("ListJobs = %+v, %v", jobs, err)
+	}
+	if _, err := c.GetJob(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetJob(9999) error = %v, want ErrNotFound", err)
+	}
+	if record, err := c.RecordOutcome(ctx, result.Metadata.HistoryID, history.Outcome{ActualSeverity: history.NoImpact}); err != nil || record.Outcome == nil || record.Outcome.ActualSeverity != history.NoImpact {
+		t.Errorf("RecordOutcome = %+v, %v", record, err)
+	}
+	if samples, err := c.Outcomes(ctx, history.Filter{}); err != nil || len(samples) != 1 || samples[0].HistoryID != result.Metadata.HistoryID || samples[0].Multiplier == 0 {
+		t.Errorf("Outcomes = %+v, %v", samples, err)
+	}
+	if rows, err := c.Calibration(ctx, history.Filter{Reference: "CHG-1"}); err != nil || len(rows) != 1 || rows[0].Count != 1 || rows[0].Impacted != 0 {
+		t.Errorf("Calibration = %+v, %v", rows, err)
+	}
+	jobResult, err := c.CalculateJob(ctx, req)
+	if err != nil || jobResult.TotalImpact != result.TotalImpact || jobResult.Metadata.HistoryID == 0 {
+		t.Errorf("CalculateJob = %+v, %v", jobResult, err)
+	}
+}
+
+// TestRetryIsIdempotent loses the response of a calculation the server
+// made: the retry carries the same key and gets the same record.
+func TestRetryIsIdempotent(t *testing.T) {
+	var mu sync.Mutex
+	var seen []http.Header
+	c, store := newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, r.Header.Clone())
+			first := len(seen) == 1
+			mu.Unlock()
+			if first {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "overloaded", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c.Token = "secret"
+	c.Header = http.Header{"X-Calling-Service": {"change-planner"}}
+	result, err := c.Calculate(context.Background(), impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("%d attempts, want 2", len(seen))
+	}
+	key := seen[0].Get("Idempotency-Key")
+	for i, h := range seen {
+		if h.Get("Idempotency-Key") != key || key == "" || h.Get("Authorization") != "Bearer secret" || h.Get("X-Calling-Service") != "change-planner" {
+			t.Errorf("attempt %d headers = %v", i+1, h)
+		}
+	}
+	records, err := store.List(context.Background(), history.Filter{})
+	if err != nil || len(records) != 1 || records[0].ID != result.Metadata.HistoryID {
+		t.Errorf("records = %+v, %v; want only record %d", records, err, result.Metadata.HistoryID)
+	}
+
+	// A caller's own key survives a restart of the caller.
+	ctx := WithIdempotencyKey(context.Background(), "CHG-9 rev 1")
+	req := impact.ImpactRequest{DeviceIDs: []int{2}, ImpactType: impact.PlannedWork}
+	first, err := c.SubmitJob(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.SubmitJob(ctx, req); err != nil || again.ID != first.ID {
+		t.Errorf("resubmitted job = %+v, %v; want job %d", again, err, first.ID)
+	}
+	if _, err := c.WaitJob(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	var statusErr *StatusError
+	req.DeviceIDs = []int{1}
+	if _, err := c.SubmitJob(ctx, req); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("job with a reused key: %v, want 422", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusTooManyRequests, 4},
+		{http.StatusServiceUnavailable, 4},
+		{http.StatusBadRequest, 1},
+		{http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			http.Error(w, "no", tt.status)
+		}))
+		c := New(srv.URL)
+		c.RetryBaseDelay = time.Millisecond
+		_, err := c.Calculate(context.Background(), impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork})
+		srv.Close()
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.status || statusErr.Attempts != tt.attempts || attempts != tt.attempts {
+			t.Errorf("status %d: %v after %d attempts, want %d", tt.status, err, attempts, tt.attempts)
+		}
+	}
+
+	c := New("http://impact.invalid")
+	if got := c.retryDelay(1, parseRetryAfter("7")); got != 7*time.Second {
+		t.Errorf("delay with Retry-After: 7 = %s, want 7s", got)
+	}
+	if got := c.retryDelay(1, parseRetryAfter("3600")); got != c.MaxRetryDelay {
+		t.Errorf("delay with Retry-After: 3600 = %s, want the %s cap", got, c.MaxRetryDelay)
+	}
+	if got := c.retryDelay(2, 0); got < time.Second || got > 1500*time.Millisecond {
+		t.Errorf("second back-off = %s, want 1s to 1.5s", got)
+	}
+}
@@ -0,0 +1,67 @@
+package impactclient_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/impactclient"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/server"
+)
+
+// newServer stands in for a running netbox-impact server.
+func newServer() *httptest.Server {
+	instances := netbox.NewNetboxInstances()
+	instances.Add("default", netboxfake.Sample())
+	return httptest.NewServer(server.New(server.Config{
+		Calculator: impact.NewCalculator(impact.DefaultOptions()),
+		Instances:  instances,
+		Weights:    impact.DefaultWeightConfig(),
+	}))
+}
+
+func Example() {
+	srv := newServer()
+	defer srv.Close()
+
+	c := impactclient.New(srv.URL)
+	c.Token = "token for the gateway in front of the service"
+	depth := 0
+	result, err := c.Calculate(context.Background(), impact.ImpactRequest{
+		DeviceIDs:        []int{1},
+		ImpactType:       impact.PlannedWork,
+		BlastRadiusDepth: &depth,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(result.Breakdown.Devices.Items[0].Name, result.ImpactTypeLabel)
+	// Output: core-ams01 Planned work
+}
+
+// Requests that fail come back as StatusErrors, with the server's
+// explanation.
+func ExampleClient_CalculateBatch() {
+	srv := newServer()
+	defer srv.Close()
+
+	c := impactclient.New(srv.URL)
+	results := c.CalculateBatch(context.Background(), []impact.ImpactRequest{
+		{CircuitIDs: []int{100}, ImpactType: impact.FiberWorks},
+		{CircuitIDs: []int{100}, ImpactType: "meteor-strike"},
+	})
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Println("error:", r.Err.(*impactclient.StatusError).StatusCode)
+			continue
+		}
+		fmt.Println("circuit:", r.Result.Breakdown.Circuits.Items[0].CID)
+	}
+	// Output:
+	// circuit: AMS-RTM-1
+	// error: 400
+}
@@ -2,376 +2,1633 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/history/sqlstore"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/impactclient"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/publish"
+	"github.com/R2Unit/netbox-impact/server"
 )
 
-type ImpactType string
+func verifyComposites(ctx context.Context, client netbox.NetboxAPI, store *impact.CompositeStore, out io.Writer) error {
+	problems := 0
+	for _, c := range store.List() {
+		missing, err := impact.MissingCompositeMembers(ctx, client, c)
+		if err != nil {
+			return fmt.Errorf("failed to verify composite %q: %w", c.Name, err)
+		}
+		if len(missing) == 0 {
+			fmt.Fprintf(out, "OK       %s\n", c.Name)
+			continue
+		}
+		problems++
+		var parts []string
+		for _, field := range []string{"device_ids", "circuit_ids", "interface_ids"} {
+			if ids, ok := missing[field]; ok {
+				parts = append(parts, fmt.Sprintf("%s %v", field, ids))
+			}
+		}
+		fmt.Fprintf(out, "MISSING  %s: %s\n", c.Name, strings.Join(parts, ", "))
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d composites reference objects that no longer exist in NetBox", problems)
+	}
+	return nil
+}
 
-// Weight points voor het impact_type
-const (
-	PlannedWork    ImpactType = "planned-work"
-	FiberWorks     ImpactType = "fiber-works"
-	ElectricalWork ImpactType = "electrical-work"
-	IncidentWork   ImpactType = "incident-work"
-)
+const cliPageSize = 25
 
-var ImpactTypeWeights = map[ImpactType]float64{
-	PlannedWork:    1.0,
-	FiberWorks:     1.5,
-	ElectricalWork: 2.0,
-	IncidentWork:   10.0,
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	// eof is set once the input is exhausted, so loops that re-prompt
+	// can stop.
+	eof bool
 }
 
-type ImpactRequest struct {
-	DeviceIDs    []int      `json:"device_ids"`
-	CircuitIDs   []int      `json:"circuit_ids"`
-	InterfaceIDs []int      `json:"interface_ids"`
-	ImpactType   ImpactType `json:"impact_type"`
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
 }
 
-type Node struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+func (p *prompter) ask(question string) string {
+	fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil {
+		p.eof = true
+	}
+	return strings.TrimSpace(answer)
 }
 
-type Device struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+func (p *prompter) confirm(question string, def bool) bool {
+	answer := strings.ToLower(p.ask(question))
+	if answer == "" {
+		return def
+	}
+	return answer == "y" || answer == "yes"
 }
 
-type Circuit struct {
-	ID           int    `json:"id"`
-	CID          string `json:"cid"`
-	TerminationA Node   `json:"termination_a"`
-	TerminationB Node   `json:"termination_b"`
+type cliObjectType struct {
+	name      string
+	title     string
+	fetchPage func(search string, offset, limit int) ([]string, bool, error)
 }
 
-type Interface struct {
-	ID     int    `json:"id"`
-	Name   string `json:"name"`
-	Device string `json:"device"`
+// withSearch adds a NetBox free-text search (q=) to filter.
+func withSearch(filter url.Values, search string) url.Values {
+	if search == "" {
+		return filter
+	}
+	query := url.Values{"q": {search}}
+	for key, values := range filter {
+		if key != "q" {
+			query[key] = values
+		}
+	}
+	return query
 }
 
-type NetboxClient struct {
-	APIUrl string
-	Token  string
-	Client *http.Client
+func cliObjectTypes(ctx context.Context, client *netbox.NetboxClient, filters map[string]url.Values) []cliObjectType {
+	return []cliObjectType{
+		{"devices", "Devices", func(search string, offset, limit int) ([]string, bool, error) {
+			devices, more, err := client.FetchDevicesPage(ctx, withSearch(filters["devices"], search), offset, limit)
+			var lines []string
+			for _, d := range devices {
+				lines = append(lines, fmt.Sprintf("ID: %d, Name: %s, Role: %s, Site: %s", d.ID, d.Name, d.Role.NameOrEmpty(), d.Site.NameOrEmpty()))
+			}
+			return lines, more, err
+		}},
+		{"sites", "Sites", func(search string, offset, limit int) ([]string, bool, error) {
+			sites, more, err := client.FetchSitesPage(ctx, withSearch(nil, search), offset, limit)
+			var lines []string
+			for _, s := range sites {
+				lines = append(lines, fmt.Sprintf("ID: %d, Name: %s", s.ID, s.Name))
+			}
+			return lines, more, err
+		}},
+		{"circuits", "Circuits", func(search string, offset, limit int) ([]string, bool, error) {
+			circuits, more, err := client.FetchCircuitsPage(ctx, withSearch(filters["circuits"], search), offset, limit)
+			var lines []string
+			for _, c := range circuits {
+				lines = append(lines, fmt.Sprintf("ID: %d, CID: %s, Provider: %s", c.ID, c.CID, c.Provider.NameOrEmpty()))
+			}
+			return lines, more, err
+		}},
+		{"interfaces", "Interfaces", func(search string, offset, limit int) ([]string, bool, error) {
+			interfaces, more, err := client.FetchInterfacesPage(ctx, withSearch(filters["interfaces"], search), offset, limit)
+			var lines []string
+			for _, i := range interfaces {
+				lines = append(lines, fmt.Sprintf("ID: %d, Name: %s, Device: %s", i.ID, i.Name, i.DeviceName()))
+			}
+			return lines, more, err
+		}},
+	}
 }
 
-func NewNetboxClient(apiUrl, token string) *NetboxClient {
-	return &NetboxClient{
-		APIUrl: apiUrl,
-		Token:  token,
-		Client: &http.Client{Timeout: 10 * time.Second},
+// browse pages through a listing. With several NetBox instances, instance
+// names the one listed and prefixes every line.
+func (p *prompter) browse(t cliObjectType, instance, search string) error {
+	prefix := ""
+	if instance != "" {
+		fmt.Fprintf(p.out, "\nAvailable %s in %s:\n", t.title, instance)
+		prefix = "[" + instance + "] "
+	} else {
+		fmt.Fprintf(p.out, "\nAvailable %s:\n", t.title)
+	}
+	for offset := 0; ; offset += cliPageSize {
+		lines, more, err := t.fetchPage(search, offset, cliPageSize)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Fprintln(p.out, prefix+line)
+		}
+		if !more || p.ask("Press enter for the next page, or q to stop listing: ") == "q" {
+			return nil
+		}
 	}
 }
 
-func (c *NetboxClient) fetch(endpoint string, v interface{}) error {
-	url := c.APIUrl + endpoint
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+func selectedObjectTypes(answer string) map[string]bool {
+	selected := make(map[string]bool)
+	if answer == "" || answer == "all" {
+		answer = "devices,sites,circuits,interfaces"
+	}
+	for _, part := range strings.Split(answer, ",") {
+		selected[strings.TrimSpace(strings.ToLower(part))] = true
+	}
+	return selected
+}
+
+// cliOptions are the command-line settings of an interactive session.
+// filters, keyed by object type, limit what the listings show; explain asks
+// how the score was computed and affectedTenants prints the affected tenants
+// as a table.
+type cliOptions struct {
+	filters         map[string]url.Values
+	explain         bool
+	affectedTenants bool
+	tags            []string
+}
+
+// runCLI runs the interactive session. Listings cover every instance; the
+// calculation runs against the one picked at the end.
+func runCLI(ctx context.Context, calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig, opts cliOptions, in io.Reader, out io.Writer) error {
+	p := newPrompter(in, out)
+	names := instances.Names()
+	typesByInstance := make(map[string][]cliObjectType)
+	for _, name := range names {
+		client, err := instances.Live(name)
+		types := cliObjectTypes(ctx, client, opts.filters)
+		if err != nil {
+			// Offline data cannot be listed; its IDs are typed in.
+			for i := range types {
+				types[i].fetchPage = func(string, int, int) ([]string, bool, error) { return nil, false, err }
+			}
+		}
+		typesByInstance[name] = types
 	}
-	req.Header.Set("Authorization", "Token "+c.Token)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.Client.Do(req)
+
+	selected := selectedObjectTypes(p.ask("Which object types do you want to select (devices, sites, circuits, interfaces) [all]: "))
+	ids := make(map[string][]int)
+	for i, t := range typesByInstance[names[0]] {
+		if !selected[t.name] {
+			continue
+		}
+		idPrompt := fmt.Sprintf("Enter %s IDs (comma-separated): ", strings.TrimSuffix(t.name, "s"))
+		if !p.confirm(fmt.Sprintf("\nList available %s? (y/N, answer n if you already know the IDs): ", t.name), false) {
+			ids[t.name] = netbox.ParseIDs(p.ask(idPrompt))
+			continue
+		}
+		search := p.ask(fmt.Sprintf("Search %s (free text, empty lists all): ", t.name))
+		for {
+			var lastErr error
+			failed := 0
+			for _, name := range names {
+				label := ""
+				if len(names) > 1 {
+					label = name
+				}
+				if err := p.browse(typesByInstance[name][i], label, search); err != nil {
+					if label != "" {
+						fmt.Fprintf(out, "Error fetching %s from %s: %v\n", t.name, name, err)
+					} else {
+						fmt.Fprintf(out, "Error fetching %s: %v\n", t.name, err)
+					}
+					lastErr = err
+					failed++
+				}
+			}
+			if failed == len(names) {
+				if !p.confirm("Continue with the remaining object types? (Y/n): ", true) {
+					return fmt.Errorf("aborted after failing to fetch %s: %w", t.name, lastErr)
+				}
+				break
+			}
+			ids[t.name] = append(ids[t.name], netbox.ParseIDs(p.ask(idPrompt))...)
+			if search = p.ask(fmt.Sprintf("Search %s again, or press enter to continue: ", t.name)); search == "" {
+				break
+			}
+		}
+	}
+
+	instance := ""
+	if len(names) > 1 {
+		instance = p.ask(fmt.Sprintf("\nWhich NetBox instance do these IDs belong to (%s) [%s]: ", strings.Join(names, ", "), names[0]))
+	}
+	client, err := instances.Client(instance)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to fetch %s: status %d", endpoint, resp.StatusCode)
+
+	var impactType impact.ImpactType
+	for {
+		impactType = impact.ImpactType(p.ask(fmt.Sprintf("\nEnter impact type (%s): ", strings.Join(weights.ImpactTypeNames(), ", "))))
+		err := weights.CheckImpactType(impactType)
+		if err == nil {
+			break
+		}
+		if p.eof {
+			return err
+		}
+		fmt.Fprintln(out, err)
 	}
-	return json.NewDecoder(resp.Body).Decode(v)
-}
 
-func (c *NetboxClient) FetchDevices() ([]Device, error) {
-	var result struct {
-		Results []Device `json:"results"`
+	req := impact.ImpactRequest{
+		DeviceIDs:    ids["devices"],
+		CircuitIDs:   ids["circuits"],
+		InterfaceIDs: ids["interfaces"],
+		SiteIDs:      ids["sites"],
+		ImpactType:   impactType,
+		Instance:     instance,
+		Explain:      opts.explain,
+		Tags:         opts.tags,
+
+		IncludeAffectedTenants: opts.affectedTenants,
 	}
-	err := c.fetch("/api/dcim/devices/", &result)
+	for !p.eof {
+		answer := p.ask("Enter maintenance start (RFC3339, e.g. 2026-12-24T02:00:00+01:00) or press enter to skip: ")
+		if answer == "" {
+			break
+		}
+		start, err := time.Parse(time.RFC3339, answer)
+		if err != nil {
+			fmt.Fprintln(out, "Invalid time:", err)
+			continue
+		}
+		req.StartTime = &start
+		break
+	}
+	for req.StartTime != nil && !p.eof {
+		answer := p.ask("Enter duration in minutes or press enter to skip: ")
+		if answer == "" {
+			break
+		}
+		minutes, err := strconv.ParseFloat(answer, 64)
+		if err != nil || minutes <= 0 {
+			fmt.Fprintln(out, "Duration must be a positive number of minutes")
+			continue
+		}
+		req.DurationMinutes = &minutes
+		break
+	}
+	result, err := calc.Calculate(ctx, req, client, weights)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error calculating impact: %w", err)
+	}
+	calc.Redact(&result, false)
+	resultJSON, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintf(out, "\nDetailed Impact Result:\n%s\n", string(resultJSON))
+	if result.FreezeWindow != "" {
+		fmt.Fprintf(out, "\nWARNING: the maintenance window overlaps %q (multiplier ×%s)\n", result.FreezeWindow, impact.ExplainNumber(result.CalendarMultiplier))
+	}
+	if len(result.Explanation) > 0 {
+		fmt.Fprintln(out, "\nExplanation:")
+		for _, line := range result.Explanation {
+			fmt.Fprintf(out, "  - %s\n", line)
+		}
+	}
+	if opts.affectedTenants {
+		fmt.Fprintln(out, "\nAffected tenants:")
+		if len(result.AffectedTenants) == 0 {
+			fmt.Fprintln(out, "  none")
+		} else {
+			tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "  TENANT\tDEVICES\tCIRCUITS\tIMPLICIT DEVICES\tIMPACT")
+			for _, t := range result.AffectedTenants {
+				fmt.Fprintf(tw, "  %s\t%d\t%d\t%d\t%s\n", t.Name, t.Objects["device"], t.Objects["circuit"], t.Objects["implicit_device"], impact.ExplainNumber(t.Impact))
+			}
+			tw.Flush()
+		}
 	}
-	return result.Results, nil
+	return nil
 }
 
-func (c *NetboxClient) FetchCircuits() ([]Circuit, error) {
-	var result struct {
-		Results []Circuit `json:"results"`
+// runCompare reads the two requests named in files ("a.json,b.json") and
+// prints their comparison.
+func runCompare(ctx context.Context, calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig, files string, out io.Writer) error {
+	paths := strings.Split(files, ",")
+	if len(paths) != 2 {
+		return fmt.Errorf("-compare takes two comma-separated files, got %q", files)
 	}
-	err := c.fetch("/api/circuits/circuits/", &result)
+	var req impact.CompareRequest
+	for i, side := range []*impact.ImpactRequest{&req.A, &req.B} {
+		path := strings.TrimSpace(paths[i])
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := impact.CheckWindowTimes(data, ""); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := json.Unmarshal(data, side); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	result, err := calc.Compare(ctx, req, instances, weights)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error comparing impact: %w", err)
 	}
-	return result.Results, nil
+	calc.Redact(&result, req.A.Redact || req.B.Redact)
+	resultJSON, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintf(out, "Impact Comparison:\n%s\n", string(resultJSON))
+	fmt.Fprintf(out, "\nTotal impact: %s -> %s (%+g)\n", impact.ExplainNumber(result.A.TotalImpact), impact.ExplainNumber(result.B.TotalImpact), math.Round(result.Delta.TotalImpact*100)/100)
+	return nil
 }
 
-func (c *NetboxClient) FetchInterfaces() ([]Interface, error) {
-	var result struct {
-		Results []Interface `json:"results"`
+// runCalculateCommand implements "calculate -snapshot FILE -request-file
+// FILE [-baseline-snapshot FILE]": the request scored against a snapshot, or
+// against both snapshots with the delta when a baseline is given.
+func runCalculateCommand(calc *impact.Calculator, args []string, weights impact.WeightConfig, baseURL string, out io.Writer) error {
+	flags := flag.NewFlagSet("calculate", flag.ContinueOnError)
+	snapshot := flags.String("snapshot", "", "Snapshot of the current network (offline export with meta.schema_version)")
+	baselineSnapshot := flags.String("baseline-snapshot", "", "Snapshot to compare against, e.g. the network with the planned circuits")
+	requestFile := flags.String("request-file", "", "JSON impact request to score")
+	var tags []string
+	flags.Func("tag", "Tag added to the request's tags (repeatable)", func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *snapshot == "" || *requestFile == "" {
+		return errors.New("usage: calculate -snapshot FILE -request-file FILE [-baseline-snapshot FILE]")
 	}
-	err := c.fetch("/api/dcim/interfaces/", &result)
+	data, err := os.ReadFile(*requestFile)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := impact.CheckWindowTimes(data, ""); err != nil {
+		return fmt.Errorf("%s: %w", *requestFile, err)
 	}
-	return result.Results, nil
+	var req impact.ImpactRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("%s: %w", *requestFile, err)
+	}
+	req.Tags = append(req.Tags, tags...)
+	current, err := netboxfake.LoadSnapshot(*snapshot, baseURL)
+	if err != nil {
+		return err
+	}
+	if *baselineSnapshot == "" {
+		result, err := calc.Calculate(context.Background(), req, current, weights)
+		if err != nil {
+			return fmt.Errorf("error calculating impact: %w", err)
+		}
+		calc.Redact(&result, req.Redact)
+		resultJSON, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Fprintf(out, "%s\n", resultJSON)
+		return nil
+	}
+	baseline, err := netboxfake.LoadSnapshot(*baselineSnapshot, baseURL)
+	if err != nil {
+		return err
+	}
+	result, err := calc.CompareSnapshots(context.Background(), req, current, baseline, weights)
+	if err != nil {
+		return fmt.Errorf("error comparing snapshots: %w", err)
+	}
+	calc.Redact(&result, req.Redact)
+	resultJSON, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintf(out, "%s\n", resultJSON)
+	fmt.Fprintf(out, "\nTotal impact: %s -> %s (%+g)\n", impact.ExplainNumber(result.A.TotalImpact), impact.ExplainNumber(result.B.TotalImpact), math.Round(result.Delta.TotalImpact*100)/100)
+	return nil
 }
 
-func (c *NetboxClient) FetchCircuitByID(id int) (*Circuit, error) {
-	endpoint := fmt.Sprintf("/api/circuits/circuits/%d/", id)
-	var circuit Circuit
-	err := c.fetch(endpoint, &circuit)
+// A scenario is a directory holding netbox.json (an offline export, see
+// LoadOfflineData; without it the scenario runs over the examples/offline
+// dataset the demo serves), request.json, an optional weights.json read over the
+// default weights, and expected.json, the golden result. Timings and the
+// echoed weights are left out of the golden file.
+
+// ScenarioOutcome is the result of running one scenario: the paths at which
+// its result differs from the golden file, or the error that stopped it.
+type ScenarioOutcome struct {
+	Name    string
+	Diffs   []string
+	Err     error
+	Updated bool
+}
+
+func (o ScenarioOutcome) Failed() bool {
+	return o.Err != nil || len(o.Diffs) > 0
+}
+
+// RunScenarios runs every scenario directory under dir, in name order. With
+// update it rewrites the golden files instead of comparing against them.
+func RunScenarios(ctx context.Context, dir string, update bool) ([]ScenarioOutcome, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	return &circuit, nil
+	var outcomes []ScenarioOutcome
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		outcome := ScenarioOutcome{Name: entry.Name()}
+		outcome.Diffs, outcome.Updated, outcome.Err = runScenario(ctx, filepath.Join(dir, entry.Name()), update)
+		outcomes = append(outcomes, outcome)
+	}
+	if len(outcomes) == 0 {
+		return nil, fmt.Errorf("no scenarios in %s", dir)
+	}
+	return outcomes, nil
 }
 
-func redundancyFactorCircuit(c Circuit) float64 {
-	if c.TerminationA.ID == c.TerminationB.ID {
-		return 0.8
+func runScenario(ctx context.Context, dir string, update bool) ([]string, bool, error) {
+	var data *netboxfake.FakeNetbox
+	var err error
+	if path := filepath.Join(dir, "netbox.json"); fileExists(path) {
+		data, err = netboxfake.LoadOfflineData(path, "https://netbox.example.com")
+	} else {
+		data, err = demoData()
+	}
+	if err != nil {
+		return nil, false, err
 	}
-	return 1.0
+	weights := impact.DefaultWeightConfig()
+	if path := filepath.Join(dir, "weights.json"); fileExists(path) {
+		if weights, _, err = impact.LoadWeightsFile(path, weights); err != nil {
+			return nil, false, err
+		}
+	}
+	body, err := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil {
+		return nil, false, err
+	}
+	var req impact.ImpactRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false, fmt.Errorf("request.json: %w", err)
+	}
+	result, err := impact.NewCalculator(impact.DefaultOptions()).Calculate(ctx, req, data, weights)
+	if err != nil {
+		return nil, false, err
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, false, err
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		return nil, false, err
+	}
+	if metadata, ok := got["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "timings_ms")
+		delete(metadata, "weights")
+	}
+	golden := filepath.Join(dir, "expected.json")
+	if update {
+		out, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, true, os.WriteFile(golden, append(out, '\n'), 0o644)
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		return nil, false, err
+	}
+	var want interface{}
+	if err := json.Unmarshal(expected, &want); err != nil {
+		return nil, false, fmt.Errorf("expected.json: %w", err)
+	}
+	return jsonDiff("", want, got), false, nil
 }
 
-type DeviceImpact struct {
-	Count           int     `json:"count"`
-	WeightPerDevice float64 `json:"weight_per_device"`
-	Impact          float64 `json:"impact"`
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
-type CircuitImpactDetail struct {
-	ID               int     `json:"id"`
-	CID              string  `json:"cid"`
-	RedundancyFactor float64 `json:"redundancy_factor"`
-	Weight           float64 `json:"weight"`
-	Impact           float64 `json:"impact"`
+// jsonDiff lists the paths at which two decoded JSON values differ, as
+// "path: want X, got Y".
+func jsonDiff(path string, want, got interface{}) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		union := maps.Clone(w)
+		maps.Copy(union, g)
+		var diffs []string
+		for _, key := range slices.Sorted(maps.Keys(union)) {
+			diffs = append(diffs, jsonDiff(path+"."+key, w[key], g[key])...)
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			break
+		}
+		var diffs []string
+		for i := range w {
+			diffs = append(diffs, jsonDiff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i])...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(want, got) {
+		return nil
+	}
+	encode := func(v interface{}) string {
+		if v == nil {
+			return "nothing"
+		}
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return []string{fmt.Sprintf("%s: want %s, got %s", strings.TrimPrefix(path, "."), encode(want), encode(got))}
 }
 
-type CircuitImpact struct {
-	Items       []CircuitImpactDetail `json:"items"`
-	TotalImpact float64               `json:"total_impact"`
+// featureUsage lists the features for the -features help.
+func featureUsage() string {
+	var lines []string
+	for _, f := range impact.Features {
+		lines = append(lines, fmt.Sprintf("%s (default %t, sunset %s: %s)", f.Name, f.Default, f.Sunset, f.Effect))
+	}
+	return strings.Join(lines, "; ")
 }
 
-type InterfaceImpact struct {
-	Count              int     `json:"count"`
-	WeightPerInterface float64 `json:"weight_per_interface"`
-	Impact             float64 `json:"impact"`
+// snapshotState writes the state of store to dir every interval until ctx
+// is done.
+func snapshotState(ctx context.Context, store history.Store, dir string, interval, keyAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := server.SaveState(ctx, store, dir, keyAge); err != nil {
+			log.Printf("warning: saving state: %v", err)
+		}
+	}
 }
 
-type ImpactBreakdown struct {
-	Devices         DeviceImpact    `json:"devices"`
-	ImplicitDevices DeviceImpact    `json:"implicit_devices"`
-	Circuits        CircuitImpact   `json:"circuits"`
-	Interfaces      InterfaceImpact `json:"interfaces"`
+// pruneHistory deletes what is older than retention from store every hour
+// until ctx is done.
+func pruneHistory(ctx context.Context, store history.Store, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		pruned, err := store.Prune(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("history: pruning: %v", err)
+		} else if pruned > 0 {
+			log.Printf("history: pruned %d records older than %s", pruned, retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-type ImpactResult struct {
-	TotalImpact                 float64         `json:"total_impact"`
-	TotalImpactBeforeMultiplier float64         `json:"total_impact_before_multiplier"`
-	Multiplier                  float64         `json:"multiplier"`
-	Breakdown                   ImpactBreakdown `json:"breakdown"`
+// runConfigCommand implements "config validate": it loads each file named
+// by its flags the way startup would and reports every problem, warnings
+// included, failing if there were any.
+func runConfigCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	weightsFile := flags.String("weights-file", "", "Weights file to check")
+	calendarFile := flags.String("calendar-file", "", "Calendar file to check")
+	tenantTiersFile := flags.String("tenant-tiers-file", "", "Tenant tiers file to check")
+	compositesFile := flags.String("composites-file", "", "Composites file to check")
+	enrichersFile := flags.String("enrichers-file", "", "Enrichers file to check")
+	instancesFile := flags.String("netbox-instances", "", "NetBox instances file to check")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *weightsFile+*calendarFile+*tenantTiersFile+*compositesFile+*enrichersFile+*instancesFile == "" {
+		return errors.New("usage: config validate [-weights-file FILE] [-calendar-file FILE] [-tenant-tiers-file FILE] [-composites-file FILE] [-enrichers-file FILE] [-netbox-instances FILE]")
+	}
+	var problems []string
+	check := func(path string, err error, warnings ...string) {
+		if err != nil {
+			warnings = append([]string{err.Error()}, warnings...)
+		}
+		if len(warnings) == 0 {
+			fmt.Fprintf(out, "ok %s\n", path)
+		}
+		problems = append(problems, warnings...)
+	}
+	weights := impact.DefaultWeightConfig()
+	if *weightsFile != "" {
+		loaded, warnings, err := impact.LoadWeightsFile(*weightsFile, weights)
+		if err == nil {
+			weights = loaded
+		}
+		check(*weightsFile, err, warnings...)
+	}
+	if *tenantTiersFile != "" {
+		tiers, err := impact.LoadTenantTiersFile(*tenantTiersFile)
+		if err == nil {
+			weights.TenantTiers = tiers
+		}
+		check(*tenantTiersFile, err)
+	}
+	if *calendarFile != "" {
+		calendar, err := impact.LoadCalendarFile(*calendarFile)
+		if err == nil {
+			weights.Calendar = calendar
+		}
+		check(*calendarFile, err)
+	}
+	if *tenantTiersFile != "" || *calendarFile != "" {
+		if err := weights.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("combined weights: %v", err))
+		}
+	}
+	if *compositesFile != "" {
+		check(*compositesFile, impact.LoadCompositesFile(*compositesFile, impact.NewCompositeStore()))
+	}
+	if *enrichersFile != "" {
+		_, err := impact.LoadEnrichersFile(*enrichersFile)
+		check(*enrichersFile, err)
+	}
+	if *instancesFile != "" {
+		_, err := netbox.LoadNetboxInstancesFile(*instancesFile)
+		check(*instancesFile, err)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
 }
 
-func CalculateImpactDetailed(req ImpactRequest, client *NetboxClient) (ImpactResult, error) {
-	deviceWeight := 5.0
-	circuitWeight := 3.0
-	interfaceWeight := 1.0
-
-	deviceCount := len(req.DeviceIDs)
-	deviceImpact := float64(deviceCount) * deviceWeight
+// runScenariosCommand implements "scenarios run [-update] DIR".
+func runScenariosCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("scenarios run", flag.ContinueOnError)
+	update := flags.Bool("update", false, "Rewrite the expected.json files from the current results")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: scenarios run [-update] DIR")
+	}
+	outcomes, err := RunScenarios(context.Background(), flags.Arg(0), *update)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, o := range outcomes {
+		switch {
+		case o.Err != nil:
+			fmt.Fprintf(out, "FAIL %s: %v\n", o.Name, o.Err)
+		case len(o.Diffs) > 0:
+			fmt.Fprintf(out, "FAIL %s\n", o.Name)
+			for _, diff := range o.Diffs {
+				fmt.Fprintf(out, "    %s\n", diff)
+			}
+		case o.Updated:
+			fmt.Fprintf(out, "updated %s\n", o.Name)
+		default:
+			fmt.Fprintf(out, "ok %s\n", o.Name)
+		}
+		if o.Failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scenarios failed", failed, len(outcomes))
+	}
+	return nil
+}
 
-	interfaceCount := len(req.InterfaceIDs)
-	interfaceImpact := float64(interfaceCount) * interfaceWeight
+// runOutcomeCommand implements "outcome record" and "outcome report",
+// which record what changes actually did and compare the estimates with
+// it, through the service's API.
+func runOutcomeCommand(ctx context.Context, args []string, out io.Writer) error {
+	usage := errors.New("usage: outcome record -server URL -severity SEVERITY [-tickets N] [-notes TEXT] HISTORY_ID\n       outcome report -server URL [-impact-type TYPE] [-instance NAME] [-tag TAG] [-since TIME] [-until TIME] [-format json|csv]")
+	if len(args) == 0 || (args[0] != "record" && args[0] != "report") {
+		return usage
+	}
+	flags := flag.NewFlagSet("outcome "+args[0], flag.ContinueOnError)
+	serverURL := flags.String("server", "http://localhost", "URL of the impact service")
+	if args[0] == "record" {
+		severity := flags.String("severity", "", "What the change actually did: "+strings.Join(history.ActualSeverities, ", "))
+		tickets := flags.Int("tickets", 0, "Customer tickets the change caused")
+		notes := flags.String("notes", "", "Notes on the outcome")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if flags.NArg() != 1 || err != nil || *severity == "" {
+			return usage
+		}
+		record, err := impactclient.New(*serverURL).RecordOutcome(ctx, id, history.Outcome{ActualSeverity: *severity, CustomerTickets: *tickets, Notes: *notes})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "history record %d (%s, estimated %s): outcome %s, %d customer tickets\n", record.ID, record.ImpactType,
+			impact.ScoreSeverity(record.NormalizedScore), record.Outcome.ActualSeverity, record.Outcome.CustomerTickets)
+		return nil
+	}
+	var f history.Filter
+	flags.Func("impact-type", "Only calculations of this impact type", func(v string) error {
+		f.ImpactType = impact.ImpactType(v)
+		return nil
+	})
+	flags.StringVar(&f.Instance, "instance", "", "Only calculations on this NetBox instance")
+	flags.Func("tag", "Only calculations carrying this tag (repeatable)", func(v string) error {
+		f.Tags = append(f.Tags, v)
+		return nil
+	})
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		flags.Func(name, "Only calculations made "+name+" this RFC3339 time", func(v string) error {
+			var err error
+			*t, err = time.Parse(time.RFC3339, v)
+			return err
+		})
+	}
+	format := flags.String("format", "json", "Report format: json or csv")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || (*format != "json" && *format != "csv") {
+		return usage
+	}
+	rows, err := impactclient.New(*serverURL).Calibration(ctx, f)
+	if err != nil {
+		return err
+	}
+	if *format == "csv" {
+		return history.WriteCalibrationCSV(out, rows)
+	}
+	data, _ := json.MarshalIndent(rows, "", "  ")
+	fmt.Fprintf(out, "%s\n", data)
+	return nil
+}
 
-	var circuitDetails []CircuitImpactDetail
-	totalCircuitImpact := 0.0
-	implicitDeviceIDs := make(map[int]bool)
+// WeightsSuggestion is the output of "weights suggest": a weights file
+// fragment holding the suggested impact type multipliers, to merge into
+// the -weights-file in use by hand, and the evidence for each.
+type WeightsSuggestion struct {
+	Weights  map[string]interface{}         `json:"weights"`
+	Evidence []history.MultiplierSuggestion `json:"evidence"`
+}
 
-	for _, cid := range req.CircuitIDs {
-		circuit, err := client.FetchCircuitByID(cid)
-		if err != nil {
-			return ImpactResult{}, fmt.Errorf("failed to fetch circuit %d: %v", cid, err)
-		}
-		rf := redundancyFactorCircuit(*circuit)
-		impact := circuitWeight * rf
-		detail := CircuitImpactDetail{
-			ID:               circuit.ID,
-			CID:              circuit.CID,
-			RedundancyFactor: rf,
-			Weight:           circuitWeight,
-			Impact:           impact,
-		}
-		circuitDetails = append(circuitDetails, detail)
-		totalCircuitImpact += impact
-
-		if rf < 1.0 {
-			implicitDeviceIDs[circuit.TerminationA.ID] = true
-		}
-	}
-
-	implicitDeviceCount := len(implicitDeviceIDs)
-	implicitDeviceImpact := float64(implicitDeviceCount) * deviceWeight
-
-	totalBeforeMultiplier := deviceImpact + implicitDeviceImpact + totalCircuitImpact + interfaceImpact
-
-	multiplier, ok := ImpactTypeWeights[req.ImpactType]
-	if !ok {
-		multiplier = 1.0
-	}
-	totalImpact := multiplier * totalBeforeMultiplier
-
-	result := ImpactResult{
-		TotalImpact:                 totalImpact,
-		TotalImpactBeforeMultiplier: totalBeforeMultiplier,
-		Multiplier:                  multiplier,
-		Breakdown: ImpactBreakdown{
-			Devices: DeviceImpact{
-				Count:           deviceCount,
-				WeightPerDevice: deviceWeight,
-				Impact:          deviceImpact,
-			},
-			ImplicitDevices: DeviceImpact{
-				Count:           implicitDeviceCount,
-				WeightPerDevice: deviceWeight,
-				Impact:          implicitDeviceImpact,
-			},
-			Circuits: CircuitImpact{
-				Items:       circuitDetails,
-				TotalImpact: totalCircuitImpact,
-			},
-			Interfaces: InterfaceImpact{
-				Count:              interfaceCount,
-				WeightPerInterface: interfaceWeight,
-				Impact:             interfaceImpact,
-			},
-		},
-	}
-	return result, nil
-}
-
-func ImpactMiddleware(client *NetboxClient, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/calculateImpact" && r.Method == http.MethodPost {
-			var req ImpactRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, "Invalid request payload", http.StatusBadRequest)
-				return
-			}
-			result, err := CalculateImpactDetailed(req, client)
+// runWeightsSuggestCommand implements "weights suggest": it fetches the
+// recorded outcomes from the service and prints the impact type
+// multipliers that would have matched them best. It never changes a
+// weights file.
+func runWeightsSuggestCommand(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("weights suggest", flag.ContinueOnError)
+	serverURL := flags.String("server", "http://localhost", "URL of the impact service")
+	weightsFile := flags.String("weights-file", "", "Weights file the service runs with (default the built-in weights)")
+	minSamples := flags.Int("min-samples", 10, "Fewest outcomes of an impact type to suggest a multiplier from")
+	var f history.Filter
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		flags.Func(name, "Only calculations made "+name+" this date or RFC3339 time", func(v string) error {
+			parsed, err := time.Parse(time.RFC3339, v)
 			if err != nil {
-				http.Error(w, "Error calculating impact: "+err.Error(), http.StatusInternalServerError)
-				return
+				if parsed, err = time.Parse(time.DateOnly, v); err != nil {
+					return fmt.Errorf("%q is not a date or RFC3339 time", v)
+				}
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
-			return
+			*t = parsed
+			return nil
+		})
+	}
+	flags.StringVar(&f.Instance, "instance", "", "Only calculations on this NetBox instance")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: weights suggest -server URL [-since DATE] [-until DATE] [-weights-file FILE] [-min-samples N] [-instance NAME]")
+	}
+	weights := impact.DefaultWeightConfig()
+	if *weightsFile != "" {
+		var err error
+		if weights, _, err = impact.LoadWeightsFile(*weightsFile, weights); err != nil {
+			return err
 		}
-		next.ServeHTTP(w, r)
-	})
+	}
+	samples, err := impactclient.New(*serverURL).Outcomes(ctx, f)
+	if err != nil {
+		return err
+	}
+	suggestion := WeightsSuggestion{Weights: map[string]interface{}{}, Evidence: history.SuggestMultipliers(samples, weights, *minSamples)}
+	if len(suggestion.Evidence) > 0 {
+		multipliers := map[impact.ImpactType]float64{}
+		for _, s := range suggestion.Evidence {
+			multipliers[s.ImpactType] = s.Suggested
+		}
+		suggestion.Weights["impact_types"] = multipliers
+	}
+	if suggestion.Evidence == nil {
+		suggestion.Evidence = []history.MultiplierSuggestion{}
+	}
+	data, _ := json.MarshalIndent(suggestion, "", "  ")
+	fmt.Fprintf(out, "%s\n", data)
+	return nil
 }
 
-func runCLI(client *NetboxClient) {
-	reader := bufio.NewReader(os.Stdin)
-
-	devices, err := client.FetchDevices()
+// newMockNetbox serves the NetBox export at path, injecting the faults of
+// the chaos file, a JSON object of netboxfake.Chaos keyed by path prefix.
+func newMockNetbox(path, chaosFile string, seed uint64) (*netboxfake.Server, error) {
+	data, err := netboxfake.LoadOfflineData(path, "https://netbox.example.com")
 	if err != nil {
-		log.Fatalf("Error fetching devices: %v", err)
+		return nil, err
 	}
-	fmt.Println("Available Devices:")
-	for _, d := range devices {
-		fmt.Printf("ID: %d, Name: %s\n", d.ID, d.Name)
+	srv := netboxfake.New(data)
+	if seed != 0 {
+		srv.Seed(seed)
 	}
-	fmt.Print("Enter device IDs (comma-separated): ")
-	deviceInput, _ := reader.ReadString('\n')
-	deviceIDs := parseIDs(deviceInput)
+	if chaosFile != "" {
+		raw, err := os.ReadFile(chaosFile)
+		if err != nil {
+			return nil, err
+		}
+		var chaos map[string]netboxfake.Chaos
+		if err := json.Unmarshal(raw, &chaos); err != nil {
+			return nil, fmt.Errorf("invalid chaos file %s: %w", chaosFile, err)
+		}
+		for prefix, c := range chaos {
+			srv.SetChaos(prefix, c)
+		}
+	}
+	return srv, nil
+}
 
-	circuits, err := client.FetchCircuits()
+// runMockNetboxCommand implements "mock-netbox [-listen ADDR] [-chaos FILE]
+// [-seed N] PATH".
+func runMockNetboxCommand(args []string) error {
+	flags := flag.NewFlagSet("mock-netbox", flag.ContinueOnError)
+	listen := flags.String("listen", ":8000", "Address to serve the NetBox API on")
+	chaosFile := flags.String("chaos", "", "JSON file of faults to inject, keyed by path prefix; "+netboxfake.ChaosPath+" changes them at runtime")
+	seed := flags.Uint64("seed", 0, "Seed for the injected faults (0 = random)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: mock-netbox [-listen ADDR] [-chaos FILE] [-seed N] PATH")
+	}
+	srv, err := newMockNetbox(flags.Arg(0), *chaosFile, *seed)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving %s as a mock NetBox on %s", flags.Arg(0), *listen)
+	return http.ListenAndServe(*listen, srv)
+}
+
+//go:embed examples/offline/*.json
+var demoFiles embed.FS
+
+// demoData is the dataset of the demo command: the examples/offline export,
+// built into the binary.
+func demoData() (*netboxfake.FakeNetbox, error) {
+	sub, err := fs.Sub(demoFiles, "examples/offline")
 	if err != nil {
-		log.Fatalf("Error fetching circuits: %v", err)
+		return nil, err
 	}
-	fmt.Println("\nAvailable Circuits:")
-	for _, c := range circuits {
-		fmt.Printf("ID: %d, CID: %s, TerminationA: %s, TerminationB: %s\n",
-			c.ID, c.CID, c.TerminationA.Name, c.TerminationB.Name)
+	return netboxfake.LoadOfflineFS(sub, "examples/offline", "https://netbox.example.com")
+}
+
+// demoRequests seed the demo history; the outcomes are recorded against
+// the first of them.
+var (
+	demoRequests = []impact.ImpactRequest{
+		{DeviceIDs: []int{5}, ImpactType: impact.PlannedWork, Reference: "CHG-1001", Tags: []string{"demo", "core-upgrade"}},
+		{CircuitIDs: []int{103, 104}, ImpactType: impact.FiberWorks, Reference: "CHG-1002", Tags: []string{"demo"}},
+		{SiteIDs: []int{2}, ImpactType: impact.ElectricalWork, Reference: "CHG-1003", Tags: []string{"demo"}},
+		{DeviceIDs: []int{9, 17}, ImpactType: impact.IncidentWork, Reference: "INC-2001", Tags: []string{"demo"}},
+		{CircuitIDs: []int{110}, InterfaceIDs: []int{503}, ImpactType: impact.PlannedWork, Reference: "CHG-1004", Tags: []string{"demo"}},
+	}
+	demoOutcomes = []history.Outcome{
+		{ActualSeverity: "low", Notes: "Traffic moved to core-fra01-2 as planned."},
+		{ActualSeverity: "medium", CustomerTickets: 3, Notes: "Slow convergence on AMS-FRA-2."},
+		{ActualSeverity: "high", CustomerTickets: 11},
 	}
-	fmt.Print("Enter circuit IDs (comma-separated): ")
-	circuitInput, _ := reader.ReadString('\n')
-	circuitIDs := parseIDs(circuitInput)
+)
 
-	interfaces, err := client.FetchInterfaces()
+// newDemo configures a server over the embedded dataset that records into
+// store, and seeds store. Nothing is written outside store: there is no
+// publisher, enricher or composites file.
+func newDemo(ctx context.Context, store history.Store) (server.Config, error) {
+	data, err := demoData()
 	if err != nil {
-		log.Fatalf("Error fetching interfaces: %v", err)
+		return server.Config{}, err
 	}
-	fmt.Println("\nAvailable Interfaces:")
-	for _, i := range interfaces {
-		fmt.Printf("ID: %d, Name: %s, Device: %s\n", i.ID, i.Name, i.Device)
+	instances := netbox.NewNetboxInstances()
+	if err := instances.Add("demo", data); err != nil {
+		return server.Config{}, err
 	}
-	fmt.Print("Enter interface IDs (comma-separated): ")
-	interfaceInput, _ := reader.ReadString('\n')
-	interfaceIDs := parseIDs(interfaceInput)
+	opts := impact.DefaultOptions()
+	opts.Redactor.Key = make([]byte, 32)
+	crand.Read(opts.Redactor.Key)
+	cfg := server.Config{
+		Calculator:      impact.NewCalculator(opts),
+		Instances:       instances,
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+		Started:         time.Now(),
+		History:         store,
+	}
+	for i, req := range demoRequests {
+		result, err := cfg.Calculator.Calculate(ctx, req, data, cfg.Weights)
+		if err != nil {
+			return server.Config{}, fmt.Errorf("seeding demo history: %s: %w", req.Reference, err)
+		}
+		record, err := store.Save(ctx, history.NewRecord(req, result))
+		if err != nil {
+			return server.Config{}, fmt.Errorf("seeding demo history: %w", err)
+		}
+		if i < len(demoOutcomes) {
+			if _, err := store.RecordOutcome(ctx, record.ID, demoOutcomes[i]); err != nil {
+				return server.Config{}, fmt.Errorf("seeding demo history: %w", err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// demoExample is a request printed, as a curl command, when the demo starts.
+type demoExample struct {
+	Title  string
+	Method string
+	Path   string
+	Body   string
+}
 
-	fmt.Print("\nEnter impact type (planned-work, fiber-works, electrical-work, incident-work): ")
-	impactTypeInput, _ := reader.ReadString('\n')
-	impactTypeInput = strings.TrimSpace(impactTypeInput)
-	var impactType ImpactType = ImpactType(impactTypeInput)
+var demoExamples = []demoExample{
+	{"Quick score of a core router", http.MethodGet, "/quickImpact/devices/5", ""},
+	{"Work on both FRA01 core routers", http.MethodPost, "/calculateImpact", `{"device_ids": [5, 6], "impact_type": "planned-work", "reference": "CHG-1005"}`},
+	{"Power work at RTM01, with the tenants affected", http.MethodPost, "/calculateImpact", `{"site_ids": [2], "impact_type": "electrical-work", "include_affected_tenants": true}`},
+	{"Compare two fibre cuts", http.MethodPost, "/compareImpact", `{"a": {"circuit_ids": [103], "impact_type": "fiber-works"}, "b": {"circuit_ids": [103, 104], "impact_type": "fiber-works"}}`},
+	{"A NetBox webhook for an updated circuit", http.MethodPost, "/webhooks/netbox", `{"event": "updated", "model": "circuit", "request_id": "demo-1", "data": {"id": 107}}`},
+	{"The seeded history", http.MethodGet, "/history?tag=demo", ""},
+	{"How the seeded estimates compare with their outcomes", http.MethodGet, "/history/calibration", ""},
+}
 
-	req := ImpactRequest{
-		DeviceIDs:    deviceIDs,
-		CircuitIDs:   circuitIDs,
-		InterfaceIDs: interfaceIDs,
-		ImpactType:   impactType,
+// printDemoExamples writes the demo examples as curl commands against
+// baseURL.
+func printDemoExamples(out io.Writer, baseURL string) {
+	for _, ex := range demoExamples {
+		fmt.Fprintf(out, "# %s\n", ex.Title)
+		if ex.Body == "" {
+			fmt.Fprintf(out, "curl -s '%s%s'\n\n", baseURL, ex.Path)
+			continue
+		}
+		fmt.Fprintf(out, "curl -s -X %s '%s%s' -H 'Content-Type: application/json' -d '%s'\n\n", ex.Method, baseURL, ex.Path, ex.Body)
 	}
-	result, err := CalculateImpactDetailed(req, client)
+}
+
+// runDemoCommand implements "demo [-listen ADDR]": the server over the
+// embedded dataset, with seeded history kept in a temporary SQLite file
+// that is removed on exit. The global flags do not apply.
+// runMigrateCommand migrates a history database ahead of an upgrade,
+// reporting each step, after backing a SQLite file up next to it.
+func runMigrateCommand(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dsn := flags.String("history-dsn", "", "History database to migrate: postgres://… or a SQLite file path (sqlite:PATH)")
+	dryRun := flags.Bool("dry-run", false, "Print the SQL of the pending migrations and change nothing")
+	noBackup := flags.Bool("no-backup", false, "Migrate without backing the SQLite file up first; Postgres, which is backed up with pg_dump, needs it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *dsn == "" {
+		return errors.New("usage: migrate -history-dsn DSN [-dry-run] [-no-backup]")
+	}
+	m, err := sqlstore.NewMigrator(ctx, *dsn)
 	if err != nil {
-		log.Fatalf("Error calculating impact: %v", err)
+		return err
 	}
-	resultJSON, _ := json.MarshalIndent(result, "", "  ")
-	fmt.Printf("\nDetailed Impact Result:\n%s\n", string(resultJSON))
+	defer m.Close()
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "history schema version %d; netbox-impact %s migrates to %d\n", version, netbox.Version, m.Latest())
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "nothing to migrate")
+		return nil
+	}
+	if *dryRun {
+		for _, p := range pending {
+			fmt.Fprintf(out, "-- migration %d: %s\n", p.Version, p.Name)
+			for _, stmt := range p.Statements {
+				fmt.Fprintf(out, "%s;\n", stmt)
+			}
+		}
+		return nil
+	}
+	if !*noBackup {
+		if m.Path() == "" {
+			return errors.New("Postgres history is not backed up by migrate: back it up with pg_dump, then run again with -no-backup")
+		}
+		backup := fmt.Sprintf("%s.v%d-%s.bak", m.Path(), version, time.Now().UTC().Format("20060102T150405Z"))
+		if err := m.Backup(ctx, backup); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "backed up to %s\n", backup)
+	}
+	start := time.Now()
+	err = m.Migrate(ctx, func(p sqlstore.Migration, took time.Duration) {
+		fmt.Fprintf(out, "applied migration %d/%d: %s (%s)\n", p.Version, m.Latest(), p.Name, took.Round(time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "history schema version %d, migrated in %s\n", m.Latest(), time.Since(start).Round(time.Millisecond))
+	return nil
 }
 
-func parseIDs(input string) []int {
-	var ids []int
-	parts := strings.Split(strings.TrimSpace(input), ",")
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if id, err := strconv.Atoi(part); err == nil {
-			ids = append(ids, id)
-		}
+func runDemoCommand(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("demo", flag.ContinueOnError)
+	listen := flags.String("listen", "localhost:8080", "Address to serve the demo API on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: demo [-listen ADDR]")
+	}
+	dir, err := os.MkdirTemp("", "netbox-impact-demo-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store, err := sqlstore.Open(ctx, filepath.Join(dir, "history.db"))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	cfg, err := newDemo(ctx, store)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
 	}
-	return ids
+	worker := server.NewJobWorker(cfg, "demo")
+	workerDone := make(chan struct{})
+	defer func() { <-workerDone }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		worker.Run(ctx)
+		close(workerDone)
+	}()
+	srv := &http.Server{Handler: server.New(cfg)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	fmt.Fprintf(out, "Demo API on http://%s over the bundled sample network (examples/offline) with %d seeded history records.\n", ln.Addr(), len(demoRequests))
+	fmt.Fprintf(out, "Nothing is published or written outside a temporary history database. Try:\n\n")
+	printDemoExamples(out, "http://"+ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func main() {
 	mode := flag.String("mode", "server", "Mode to run: server or cli")
 	netboxURL := flag.String("netbox-url", "http://localhost:8000", "NetBox API URL")
 	netboxToken := flag.String("netbox-token", "YOUR_NETBOX_TOKEN", "NetBox API token")
+	instancesFile := flag.String("netbox-instances", "", "JSON file listing several NetBox instances as [{\"name\", \"url\", \"token\"}]; replaces -netbox-url/-netbox-token")
+	clientOpts := netbox.DefaultNetboxClientOptions()
+	flag.DurationVar(&clientOpts.Timeout, "netbox-timeout", clientOpts.Timeout, "Overall timeout per NetBox request")
+	flag.DurationVar(&clientOpts.DialTimeout, "netbox-dial-timeout", clientOpts.DialTimeout, "Timeout for connecting to NetBox")
+	flag.StringVar(&clientOpts.Proxy, "netbox-proxy", "", "Proxy for NetBox requests (http://, https:// or socks5://, user:password@ allowed); overrides HTTP(S)_PROXY")
+	flag.DurationVar(&clientOpts.ResponseHeaderTimeout, "netbox-response-header-timeout", 0, "Timeout for NetBox to start responding (0 = only -netbox-timeout applies)")
+	flag.StringVar(&clientOpts.Tracing.RequestIDHeader, "netbox-request-id-header", clientOpts.Tracing.RequestIDHeader, "Header carrying the service's request ID on NetBox requests (empty disables)")
+	flag.StringVar(&clientOpts.Tracing.TraceparentHeader, "netbox-traceparent-header", clientOpts.Tracing.TraceparentHeader, "Header forwarding the caller's W3C traceparent to NetBox (empty disables)")
+	staticHeaders := flag.String("netbox-static-headers", "", "Comma-separated \"Name: value\" headers sent on every NetBox request, e.g. \"X-Calling-Service: netbox-impact\"")
+	tlsOpts := &clientOpts.TLS
+	flag.StringVar(&tlsOpts.CACertFile, "netbox-ca-cert", "", "PEM bundle of CA certificates trusted for the NetBox connection")
+	flag.StringVar(&tlsOpts.ClientCertFile, "netbox-client-cert", "", "PEM client certificate for mTLS to NetBox")
+	flag.StringVar(&tlsOpts.ClientKeyFile, "netbox-client-key", "", "PEM private key for -netbox-client-cert")
+	flag.BoolVar(&tlsOpts.InsecureSkipVerify, "netbox-insecure-skip-verify", false, "Do not verify the NetBox TLS certificate (testing only)")
+	cacheTTL := flag.Duration("cache-ttl", netbox.DefaultCacheTTL, "How long NetBox object lookups and listings for conditional requests are cached (0 disables the cache)")
+	prewarm := flag.Bool("prewarm", false, "In server mode, load the devices and circuits matching -prewarm-scope into the cache at startup and every -prewarm-interval")
+	prewarmScope := flag.String("prewarm-scope", "", "NetBox filters limiting the warm-up, e.g. \"site=ams01,tag=core\" (empty = everything)")
+	prewarmInterval := flag.Duration("prewarm-interval", 4*time.Minute, "How often to repeat the warm-up; keep it below -cache-ttl (0 = only at startup)")
+	prewarmGrace := flag.Duration("prewarm-grace", 30*time.Second, "How long /readyz waits for the first warm-up before reporting ready anyway")
+	maxRetries := flag.Int("netbox-max-retries", 3, "Retries for NetBox GETs answered with 429, 502, 503 or 504")
+	maxConcurrent := flag.Int("netbox-max-concurrent", netbox.DefaultMaxConcurrent, "Maximum number of NetBox requests in flight at once per instance, shared by all calculations (0 = no limit)")
+	maxPages := flag.Int("netbox-max-pages", 0, "Maximum number of pages to fetch per NetBox listing (0 = no limit)")
+	opts := impact.DefaultOptions()
+	flag.Float64Var(&opts.SanityMismatchFraction, "sanity-mismatch-fraction", 0, "Reject requests when more than this fraction of device/interface IDs resolve as the other type (0 disables)")
+	flag.BoolVar(&opts.Strict, "strict", false, "Enable every correctness guard (strict JSON, sanity checks, strict data) for all requests")
+	flag.BoolVar(&opts.Compat, "compat", false, "Skip ID validation and sanity checks unless a request asks for strict mode (mutually exclusive with -strict)")
+	flag.BoolVar(&opts.Debug, "debug", false, "Enable debug logging")
+	quickImpactType := flag.String("quick-impact-type", string(impact.PlannedWork), "Impact type used by /quickImpact when the caller does not pass one")
+	cliAffectedTenants := flag.Bool("affected-tenants", false, "In CLI mode, list the tenants touched by the change as a table after the result")
+	cliExplain := flag.Bool("explain", false, "In CLI mode, print a plain-English explanation of the score after the result")
+	var cliTags []string
+	flag.Func("tag", "In CLI mode, tag the calculation, e.g. \"datacenter-migration\" (repeatable)", func(tag string) error {
+		cliTags = append(cliTags, tag)
+		return nil
+	})
+	cliTimeout := flag.Duration("cli-timeout", 15*time.Minute, "Maximum duration of an interactive CLI session")
+	compareFiles := flag.String("compare", "", "Compare two impact requests read from JSON files given as \"a.json,b.json\", print the result and exit")
+	flag.IntVar(&opts.BlastRadiusDepth, "blast-radius-depth", opts.BlastRadiusDepth, "Cable hops walked from each explicit device to find downstream devices (0 disables)")
+	flag.BoolVar(&opts.ExpandVMs, "expand-vms", opts.ExpandVMs, "Score the virtual machines hosted on requested devices (one NetBox lookup per device)")
+	flag.StringVar(&opts.ConfigContextPath, "config-context-path", "", "Dotted path of the impact hint in device config contexts, e.g. \"impact\" (empty disables; one NetBox lookup per device)")
+	flag.IntVar(&opts.ConfigContextMaxDevices, "config-context-max-devices", 0, "Read config context hints for at most this many devices per calculation, highest impact first (0 = all)")
+	weights := impact.DefaultWeightConfig()
+	flag.Float64Var(&opts.MaxWeightOverride, "max-weight-override", opts.MaxWeightOverride, "Largest weight or multiplier a request may set in its overrides block")
+	flag.Float64Var(&weights.VirtualMachine, "vm-weight", weights.VirtualMachine, "Impact weight per virtual machine on a requested device (a -weights-file value takes precedence)")
+	weightsFile := flag.String("weights-file", "", "JSON file overriding the impact weights, multipliers and redundancy factors")
+	flag.IntVar(&opts.CallBudget, "netbox-call-budget", opts.CallBudget, "NetBox requests one calculation may send before it stops expanding racks, sites, power feeds, VMs, the blast radius, parallel circuit searches and config context hints (0 = no limit)")
+	flag.IntVar(&opts.FetchConcurrency, "fetch-concurrency", opts.FetchConcurrency, "Maximum number of objects of one type fetched from NetBox in parallel per calculation")
+	calendarFile := flag.String("calendar-file", "", "JSON list of holidays and change freezes ({\"name\", \"start\", \"end\", \"multiplier\"}) that replaces the weights file's calendar")
+	tenantTiersFile := flag.String("tenant-tiers-file", "", "JSON object mapping tenant slugs or names to SLA tiers; replaces the weights file's tenant_tiers")
+	compositesFile := flag.String("composites-file", "", "JSON file with composite (service chain) definitions, loaded at startup and rewritten on every /composites change")
+	enrichersFile := flag.String("enrichers-file", "", "JSON list of enrichers ({\"name\", \"kind\", \"config\"}) that annotate every calculation with data from outside NetBox")
+	hostAliases := flag.String("netbox-host-aliases", "", "Comma-separated extra hostnames accepted in object_urls")
+	netboxAPI := flag.String("netbox-api", "rest", "NetBox API used for bulk device and circuit lookups: rest or graphql")
+	readOnly := flag.Bool("read-only", false, "Refuse every request that changes state (composite edits, cache purges, jobs) with 403 and record no history; shown on /version and /admin/config")
+	historyDSN := flag.String("history-dsn", "", "In server mode, record every result and enable /history and /jobs in this database: postgres://… or a SQLite file path (sqlite:PATH)")
+	historyRetention := flag.Duration("history-retention", 0, "Delete recorded results and finished jobs older than this, checked hourly (0 = keep everything)")
+	publishDir := flag.String("publish-dir", "", "In server mode, also write every result as JSON under this directory, with a latest.json per reference")
+	publishS3URL := flag.String("publish-s3-url", "", "In server mode, also PUT every result to this S3-compatible bucket, path-style, e.g. \"https://s3.eu-west-1.amazonaws.com/impact-results\" (credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	publishS3Region := flag.String("publish-s3-region", "us-east-1", "Region the -publish-s3-url requests are signed for")
+	publishKey := flag.String("publish-key", publish.DefaultKeyTemplate, "Key of published results; may use {reference}, {impact_type}, {instance}, {history_id} and {timestamp}")
+	capacityCeiling := flag.Float64("capacity-ceiling", 0, "Most impact points the recorded calculations may schedule in one maintenance window; above it calculations warn, or fail with 409 in strict mode (0 = no ceiling; needs -history-dsn)")
+	webhookTemplate := flag.String("webhook-response-template", "", "Go text/template rendering the body of synchronous /webhooks/netbox answers from their event, model, object_id, impact_type, severity, score, total_impact and history_id fields, e.g. '{{.Severity}} {{.Score}}' (empty = JSON)")
+	webhookCriticalStatus := flag.Int("webhook-critical-status", http.StatusOK, "HTTP status of synchronous /webhooks/netbox answers whose severity is critical")
+	jobTimeout := flag.Duration("job-timeout", server.DefaultJobTimeout, "Maximum duration of one /jobs calculation")
+	jobWorkers := flag.Int("job-workers", server.DefaultJobConcurrency, "Jobs this instance calculates at once, claimed from the -history-dsn database shared with other instances (0 = only queue and answer for jobs)")
+	jobLease := flag.Duration("job-lease", server.DefaultJobLease, "How long a job stays claimed without a heartbeat before another instance may take it over")
+	snapshotDir := flag.String("snapshot-dir", "", "Directory of network snapshots (offline exports with meta.schema_version) that POST /compareSnapshots can name")
+	offlineData := flag.String("offline-data", "", "Calculate impact from a NetBox export (directory of <section>.json files or one combined JSON file) instead of querying NetBox")
+	stateDir := flag.String("state-dir", "", "In server mode, snapshot the pending jobs and recent idempotency keys to state.json in this directory every -state-interval and at shutdown, and import the snapshot at startup into a history database without jobs (needs -history-dsn)")
+	stateInterval := flag.Duration("state-interval", time.Minute, "How often to write the -state-dir snapshot")
+	stateKeyAge := flag.Duration("state-key-age", server.DefaultStateKeyAge, "How far back the exported state carries records created with an idempotency key")
+	features := flag.String("features", "", "Comma-separated features to turn on, or off with =false, ahead of their sunset: "+featureUsage())
+	statsMinGroupSize := flag.Int("stats-min-group-size", server.DefaultStatsMinGroupSize, "Smallest group of recorded calculations GET /stats reports; smaller ones are left out")
+	statsPublic := flag.Bool("stats-public", false, "Serve GET /stats without an API key when -api-keys-file is set")
+	apiKeysFile := flag.String("api-keys-file", "", "In server mode, JSON list of API keys ({\"name\", \"key_sha256\", \"tenants\"}) one of which every request but /, /readyz, /metrics and /version must send as \"Authorization: Bearer KEY\"; keys with tenants see only those tenants' history")
+	skipNetboxCheck := flag.Bool("skip-netbox-check", false, "Start without checking the NetBox URL and token via /api/status/")
+	filterSpecs := map[string]*string{
+		"devices":    flag.String("device-filter", "", "NetBox filters for the CLI device listing, e.g. \"site=ams01,role=core-switch,status=active,tag=edge,q=rtr\""),
+		"circuits":   flag.String("circuit-filter", "", "NetBox filters for the CLI circuit listing"),
+		"interfaces": flag.String("interface-filter", "", "NetBox filters for the CLI interface listing"),
+	}
+	flag.StringVar(&opts.Lang, "lang", opts.Lang, "Language of the severity and impact type labels in results ("+strings.Join(impact.Langs(), ", ")+")")
+	flag.BoolVar(&opts.RedactAll, "redact", false, "Redact tenant names and -redact-pattern matches in every result (requests can also ask with \"redact\": true)")
+	redactKeyFile := flag.String("redact-key-file", "", "File holding the HMAC key for redaction pseudonyms (default: a random key per start)")
+	flag.Func("redact-pattern", "Regular expression for names to redact, e.g. \"^cust-[a-z]+\" (repeatable)", func(pattern string) error {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		opts.Redactor.Patterns = append(opts.Redactor.Patterns, re)
+		return nil
+	})
 	flag.Parse()
 
-	client := NewNetboxClient(*netboxURL, *netboxToken)
+	if *redactKeyFile != "" {
+		key, err := os.ReadFile(*redactKeyFile)
+		if err != nil {
+			log.Fatalf("Error reading redaction key: %v", err)
+		}
+		opts.Redactor.Key = bytes.TrimSpace(key)
+	} else {
+		opts.Redactor.Key = make([]byte, 32)
+		crand.Read(opts.Redactor.Key)
+	}
+
+	if flag.Arg(0) == "config" && flag.Arg(1) == "validate" {
+		if err := runConfigCommand(flag.Args()[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "scenarios" && flag.Arg(1) == "run" {
+		if err := runScenariosCommand(flag.Args()[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "weights" && flag.Arg(1) == "suggest" {
+		if err := runWeightsSuggestCommand(context.Background(), flag.Args()[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "outcome" {
+		if err := runOutcomeCommand(context.Background(), flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(context.Background(), flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "demo" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runDemoCommand(ctx, flag.Args()[1:], os.Stdout)
+		stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "mock-netbox" {
+		if err := runMockNetboxCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	filters := make(map[string]url.Values)
+	for name, spec := range filterSpecs {
+		filter, err := netbox.ParseListFilter(*spec)
+		if err != nil {
+			log.Fatalf("Invalid %s filter: %v", strings.TrimSuffix(name, "s"), err)
+		}
+		filters[name] = filter
+	}
+
+	if *weightsFile != "" {
+		var warnings []string
+		var err error
+		if weights, warnings, err = impact.LoadWeightsFile(*weightsFile, weights); err != nil {
+			log.Fatalf("Error loading weights: %v", err)
+		}
+		for _, w := range warnings {
+			log.Printf("warning: %s", w)
+		}
+		log.Printf("Using weight set %q from %s", weights.Name, *weightsFile)
+	}
+	if *tenantTiersFile != "" {
+		var err error
+		if weights.TenantTiers, err = impact.LoadTenantTiersFile(*tenantTiersFile); err != nil {
+			log.Fatalf("Error loading tenant tiers: %v", err)
+		}
+	}
+	if *calendarFile != "" {
+		var err error
+		if weights.Calendar, err = impact.LoadCalendarFile(*calendarFile); err != nil {
+			log.Fatalf("Error loading calendar: %v", err)
+		}
+		log.Printf("Loaded %d calendar entries from %s", len(weights.Calendar), *calendarFile)
+	}
+	if err := weights.Validate(); err != nil {
+		log.Fatalf("Invalid weights: %v", err)
+	}
+
+	if opts.Strict && opts.Compat {
+		log.Fatal("-strict and -compat are mutually exclusive")
+	}
+	var err error
+	if opts.Features, err = impact.ParseFeatureFlags(*features); err != nil {
+		log.Fatalf("Invalid -features: %v", err)
+	}
+	for _, w := range opts.Features.Deprecations(weights) {
+		log.Printf("warning: %s", w)
+	}
+	if err := impact.CheckLang(opts.Lang); err != nil {
+		log.Fatalf("Invalid -lang: %v", err)
+	}
+
+	for _, alias := range strings.Split(*hostAliases, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			opts.HostAliases = append(opts.HostAliases, alias)
+		}
+	}
+	if *enrichersFile != "" {
+		var err error
+		if opts.Enrichers, err = impact.LoadEnrichersFile(*enrichersFile); err != nil {
+			log.Fatalf("Error loading enrichers: %v", err)
+		}
+		log.Printf("Loaded %d enrichers from %s", len(opts.Enrichers), *enrichersFile)
+	}
+	calc := impact.NewCalculator(opts)
+
+	if flag.Arg(0) == "calculate" {
+		if err := runCalculateCommand(calc, flag.Args()[1:], weights, *netboxURL, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, header := range strings.Split(*staticHeaders, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			log.Fatalf("Invalid -netbox-static-headers entry %q (expected Name: value)", header)
+		}
+		if clientOpts.Tracing.StaticHeaders == nil {
+			clientOpts.Tracing.StaticHeaders = make(map[string]string)
+		}
+		clientOpts.Tracing.StaticHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	if *netboxAPI != "rest" && *netboxAPI != "graphql" {
+		log.Fatalf("Invalid -netbox-api %q (expected rest or graphql)", *netboxAPI)
+	}
+	configs := []netbox.NetboxInstanceConfig{{Name: "default", URL: *netboxURL, Token: *netboxToken}}
+	if *instancesFile != "" {
+		var err error
+		if configs, err = netbox.LoadNetboxInstancesFile(*instancesFile); err != nil {
+			log.Fatalf("Error loading NetBox instances: %v", err)
+		}
+	}
+	instances := netbox.NewNetboxInstances()
+	if *offlineData != "" {
+		if *instancesFile != "" {
+			log.Fatal("-offline-data and -netbox-instances are mutually exclusive")
+		}
+		data, err := netboxfake.LoadOfflineData(*offlineData, *netboxURL)
+		if err != nil {
+			log.Fatalf("Error loading offline data: %v", err)
+		}
+		instances.Add("offline", data)
+		log.Printf("Using offline NetBox data from %s (%d devices, %d circuits, %d interfaces)", *offlineData, len(data.Devices), len(data.Circuits), len(data.Interfaces))
+		configs = nil
+	}
+	for _, cfg := range configs {
+		client, err := netbox.NewNetboxClientWithOptions(cfg.URL, cfg.Token, clientOpts)
+		if err != nil {
+			log.Fatalf("Invalid NetBox client options: %v", err)
+		}
+		client.MaxPages = *maxPages
+		client.MaxRetries = *maxRetries
+		client.FetchConcurrency = opts.FetchConcurrency
+		if opts.Debug {
+			client.Logger = netbox.DebugRequestLogger
+		}
+		client.SetMaxConcurrent(*maxConcurrent)
+		client.SetCacheTTL(*cacheTTL)
+		if *netboxAPI == "graphql" {
+			client.EnableGraphQL()
+		}
+		client.AllowFeatures(weights.NetboxFeatures())
+		if err := instances.Add(cfg.Name, client); err != nil {
+			log.Fatalf("Error loading NetBox instances: %v", err)
+		}
+		if *skipNetboxCheck {
+			continue
+		}
+		version, err := client.Validate(context.Background())
+		if err != nil {
+			log.Fatalf("NetBox %s at %s is not usable: %v", cfg.Name, cfg.URL, err)
+		}
+		log.Printf("Connected to NetBox %s at %s (%s)", version, cfg.URL, cfg.Name)
+	}
+	client := instances.Default()
+	if tlsOpts.InsecureSkipVerify {
+		log.Println("warning: NetBox TLS certificate verification is disabled")
+	}
+
+	if *compositesFile != "" {
+		// A missing file starts the store empty; the API creates it.
+		if err := impact.LoadCompositesFile(*compositesFile, opts.Composites); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("Error loading composites: %v", err)
+		}
+		opts.Composites.Path = *compositesFile
+	}
+
+	if flag.Arg(0) == "composites" && flag.Arg(1) == "verify" {
+		if err := verifyComposites(context.Background(), client, opts.Composites, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *compareFiles != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), *cliTimeout)
+		err := runCompare(ctx, calc, instances, weights, *compareFiles, os.Stdout)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if *mode == "cli" {
-		runCLI(client)
+		ctx, cancel := context.WithTimeout(context.Background(), *cliTimeout)
+		err := runCLI(ctx, calc, instances, weights, cliOptions{filters: filters, explain: *cliExplain, affectedTenants: *cliAffectedTenants, tags: cliTags}, os.Stdin, os.Stdout)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Netbox Impact API"))
-	})
+	if err := weights.CheckImpactType(impact.ImpactType(*quickImpactType)); err != nil {
+		log.Fatalf("Invalid -quick-impact-type: %v", err)
+	}
+	cfg := server.Config{
+		Calculator:      calc,
+		Instances:       instances,
+		Weights:         weights,
+		QuickImpactType: impact.ImpactType(*quickImpactType),
+		PrewarmGrace:    *prewarmGrace,
+		Started:         time.Now(),
+		ReadOnly:        *readOnly,
+		JobTimeout:      *jobTimeout,
+		CapacityCeiling: *capacityCeiling,
+		StateKeyAge:     *stateKeyAge,
+		StatsPublic:     *statsPublic,
+		Webhook:         server.WebhookConfig{CriticalStatus: *webhookCriticalStatus},
+	}
+	if *statsMinGroupSize < 1 {
+		log.Fatalf("Invalid -stats-min-group-size %d", *statsMinGroupSize)
+	}
+	cfg.StatsMinGroupSize = *statsMinGroupSize
+	if *webhookCriticalStatus < 200 || *webhookCriticalStatus > 599 {
+		log.Fatalf("Invalid -webhook-critical-status %d", *webhookCriticalStatus)
+	}
+	if *webhookTemplate != "" {
+		tmpl, err := template.New("webhook").Parse(*webhookTemplate)
+		if err != nil {
+			log.Fatalf("Invalid -webhook-response-template: %v", err)
+		}
+		cfg.Webhook.ResponseTemplate = tmpl
+	}
+	if *readOnly {
+		log.Printf("Read-only instance: composite edits, cache purges, jobs, history recording and publishing are disabled")
+	}
+	if *apiKeysFile != "" {
+		keys, err := server.LoadAPIKeysFile(*apiKeysFile)
+		if err != nil {
+			log.Fatalf("Error loading API keys: %v", err)
+		}
+		cfg.APIKeys = keys
+		log.Printf("Requiring one of %d API keys", keys.Len())
+	}
+	if *snapshotDir != "" {
+		cfg.Snapshots = netboxfake.NewSnapshotStore(*snapshotDir, *netboxURL)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *prewarm {
+		scope, err := netbox.ParseListFilter(*prewarmScope)
+		if err != nil {
+			log.Fatalf("Invalid -prewarm-scope: %v", err)
+		}
+		if *cacheTTL <= 0 {
+			log.Println("warning: -prewarm has no effect with -cache-ttl=0")
+		}
+		for _, name := range instances.Names() {
+			client, err := instances.Live(name)
+			if err != nil || *cacheTTL <= 0 {
+				continue
+			}
+			p := netbox.NewPrewarmer(name, client, scope, *prewarmInterval)
+			cfg.Prewarmers = append(cfg.Prewarmers, p)
+			go p.Run(ctx)
+		}
+	}
+
+	if *historyDSN != "" {
+		store, err := sqlstore.Open(ctx, *historyDSN)
+		if err != nil {
+			log.Fatalf("Error opening history: %v", err)
+		}
+		defer store.Close()
+		cfg.History = store
+		if *historyRetention > 0 {
+			go pruneHistory(ctx, store, *historyRetention)
+		}
+	}
+	if *stateDir != "" {
+		if cfg.History == nil {
+			log.Fatal("-state-dir needs -history-dsn")
+		}
+		if *stateInterval <= 0 {
+			log.Fatalf("Invalid -state-interval %s", *stateInterval)
+		}
+		if !*readOnly {
+			n, imported, err := server.LoadState(ctx, cfg.History, *stateDir)
+			if err != nil {
+				log.Fatalf("Error importing state: %v", err)
+			}
+			if imported {
+				log.Printf("Imported state from %s: %d jobs, %d records, %d conflicting keys", *stateDir, n.Jobs, n.Records, n.Conflicts)
+			}
+		}
+		go snapshotState(ctx, cfg.History, *stateDir, *stateInterval, *stateKeyAge)
+		// Runs after the job worker has queued its jobs again.
+		defer func() {
+			if err := server.SaveState(context.Background(), cfg.History, *stateDir, *stateKeyAge); err != nil {
+				log.Printf("warning: saving state: %v", err)
+			}
+		}()
+	}
+
+	if *publishDir != "" && *publishS3URL != "" {
+		log.Fatal("-publish-dir and -publish-s3-url are exclusive")
+	}
+	var dest publish.Destination
+	if *publishDir != "" {
+		dest = publish.Dir(*publishDir)
+	}
+	if *publishS3URL != "" {
+		dest = &publish.S3{BucketURL: *publishS3URL, Region: *publishS3Region, AccessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"), SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY")}
+	}
+	if dest != nil {
+		publisher, err := publish.New(dest, *publishKey)
+		if err != nil {
+			log.Fatalf("Invalid -publish-key: %v", err)
+		}
+		defer publisher.Close()
+		cfg.Publisher = publisher
+	}
+
+	if cfg.History != nil && !*readOnly && *jobWorkers > 0 {
+		host, _ := os.Hostname()
+		worker := server.NewJobWorker(cfg, fmt.Sprintf("%s-%d", host, os.Getpid()))
+		worker.Concurrency, worker.Lease = *jobWorkers, *jobLease
+		workerDone := make(chan struct{})
+		go func() {
+			worker.Run(ctx)
+			close(workerDone)
+		}()
+		// Jobs still running are queued again for the other instances.
+		defer func() { <-workerDone }()
+	}
 
-	handler := ImpactMiddleware(client, mux)
+	srv := &http.Server{Addr: ":80", Handler: server.New(cfg)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
 	log.Println("Server running on HTTP port (80)")
-	if err := http.ListenAndServe(":80", handler); err != nil {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 }
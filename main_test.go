@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/history/sqlstore"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/server"
+)
+
+// writeSnapshot saves the sites and the given circuits of netboxfake.Sample as a
+// one-file offline export with meta.schema_version version (0 = no meta).
+func writeSnapshot(t *testing.T, path string, version int, circuitIDs ...int) {
+	t.Helper()
+	f := netboxfake.Sample()
+	sections := map[string]interface{}{"sites": slices.Collect(maps.Values(f.Sites))}
+	var circuits []netbox.Circuit
+	for _, id := range circuitIDs {
+		circuits = append(circuits, f.Circuits[id])
+	}
+	sections["circuits"] = circuits
+	if version != 0 {
+		sections["meta"] = map[string]int{"schema_version": version}
+	}
+	data, _ := json.Marshal(sections)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	// Today AMS-RTM-1 is single-homed; the baseline adds AMS-RTM-2.
+	writeSnapshot(t, filepath.Join(dir, "current.json"), 1, 100)
+	writeSnapshot(t, filepath.Join(dir, "future.json"), 1, 100, 101)
+	writeSnapshot(t, filepath.Join(dir, "unversioned.json"), 0, 100)
+	writeSnapshot(t, filepath.Join(dir, "newer.json"), netboxfake.SnapshotSchemaVersion+1, 100)
+	store := netboxfake.NewSnapshotStore(dir, "https://netbox.example.com")
+	handler := server.SnapshotCompareHandler(impact.NewCalculator(impact.DefaultOptions()), store, impact.DefaultWeightConfig())
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/compareSnapshots", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"snapshot": "current", "baseline_snapshot": "future", "request": {"circuit_ids": [100], "impact_type": "planned-work"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var result impact.CompareResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.A.Breakdown.Circuits.Items[0].RedundantVia != "" || result.B.Breakdown.Circuits.Items[0].RedundantVia != "AMS-RTM-2" {
+		t.Errorf("redundant_via: current %q, baseline %q", result.A.Breakdown.Circuits.Items[0].RedundantVia, result.B.Breakdown.Circuits.Items[0].RedundantVia)
+	}
+	if result.Delta.TotalImpact >= 0 {
+		t.Errorf("delta = %v, want the baseline to score lower", result.Delta.TotalImpact)
+	}
+
+	for body, want := range map[string]string{
+		`{"snapshot": "current", "baseline_snapshot": "unversioned", "request": {"circuit_ids": [100], "impact_type": "planned-work"}}`: "meta.schema_version is missing",
+		`{"snapshot": "newer", "baseline_snapshot": "future", "request": {"circuit_ids": [100], "impact_type": "planned-work"}}`:        "schema version 2 is not supported",
+		`{"snapshot": "../current", "baseline_snapshot": "future", "request": {"circuit_ids": [100], "impact_type": "planned-work"}}`:   "invalid snapshot name",
+		`{"snapshot": "current", "request": {"circuit_ids": [100], "impact_type": "planned-work"}}`:                                     "baseline_snapshot: is required",
+	} {
+		if rec := post(body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: status %d %q, want 400 mentioning %q", body, rec.Code, rec.Body, want)
+		}
+	}
+
+	request := filepath.Join(dir, "request.json")
+	os.WriteFile(request, []byte(`{"circuit_ids": [100], "impact_type": "planned-work"}`), 0o644)
+	var out bytes.Buffer
+	err := runCalculateCommand(impact.NewCalculator(impact.DefaultOptions()), []string{"-snapshot", filepath.Join(dir, "current.json"), "-baseline-snapshot", filepath.Join(dir, "future.json"), "-request-file", request}, impact.DefaultWeightConfig(), "https://netbox.example.com", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("Total impact: %s -> %s", impact.ExplainNumber(result.A.TotalImpact), impact.ExplainNumber(result.B.TotalImpact)); !strings.Contains(out.String(), want) {
+		t.Errorf("CLI output lacks %q:\n%s", want, out.String())
+	}
+}
+
+func TestRedactionLeaksNoNames(t *testing.T) {
+	opts := impact.DefaultOptions()
+	opts.Redactor.Key = []byte("test key")
+	opts.Redactor.Patterns = []*regexp.Regexp{regexp.MustCompile(`sw-[a-z0-9]+`)}
+	calc := impact.NewCalculator(opts)
+	weights := impact.DefaultWeightConfig()
+	weights.TenantTiers = map[string]string{"Globex": "gold"}
+	instances := netboxfake.Instances(t, netboxfake.Sample())
+	secrets := []string{"Acme", "Globex", "sw-ams01"}
+	body := `{"device_ids": [2, 4], "circuit_ids": [103], "impact_type": "planned-work", "include_tenants": true, "include_affected_tenants": true, "explain": true, "blast_radius_depth": 0, "redact": true}`
+
+	outputs := make(map[string]string)
+	calculate := server.ImpactMiddleware(calc, instances, weights, http.NotFoundHandler())
+	for _, target := range []string{"/calculateImpact", "/calculateImpact?units=millipoints"} {
+		rec := httptest.NewRecorder()
+		calculate.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		outputs[target] = rec.Body.String()
+	}
+	rec := httptest.NewRecorder()
+	server.CompareImpactHandler(calc, instances, weights).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/compareImpact", strings.NewReader(`{"a": `+body+`, "b": {"device_ids": [4], "impact_type": "planned-work"}}`)))
+	outputs["compare"] = rec.Body.String()
+	calc.RedactAll = true
+	var cli strings.Builder
+	input := "devices\nn\n2,4\nplanned-work\n\n"
+	if err := runCLI(context.Background(), calc, instances, weights, cliOptions{}, strings.NewReader(input), &cli); err != nil {
+		t.Fatal(err)
+	}
+	outputs["cli"] = cli.String()
+
+	for name, output := range outputs {
+		if !strings.Contains(output, "tenant-") || !strings.Contains(output, "name-") {
+			t.Errorf("%s: no pseudonyms in output:\n%s", name, output)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(output, secret) {
+				t.Errorf("%s: %q leaks into output:\n%s", name, secret, output)
+			}
+		}
+	}
+	if weights.TenantTiers["Globex"] != "gold" {
+		t.Error("redaction modified the weight configuration")
+	}
+
+	var result impact.ImpactResult
+	if err := json.Unmarshal([]byte(outputs["/calculateImpact"]), &result); err != nil {
+		t.Fatal(err)
+	}
+	acme := opts.Redactor.Pseudonym("tenant", "Acme")
+	if result.Breakdown.Devices.Items[0].Tenant != acme || result.Breakdown.Circuits.Items[0].Tenant != acme {
+		t.Errorf("Acme is not redacted consistently: %+v", result.Breakdown)
+	}
+	if result.TotalImpact == 0 || result.Breakdown.Devices.Items[0].ID != 2 {
+		t.Errorf("redaction changed IDs or scores: %+v", result)
+	}
+}
+
+func TestCLIRepromptsForUnknownImpactType(t *testing.T) {
+	instances := netboxfake.Instances(t, netboxfake.Sample())
+	input := strings.Join([]string{
+		"devices", // object types
+		"n",       // do not list devices
+		"1",       // device IDs
+		"incident-wrok",
+		"",
+		"incident-work",
+		"", // no start time
+	}, "\n") + "\n"
+	var out strings.Builder
+	if err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	for _, want := range []string{
+		`unknown impact type "incident-wrok"`,
+		"impact type is required",
+		`"multiplier": 10`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output does not contain %q:\n%s", want, output)
+		}
+	}
+	if got := strings.Count(output, "Enter impact type"); got != 3 {
+		t.Errorf("asked for the impact type %d times, want 3", got)
+	}
+
+	// Running out of input ends the session instead of looping.
+	err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader("devices\nn\n1\nincident-wrok\n"), io.Discard)
+	var verr *netbox.ValidationError
+	if !errors.As(err, &verr) || verr.Field != "impact_type" {
+		t.Errorf("err = %v, want the impact type error", err)
+	}
+}
+
+func TestCLIListsOnlySelectedTypesLazily(t *testing.T) {
+	fake := netboxfake.Sample()
+	for id := 110; id < 170; id++ {
+		fake.Circuits[id] = netbox.Circuit{ID: id, CID: fmt.Sprintf("CID-%d", id)}
+	}
+	srv := netboxfake.NewServer(t, fake)
+	input := strings.Join([]string{
+		"circuits", // object types
+		"y",        // list circuits
+		"",         // no search
+		"q",        // stop after the first page
+		"100",      // circuit IDs
+		"",         // no second search
+		"planned-work",
+		"", // no start time
+	}, "\n") + "\n"
+	var out strings.Builder
+	if err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, srv.Client()), impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	if strings.Contains(output, "Available Devices") || !strings.Contains(output, "Available Circuits") {
+		t.Errorf("listed the wrong object types:\n%s", output)
+	}
+	if got := strings.Count(output, "\nID: "); got != cliPageSize {
+		t.Errorf("printed %d circuits, want one page of %d", got, cliPageSize)
+	}
+	if got := srv.Pages(cliPageSize); got != 1 {
+		t.Errorf("fetched %d listing pages, want 1", got)
+	}
+	if !strings.Contains(output, `"cid": "AMS-RTM-1"`) {
+		t.Errorf("circuit 100 was not scored:\n%s", output)
+	}
+
+	// Known IDs skip the listing altogether.
+	before := srv.Pages(cliPageSize)
+	input = "devices,circuits\nn\n1\nn\n100\nplanned-work\n\n"
+	if err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, srv.Client()), impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader(input), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Pages(cliPageSize) - before; got != 0 {
+		t.Errorf("fetched %d listing pages for known IDs, want 0", got)
+	}
+}
+
+func TestCLIContinuesAfterListingFailure(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	srv.Fail = map[string]int{"/api/dcim/sites/": http.StatusForbidden}
+	script := func(answer string) string {
+		return strings.Join([]string{
+			"sites,circuits", // object types
+			"y",              // list sites, which fails
+			"",               // no search
+			answer,           // continue with the remaining types?
+			"n",              // do not list circuits
+			"100",            // circuit IDs
+			"planned-work",
+			"", // no start time
+		}, "\n") + "\n"
+	}
+	var out strings.Builder
+	if err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, srv.Client()), impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader(script("y")), &out); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	for _, want := range []string{"Error fetching sites", "Continue with the remaining object types?", `"cid": "AMS-RTM-1"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output does not contain %q:\n%s", want, output)
+		}
+	}
+
+	err := runCLI(context.Background(), impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, srv.Client()), impact.DefaultWeightConfig(), cliOptions{}, strings.NewReader(script("n")), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "aborted after failing to fetch sites") {
+		t.Errorf("err = %v, want the session aborted", err)
+	}
+}
+
+func TestCLIDeviceListingShowsRoleAndSite(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	types := cliObjectTypes(context.Background(), srv.Client(), nil)
+	lines, more, err := types[0].fetchPage("", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ID: 1, Name: core-ams01, Role: Core Router, Site: AMS01",
+		"ID: 2, Name: sw-ams01, Role: Access Switch, Site: AMS01",
+	}
+	if !slices.Equal(lines, want) || !more {
+		t.Errorf("got %q (more %v), want %q with more pages", lines, more, want)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata")
+
+func TestScenarioCorpus(t *testing.T) {
+	outcomes, err := RunScenarios(context.Background(), filepath.Join("testdata", "scenarios"), *updateGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcomes) < 8 {
+		t.Errorf("%d scenarios, want at least 8", len(outcomes))
+	}
+	for _, o := range outcomes {
+		if o.Err != nil {
+			t.Errorf("%s: %v", o.Name, o.Err)
+		}
+		for _, diff := range o.Diffs {
+			t.Errorf("%s: %s (rerun with -update to accept)", o.Name, diff)
+		}
+	}
+}
+
+func TestScenarioRunnerReportsDiffs(t *testing.T) {
+	dir := t.TempDir()
+	scenario := filepath.Join(dir, "looped-circuit")
+	if err := os.Mkdir(scenario, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"netbox.json", "request.json", "expected.json"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "scenarios", "looped-circuit", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "expected.json" {
+			data = []byte(strings.Replace(string(data), `"total_impact": 4.9`, `"total_impact": 5.9`, 1))
+		}
+		if err := os.WriteFile(filepath.Join(scenario, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	err := runScenariosCommand([]string{dir}, &out)
+	if err == nil || !strings.Contains(out.String(), "total_impact: want 5.9, got 4.9") {
+		t.Errorf("err = %v, output:\n%s", err, out.String())
+	}
+	out.Reset()
+	if err := runScenariosCommand([]string{"-update", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := runScenariosCommand([]string{dir}, &out); err != nil {
+		t.Errorf("after -update: %v\n%s", err, out.String())
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := write("good.json", `{"device": 7, "time_bands": [{"name": "day", "start": "08:00", "end": "18:00", "multiplier": 2}]}`)
+	var out bytes.Buffer
+	if err := runConfigCommand([]string{"-weights-file", good}, &out); err != nil {
+		t.Fatalf("clean file: %v\n%s", err, &out)
+	}
+	if got := out.String(); got != "ok "+good+"\n" {
+		t.Errorf("clean file output = %q", got)
+	}
+
+	weights := write("weights.json", `{
+  "time_bands": [
+    {"name": "peak", "days": ["mon"], "start": "09:00", "end": "12:00", "multiplier": 3},
+    {"name": "day", "start": "08:00", "end": "18:00", "multiplier": 2, "multiplyer": 4}
+  ],
+  "caps": {"sharez": {}}
+}`)
+	calendar := write("calendar.json", "[\n  {\"name\": \"Christmas\", \"start\": 2026}\n]")
+	out.Reset()
+	err := runConfigCommand([]string{"-weights-file", weights, "-calendar-file", calendar}, &out)
+	if err == nil || err.Error() != "4 problems found" {
+		t.Errorf("err = %v, want 4 problems found", err)
+	}
+	for _, want := range []string{
+		weights + `: unknown key "caps.sharez" ignored (did you mean "shares"?)`,
+		weights + `: unknown key "time_bands[1].multiplyer" ignored (did you mean "multiplier"?)`,
+		weights + `: time_bands[1] "day" overlaps time_bands[0] "peak" from mon 09:00; "peak" wins there`,
+		calendar + `:2:38: json: cannot unmarshal number`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, &out)
+		}
+	}
+}
+
+func TestMockNetbox(t *testing.T) {
+	chaosFile := filepath.Join(t.TempDir(), "chaos.json")
+	if err := os.WriteFile(chaosFile, []byte(`{"/api/circuits/": {"error_rate": 1, "error_status": 500}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mock, err := newMockNetbox("examples/offline", chaosFile, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+	client := netbox.NewNetboxClient(srv.URL, "token")
+	devices, err := client.FetchDevices(context.Background(), nil)
+	if err != nil || len(devices) == 0 {
+		t.Errorf("devices = %d, err = %v", len(devices), err)
+	}
+	var serr *netbox.StatusError
+	if _, err := client.FetchCircuits(context.Background(), nil); !errors.As(err, &serr) || serr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("circuits err = %v, want a 500", err)
+	}
+	resp, err := http.Get(srv.URL + netboxfake.ChaosPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got := strings.TrimSpace(string(body)); got != `{"/api/circuits/":{"error_rate":1,"error_status":500}}` {
+		t.Errorf("GET %s = %s", netboxfake.ChaosPath, got)
+	}
+
+	if _, err := newMockNetbox("examples/offline", "testdata/missing.json", 0); err == nil {
+		t.Error("missing chaos file accepted")
+	}
+}
+
+// historyServer serves the API with a history store over the sample data.
+func historyServer(t *testing.T) (*httptest.Server, history.Store) {
+	t.Helper()
+	store, err := sqlstore.Open(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	srv := httptest.NewServer(server.New(server.Config{
+		Calculator:      impact.NewCalculator(impact.DefaultOptions()),
+		Instances:       netboxfake.Instances(t, netboxfake.NewServer(t, netboxfake.Sample()).Client()),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+		History:         store,
+	}))
+	t.Cleanup(srv.Close)
+	return srv, store
+}
+
+// saveOutcome records a planned-work calculation of total points and its
+// outcome.
+func saveOutcome(t *testing.T, store history.Store, total float64, actual string) history.Record {
+	t.Helper()
+	result := impact.ImpactResult{ImpactType: impact.PlannedWork, TotalImpact: total, Multiplier: 1, NormalizedScore: impact.DefaultWeightConfig().NormalizedScore(total)}
+	record, err := store.Save(context.Background(), history.NewRecord(impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork}, result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "" {
+		if record, err = store.RecordOutcome(context.Background(), record.ID, history.Outcome{ActualSeverity: actual}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return record
+}
+
+func TestOutcomeCommand(t *testing.T) {
+	srv, store := historyServer(t)
+	id := fmt.Sprint(saveOutcome(t, store, 4, "").ID)
+
+	var out bytes.Buffer
+	if err := runOutcomeCommand(context.Background(), []string{"record", "-server", srv.URL, "-severity", "high", "-tickets", "12", id}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "history record " + id + " (planned-work, estimated low): outcome high, 12 customer tickets\n"; out.String() != want {
+		t.Errorf("outcome record printed %q, want %q", out.String(), want)
+	}
+	out.Reset()
+	if err := runOutcomeCommand(context.Background(), []string{"report", "-server", srv.URL, "-impact-type", "planned-work", "-format", "csv"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "impact_type,band,count,impacted,impacted_rate,matched,under,over,average_tickets,actual_none,actual_low,actual_medium,actual_high,actual_critical\n" +
+		"planned-work,low,1,1,1.0000,0,1,0,12.00,0,0,0,1,0\n"
+	if out.String() != want {
+		t.Errorf("outcome report printed\n%s\nwant\n%s", out.String(), want)
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"record", "-server", srv.URL, id},
+		{"record", "-server", srv.URL, "-severity", "dire", id},
+		{"record", "-server", srv.URL, "-severity", "none", "9999"},
+		{"report", "-server", srv.URL, "-since", "yesterday"},
+		{"report", "-server", srv.URL, "-format", "xml"},
+	} {
+		if err := runOutcomeCommand(context.Background(), args, io.Discard); err == nil {
+			t.Errorf("outcome %v succeeded", args)
+		}
+	}
+}
+
+func TestWeightsSuggestCommand(t *testing.T) {
+	srv, store := historyServer(t)
+	// Totals of 20 and 25 are estimated low under the default
+	// normalization; the changes were medium.
+	for _, total := range []float64{20, 25, 20} {
+		saveOutcome(t, store, total, "medium")
+	}
+	weightsFile := filepath.Join(t.TempDir(), "weights.json")
+	if err := os.WriteFile(weightsFile, []byte(`{"impact_types": {"planned-work": 0.5}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runWeightsSuggestCommand(context.Background(), []string{"-server", srv.URL, "-since", "2000-01-01", "-min-samples", "3", "-weights-file", weightsFile}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var got WeightsSuggestion
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	// The records were calculated with a multiplier of 1, and 1.68 is the
+	// step on 0.5 closest to it that lifts them all to medium.
+	if fmt.Sprint(got.Weights) != "map[impact_types:map[planned-work:1.68]]" || len(got.Evidence) != 1 ||
+		got.Evidence[0].Current != 0.5 || got.Evidence[0].Samples != 3 || got.Evidence[0].ErrorBefore != 1 || got.Evidence[0].ErrorAfter != 0 {
+		t.Errorf("weights suggest printed %s", out.String())
+	}
+	// The suggestion is a weights file fragment the service would load.
+	fragment, _ := json.Marshal(got.Weights)
+	if err := os.WriteFile(weightsFile, fragment, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if weights, _, err := impact.LoadWeightsFile(weightsFile, impact.DefaultWeightConfig()); err != nil || weights.ImpactTypes[impact.PlannedWork] != 1.68 {
+		t.Errorf("loading the suggestion: %v", err)
+	}
+
+	out.Reset()
+	if err := runWeightsSuggestCommand(context.Background(), []string{"-server", srv.URL}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"evidence": []`) {
+		t.Errorf("weights suggest with too few samples printed %s", out.String())
+	}
+	if err := runWeightsSuggestCommand(context.Background(), []string{"-server", srv.URL, "-since", "last year"}, io.Discard); err == nil {
+		t.Error("weights suggest accepted -since \"last year\"")
+	}
+}
+
+func TestDemo(t *testing.T) {
+	data, err := demoData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Sites) != 3 || len(data.Devices) != 40 || len(data.Circuits) != 25 || len(data.Tenants) != 3 {
+		t.Errorf("demo dataset has %d sites, %d devices, %d circuits and %d tenants, want 3, 40, 25 and 3", len(data.Sites), len(data.Devices), len(data.Circuits), len(data.Tenants))
+	}
+	onDisk, err := netboxfake.LoadOfflineData("examples/offline", "https://netbox.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data.Devices, onDisk.Devices) || !reflect.DeepEqual(data.Circuits, onDisk.Circuits) {
+		t.Error("the embedded demo dataset differs from examples/offline")
+	}
+
+	store, err := sqlstore.Open(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cfg, err := newDemo(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Publisher != nil || cfg.ReadOnly || len(cfg.Calculator.Enrichers) != 0 {
+		t.Errorf("demo config = %+v, want no publisher or enrichers", cfg)
+	}
+	samples, err := store.Outcomes(context.Background(), history.Filter{})
+	if err != nil || len(samples) != len(demoOutcomes) {
+		t.Errorf("seeded outcomes = %+v, %v", samples, err)
+	}
+	srv := httptest.NewServer(server.New(cfg))
+	defer srv.Close()
+	for _, ex := range demoExamples {
+		req, err := http.NewRequest(ex.Method, srv.URL+ex.Path, strings.NewReader(ex.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: %s %s = %d %s", ex.Title, ex.Method, ex.Path, resp.StatusCode, body)
+		}
+		if ex.Path == "/history?tag=demo" && strings.Count(string(body), `"created_at"`) != len(demoRequests) {
+			t.Errorf("demo history = %s, want %d records", body, len(demoRequests))
+		}
+	}
+
+	var out bytes.Buffer
+	printDemoExamples(&out, "http://localhost:8080")
+	if want := `curl -s -X POST 'http://localhost:8080/calculateImpact' -H 'Content-Type: application/json' -d '{"device_ids": [5, 6]`; !strings.Contains(out.String(), want) {
+		t.Errorf("examples = %s, want %s", out.String(), want)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.db")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var out bytes.Buffer
+	if err := runMigrateCommand(ctx, []string{"-history-dsn", path, "-dry-run"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "history schema version 0;") || !strings.Contains(out.String(), "-- migration 1: records and jobs\nCREATE TABLE records") {
+		t.Errorf("dry run printed\n%s", out.String())
+	}
+
+	// The backup is named after version 0: the dry run migrated nothing.
+	out.Reset()
+	if err := runMigrateCommand(ctx, []string{"-history-dsn", "sqlite:" + path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^backed up to .*history\.db\.v0-\d{8}T\d{6}Z\.bak\n(applied migration \d+/\d+: .+ \(.+\)\n)+history schema version \d+, migrated in `).MatchString(out.String()) {
+		t.Errorf("migrate printed\n%s", out.String())
+	}
+	if backups, _ := filepath.Glob(path + ".v0-*.bak"); len(backups) != 1 {
+		t.Errorf("backups %v, want one", backups)
+	}
+	store, err := sqlstore.Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	out.Reset()
+	if err := runMigrateCommand(ctx, []string{"-history-dsn", path, "-no-backup"}, &out); err != nil || !strings.HasSuffix(out.String(), "nothing to migrate\n") {
+		t.Errorf("second migrate printed %q, %v", out.String(), err)
+	}
+
+	for _, args := range [][]string{nil, {"-history-dsn", filepath.Join(dir, "missing.db")}, {"-history-dsn", path, "extra"}} {
+		if err := runMigrateCommand(ctx, args, io.Discard); err == nil {
+			t.Errorf("migrate %v succeeded", args)
+		}
+	}
+}
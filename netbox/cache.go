@@ -0,0 +1,330 @@
+package netbox
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultCacheTTL = 5 * time.Minute
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type objectCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+func newObjectCache(ttl time.Duration) *objectCache {
+	return &objectCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *objectCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *objectCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *objectCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	return n
+}
+
+// Prewarmer loads the devices and circuits matching Scope into a client's
+// object cache with paginated listings, once at start and then every
+// Interval. It lists full objects rather than brief=1 ones: the cache
+// serves scoring, which needs the role, status, tenant and custom fields
+// the brief form leaves out. Device listings skip config contexts.
+type Prewarmer struct {
+	Instance string
+	Client   *NetboxClient
+	Scope    url.Values
+	Interval time.Duration
+
+	// lastWarm is the Unix time the last warm-up completed.
+	lastWarm atomic.Int64
+	devices  atomic.Int64
+	circuits atomic.Int64
+	failures atomic.Int64
+	first    chan struct{}
+	once     sync.Once
+}
+
+func NewPrewarmer(instance string, client *NetboxClient, scope url.Values, interval time.Duration) *Prewarmer {
+	return &Prewarmer{Instance: instance, Client: client, Scope: scope, Interval: interval, first: make(chan struct{})}
+}
+
+func (p *Prewarmer) warm(ctx context.Context) error {
+	start := time.Now()
+	query := url.Values{"exclude": {"config_context"}}
+	for key, values := range p.Scope {
+		query[key] = values
+	}
+	devices, err := fetchAll[Device](ctx, p.Client, "/api/dcim/devices/", query)
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %w", err)
+	}
+	for _, device := range devices {
+		p.Client.cache.set(fmt.Sprintf("device:%d", device.ID), device)
+	}
+	log.Printf("prewarm %s: cached %d devices", p.Instance, len(devices))
+	circuits, err := fetchAll[Circuit](ctx, p.Client, "/api/circuits/circuits/", p.Scope)
+	if err != nil {
+		return fmt.Errorf("failed to list circuits: %w", err)
+	}
+	for _, circuit := range circuits {
+		p.Client.cache.set(fmt.Sprintf("circuit:%d", circuit.ID), circuit)
+	}
+	p.devices.Store(int64(len(devices)))
+	p.circuits.Store(int64(len(circuits)))
+	p.lastWarm.Store(time.Now().Unix())
+	log.Printf("prewarm %s: cached %d circuits, done in %s", p.Instance, len(circuits), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Run warms the cache until ctx is cancelled. A failed warm-up is logged
+// and counted, and retried at the next interval.
+func (p *Prewarmer) Run(ctx context.Context) {
+	for {
+		if err := p.warm(ctx); err != nil && ctx.Err() == nil {
+			p.failures.Add(1)
+			log.Printf("warning: prewarm %s: %v", p.Instance, err)
+		}
+		p.once.Do(func() { close(p.first) })
+		if p.Interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+// Warmed reports whether the first warm-up has finished, successfully or
+// not.
+func (p *Prewarmer) Warmed() bool {
+	select {
+	case <-p.first:
+		return true
+	default:
+		return false
+	}
+}
+
+// LastWarm is the Unix time the last warm-up completed, 0 if none has.
+func (p *Prewarmer) LastWarm() int64 { return p.lastWarm.Load() }
+
+// Objects is how many devices and circuits the last warm-up loaded.
+func (p *Prewarmer) Objects() (devices, circuits int64) {
+	return p.devices.Load(), p.circuits.Load()
+}
+
+// Failures counts the warm-ups that failed.
+func (p *Prewarmer) Failures() int64 { return p.failures.Load() }
+
+// SetCacheTTL changes how long per-object lookups and listing bodies for
+// conditional requests are kept; 0 disables both.
+func (c *NetboxClient) SetCacheTTL(ttl time.Duration) {
+	c.validators.setTTL(ttl)
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	c.cache.ttl = ttl
+	if ttl <= 0 {
+		c.cache.entries = make(map[string]cacheEntry)
+	}
+}
+
+// PurgeCache drops every cached object and stored listing and returns how
+// many were removed.
+func (c *NetboxClient) PurgeCache() int {
+	return c.cache.purge() + c.validators.purge()
+}
+
+// Most listing bytes kept for conditional requests per client.
+const maxValidatorBytes = 32 << 20
+
+// validatorStore keeps the last response of each listing page with its
+// ETag/Last-Modified, so a 304 can be answered from the stored body. Entries
+// expire after ttl (0 stores nothing) and the least recently used ones are
+// dropped once the stored bodies exceed maxBytes.
+type validatorStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	// lru holds the entries, most recently used first.
+	lru    *list.List
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type validatorEntry struct {
+	endpoint     string
+	etag         string
+	lastModified string
+	body         []byte
+	expires      time.Time
+}
+
+func newValidatorStore(ttl time.Duration, maxBytes int) *validatorStore {
+	return &validatorStore{ttl: ttl, maxBytes: maxBytes, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *validatorStore) get(endpoint string) (validatorEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[endpoint]
+	if !ok {
+		return validatorEntry{}, false
+	}
+	e := elem.Value.(*validatorEntry)
+	if time.Now().After(e.expires) {
+		s.remove(elem)
+		return validatorEntry{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return *e, true
+}
+
+func (s *validatorStore) set(e validatorEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[e.endpoint]; ok {
+		s.remove(elem)
+	}
+	if s.ttl <= 0 || len(e.body) > s.maxBytes {
+		return
+	}
+	e.expires = time.Now().Add(s.ttl)
+	s.entries[e.endpoint] = s.lru.PushFront(&e)
+	s.size += len(e.body)
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *validatorStore) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*validatorEntry)
+	delete(s.entries, e.endpoint)
+	s.size -= len(e.body)
+}
+
+// setTTL changes the lifetime of new entries; 0 also drops the stored ones.
+func (s *validatorStore) setTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.ttl = ttl
+	s.mu.Unlock()
+	if ttl <= 0 {
+		s.purge()
+	}
+}
+
+func (s *validatorStore) purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.entries)
+	s.entries = make(map[string]*list.Element)
+	s.lru.Init()
+	s.size = 0
+	return n
+}
+
+type ConditionalStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int   `json:"bytes"`
+}
+
+// ConditionalStats reports how often NetBox answered a listing with 304 Not
+// Modified (hits) rather than a full page (misses).
+func (c *NetboxClient) ConditionalStats() ConditionalStats {
+	c.validators.mu.Lock()
+	entries, size := len(c.validators.entries), c.validators.size
+	c.validators.mu.Unlock()
+	return ConditionalStats{
+		Hits:    c.validators.hits.Load(),
+		Misses:  c.validators.misses.Load(),
+		Entries: entries,
+		Bytes:   size,
+	}
+}
+
+// isListEndpoint reports whether endpoint is a paginated listing; only those
+// are sent as conditional requests.
+func isListEndpoint(endpoint string) bool {
+	_, query, _ := strings.Cut(endpoint, "?")
+	values, _ := url.ParseQuery(query)
+	return values.Has("limit")
+}
+
+func (c *NetboxClient) authorize(method, endpoint string) error {
+	path := strings.SplitN(endpoint, "?", 2)[0]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rule := range c.Allowlist {
+		if rule.Method == method && strings.HasPrefix(path, rule.PathPrefix) {
+			c.callCounts[rule.Method+" "+rule.PathPrefix]++
+			return nil
+		}
+	}
+	c.deniedCalls++
+	return fmt.Errorf("%w: %s %s", ErrEndpointNotAllowed, method, path)
+}
+
+type AllowlistReport struct {
+	Allowlist   []AllowRule    `json:"allowlist"`
+	Calls       map[string]int `json:"calls"`
+	DeniedCalls int            `json:"denied_calls"`
+}
+
+func (c *NetboxClient) AllowlistReport() AllowlistReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := make(map[string]int, len(c.callCounts))
+	for k, v := range c.callCounts {
+		calls[k] = v
+	}
+	return AllowlistReport{
+		Allowlist:   append([]AllowRule(nil), c.Allowlist...),
+		Calls:       calls,
+		DeniedCalls: c.deniedCalls,
+	}
+}
+
+func (c *NetboxClient) BaseURL() string {
+	return c.APIUrl
+}
@@ -0,0 +1,786 @@
+// Package netbox is the NetBox REST and GraphQL client the impact
+// calculation reads devices, circuits and their neighbours with, and the
+// NetboxAPI interface it is written against.
+package netbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JSONErrorAt adds the line and column of a JSON syntax or type error.
+func JSONErrorAt(path string, data []byte, err error) error {
+	var offset int64
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &serr):
+		offset = serr.Offset
+	case errors.As(err, &terr):
+		offset = terr.Offset
+	default:
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("%s:%d:%d: %w", path, line, column, err)
+}
+
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// NetboxAPI is the NetBox data the impact calculation reads. NetboxClient
+// implements it over HTTP and FakeNetbox from memory.
+type NetboxAPI interface {
+	// BaseURL is the NetBox URL used to build object links and to
+	// recognise object_urls.
+	BaseURL() string
+	FetchDeviceByID(ctx context.Context, id int) (*Device, error)
+	FetchDevicesByIDs(ctx context.Context, ids []int) ([]*Device, error)
+	FetchDevicesBySites(ctx context.Context, siteIDs []int) ([]Device, error)
+	FetchDevicesByRack(ctx context.Context, rackID int) ([]Device, error)
+	// FetchConfigContext returns the device's rendered config context.
+	FetchConfigContext(ctx context.Context, deviceID int) (map[string]interface{}, error)
+	FetchCircuitByID(ctx context.Context, id int) (*Circuit, error)
+	FetchCircuitsByIDs(ctx context.Context, ids []int) (map[int]Circuit, error)
+	FetchCircuitsByEndpoint(ctx context.Context, endpoint string) ([]Circuit, error)
+	// FetchCircuitTerminations lists the terminations of the circuits with
+	// their link peers.
+	FetchCircuitTerminations(ctx context.Context, circuitIDs []int) ([]CircuitTermination, error)
+	// FetchInterfacesByIDs leaves unknown IDs out of the result.
+	FetchInterfacesByIDs(ctx context.Context, ids []int) (map[int]Interface, error)
+	FetchCableByID(ctx context.Context, id int) (*Cable, error)
+	FetchCablesByDevice(ctx context.Context, deviceID int) ([]Cable, error)
+	FetchPortPathEndpoints(ctx context.Context, portType string, id int) ([]CableEndpoint, error)
+	FetchPowerFeedByID(ctx context.Context, id int) (*PowerFeed, error)
+	FetchPowerFeedsByRack(ctx context.Context, rackID int) ([]PowerFeed, error)
+	FetchVirtualMachinesByDevice(ctx context.Context, device Device) ([]VirtualMachine, error)
+	// FetchConsoleServerPorts lists the device's cabled console server
+	// ports.
+	FetchConsoleServerPorts(ctx context.Context, deviceID int) ([]ConsoleServerPort, error)
+	// FetchTenants leaves unknown IDs out of the result.
+	FetchTenants(ctx context.Context, ids []int) ([]Tenant, error)
+	FetchSitesByIDs(ctx context.Context, ids []int) (map[int]Site, error)
+	// FetchNamesByIDs returns the names of the objects under a list
+	// endpoint such as "/api/dcim/sites/"; unknown IDs are left out.
+	FetchNamesByIDs(ctx context.Context, endpoint string, ids []int) (map[int]string, error)
+}
+
+type NetboxClient struct {
+	APIUrl    string
+	Token     string
+	Client    *http.Client
+	Allowlist []AllowRule
+	MaxPages  int
+
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+
+	// FetchConcurrency is the number of devices FetchDevicesByIDs looks up
+	// in parallel over REST.
+	FetchConcurrency int
+
+	// Logger is called after every NetBox request; nil disables it.
+	Logger func(RequestLog)
+
+	options    NetboxClientOptions
+	cache      *objectCache
+	validators *validatorStore
+	graphQL    atomic.Bool
+	// gqlSiteTerminations is set once NetBox rejects the 4.2 circuit
+	// termination fields, so circuits are queried in the older layout.
+	gqlSiteTerminations atomic.Bool
+
+	// slots bounds the number of requests in flight across all callers.
+	slots    chan struct{}
+	inFlight atomic.Int64
+
+	requests     atomic.Int64
+	failures     atomic.Int64
+	totalLatency atomic.Int64
+
+	mu          sync.Mutex
+	callCounts  map[string]int
+	deniedCalls int
+}
+
+var (
+	ErrNotFound     = errors.New("netbox object not found")
+	ErrUnauthorized = errors.New("netbox rejected the API token")
+	ErrRateLimited  = errors.New("netbox rate limit exceeded")
+)
+
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+	Attempts   int
+}
+
+func (e *StatusError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("failed to fetch %s: status %d after %d attempts", e.Endpoint, e.StatusCode, e.Attempts)
+	}
+	return fmt.Sprintf("failed to fetch %s: status %d", e.Endpoint, e.StatusCode)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+type AllowRule struct {
+	Method     string `json:"method"`
+	PathPrefix string `json:"path_prefix"`
+}
+
+var ErrEndpointNotAllowed = errors.New("netbox endpoint not in outbound allowlist")
+
+// Version is reported in the User-Agent sent to NetBox; set it at build time
+// with -ldflags "-X github.com/R2Unit/netbox-impact/netbox.Version=1.2.3".
+var Version = "dev"
+
+type RequestLog struct {
+	Method   string
+	Endpoint string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// DebugRequestLogger is a Logger that logs every request.
+func DebugRequestLogger(r RequestLog) {
+	if r.Err != nil {
+		log.Printf("debug: netbox %s %s -> %d in %s: %v", r.Method, r.Endpoint, r.Status, r.Duration, r.Err)
+		return
+	}
+	log.Printf("debug: netbox %s %s -> %d in %s", r.Method, r.Endpoint, r.Status, r.Duration)
+}
+
+type ClientStats struct {
+	Requests       int64   `json:"requests"`
+	Errors         int64   `json:"errors"`
+	TotalLatencyMs float64 `json:"total_latency_ms"`
+	InFlight       int64   `json:"in_flight"`
+	MaxConcurrent  int     `json:"max_concurrent"`
+}
+
+// Stats returns counters over every request sent to NetBox, retries included.
+func (c *NetboxClient) Stats() ClientStats {
+	return ClientStats{
+		Requests:       c.requests.Load(),
+		Errors:         c.failures.Load(),
+		TotalLatencyMs: float64(time.Duration(c.totalLatency.Load()).Microseconds()) / 1000,
+		InFlight:       c.inFlight.Load(),
+		MaxConcurrent:  cap(c.slots),
+	}
+}
+
+// DefaultMaxConcurrent is the number of NetBox requests a client runs at once.
+const DefaultMaxConcurrent = 10
+
+// SetMaxConcurrent limits how many requests the client sends to NetBox at
+// once; n <= 0 removes the limit. Call it before the client is shared.
+func (c *NetboxClient) SetMaxConcurrent(n int) {
+	if n <= 0 {
+		c.slots = nil
+		return
+	}
+	c.slots = make(chan struct{}, n)
+}
+
+func (c *NetboxClient) acquire(ctx context.Context) error {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.inFlight.Add(1)
+	return nil
+}
+
+func (c *NetboxClient) release() {
+	c.inFlight.Add(-1)
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+func (c *NetboxClient) record(r RequestLog) {
+	c.requests.Add(1)
+	c.totalLatency.Add(int64(r.Duration))
+	if r.Err != nil {
+		c.failures.Add(1)
+	}
+	if c.Logger != nil {
+		c.Logger(r)
+	}
+}
+
+var ErrCallBudgetExhausted = errors.New("netbox call budget exhausted")
+
+// CallBudget counts the NetBox requests, retries included, sent on behalf of
+// one calculation. Once limit is reached only calls on an expansion context
+// are refused: the objects named in the request are always fetched.
+type CallBudget struct {
+	limit     int64
+	used      atomic.Int64
+	exhausted atomic.Bool
+}
+
+// Limit is the budget's call limit; 0 means no limit.
+func (b *CallBudget) Limit() int64 { return b.limit }
+
+// Used is how many NetBox requests were sent against the budget.
+func (b *CallBudget) Used() int64 { return b.used.Load() }
+
+// Exhausted reports whether a request was refused for lack of budget.
+func (b *CallBudget) Exhausted() bool { return b.exhausted.Load() }
+
+type callBudgetKey struct{}
+
+type callBudgetLimitKey struct{}
+
+type expansionKey struct{}
+
+// WithCallBudget sets the NetBox call budget of the calculations run with
+// ctx, replacing Options.CallBudget; limit <= 0 removes the limit.
+func WithCallBudget(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, callBudgetLimitKey{}, limit)
+}
+
+// NewCallBudget starts counting the NetBox requests made under the returned
+// context against limit, or against the limit set by WithCallBudget.
+func NewCallBudget(ctx context.Context, limit int) (context.Context, *CallBudget) {
+	if l, ok := ctx.Value(callBudgetLimitKey{}).(int); ok {
+		limit = l
+	}
+	b := &CallBudget{limit: int64(limit)}
+	return context.WithValue(ctx, callBudgetKey{}, b), b
+}
+
+// Expanding marks ctx as expansion work that stops once the budget is spent.
+func Expanding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, expansionKey{}, true)
+}
+
+// spend counts one request and reports whether it may be sent.
+func (b *CallBudget) spend(ctx context.Context) bool {
+	n := b.used.Add(1)
+	if b.limit > 0 && n > b.limit && ctx.Value(expansionKey{}) != nil {
+		b.used.Add(-1)
+		b.exhausted.Store(true)
+		return false
+	}
+	return true
+}
+
+// defaultAllowlist holds the endpoints a request can make any calculation
+// read. Endpoints only server configuration reaches are added by
+// AllowFeatures and EnableGraphQL.
+func defaultAllowlist() []AllowRule {
+	return []AllowRule{
+		{http.MethodGet, "/api/status/"},
+		{http.MethodGet, "/api/dcim/devices/"},
+		{http.MethodGet, "/api/dcim/interfaces/"},
+		{http.MethodGet, "/api/dcim/sites/"},
+		{http.MethodGet, "/api/dcim/racks/"},
+		{http.MethodGet, "/api/circuits/circuits/"},
+		{http.MethodGet, "/api/circuits/circuit-terminations/"},
+		{http.MethodGet, "/api/dcim/cables/"},
+		{http.MethodGet, "/api/dcim/power-feeds/"},
+		{http.MethodGet, "/api/virtualization/virtual-machines/"},
+		{http.MethodGet, "/api/dcim/front-ports/"},
+		{http.MethodGet, "/api/dcim/rear-ports/"},
+	}
+}
+
+// Features are the optional reads a weight set turns on.
+type Features struct {
+	Tenants            bool
+	ConsoleServerPorts bool
+}
+
+// AllowFeatures allows the endpoints that the given optional features read.
+func (c *NetboxClient) AllowFeatures(f Features) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.Tenants {
+		c.Allowlist = append(c.Allowlist, AllowRule{http.MethodGet, "/api/tenancy/tenants/"})
+	}
+	if f.ConsoleServerPorts {
+		c.Allowlist = append(c.Allowlist, AllowRule{http.MethodGet, "/api/dcim/console-server-ports/"})
+	}
+}
+
+type NetboxClientOptions struct {
+	// Timeout bounds a whole request including reading the body.
+	Timeout time.Duration
+	// DialTimeout bounds establishing the TCP connection.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for response headers once the
+	// request is sent; 0 means no separate limit.
+	ResponseHeaderTimeout time.Duration
+	// Proxy is an http, https or socks5 proxy URL, optionally with
+	// user:password. Empty means HTTP_PROXY/HTTPS_PROXY/NO_PROXY apply.
+	Proxy   string
+	TLS     NetboxTLSOptions
+	Tracing TracingOptions
+}
+
+// TracingOptions names the headers that tie each NetBox request to the
+// calculation that made it. Empty names disable a header.
+type TracingOptions struct {
+	// RequestIDHeader carries the service's request ID.
+	RequestIDHeader string
+	// TraceparentHeader forwards the W3C traceparent the caller sent.
+	TraceparentHeader string
+	// StaticHeaders are sent as-is on every request, e.g. X-Calling-Service.
+	StaticHeaders map[string]string
+}
+
+func DefaultNetboxClientOptions() NetboxClientOptions {
+	return NetboxClientOptions{
+		Timeout:     10 * time.Second,
+		DialTimeout: 5 * time.Second,
+		Tracing: TracingOptions{
+			RequestIDHeader:   "X-Request-ID",
+			TraceparentHeader: "traceparent",
+		},
+	}
+}
+
+func (t TracingOptions) validate() error {
+	names := []string{t.RequestIDHeader, t.TraceparentHeader}
+	for name, value := range t.StaticHeaders {
+		if value != SanitizeHeaderValue(value) {
+			return fmt.Errorf("invalid value for header %s: only printable ASCII is allowed", name)
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if strings.IndexFunc(name, func(r rune) bool {
+			return !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+		}) >= 0 {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// maxTraceValueLen caps request IDs and traceparents taken from callers.
+const maxTraceValueLen = 128
+
+// SanitizeHeaderValue drops everything but printable ASCII, so a caller's
+// request ID cannot inject headers, and caps the length.
+func SanitizeHeaderValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, v)
+	if len(v) > maxTraceValueLen {
+		v = v[:maxTraceValueLen]
+	}
+	return strings.TrimSpace(v)
+}
+
+type traceKey struct{}
+
+type traceInfo struct {
+	requestID   string
+	traceparent string
+}
+
+// WithTrace attaches a request ID and W3C traceparent to ctx; NetBox
+// requests made under ctx carry them.
+func WithTrace(ctx context.Context, requestID, traceparent string) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceInfo{requestID: requestID, traceparent: traceparent})
+}
+
+// TraceFrom returns the request ID and traceparent WithTrace attached to ctx.
+func TraceFrom(ctx context.Context) (requestID, traceparent string) {
+	trace, _ := ctx.Value(traceKey{}).(traceInfo)
+	return trace.requestID, trace.traceparent
+}
+
+// ValidTraceparent reports whether v has the W3C traceparent layout
+// version-traceid-parentid-flags in lowercase hex.
+func ValidTraceparent(v string) bool {
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	return strings.IndexFunc(v, func(r rune) bool {
+		return !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'f')
+	}) < 0
+}
+
+func NewNetboxClient(apiUrl, token string) *NetboxClient {
+	c, _ := NewNetboxClientWithOptions(apiUrl, token, DefaultNetboxClientOptions())
+	return c
+}
+
+func NewNetboxClientWithOptions(apiUrl, token string, opts NetboxClientOptions) (*NetboxClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		proxy, err := parseProxyURL(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	c := &NetboxClient{
+		APIUrl:     apiUrl,
+		Token:      token,
+		Client:     &http.Client{Timeout: opts.Timeout, Transport: transport},
+		Allowlist:  defaultAllowlist(),
+		callCounts: make(map[string]int),
+
+		MaxRetries:       3,
+		RetryBaseDelay:   500 * time.Millisecond,
+		FetchConcurrency: DefaultFetchConcurrency,
+
+		options:    opts,
+		cache:      newObjectCache(DefaultCacheTTL),
+		validators: newValidatorStore(DefaultCacheTTL, maxValidatorBytes),
+	}
+	c.SetMaxConcurrent(DefaultMaxConcurrent)
+	if err := c.ConfigureTLS(opts.TLS); err != nil {
+		return nil, err
+	}
+	if err := opts.Tracing.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// The *url.Error would echo the URL, password included.
+		return nil, fmt.Errorf("invalid proxy URL: %w", err.(*url.Error).Err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be http, https or socks5", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", u.Redacted())
+	}
+	return u, nil
+}
+
+type TimeoutError struct {
+	Endpoint string
+	Phase    string
+	After    time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("netbox request timed out after %s %s %s", e.After, e.Phase, e.Endpoint)
+}
+
+func (e *TimeoutError) Timeout() bool { return true }
+
+// ResponseError is a NetBox response the client could not read or decode:
+// a reset connection, a truncated body or malformed JSON.
+type ResponseError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("unusable netbox response for %s: %v", e.Endpoint, e.Err)
+}
+
+func (e *ResponseError) Unwrap() error { return e.Err }
+
+func (c *NetboxClient) classifyTimeout(endpoint string, err error) error {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return &ResponseError{Endpoint: endpoint, Err: err}
+	}
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return &TimeoutError{Endpoint: endpoint, Phase: "connecting to NetBox for", After: c.options.DialTimeout}
+	case strings.Contains(err.Error(), "awaiting response headers"):
+		return &TimeoutError{Endpoint: endpoint, Phase: "waiting for response headers fetching", After: c.options.ResponseHeaderTimeout}
+	}
+	return &TimeoutError{Endpoint: endpoint, Phase: "fetching", After: c.Client.Timeout}
+}
+
+// Validate checks that NetBox is reachable and accepts the token, returning
+// the NetBox version. NetBox releases without /api/status/ are checked with a
+// one-item device listing instead, which proves the token can read devices.
+func (c *NetboxClient) Validate(ctx context.Context) (string, error) {
+	var status struct {
+		NetboxVersion string `json:"netbox-version"`
+	}
+	err := c.fetch(ctx, "/api/status/", &status)
+	if errors.Is(err, ErrNotFound) {
+		status.NetboxVersion = "unknown"
+		err = c.fetch(ctx, "/api/dcim/devices/?brief=1&limit=1", &struct{}{})
+	}
+	if err == nil {
+		return status.NetboxVersion, nil
+	}
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownCA x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return "", fmt.Errorf("NetBox token rejected (check -netbox-token): %w", err)
+	case errors.As(err, &dnsErr):
+		return "", fmt.Errorf("cannot resolve NetBox host %s (check -netbox-url): %w", dnsErr.Name, err)
+	case errors.As(err, &certErr), errors.As(err, &unknownCA), errors.As(err, &hostErr):
+		return "", fmt.Errorf("NetBox TLS certificate not trusted (see -netbox-ca-cert): %w", err)
+	case errors.As(err, &recordErr):
+		return "", fmt.Errorf("TLS handshake with NetBox failed, is -netbox-url using the right scheme?: %w", err)
+	}
+	return "", fmt.Errorf("NetBox check failed: %w", err)
+}
+
+type NetboxTLSOptions struct {
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+}
+
+func (o NetboxTLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CACertFile != "" {
+		pem, err := os.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading NetBox CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("NetBox CA bundle %s contains no valid PEM certificates", o.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+	if (o.ClientCertFile == "") != (o.ClientKeyFile == "") {
+		return nil, fmt.Errorf("NetBox client certificate and key must be given together")
+	}
+	if o.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading NetBox client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (c *NetboxClient) ConfigureTLS(opts NetboxTLSOptions) error {
+	config, err := opts.Config()
+	if err != nil {
+		return err
+	}
+	transport, ok := c.Client.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("NetBox client transport does not support TLS configuration")
+	}
+	transport.TLSClientConfig = config
+	return nil
+}
+
+func (c *NetboxClient) fetch(ctx context.Context, endpoint string, v interface{}) error {
+	return c.send(ctx, http.MethodGet, endpoint, nil, v)
+}
+
+// send performs an allowlisted NetBox call, retrying transient failures.
+// body is only used for POST.
+func (c *NetboxClient) send(ctx context.Context, method, endpoint string, body []byte, v interface{}) error {
+	if err := c.authorize(method, endpoint); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		if b, ok := ctx.Value(callBudgetKey{}).(*CallBudget); ok && !b.spend(ctx) {
+			return ErrCallBudgetExhausted
+		}
+		// The slot is held per attempt so retry back-off does not block
+		// other callers.
+		if err := c.acquire(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		status, retryAfter, err := c.fetchOnce(ctx, method, endpoint, body, v)
+		c.release()
+		c.record(RequestLog{Method: method, Endpoint: endpoint, Status: status, Duration: time.Since(start), Err: err})
+		if err == nil {
+			return nil
+		}
+		if !retryableStatus(status) {
+			return err
+		}
+		if attempt > c.MaxRetries {
+			return &StatusError{Endpoint: endpoint, StatusCode: status, Attempts: attempt}
+		}
+		select {
+		case <-time.After(c.retryDelay(attempt, retryAfter)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *NetboxClient) fetchOnce(ctx context.Context, method, endpoint string, body []byte, v interface{}) (int, time.Duration, error) {
+	url := c.APIUrl + endpoint
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Authorization", "Token "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "netbox-impact/"+Version)
+	tracing := c.options.Tracing
+	for name, value := range tracing.StaticHeaders {
+		req.Header.Set(name, value)
+	}
+	if trace, ok := ctx.Value(traceKey{}).(traceInfo); ok {
+		if tracing.RequestIDHeader != "" && trace.requestID != "" {
+			req.Header.Set(tracing.RequestIDHeader, trace.requestID)
+		}
+		if tracing.TraceparentHeader != "" && trace.traceparent != "" {
+			req.Header.Set(tracing.TraceparentHeader, trace.traceparent)
+		}
+	}
+	conditional := method == http.MethodGet && isListEndpoint(endpoint)
+	stored, haveStored := validatorEntry{}, false
+	if conditional {
+		if stored, haveStored = c.validators.get(endpoint); haveStored {
+			if stored.etag != "" {
+				req.Header.Set("If-None-Match", stored.etag)
+			}
+			if stored.lastModified != "" {
+				req.Header.Set("If-Modified-Since", stored.lastModified)
+			}
+		}
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		return 0, 0, c.classifyTimeout(endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && haveStored {
+		c.validators.hits.Add(1)
+		return resp.StatusCode, 0, json.Unmarshal(stored.body, v)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")),
+			&StatusError{Endpoint: endpoint, StatusCode: resp.StatusCode}
+	}
+	if conditional {
+		c.validators.misses.Add(1)
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				if ctx.Err() != nil {
+					return resp.StatusCode, 0, ctx.Err()
+				}
+				return resp.StatusCode, 0, c.classifyTimeout(endpoint, err)
+			}
+			if err := json.Unmarshal(data, v); err != nil {
+				return resp.StatusCode, 0, &ResponseError{Endpoint: endpoint, Err: err}
+			}
+			c.validators.set(validatorEntry{endpoint: endpoint, etag: etag, lastModified: lastModified, body: data})
+			return resp.StatusCode, 0, nil
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		if ctx.Err() != nil {
+			return resp.StatusCode, 0, ctx.Err()
+		}
+		return resp.StatusCode, 0, c.classifyTimeout(endpoint, err)
+	}
+	return resp.StatusCode, 0, nil
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay prefers the server's Retry-After and otherwise backs off
+// exponentially from RetryBaseDelay with up to 50% jitter.
+func (c *NetboxClient) retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, maxRetryDelay)
+	}
+	delay := c.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/2+1))
+}
@@ -0,0 +1,407 @@
+package netbox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pagedDevicesServer serves total devices from /api/dcim/devices/, paged by
+// the limit and offset parameters like NetBox.
+func pagedDevicesServer(t *testing.T, total int, requests *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/dcim/devices/" {
+			http.NotFound(w, r)
+			return
+		}
+		requests.Add(1)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		page := map[string]interface{}{"count": total, "next": nil, "previous": nil}
+		var results []Device
+		for id := offset + 1; id <= min(offset+limit, total); id++ {
+			results = append(results, Device{ID: id, Name: fmt.Sprintf("dev-%d", id)})
+		}
+		page["results"] = results
+		if offset+limit < total {
+			page["next"] = fmt.Sprintf("http://%s/api/dcim/devices/?limit=%d&offset=%d", r.Host, limit, offset+limit)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchDevicesFollowsPages(t *testing.T) {
+	var requests atomic.Int64
+	srv := pagedDevicesServer(t, 2*listPageSize+17, &requests)
+	client := NewNetboxClient(srv.URL, "token")
+	devices, err := client.FetchDevices(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2*listPageSize+17 {
+		t.Errorf("got %d devices, want %d", len(devices), 2*listPageSize+17)
+	}
+	for i, d := range devices {
+		if d.ID != i+1 {
+			t.Fatalf("device %d has ID %d, want %d", i, d.ID, i+1)
+		}
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("made %d requests, want 3", got)
+	}
+}
+
+func TestFetchDevicesMaxPages(t *testing.T) {
+	var requests atomic.Int64
+	srv := pagedDevicesServer(t, 2*listPageSize+17, &requests)
+	client := NewNetboxClient(srv.URL, "token")
+	client.MaxPages = 2
+	devices, err := client.FetchDevices(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2*listPageSize {
+		t.Errorf("got %d devices, want %d", len(devices), 2*listPageSize)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("made %d requests, want 2", got)
+	}
+}
+
+// flakyServer answers the first failures requests with status and then
+// serves a device.
+func flakyServer(t *testing.T, failures int, status int, requests *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= int64(failures) {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Device{ID: 1, Name: "core-ams01"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		status   int
+		requests int64
+		wantErr  error
+	}{
+		{name: "succeeds after two 502s", failures: 2, status: http.StatusBadGateway, requests: 3},
+		{name: "succeeds after two 429s", failures: 2, status: http.StatusTooManyRequests, requests: 3},
+		{name: "gives up after max retries", failures: 10, status: http.StatusServiceUnavailable, requests: 4},
+		{name: "404 is not retried", failures: 10, status: http.StatusNotFound, requests: 1, wantErr: ErrNotFound},
+		{name: "401 is not retried", failures: 10, status: http.StatusUnauthorized, requests: 1, wantErr: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			client := NewNetboxClient(flakyServer(t, tt.failures, tt.status, &requests).URL, "token")
+			client.RetryBaseDelay = time.Millisecond
+			client.SetCacheTTL(0)
+			device, err := client.FetchDeviceByID(context.Background(), 1)
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("made %d requests, want %d", got, tt.requests)
+			}
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.failures > client.MaxRetries:
+				var serr *StatusError
+				if !errors.As(err, &serr) || serr.Attempts != client.MaxRetries+1 {
+					t.Errorf("err = %v, want a StatusError after %d attempts", err, client.MaxRetries+1)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case device.Name != "core-ams01":
+				t.Errorf("device = %+v", device)
+			}
+		})
+	}
+}
+
+func TestRetryDelayHonoursRetryAfter(t *testing.T) {
+	client := NewNetboxClient("http://netbox.invalid", "token")
+	if got := client.retryDelay(1, parseRetryAfter("7")); got != 7*time.Second {
+		t.Errorf("delay with Retry-After: 7 = %s, want 7s", got)
+	}
+	if got := client.retryDelay(1, parseRetryAfter("3600")); got != maxRetryDelay {
+		t.Errorf("delay with Retry-After: 3600 = %s, want the %s cap", got, maxRetryDelay)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		base := client.RetryBaseDelay << (attempt - 1)
+		if got := client.retryDelay(attempt, 0); got < base || got > base+base/2 {
+			t.Errorf("attempt %d delay = %s, want %s plus up to 50%% jitter", attempt, got, base)
+		}
+	}
+}
+
+// writePEM writes blocks of the given type to a file in dir.
+func writePEM(t *testing.T, dir, name, blockType string, blocks ...[]byte) string {
+	t.Helper()
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// selfSignedClientCert returns the PEM files of a self-signed client
+// certificate and its certificate.
+func selfSignedClientCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netbox-impact"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER), cert
+}
+
+func TestNetboxTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey, clientX509 := selfSignedClientCert(t, dir)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The name tells the client whether it presented a certificate.
+		name := "anonymous"
+		if len(r.TLS.PeerCertificates) > 0 {
+			name = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		json.NewEncoder(w).Encode(Device{ID: 1, Name: name})
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	srv.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	serverCA := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	otherCA := writePEM(t, dir, "other-ca.pem", "CERTIFICATE", clientX509.Raw)
+
+	tests := []struct {
+		name    string
+		opts    NetboxTLSOptions
+		wantErr bool
+		// peer is the client certificate name the server saw.
+		peer string
+	}{
+		{name: "custom CA trusted", opts: NetboxTLSOptions{CACertFile: serverCA}, peer: "anonymous"},
+		{name: "system roots only", wantErr: true},
+		{name: "wrong CA", opts: NetboxTLSOptions{CACertFile: otherCA}, wantErr: true},
+		{name: "insecure skip verify", opts: NetboxTLSOptions{InsecureSkipVerify: true}, peer: "anonymous"},
+		{name: "client certificate", opts: NetboxTLSOptions{CACertFile: serverCA, ClientCertFile: clientCert, ClientKeyFile: clientKey}, peer: "netbox-impact"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultNetboxClientOptions()
+			opts.TLS = tt.opts
+			client, err := NewNetboxClientWithOptions(srv.URL, "token", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SetCacheTTL(0)
+			device, err := client.FetchDeviceByID(context.Background(), 1)
+			var certErr *tls.CertificateVerificationError
+			switch {
+			case tt.wantErr && !errors.As(err, &certErr):
+				t.Errorf("err = %v, want a certificate verification error", err)
+			case !tt.wantErr && err != nil:
+				t.Errorf("err = %v", err)
+			case !tt.wantErr && device.Name != tt.peer:
+				t.Errorf("server saw client certificate %q, want %q", device.Name, tt.peer)
+			}
+		})
+	}
+}
+
+func TestNetboxTLSOptionsErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+	tests := []struct {
+		name string
+		opts NetboxTLSOptions
+		want string
+	}{
+		{"unreadable CA", NetboxTLSOptions{CACertFile: filepath.Join(dir, "missing.pem")}, "reading NetBox CA bundle"},
+		{"malformed CA", NetboxTLSOptions{CACertFile: garbage}, "contains no valid PEM certificates"},
+		{"certificate without key", NetboxTLSOptions{ClientCertFile: garbage}, "must be given together"},
+		{"malformed client certificate", NetboxTLSOptions{ClientCertFile: garbage, ClientKeyFile: garbage}, "loading NetBox client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultNetboxClientOptions()
+			opts.TLS = tt.opts
+			_, err := NewNetboxClientWithOptions("https://netbox.example.com", "token", opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionalListing(t *testing.T) {
+	var version atomic.Int64
+	version.Store(1)
+	var notModified atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version.Load())
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count":   1,
+			"next":    nil,
+			"results": []Device{{ID: 1, Name: fmt.Sprintf("core-ams01-v%d", version.Load())}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	client := NewNetboxClient(srv.URL, "token")
+
+	steps := []struct {
+		name         string
+		bump         bool
+		want         string
+		hits, misses int64
+	}{
+		{name: "first listing", want: "core-ams01-v1", misses: 1},
+		{name: "unchanged", want: "core-ams01-v1", hits: 1, misses: 1},
+		{name: "changed", bump: true, want: "core-ams01-v2", hits: 1, misses: 2},
+	}
+	for _, step := range steps {
+		if step.bump {
+			version.Add(1)
+		}
+		devices, err := client.FetchDevices(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(devices) != 1 || devices[0].Name != step.want {
+			t.Errorf("%s: devices = %+v, want %s", step.name, devices, step.want)
+		}
+		stats := client.ConditionalStats()
+		if stats.Hits != step.hits || stats.Misses != step.misses {
+			t.Errorf("%s: hits/misses = %d/%d, want %d/%d", step.name, stats.Hits, stats.Misses, step.hits, step.misses)
+		}
+	}
+	if notModified.Load() != 1 {
+		t.Errorf("server answered 304 %d times, want 1", notModified.Load())
+	}
+}
+
+func TestValidatorStoreBounds(t *testing.T) {
+	entry := func(endpoint string, size int) validatorEntry {
+		return validatorEntry{endpoint: endpoint, etag: `"x"`, body: make([]byte, size)}
+	}
+	s := newValidatorStore(time.Minute, 100)
+	s.set(entry("a", 40))
+	s.set(entry("b", 40))
+	s.get("a") // a is now more recently used than b
+	s.set(entry("c", 40))
+	if _, ok := s.get("b"); ok {
+		t.Error("least recently used entry b was kept")
+	}
+	for _, endpoint := range []string{"a", "c"} {
+		if _, ok := s.get(endpoint); !ok {
+			t.Errorf("entry %s was dropped", endpoint)
+		}
+	}
+	if s.size != 80 {
+		t.Errorf("size = %d, want 80", s.size)
+	}
+	s.set(entry("huge", 101))
+	if _, ok := s.get("huge"); ok || s.size != 80 {
+		t.Errorf("stored a body larger than the limit (size %d)", s.size)
+	}
+
+	s = newValidatorStore(time.Millisecond, 100)
+	s.set(entry("a", 10))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := s.get("a"); ok || s.size != 0 {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestConditionalListingDisabledWithCache(t *testing.T) {
+	var conditional atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			conditional.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": 0, "next": nil, "results": []Device{}})
+	}))
+	t.Cleanup(srv.Close)
+	client := NewNetboxClient(srv.URL, "token")
+	if _, err := client.FetchDevices(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	client.SetCacheTTL(0)
+	if stats := client.ConditionalStats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("disabling the cache left %d stored listings (%d bytes)", stats.Entries, stats.Bytes)
+	}
+	for range 2 {
+		if _, err := client.FetchDevices(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conditional.Load() != 0 {
+		t.Errorf("sent %d conditional requests with the cache disabled", conditional.Load())
+	}
+}
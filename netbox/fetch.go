@@ -0,0 +1,578 @@
+package netbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const listPageSize = 100
+
+func fetchAll[T any](ctx context.Context, c *NetboxClient, endpoint string, query url.Values) ([]T, error) {
+	var all []T
+	for page, offset := 0, 0; ; page++ {
+		if c.MaxPages > 0 && page == c.MaxPages {
+			log.Printf("warning: stopped listing %s after %d pages (-netbox-max-pages)", endpoint, c.MaxPages)
+			return all, nil
+		}
+		var items []T
+		more, err := c.fetchPage(ctx, endpoint, query, offset, listPageSize, &items)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if !more || len(items) == 0 {
+			return all, nil
+		}
+		offset += len(items)
+	}
+}
+
+// ErrPaginationLoop is returned for a listing NetBox keeps paging past its
+// own count.
+var ErrPaginationLoop = errors.New("netbox pagination loop")
+
+// ParseListFilter turns "site=ams01,role=core-switch" into NetBox query
+// parameters. A key may repeat to match any of several values.
+func ParseListFilter(spec string) (url.Values, error) {
+	filter := url.Values{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid filter %q (expected key=value)", part)
+		}
+		filter.Add(key, value)
+	}
+	return filter, nil
+}
+
+// briefQuery adds brief=1 to query, so NetBox returns the slim nested
+// representation (id, name and a few identifying fields) of each object.
+func briefQuery(query url.Values) url.Values {
+	brief := url.Values{"brief": {"1"}}
+	for key, values := range query {
+		brief[key] = values
+	}
+	return brief
+}
+
+func (c *NetboxClient) FetchDevices(ctx context.Context, filter url.Values) ([]Device, error) {
+	return fetchAll[Device](ctx, c, "/api/dcim/devices/", filter)
+}
+
+func (c *NetboxClient) FetchCircuits(ctx context.Context, filter url.Values) ([]Circuit, error) {
+	return fetchAll[Circuit](ctx, c, "/api/circuits/circuits/", filter)
+}
+
+func (c *NetboxClient) FetchInterfaces(ctx context.Context, filter url.Values) ([]Interface, error) {
+	return fetchAll[Interface](ctx, c, "/api/dcim/interfaces/", filter)
+}
+
+func (c *NetboxClient) FetchSites(ctx context.Context) ([]Node, error) {
+	return fetchAll[Node](ctx, c, "/api/dcim/sites/", briefQuery(nil))
+}
+
+func (c *NetboxClient) fetchPage(ctx context.Context, endpoint string, query url.Values, offset, limit int, v interface{}) (bool, error) {
+	var page struct {
+		Count   *int            `json:"count"`
+		Next    *string         `json:"next"`
+		Results json.RawMessage `json:"results"`
+	}
+	params := url.Values{}
+	for key, values := range query {
+		params[key] = values
+	}
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("offset", strconv.Itoa(offset))
+	err := c.fetch(ctx, endpoint+"?"+params.Encode(), &page)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(page.Results, v); err != nil {
+		return false, &ResponseError{Endpoint: endpoint, Err: err}
+	}
+	// A NetBox that keeps answering with a next page past the count it
+	// reported would page forever without -netbox-max-pages.
+	if page.Next != nil && page.Count != nil {
+		var items []json.RawMessage
+		json.Unmarshal(page.Results, &items)
+		if offset+len(items) >= *page.Count {
+			return false, fmt.Errorf("%w: %s has a next page after %d of %d objects", ErrPaginationLoop, endpoint, offset+len(items), *page.Count)
+		}
+	}
+	return page.Next != nil, nil
+}
+
+// BriefCircuit is the brief=1 representation of a circuit.
+type BriefCircuit struct {
+	ID       int    `json:"id"`
+	CID      string `json:"cid"`
+	Provider *Node  `json:"provider"`
+}
+
+// The page fetchers serve listings and request brief=1 objects; use the
+// ByID fetchers for the full schema. Devices are the exception: the brief
+// form drops the role and site the listing shows.
+
+func (c *NetboxClient) FetchDevicesPage(ctx context.Context, filter url.Values, offset, limit int) ([]Device, bool, error) {
+	var devices []Device
+	more, err := c.fetchPage(ctx, "/api/dcim/devices/", filter, offset, limit, &devices)
+	return devices, more, err
+}
+
+func (c *NetboxClient) FetchCircuitsPage(ctx context.Context, filter url.Values, offset, limit int) ([]BriefCircuit, bool, error) {
+	var circuits []BriefCircuit
+	more, err := c.fetchPage(ctx, "/api/circuits/circuits/", briefQuery(filter), offset, limit, &circuits)
+	return circuits, more, err
+}
+
+func (c *NetboxClient) FetchInterfacesPage(ctx context.Context, filter url.Values, offset, limit int) ([]Interface, bool, error) {
+	var interfaces []Interface
+	more, err := c.fetchPage(ctx, "/api/dcim/interfaces/", briefQuery(filter), offset, limit, &interfaces)
+	return interfaces, more, err
+}
+
+func (c *NetboxClient) FetchSitesPage(ctx context.Context, filter url.Values, offset, limit int) ([]Node, bool, error) {
+	var sites []Node
+	more, err := c.fetchPage(ctx, "/api/dcim/sites/", briefQuery(filter), offset, limit, &sites)
+	return sites, more, err
+}
+
+// FetchTenants returns the tenants with their custom fields, cached like
+// single-object lookups.
+func (c *NetboxClient) FetchTenants(ctx context.Context, ids []int) ([]Tenant, error) {
+	var tenants []Tenant
+	var uncached []int
+	for _, id := range ids {
+		if cached, ok := c.cache.get(fmt.Sprintf("tenant:%d", id)); ok {
+			tenants = append(tenants, cached.(Tenant))
+		} else {
+			uncached = append(uncached, id)
+		}
+	}
+	for start := 0; start < len(uncached); start += idFilterChunkSize {
+		chunk := uncached[start:min(start+idFilterChunkSize, len(uncached))]
+		results, err := fetchAll[Tenant](ctx, c, "/api/tenancy/tenants/", url.Values{"id__in": {IDList(chunk)}})
+		if err != nil {
+			return nil, err
+		}
+		for _, tenant := range results {
+			tenants = append(tenants, tenant)
+			c.cache.set(fmt.Sprintf("tenant:%d", tenant.ID), tenant)
+		}
+	}
+	return tenants, nil
+}
+
+func (c *NetboxClient) FetchSitesByIDs(ctx context.Context, ids []int) (map[int]Site, error) {
+	sites := make(map[int]Site, len(ids))
+	var uncached []int
+	for _, id := range ids {
+		if cached, ok := c.cache.get(fmt.Sprintf("site:%d", id)); ok {
+			sites[id] = cached.(Site)
+		} else {
+			uncached = append(uncached, id)
+		}
+	}
+	for start := 0; start < len(uncached); start += idFilterChunkSize {
+		chunk := uncached[start:min(start+idFilterChunkSize, len(uncached))]
+		results, err := fetchAll[Site](ctx, c, "/api/dcim/sites/", url.Values{"id__in": {IDList(chunk)}})
+		if err != nil {
+			return nil, err
+		}
+		for _, site := range results {
+			sites[site.ID] = site
+			c.cache.set(fmt.Sprintf("site:%d", site.ID), site)
+		}
+	}
+	return sites, nil
+}
+
+func (c *NetboxClient) FetchDeviceByID(ctx context.Context, id int) (*Device, error) {
+	key := fmt.Sprintf("device:%d", id)
+	if cached, ok := c.cache.get(key); ok {
+		device := cached.(Device)
+		return &device, nil
+	}
+	endpoint := fmt.Sprintf("/api/dcim/devices/%d/", id)
+	var device Device
+	err := c.fetch(ctx, endpoint, &device)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, device)
+	return &device, nil
+}
+
+func (c *NetboxClient) FetchConfigContext(ctx context.Context, deviceID int) (map[string]interface{}, error) {
+	key := fmt.Sprintf("config_context:%d", deviceID)
+	if cached, ok := c.cache.get(key); ok {
+		return cached.(map[string]interface{}), nil
+	}
+	var device struct {
+		ConfigContext map[string]interface{} `json:"config_context"`
+	}
+	if err := c.fetch(ctx, fmt.Sprintf("/api/dcim/devices/%d/", deviceID), &device); err != nil {
+		return nil, err
+	}
+	c.cache.set(key, device.ConfigContext)
+	return device.ConfigContext, nil
+}
+
+func (c *NetboxClient) FetchCircuitByID(ctx context.Context, id int) (*Circuit, error) {
+	key := fmt.Sprintf("circuit:%d", id)
+	if cached, ok := c.cache.get(key); ok {
+		circuit := cached.(Circuit)
+		return &circuit, nil
+	}
+	endpoint := fmt.Sprintf("/api/circuits/circuits/%d/", id)
+	var circuit Circuit
+	err := c.fetch(ctx, endpoint, &circuit)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, circuit)
+	return &circuit, nil
+}
+
+// FetchDevicesByIDs returns the devices in the order of ids, in one GraphQL
+// query per idFilterChunkSize devices or with concurrent lookups over REST.
+// Either way an unknown ID is a ValidationError on device_ids.
+func (c *NetboxClient) FetchDevicesByIDs(ctx context.Context, ids []int) ([]*Device, error) {
+	if c.graphQL.Load() {
+		devices, err := c.graphQLDevices(ctx, ids)
+		if !errors.Is(err, errGraphQLUnavailable) {
+			return devices, err
+		}
+	}
+	return FetchConcurrently(ctx, "device", ids, c.FetchConcurrency, c.FetchDeviceByID)
+}
+
+const idFilterChunkSize = 50
+
+// uniqueIDs returns ids without repeats, in first-seen order.
+func uniqueIDs(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	unique := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func IDList(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c *NetboxClient) FetchCircuitTerminations(ctx context.Context, circuitIDs []int) ([]CircuitTermination, error) {
+	var terminations []CircuitTermination
+	for start := 0; start < len(circuitIDs); start += idFilterChunkSize {
+		query := url.Values{}
+		for _, id := range circuitIDs[start:min(start+idFilterChunkSize, len(circuitIDs))] {
+			query.Add("circuit_id", strconv.Itoa(id))
+		}
+		results, err := fetchAll[CircuitTermination](ctx, c, "/api/circuits/circuit-terminations/", query)
+		if err != nil {
+			return nil, err
+		}
+		terminations = append(terminations, results...)
+	}
+	return terminations, nil
+}
+
+func (c *NetboxClient) FetchCircuitsByIDs(ctx context.Context, ids []int) (map[int]Circuit, error) {
+	circuits := make(map[int]Circuit, len(ids))
+	var uncached []int
+	for _, id := range uniqueIDs(ids) {
+		if cached, ok := c.cache.get(fmt.Sprintf("circuit:%d", id)); ok {
+			circuits[id] = cached.(Circuit)
+		} else {
+			uncached = append(uncached, id)
+		}
+	}
+	if len(uncached) > 0 && c.graphQL.Load() {
+		results, err := c.graphQLCircuits(ctx, uncached)
+		if !errors.Is(err, errGraphQLUnavailable) {
+			if err != nil {
+				return nil, err
+			}
+			for _, circuit := range results {
+				circuits[circuit.ID] = circuit
+				c.cache.set(fmt.Sprintf("circuit:%d", circuit.ID), circuit)
+			}
+			return circuits, nil
+		}
+	}
+	for start := 0; start < len(uncached); start += idFilterChunkSize {
+		chunk := uncached[start:min(start+idFilterChunkSize, len(uncached))]
+		results, err := fetchAll[Circuit](ctx, c, "/api/circuits/circuits/", url.Values{"id__in": {IDList(chunk)}})
+		if err != nil {
+			return nil, err
+		}
+		for _, circuit := range results {
+			circuits[circuit.ID] = circuit
+			c.cache.set(fmt.Sprintf("circuit:%d", circuit.ID), circuit)
+		}
+	}
+	return circuits, nil
+}
+
+func (c *NetboxClient) FetchInterfacesByIDs(ctx context.Context, ids []int) (map[int]Interface, error) {
+	interfaces := make(map[int]Interface, len(ids))
+	var uncached []int
+	for _, id := range uniqueIDs(ids) {
+		if cached, ok := c.cache.get(fmt.Sprintf("interface:%d", id)); ok {
+			interfaces[id] = cached.(Interface)
+		} else {
+			uncached = append(uncached, id)
+		}
+	}
+	for start := 0; start < len(uncached); start += idFilterChunkSize {
+		chunk := uncached[start:min(start+idFilterChunkSize, len(uncached))]
+		results, err := fetchAll[Interface](ctx, c, "/api/dcim/interfaces/", url.Values{"id__in": {IDList(chunk)}})
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range results {
+			interfaces[iface.ID] = iface
+			c.cache.set(fmt.Sprintf("interface:%d", iface.ID), iface)
+		}
+	}
+	return interfaces, nil
+}
+
+// FetchCircuitsByEndpoint lists the active circuits with a termination at
+// endpoint, as returned by CircuitTermination.Endpoint. Only site and
+// provider network endpoints can be searched; others yield no circuits. The
+// result is cached like a single object.
+func (c *NetboxClient) FetchCircuitsByEndpoint(ctx context.Context, endpoint string) ([]Circuit, error) {
+	kind, id, _ := strings.Cut(endpoint, ":")
+	query := url.Values{"status": {"active"}}
+	switch kind {
+	case "site":
+		query.Set("site_id", id)
+	case "provider_network":
+		query.Set("provider_network_id", id)
+	default:
+		return nil, nil
+	}
+	key := "circuits-at:" + endpoint
+	if cached, ok := c.cache.get(key); ok {
+		return cached.([]Circuit), nil
+	}
+	circuits, err := fetchAll[Circuit](ctx, c, "/api/circuits/circuits/", query)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, circuits)
+	return circuits, nil
+}
+
+// FetchDevicesBySites lists every device at the given sites. The devices are
+// cached like FetchDeviceByID lookups.
+func (c *NetboxClient) FetchDevicesBySites(ctx context.Context, siteIDs []int) ([]Device, error) {
+	var devices []Device
+	for start := 0; start < len(siteIDs); start += idFilterChunkSize {
+		query := url.Values{}
+		for _, id := range siteIDs[start:min(start+idFilterChunkSize, len(siteIDs))] {
+			query.Add("site_id", strconv.Itoa(id))
+		}
+		results, err := fetchAll[Device](ctx, c, "/api/dcim/devices/", query)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range results {
+			c.cache.set(fmt.Sprintf("device:%d", device.ID), device)
+		}
+		devices = append(devices, results...)
+	}
+	return devices, nil
+}
+
+func (c *NetboxClient) FetchDevicesByRack(ctx context.Context, rackID int) ([]Device, error) {
+	devices, err := fetchAll[Device](ctx, c, "/api/dcim/devices/", url.Values{"rack_id": {strconv.Itoa(rackID)}})
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		c.cache.set(fmt.Sprintf("device:%d", device.ID), device)
+	}
+	return devices, nil
+}
+
+func (c *NetboxClient) FetchPowerFeedByID(ctx context.Context, id int) (*PowerFeed, error) {
+	key := fmt.Sprintf("power-feed:%d", id)
+	if cached, ok := c.cache.get(key); ok {
+		feed := cached.(PowerFeed)
+		return &feed, nil
+	}
+	endpoint := fmt.Sprintf("/api/dcim/power-feeds/%d/", id)
+	var feed PowerFeed
+	err := c.fetch(ctx, endpoint, &feed)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, feed)
+	return &feed, nil
+}
+
+func (c *NetboxClient) FetchPowerFeedsByRack(ctx context.Context, rackID int) ([]PowerFeed, error) {
+	return fetchAll[PowerFeed](ctx, c, "/api/dcim/power-feeds/", url.Values{"rack_id": {strconv.Itoa(rackID)}})
+}
+
+func (c *NetboxClient) FetchCableByID(ctx context.Context, id int) (*Cable, error) {
+	key := fmt.Sprintf("cable:%d", id)
+	if cached, ok := c.cache.get(key); ok {
+		cable := cached.(Cable)
+		return &cable, nil
+	}
+	endpoint := fmt.Sprintf("/api/dcim/cables/%d/", id)
+	var cable Cable
+	err := c.fetch(ctx, endpoint, &cable)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, cable)
+	return &cable, nil
+}
+
+func (c *NetboxClient) FetchCablesByDevice(ctx context.Context, deviceID int) ([]Cable, error) {
+	return fetchAll[Cable](ctx, c, "/api/dcim/cables/", url.Values{"device_id": {strconv.Itoa(deviceID)}})
+}
+
+// FetchVirtualMachinesByDevice lists the VMs pinned to the device. When there
+// are none and the device belongs to a cluster, the cluster's VMs are
+// returned instead, since they can run on any of its hosts.
+func (c *NetboxClient) FetchVirtualMachinesByDevice(ctx context.Context, device Device) ([]VirtualMachine, error) {
+	vms, err := fetchAll[VirtualMachine](ctx, c, "/api/virtualization/virtual-machines/", url.Values{"device_id": {strconv.Itoa(device.ID)}})
+	if err != nil || len(vms) > 0 || device.Cluster == nil {
+		return vms, err
+	}
+	return fetchAll[VirtualMachine](ctx, c, "/api/virtualization/virtual-machines/", url.Values{"cluster_id": {strconv.Itoa(device.Cluster.ID)}})
+}
+
+func (c *NetboxClient) FetchConsoleServerPorts(ctx context.Context, deviceID int) ([]ConsoleServerPort, error) {
+	return fetchAll[ConsoleServerPort](ctx, c, "/api/dcim/console-server-ports/", url.Values{"device_id": {strconv.Itoa(deviceID)}, "cabled": {"true"}})
+}
+
+func (c *NetboxClient) FetchPortPathEndpoints(ctx context.Context, portType string, id int) ([]CableEndpoint, error) {
+	endpoint := fmt.Sprintf("/api/dcim/%s/%d/paths/", portType, id)
+	var paths []struct {
+		Path [][]CableEndpoint `json:"path"`
+	}
+	err := c.fetch(ctx, endpoint, &paths)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []CableEndpoint
+	for _, p := range paths {
+		for _, hop := range p.Path {
+			endpoints = append(endpoints, hop...)
+		}
+	}
+	return endpoints, nil
+}
+
+func (c *NetboxClient) FetchNamesByIDs(ctx context.Context, endpoint string, ids []int) (map[int]string, error) {
+	names := make(map[int]string)
+	if len(ids) == 0 {
+		return names, nil
+	}
+	for start := 0; start < len(ids); start += idFilterChunkSize {
+		chunk := ids[start:min(start+idFilterChunkSize, len(ids))]
+		nodes, err := fetchAll[Node](ctx, c, endpoint, briefQuery(url.Values{"id__in": {IDList(chunk)}}))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			names[n.ID] = n.Name
+		}
+	}
+	return names, nil
+}
+
+// DefaultFetchConcurrency is the default number of objects of one type
+// fetched from NetBox in parallel.
+const DefaultFetchConcurrency = 8
+
+func FetchConcurrently[T any](ctx context.Context, kind string, ids []int, workers int, fetch func(context.Context, int) (*T, error)) ([]*T, error) {
+	objects := make([]*T, len(ids))
+	errs := make([]error, len(ids))
+	if workers < 1 {
+		workers = 1
+	}
+	var failed atomic.Bool
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				objects[i], errs[i] = fetch(ctx, ids[i])
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range ids {
+		if failed.Load() {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil, &ValidationError{
+					Field:   kind + "_ids",
+					Message: fmt.Sprintf("%s %d does not exist in NetBox", kind, ids[i]),
+				}
+			}
+			return nil, fmt.Errorf("failed to fetch %s %d: %w", kind, ids[i], err)
+		}
+	}
+	return objects, nil
+}
+
+func ParseIDs(input string) []int {
+	var ids []int
+	parts := strings.Split(strings.TrimSpace(input), ",")
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if id, err := strconv.Atoi(part); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
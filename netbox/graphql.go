@@ -0,0 +1,289 @@
+package netbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errGraphQLUnavailable = errors.New("netbox graphql api unavailable")
+
+// EnableGraphQL makes bulk device and circuit lookups use NetBox's GraphQL
+// API. The client falls back to REST for good if /graphql/ answers 404.
+func (c *NetboxClient) EnableGraphQL() {
+	c.mu.Lock()
+	c.Allowlist = append(c.Allowlist, AllowRule{http.MethodPost, "/graphql/"})
+	c.mu.Unlock()
+	c.graphQL.Store(true)
+}
+
+func (c *NetboxClient) graphQLQuery(ctx context.Context, query string, variables map[string]interface{}, v interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err = c.send(ctx, http.MethodPost, "/graphql/", body, &resp)
+	if errors.Is(err, ErrNotFound) {
+		if c.graphQL.Swap(false) {
+			log.Printf("warning: NetBox has no GraphQL API (/graphql/ returned 404), falling back to REST")
+		}
+		return errGraphQLUnavailable
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("graphql query failed: %s", resp.Errors[0].Message)
+	}
+	return json.Unmarshal(resp.Data, v)
+}
+
+// GraphQL returns IDs as strings and choice fields as bare values; these
+// types convert them to the structs the REST API decodes into. The queries
+// use the filter syntax of NetBox 4.0 to 4.2.
+type gqlNode struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+func (n *gqlNode) node() *Node {
+	if n == nil {
+		return nil
+	}
+	id, _ := strconv.Atoi(n.ID)
+	return &Node{ID: id, Name: n.Name, Slug: n.Slug}
+}
+
+func gqlTags(tags []gqlNode) []Node {
+	var nodes []Node
+	for i := range tags {
+		nodes = append(nodes, *tags[i].node())
+	}
+	return nodes
+}
+
+func gqlChoice(value string) *Choice {
+	if value == "" {
+		return nil
+	}
+	value = strings.ToLower(value)
+	return &Choice{Value: value, Label: strings.ToUpper(value[:1]) + value[1:]}
+}
+
+func gqlIDs(ids []int) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.Itoa(id)
+	}
+	return strs
+}
+
+const graphQLDeviceQuery = `query ($ids: [String!]) {
+  device_list(filters: {id: $ids}) {
+    id name status
+    role { id name slug }
+    site { id name slug }
+    rack { id name }
+    tenant { id name slug }
+    cluster { id name slug }
+    tags { id name slug }
+    custom_fields
+  }
+}`
+
+type gqlDevice struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Status  string    `json:"status"`
+	Role    *gqlNode  `json:"role"`
+	Site    *gqlNode  `json:"site"`
+	Rack    *gqlNode  `json:"rack"`
+	Tenant  *gqlNode  `json:"tenant"`
+	Cluster *gqlNode  `json:"cluster"`
+	Tags    []gqlNode `json:"tags"`
+
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+func (d gqlDevice) device() Device {
+	id, _ := strconv.Atoi(d.ID)
+	return Device{
+		ID:      id,
+		Name:    d.Name,
+		Role:    d.Role.node(),
+		Site:    d.Site.node(),
+		Rack:    d.Rack.node(),
+		Status:  gqlChoice(d.Status),
+		Tenant:  d.Tenant.node(),
+		Cluster: d.Cluster.node(),
+		Tags:    gqlTags(d.Tags),
+
+		CustomFields: d.CustomFields,
+	}
+}
+
+func (c *NetboxClient) graphQLDevices(ctx context.Context, ids []int) ([]*Device, error) {
+	byID := make(map[int]Device, len(ids))
+	var uncached []int
+	for _, id := range ids {
+		if cached, ok := c.cache.get(fmt.Sprintf("device:%d", id)); ok {
+			byID[id] = cached.(Device)
+		} else {
+			uncached = append(uncached, id)
+		}
+	}
+	for start := 0; start < len(uncached); start += idFilterChunkSize {
+		chunk := uncached[start:min(start+idFilterChunkSize, len(uncached))]
+		var data struct {
+			DeviceList []gqlDevice `json:"device_list"`
+		}
+		if err := c.graphQLQuery(ctx, graphQLDeviceQuery, map[string]interface{}{"ids": gqlIDs(chunk)}, &data); err != nil {
+			return nil, err
+		}
+		for _, d := range data.DeviceList {
+			device := d.device()
+			byID[device.ID] = device
+			c.cache.set(fmt.Sprintf("device:%d", device.ID), device)
+		}
+	}
+	devices := make([]*Device, len(ids))
+	for i, id := range ids {
+		device, ok := byID[id]
+		if !ok {
+			return nil, &ValidationError{
+				Field:   "device_ids",
+				Message: fmt.Sprintf("device %d does not exist in NetBox", id),
+			}
+		}
+		devices[i] = &device
+	}
+	return devices, nil
+}
+
+// graphQLCircuitQuery selects the terminations in the layout of NetBox 4.2
+// and later; graphQLSiteCircuitQuery in the site/provider_network layout of
+// earlier releases.
+const graphQLCircuitQuery = `query ($ids: [String!]) {
+  circuit_list(filters: {id: $ids}) {
+    id cid status commit_rate custom_fields
+    provider { id name slug }
+    tenant { id name slug }
+    tags { id name slug }
+    terminations {
+      id term_side
+      termination_type { app_label model }
+      termination {
+        ... on SiteType { id name slug }
+        ... on ProviderNetworkType { id name }
+        ... on LocationType { id name slug }
+        ... on RegionType { id name slug }
+        ... on SiteGroupType { id name slug }
+      }
+    }
+  }
+}`
+
+const graphQLSiteCircuitQuery = `query ($ids: [String!]) {
+  circuit_list(filters: {id: $ids}) {
+    id cid status commit_rate custom_fields
+    provider { id name slug }
+    tenant { id name slug }
+    tags { id name slug }
+    terminations {
+      id term_side
+      site { id name slug }
+      provider_network { id name }
+    }
+  }
+}`
+
+type gqlCircuit struct {
+	ID           string                 `json:"id"`
+	CID          string                 `json:"cid"`
+	Status       string                 `json:"status"`
+	CommitRate   *int                   `json:"commit_rate"`
+	Provider     *gqlNode               `json:"provider"`
+	Tenant       *gqlNode               `json:"tenant"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+	Tags         []gqlNode              `json:"tags"`
+	Terminations []struct {
+		ID              string   `json:"id"`
+		TermSide        string   `json:"term_side"`
+		Site            *gqlNode `json:"site"`
+		ProviderNetwork *gqlNode `json:"provider_network"`
+		TerminationType *struct {
+			AppLabel string `json:"app_label"`
+			Model    string `json:"model"`
+		} `json:"termination_type"`
+		Termination *gqlNode `json:"termination"`
+	} `json:"terminations"`
+}
+
+func (g gqlCircuit) circuit() Circuit {
+	id, _ := strconv.Atoi(g.ID)
+	c := Circuit{ID: id, CID: g.CID, Status: gqlChoice(g.Status), CommitRate: g.CommitRate, Provider: g.Provider.node(), Tenant: g.Tenant.node(), Tags: gqlTags(g.Tags), CustomFields: g.CustomFields}
+	for _, t := range g.Terminations {
+		tid, _ := strconv.Atoi(t.ID)
+		termination := &CircuitTermination{
+			ID:              tid,
+			TermSide:        strings.ToUpper(t.TermSide),
+			Site:            t.Site.node(),
+			ProviderNetwork: t.ProviderNetwork.node(),
+			Termination:     t.Termination.node(),
+		}
+		if t.TerminationType != nil {
+			termination.TerminationType = t.TerminationType.AppLabel + "." + t.TerminationType.Model
+		}
+		switch termination.TermSide {
+		case "A":
+			c.TerminationA = termination
+		case "Z":
+			c.TerminationZ = termination
+		}
+	}
+	return c
+}
+
+// graphQLCircuitList runs the circuit query for ids, falling back to the
+// pre-4.2 termination layout for good when NetBox does not know the newer
+// fields.
+func (c *NetboxClient) graphQLCircuitList(ctx context.Context, ids []int, v interface{}) error {
+	variables := map[string]interface{}{"ids": gqlIDs(ids)}
+	if !c.gqlSiteTerminations.Load() {
+		err := c.graphQLQuery(ctx, graphQLCircuitQuery, variables, v)
+		if err == nil || !strings.Contains(err.Error(), "Cannot query field") {
+			return err
+		}
+		c.gqlSiteTerminations.Store(true)
+	}
+	return c.graphQLQuery(ctx, graphQLSiteCircuitQuery, variables, v)
+}
+
+func (c *NetboxClient) graphQLCircuits(ctx context.Context, ids []int) ([]Circuit, error) {
+	var circuits []Circuit
+	for start := 0; start < len(ids); start += idFilterChunkSize {
+		var data struct {
+			CircuitList []gqlCircuit `json:"circuit_list"`
+		}
+		chunk := ids[start:min(start+idFilterChunkSize, len(ids))]
+		if err := c.graphQLCircuitList(ctx, chunk, &data); err != nil {
+			return nil, err
+		}
+		for _, g := range data.CircuitList {
+			circuits = append(circuits, g.circuit())
+		}
+	}
+	return circuits, nil
+}
@@ -0,0 +1,88 @@
+package netbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type NetboxInstanceConfig struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func LoadNetboxInstancesFile(path string) ([]NetboxInstanceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []NetboxInstanceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, JSONErrorAt(path, data, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s: no instances defined", path)
+	}
+	return configs, nil
+}
+
+// NetboxInstances holds one data source per NetBox instance. The first
+// instance added answers requests that do not name one.
+type NetboxInstances struct {
+	names   []string
+	clients map[string]NetboxAPI
+}
+
+func NewNetboxInstances() *NetboxInstances {
+	return &NetboxInstances{clients: make(map[string]NetboxAPI)}
+}
+
+func (n *NetboxInstances) Add(name string, client NetboxAPI) error {
+	if name == "" {
+		return fmt.Errorf("instance name is required")
+	}
+	if _, exists := n.clients[name]; exists {
+		return fmt.Errorf("duplicate instance %q", name)
+	}
+	n.names = append(n.names, name)
+	n.clients[name] = client
+	return nil
+}
+
+func (n *NetboxInstances) Names() []string {
+	return n.names
+}
+
+func (n *NetboxInstances) Default() NetboxAPI {
+	return n.clients[n.names[0]]
+}
+
+func (n *NetboxInstances) Client(name string) (NetboxAPI, error) {
+	if name == "" {
+		return n.Default(), nil
+	}
+	client, ok := n.clients[name]
+	if !ok {
+		return nil, &ValidationError{
+			Field:   "instance",
+			Message: fmt.Sprintf("unknown NetBox instance %q (known: %s)", name, strings.Join(n.names, ", ")),
+		}
+	}
+	return client, nil
+}
+
+// Live returns the HTTP client of an instance, for the admin endpoints and
+// CLI listings that need more than NetboxAPI.
+func (n *NetboxInstances) Live(name string) (*NetboxClient, error) {
+	client, err := n.Client(name)
+	if err != nil {
+		return nil, err
+	}
+	live, ok := client.(*NetboxClient)
+	if !ok {
+		return nil, fmt.Errorf("NetBox instance %q is not backed by a NetBox server", name)
+	}
+	return live, nil
+}
@@ -0,0 +1,235 @@
+package netbox
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Node struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug,omitempty"`
+}
+
+func (n *Node) NameOrEmpty() string {
+	if n == nil {
+		return ""
+	}
+	return n.Name
+}
+
+type Choice struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+type Device struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Role    *Node   `json:"role"`
+	Site    *Node   `json:"site"`
+	Rack    *Node   `json:"rack"`
+	Status  *Choice `json:"status"`
+	Tenant  *Node   `json:"tenant"`
+	Cluster *Node   `json:"cluster"`
+	Tags    []Node  `json:"tags,omitempty"`
+
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+// UnmarshalJSON also accepts "device_role", which NetBox used before 4.0.
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type device Device
+	var raw struct {
+		device
+		DeviceRole *Node `json:"device_role"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*d = Device(raw.device)
+	if d.Role == nil {
+		d.Role = raw.DeviceRole
+	}
+	return nil
+}
+
+// Site is the full site object; listings use the brief Node form.
+type Site struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Slug   string `json:"slug,omitempty"`
+	Tenant *Node  `json:"tenant"`
+}
+
+type Tenant struct {
+	ID           int                    `json:"id"`
+	Name         string                 `json:"name"`
+	Slug         string                 `json:"slug"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+type VirtualMachine struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Status  *Choice `json:"status"`
+	Device  *Node   `json:"device"`
+	Cluster *Node   `json:"cluster"`
+}
+
+type PowerFeed struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	PowerPanel *Node   `json:"power_panel"`
+	Rack       *Node   `json:"rack"`
+	Status     *Choice `json:"status"`
+}
+
+// ConsoleServerPort is a port on a console server; ConnectedEndpoints are
+// the console ports at the far end of its cable path.
+type ConsoleServerPort struct {
+	ID                 int             `json:"id"`
+	Name               string          `json:"name"`
+	Device             *Node           `json:"device"`
+	ConnectedEndpoints []CableEndpoint `json:"connected_endpoints"`
+}
+
+type Circuit struct {
+	ID           int                 `json:"id"`
+	CID          string              `json:"cid"`
+	Status       *Choice             `json:"status"`
+	CommitRate   *int                `json:"commit_rate"`
+	Provider     *Node               `json:"provider"`
+	Tenant       *Node               `json:"tenant"`
+	TerminationA *CircuitTermination `json:"termination_a"`
+	TerminationZ *CircuitTermination `json:"termination_z"`
+	Tags         []Node              `json:"tags,omitempty"`
+
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+// CircuitTermination covers both NetBox layouts: up to 4.1 a termination
+// points at a site or provider_network, from 4.2 at a generic termination
+// object identified by termination_type.
+type CircuitTermination struct {
+	ID              int    `json:"id"`
+	TermSide        string `json:"term_side"`
+	Site            *Node  `json:"site"`
+	ProviderNetwork *Node  `json:"provider_network"`
+	TerminationType string `json:"termination_type"`
+	Termination     *Node  `json:"termination"`
+	// Circuit and LinkPeers are only in circuit termination listings, not
+	// in the terminations nested in a circuit.
+	Circuit   *Node           `json:"circuit,omitempty"`
+	LinkPeers []CableEndpoint `json:"link_peers,omitempty"`
+}
+
+// PeerDevice returns the device the termination is cabled to, if any.
+func (t CircuitTermination) PeerDevice() *Node {
+	for _, p := range t.LinkPeers {
+		if p.Device != nil {
+			return p.Device
+		}
+	}
+	return nil
+}
+
+// Endpoint identifies what the termination connects to, e.g. "site:12" or
+// "provider_network:3". It is empty when NetBox has no endpoint recorded.
+func (t *CircuitTermination) Endpoint() string {
+	switch {
+	case t == nil:
+		return ""
+	case t.Site != nil:
+		return fmt.Sprintf("site:%d", t.Site.ID)
+	case t.ProviderNetwork != nil:
+		return fmt.Sprintf("provider_network:%d", t.ProviderNetwork.ID)
+	case t.Termination != nil && t.TerminationType == "dcim.site":
+		return fmt.Sprintf("site:%d", t.Termination.ID)
+	case t.Termination != nil && t.TerminationType == "circuits.providernetwork":
+		return fmt.Sprintf("provider_network:%d", t.Termination.ID)
+	case t.Termination != nil && t.TerminationType != "":
+		return fmt.Sprintf("%s:%d", t.TerminationType, t.Termination.ID)
+	}
+	return ""
+}
+
+// SiteID returns the ID of the site the termination is at, 0 when it ends
+// anywhere else.
+func (t *CircuitTermination) SiteID() int {
+	switch {
+	case t == nil:
+		return 0
+	case t.Site != nil:
+		return t.Site.ID
+	case t.Termination != nil && t.TerminationType == "dcim.site":
+		return t.Termination.ID
+	}
+	return 0
+}
+
+func (t *CircuitTermination) EndpointName() string {
+	switch {
+	case t == nil:
+		return ""
+	case t.Site != nil:
+		return t.Site.Name
+	case t.ProviderNetwork != nil:
+		return t.ProviderNetwork.Name
+	}
+	return t.Termination.NameOrEmpty()
+}
+
+type Interface struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Device *Node   `json:"device"`
+	Type   *Choice `json:"type"`
+	// Speed is in kbps.
+	Speed              *int            `json:"speed"`
+	Enabled            *bool           `json:"enabled"`
+	ConnectedEndpoints []CableEndpoint `json:"connected_endpoints"`
+}
+
+// IsEnabled treats an interface without an enabled flag as enabled.
+func (i Interface) IsEnabled() bool {
+	return i.Enabled == nil || *i.Enabled
+}
+
+func (i Interface) DeviceName() string {
+	return i.Device.NameOrEmpty()
+}
+
+type CableTermination struct {
+	ObjectType string        `json:"object_type"`
+	ObjectID   int           `json:"object_id"`
+	Object     CableEndpoint `json:"object"`
+}
+
+type CableEndpoint struct {
+	ID      int    `json:"id"`
+	URL     string `json:"url"`
+	Device  *Node  `json:"device"`
+	Circuit *struct {
+		ID  int    `json:"id"`
+		CID string `json:"cid"`
+	} `json:"circuit"`
+}
+
+type Cable struct {
+	ID            int                `json:"id"`
+	Label         string             `json:"label"`
+	ATerminations []CableTermination `json:"a_terminations"`
+	BTerminations []CableTermination `json:"b_terminations"`
+}
+
+// PeerDevices returns the devices cabled to deviceID through this cable.
+func (c Cable) PeerDevices(deviceID int) []int {
+	var peers []int
+	for _, t := range append(c.ATerminations, c.BTerminations...) {
+		if t.Object.Device != nil && t.Object.Device.ID != deviceID {
+			peers = append(peers, t.Object.Device.ID)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,218 @@
+package netboxfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChaosPath is the control endpoint of a Server's chaos: GET returns the
+// faults per path prefix, PUT replaces them with a JSON object of the same
+// shape and DELETE removes them. PUT ?seed=N also reseeds the dice.
+const ChaosPath = "/_chaos"
+
+// Chaos is the faults a Server injects into responses. The rates are
+// probabilities from 0 to 1, rolled per request in this order: reset,
+// error, truncate, malformed.
+type Chaos struct {
+	// ErrorRate answers with ErrorStatus, 503 when unset.
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	ErrorStatus int     `json:"error_status,omitempty"`
+	// Every response waits LatencyMS plus up to JitterMS, and TailRate of
+	// them another TailMS, for a long-tailed latency distribution.
+	LatencyMS int     `json:"latency_ms,omitempty"`
+	JitterMS  int     `json:"jitter_ms,omitempty"`
+	TailRate  float64 `json:"tail_rate,omitempty"`
+	TailMS    int     `json:"tail_ms,omitempty"`
+	// MalformedRate cuts the body in half and appends an HTML error page,
+	// like a proxy would.
+	MalformedRate float64 `json:"malformed_rate,omitempty"`
+	// TruncateRate declares the full Content-Length but sends half the body.
+	TruncateRate float64 `json:"truncate_rate,omitempty"`
+	// ResetRate resets the connection before answering.
+	ResetRate float64 `json:"reset_rate,omitempty"`
+	// PaginationLoop answers every listing with its first page and a next
+	// link, whatever the offset.
+	PaginationLoop bool `json:"pagination_loop,omitempty"`
+}
+
+// The fault kinds Injected counts.
+const (
+	FaultError     = "error"
+	FaultLatency   = "latency"
+	FaultMalformed = "malformed"
+	FaultTruncate  = "truncate"
+	FaultReset     = "reset"
+	FaultLoop      = "pagination_loop"
+)
+
+// SetChaos injects c into the responses to paths starting with prefix; ""
+// matches every path. The longest matching prefix applies.
+func (s *Server) SetChaos(prefix string, c Chaos) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chaos[prefix] = c
+}
+
+// ResetChaos removes every fault.
+func (s *Server) ResetChaos() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.chaos)
+}
+
+// Seed makes the faults injected from now on repeatable.
+func (s *Server) Seed(seed uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rand = rand.New(rand.NewPCG(seed, seed))
+}
+
+// Injected returns the number of faults of the kind injected so far.
+func (s *Server) Injected(kind string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.injected[kind]
+}
+
+// fault is what the dice decided for one request.
+type fault struct {
+	kind    string
+	status  int
+	latency time.Duration
+	loop    bool
+}
+
+// roll decides the fault for a request to path. The caller holds s.mu.
+func (s *Server) roll(path string) fault {
+	var c Chaos
+	matched := -1
+	for prefix, pc := range s.chaos {
+		if strings.HasPrefix(path, prefix) && len(prefix) > matched {
+			c, matched = pc, len(prefix)
+		}
+	}
+	if matched < 0 {
+		return fault{}
+	}
+	var f fault
+	f.latency = time.Duration(c.LatencyMS) * time.Millisecond
+	if c.JitterMS > 0 {
+		f.latency += time.Duration(s.rand.IntN(c.JitterMS)) * time.Millisecond
+	}
+	if c.TailRate > 0 && s.rand.Float64() < c.TailRate {
+		f.latency += time.Duration(c.TailMS) * time.Millisecond
+	}
+	if f.latency > 0 {
+		s.injected[FaultLatency]++
+	}
+	switch {
+	case s.rand.Float64() < c.ResetRate:
+		f.kind = FaultReset
+	case s.rand.Float64() < c.ErrorRate:
+		f.kind, f.status = FaultError, c.ErrorStatus
+		if f.status == 0 {
+			f.status = http.StatusServiceUnavailable
+		}
+	case s.rand.Float64() < c.TruncateRate:
+		f.kind = FaultTruncate
+	case s.rand.Float64() < c.MalformedRate:
+		f.kind = FaultMalformed
+	}
+	if f.kind != "" {
+		s.injected[f.kind]++
+	}
+	f.loop = c.PaginationLoop
+	return f
+}
+
+// inject serves r through serve with the fault applied.
+func (s *Server) inject(w http.ResponseWriter, r *http.Request, f fault, serve func(http.ResponseWriter, *http.Request, bool)) {
+	time.Sleep(f.latency)
+	switch f.kind {
+	case FaultReset:
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			panic(http.ErrAbortHandler)
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+		return
+	case FaultError:
+		http.Error(w, http.StatusText(f.status), f.status)
+		return
+	case "":
+		serve(w, r, f.loop)
+		return
+	}
+	rec := httptest.NewRecorder()
+	serve(rec, r, f.loop)
+	for name, values := range rec.Header() {
+		w.Header()[name] = values
+	}
+	body := rec.Body.Bytes()
+	half := body[:len(body)/2]
+	switch f.kind {
+	case FaultTruncate:
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(rec.Code)
+		w.Write(half)
+	case FaultMalformed:
+		w.WriteHeader(rec.Code)
+		w.Write(half)
+		w.Write([]byte("<html><body>502 Bad Gateway</body></html>\n"))
+	}
+}
+
+func (s *Server) serveChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		chaos := make(map[string]Chaos)
+		if err := json.NewDecoder(r.Body).Decode(&chaos); err != nil {
+			http.Error(w, "Invalid chaos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for prefix, c := range chaos {
+			for name, rate := range map[string]float64{"error_rate": c.ErrorRate, "tail_rate": c.TailRate, "malformed_rate": c.MalformedRate, "truncate_rate": c.TruncateRate, "reset_rate": c.ResetRate} {
+				if rate < 0 || rate > 1 {
+					http.Error(w, fmt.Sprintf("Invalid chaos: %s of %q must be between 0 and 1", name, prefix), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if seed := r.URL.Query().Get("seed"); seed != "" {
+			n, err := strconv.ParseUint(seed, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid seed: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.Seed(n)
+		}
+		s.mu.Lock()
+		s.chaos = chaos
+		s.mu.Unlock()
+	case http.MethodDelete:
+		s.ResetChaos()
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.chaos)
+}
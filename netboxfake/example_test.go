@@ -0,0 +1,40 @@
+package netboxfake_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+)
+
+// A FakeNetbox scores a change without a NetBox server.
+func Example() {
+	fake := &netboxfake.FakeNetbox{
+		Devices: map[int]netbox.Device{
+			1: {ID: 1, Name: "core-ams01", Status: &netbox.Choice{Value: "active", Label: "Active"}},
+		},
+	}
+	depth := 0
+	req := impact.ImpactRequest{DeviceIDs: []int{1}, ImpactType: impact.PlannedWork, BlastRadiusDepth: &depth}
+	calc := impact.NewCalculator(impact.DefaultOptions())
+	result, err := calc.Calculate(context.Background(), req, fake, impact.DefaultWeightConfig())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(result.Breakdown.Devices.Items[0].Name, result.TotalImpact)
+	// Output: core-ams01 5
+}
+
+// Errors makes a method fail, e.g. to test how a caller handles NetBox
+// being down.
+func ExampleFakeNetbox_errors() {
+	fake := netboxfake.Sample()
+	fake.Errors = map[string]error{"FetchDeviceByID": errors.New("netbox unavailable")}
+	_, err := fake.FetchDeviceByID(context.Background(), 1)
+	fmt.Println(err)
+	// Output: netbox unavailable
+}
@@ -0,0 +1,306 @@
+// Package netboxfake provides in-memory NetboxAPI implementations: FakeNetbox
+// for scoring without a NetBox server, offline exports and snapshots loaded
+// into one, and a test Server that answers the NetBox API from it.
+package netboxfake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// FakeNetbox is an in-memory NetboxAPI for running the impact calculation
+// without a NetBox server. Unknown IDs fail with the same 404 StatusError the
+// HTTP client returns. Errors, keyed by method name (e.g. "FetchDeviceByID"),
+// makes that method fail, and every call waits Latency first.
+type FakeNetbox struct {
+	URL             string
+	Devices         map[int]netbox.Device
+	Circuits        map[int]netbox.Circuit
+	Interfaces      map[int]netbox.Interface
+	Sites           map[int]netbox.Site
+	Racks           map[int]netbox.Node
+	Cables          map[int]netbox.Cable
+	PowerFeeds      map[int]netbox.PowerFeed
+	VirtualMachines map[int]netbox.VirtualMachine
+	Tenants         map[int]netbox.Tenant
+	// ConsoleServerPorts should hold cabled ports only, as NetboxClient
+	// asks NetBox for.
+	ConsoleServerPorts map[int]netbox.ConsoleServerPort
+	// CircuitTerminations carry the link peers the circuits' nested
+	// terminations lack.
+	CircuitTerminations map[int]netbox.CircuitTermination
+	// PathEndpoints is keyed by port type and ID, e.g. "front-ports:12".
+	PathEndpoints  map[string][]netbox.CableEndpoint
+	ConfigContexts map[int]map[string]interface{}
+	// SchemaVersion is the export's meta.schema_version, 0 when it has none.
+	SchemaVersion int
+
+	Errors  map[string]error
+	Latency time.Duration
+}
+
+func (f *FakeNetbox) call(ctx context.Context, method string) error {
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.Errors[method]
+}
+
+func fakeNotFound(format string, id int) error {
+	return &netbox.StatusError{Endpoint: fmt.Sprintf(format, id), StatusCode: http.StatusNotFound}
+}
+
+// fakeFilter returns the values in m that keep accepts, ordered by ID like a
+// NetBox listing.
+func fakeFilter[T any](m map[int]T, keep func(T) bool) []T {
+	ids := make([]int, 0, len(m))
+	for id, v := range m {
+		if keep(v) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	values := make([]T, len(ids))
+	for i, id := range ids {
+		values[i] = m[id]
+	}
+	return values
+}
+
+func (f *FakeNetbox) BaseURL() string {
+	return f.URL
+}
+
+func (f *FakeNetbox) FetchDeviceByID(ctx context.Context, id int) (*netbox.Device, error) {
+	if err := f.call(ctx, "FetchDeviceByID"); err != nil {
+		return nil, err
+	}
+	device, ok := f.Devices[id]
+	if !ok {
+		return nil, fakeNotFound("/api/dcim/devices/%d/", id)
+	}
+	return &device, nil
+}
+
+func (f *FakeNetbox) FetchConfigContext(ctx context.Context, deviceID int) (map[string]interface{}, error) {
+	if err := f.call(ctx, "FetchConfigContext"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Devices[deviceID]; !ok {
+		return nil, fakeNotFound("/api/dcim/devices/%d/", deviceID)
+	}
+	return f.ConfigContexts[deviceID], nil
+}
+
+func (f *FakeNetbox) FetchDevicesByIDs(ctx context.Context, ids []int) ([]*netbox.Device, error) {
+	if err := f.call(ctx, "FetchDevicesByIDs"); err != nil {
+		return nil, err
+	}
+	return netbox.FetchConcurrently(ctx, "device", ids, netbox.DefaultFetchConcurrency, f.FetchDeviceByID)
+}
+
+func (f *FakeNetbox) FetchDevicesBySites(ctx context.Context, siteIDs []int) ([]netbox.Device, error) {
+	if err := f.call(ctx, "FetchDevicesBySites"); err != nil {
+		return nil, err
+	}
+	sites := make(map[int]bool, len(siteIDs))
+	for _, id := range siteIDs {
+		sites[id] = true
+	}
+	return fakeFilter(f.Devices, func(d netbox.Device) bool { return d.Site != nil && sites[d.Site.ID] }), nil
+}
+
+func (f *FakeNetbox) FetchDevicesByRack(ctx context.Context, rackID int) ([]netbox.Device, error) {
+	if err := f.call(ctx, "FetchDevicesByRack"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.Devices, func(d netbox.Device) bool { return d.Rack != nil && d.Rack.ID == rackID }), nil
+}
+
+func (f *FakeNetbox) FetchCircuitByID(ctx context.Context, id int) (*netbox.Circuit, error) {
+	if err := f.call(ctx, "FetchCircuitByID"); err != nil {
+		return nil, err
+	}
+	circuit, ok := f.Circuits[id]
+	if !ok {
+		return nil, fakeNotFound("/api/circuits/circuits/%d/", id)
+	}
+	return &circuit, nil
+}
+
+func (f *FakeNetbox) FetchCircuitsByIDs(ctx context.Context, ids []int) (map[int]netbox.Circuit, error) {
+	if err := f.call(ctx, "FetchCircuitsByIDs"); err != nil {
+		return nil, err
+	}
+	circuits := make(map[int]netbox.Circuit, len(ids))
+	for _, id := range ids {
+		if circuit, ok := f.Circuits[id]; ok {
+			circuits[id] = circuit
+		}
+	}
+	return circuits, nil
+}
+
+func (f *FakeNetbox) FetchCircuitsByEndpoint(ctx context.Context, endpoint string) ([]netbox.Circuit, error) {
+	if err := f.call(ctx, "FetchCircuitsByEndpoint"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.Circuits, func(c netbox.Circuit) bool {
+		active := c.Status == nil || c.Status.Value == "active"
+		return active && (c.TerminationA.Endpoint() == endpoint || c.TerminationZ.Endpoint() == endpoint)
+	}), nil
+}
+
+func (f *FakeNetbox) FetchInterfacesByIDs(ctx context.Context, ids []int) (map[int]netbox.Interface, error) {
+	if err := f.call(ctx, "FetchInterfacesByIDs"); err != nil {
+		return nil, err
+	}
+	interfaces := make(map[int]netbox.Interface, len(ids))
+	for _, id := range ids {
+		if iface, ok := f.Interfaces[id]; ok {
+			interfaces[id] = iface
+		}
+	}
+	return interfaces, nil
+}
+
+func (f *FakeNetbox) FetchTenants(ctx context.Context, ids []int) ([]netbox.Tenant, error) {
+	if err := f.call(ctx, "FetchTenants"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.Tenants, func(t netbox.Tenant) bool { return slices.Contains(ids, t.ID) }), nil
+}
+
+func (f *FakeNetbox) FetchSitesByIDs(ctx context.Context, ids []int) (map[int]netbox.Site, error) {
+	if err := f.call(ctx, "FetchSitesByIDs"); err != nil {
+		return nil, err
+	}
+	sites := make(map[int]netbox.Site, len(ids))
+	for _, id := range ids {
+		if site, ok := f.Sites[id]; ok {
+			sites[id] = site
+		}
+	}
+	return sites, nil
+}
+
+func (f *FakeNetbox) FetchCableByID(ctx context.Context, id int) (*netbox.Cable, error) {
+	if err := f.call(ctx, "FetchCableByID"); err != nil {
+		return nil, err
+	}
+	cable, ok := f.Cables[id]
+	if !ok {
+		return nil, fakeNotFound("/api/dcim/cables/%d/", id)
+	}
+	return &cable, nil
+}
+
+func (f *FakeNetbox) FetchCablesByDevice(ctx context.Context, deviceID int) ([]netbox.Cable, error) {
+	if err := f.call(ctx, "FetchCablesByDevice"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.Cables, func(c netbox.Cable) bool {
+		for _, t := range append(c.ATerminations, c.BTerminations...) {
+			if t.Object.Device != nil && t.Object.Device.ID == deviceID {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (f *FakeNetbox) FetchPortPathEndpoints(ctx context.Context, portType string, id int) ([]netbox.CableEndpoint, error) {
+	if err := f.call(ctx, "FetchPortPathEndpoints"); err != nil {
+		return nil, err
+	}
+	endpoints, ok := f.PathEndpoints[fmt.Sprintf("%s:%d", portType, id)]
+	if !ok {
+		return nil, fakeNotFound("/api/dcim/"+portType+"/%d/paths/", id)
+	}
+	return endpoints, nil
+}
+
+func (f *FakeNetbox) FetchPowerFeedByID(ctx context.Context, id int) (*netbox.PowerFeed, error) {
+	if err := f.call(ctx, "FetchPowerFeedByID"); err != nil {
+		return nil, err
+	}
+	feed, ok := f.PowerFeeds[id]
+	if !ok {
+		return nil, fakeNotFound("/api/dcim/power-feeds/%d/", id)
+	}
+	return &feed, nil
+}
+
+func (f *FakeNetbox) FetchPowerFeedsByRack(ctx context.Context, rackID int) ([]netbox.PowerFeed, error) {
+	if err := f.call(ctx, "FetchPowerFeedsByRack"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.PowerFeeds, func(p netbox.PowerFeed) bool { return p.Rack != nil && p.Rack.ID == rackID }), nil
+}
+
+// FetchVirtualMachinesByDevice falls back to the device's cluster like
+// NetboxClient does.
+func (f *FakeNetbox) FetchVirtualMachinesByDevice(ctx context.Context, device netbox.Device) ([]netbox.VirtualMachine, error) {
+	if err := f.call(ctx, "FetchVirtualMachinesByDevice"); err != nil {
+		return nil, err
+	}
+	vms := fakeFilter(f.VirtualMachines, func(vm netbox.VirtualMachine) bool { return vm.Device != nil && vm.Device.ID == device.ID })
+	if len(vms) > 0 || device.Cluster == nil {
+		return vms, nil
+	}
+	return fakeFilter(f.VirtualMachines, func(vm netbox.VirtualMachine) bool { return vm.Cluster != nil && vm.Cluster.ID == device.Cluster.ID }), nil
+}
+
+func (f *FakeNetbox) FetchCircuitTerminations(ctx context.Context, circuitIDs []int) ([]netbox.CircuitTermination, error) {
+	if err := f.call(ctx, "FetchCircuitTerminations"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.CircuitTerminations, func(t netbox.CircuitTermination) bool {
+		return t.Circuit != nil && slices.Contains(circuitIDs, t.Circuit.ID)
+	}), nil
+}
+
+func (f *FakeNetbox) FetchConsoleServerPorts(ctx context.Context, deviceID int) ([]netbox.ConsoleServerPort, error) {
+	if err := f.call(ctx, "FetchConsoleServerPorts"); err != nil {
+		return nil, err
+	}
+	return fakeFilter(f.ConsoleServerPorts, func(p netbox.ConsoleServerPort) bool { return p.Device != nil && p.Device.ID == deviceID }), nil
+}
+
+func (f *FakeNetbox) FetchNamesByIDs(ctx context.Context, endpoint string, ids []int) (map[int]string, error) {
+	if err := f.call(ctx, "FetchNamesByIDs"); err != nil {
+		return nil, err
+	}
+	var lookup func(int) (string, bool)
+	switch endpoint {
+	case "/api/dcim/devices/":
+		lookup = func(id int) (string, bool) { d, ok := f.Devices[id]; return d.Name, ok }
+	case "/api/circuits/circuits/":
+		lookup = func(id int) (string, bool) { c, ok := f.Circuits[id]; return c.CID, ok }
+	case "/api/dcim/interfaces/":
+		lookup = func(id int) (string, bool) { i, ok := f.Interfaces[id]; return i.Name, ok }
+	case "/api/dcim/sites/":
+		lookup = func(id int) (string, bool) { n, ok := f.Sites[id]; return n.Name, ok }
+	case "/api/dcim/racks/":
+		lookup = func(id int) (string, bool) { n, ok := f.Racks[id]; return n.Name, ok }
+	default:
+		return nil, fmt.Errorf("fake netbox: no objects for %s", endpoint)
+	}
+	names := make(map[int]string)
+	for _, id := range ids {
+		if name, ok := lookup(id); ok {
+			names[id] = name
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,278 @@
+package netboxfake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+func TestOfflineExampleCircuitsHaveBothEnds(t *testing.T) {
+	data, err := LoadOfflineData("../examples/offline", "https://netbox.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, c := range data.Circuits {
+		if c.TerminationA.Endpoint() == "" || c.TerminationZ.Endpoint() == "" {
+			t.Errorf("circuit %d (%s) is missing an endpoint: a=%q z=%q", id, c.CID, c.TerminationA.Endpoint(), c.TerminationZ.Endpoint())
+		}
+	}
+}
+
+func TestFetchDevicesByIDsBackends(t *testing.T) {
+	fake := &FakeNetbox{Devices: make(map[int]netbox.Device)}
+	var ids []int
+	for id := 1; id <= 120; id++ {
+		fake.Devices[id] = netbox.Device{ID: id, Name: fmt.Sprintf("dev-%d", id), Status: &netbox.Choice{Value: "active", Label: "Active"}}
+		ids = append(ids, id)
+	}
+	for _, backend := range []string{"rest", "graphql"} {
+		t.Run(backend, func(t *testing.T) {
+			srv := NewServer(t, fake)
+			newClient := func() *netbox.NetboxClient {
+				client := srv.Client()
+				if backend == "graphql" {
+					client.EnableGraphQL()
+				}
+				return client
+			}
+			devices, err := newClient().FetchDevicesByIDs(context.Background(), ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, d := range devices {
+				if d.ID != ids[i] || d.Name != fmt.Sprintf("dev-%d", ids[i]) || d.Status == nil || d.Status.Value != "active" {
+					t.Fatalf("devices[%d] = %+v, want dev-%d", i, d, ids[i])
+				}
+			}
+			if backend == "graphql" {
+				// 120 IDs in chunks of 50, and nothing over REST.
+				if got, total := srv.Count("/graphql/"), srv.Total(); got != 3 || total != 3 {
+					t.Errorf("made %d GraphQL requests of %d, want 3 of 3", got, total)
+				}
+			}
+
+			_, err = newClient().FetchDevicesByIDs(context.Background(), []int{1, 999})
+			var verr *netbox.ValidationError
+			if !errors.As(err, &verr) || verr.Field != "device_ids" || verr.Message != "device 999 does not exist in NetBox" {
+				t.Errorf("err = %v, want a device_ids error for device 999", err)
+			}
+		})
+	}
+}
+
+func TestGraphQLDecodesLikeREST(t *testing.T) {
+	active := &netbox.Choice{Value: "active", Label: "Active"}
+	ams := &netbox.Node{ID: 1, Name: "AMS01", Slug: "ams01"}
+	acme := &netbox.Node{ID: 1, Name: "Acme", Slug: "acme"}
+	core := []netbox.Node{{ID: 4, Name: "core", Slug: "core"}}
+	devices := map[int]netbox.Device{
+		1: {ID: 1, Name: "core-ams01", Role: &netbox.Node{ID: 1, Name: "Core Router", Slug: "core-router"}, Site: ams, Rack: &netbox.Node{ID: 10, Name: "R10"},
+			Status: active, Tenant: acme, Cluster: &netbox.Node{ID: 7, Name: "ams-cluster", Slug: "ams-cluster"}, Tags: core, CustomFields: map[string]interface{}{"criticality": "high"}},
+		2: {ID: 2, Name: "sw-ams01", Site: ams, Status: &netbox.Choice{Value: "planned", Label: "Planned"}},
+	}
+	tests := []struct {
+		name             string
+		siteTerminations bool
+		circuits         map[int]netbox.Circuit
+	}{
+		{name: "netbox 4.2", circuits: map[int]netbox.Circuit{
+			100: {ID: 100, CID: "AMS-RTM-1", Status: active, CommitRate: ptr(10_000_000), Provider: &netbox.Node{ID: 3, Name: "Lumen", Slug: "lumen"}, Tenant: acme, Tags: core,
+				CustomFields: map[string]interface{}{"customers": 40.0},
+				TerminationA: &netbox.CircuitTermination{ID: 1000, TermSide: "A", TerminationType: "dcim.site", Termination: ams},
+				TerminationZ: &netbox.CircuitTermination{ID: 1001, TermSide: "Z", TerminationType: "circuits.providernetwork", Termination: &netbox.Node{ID: 5, Name: "Transit-Net"}}},
+			101: {ID: 101, CID: "AMS-LOCAL", Status: active, TerminationA: &netbox.CircuitTermination{ID: 1002, TermSide: "A", TerminationType: "dcim.location", Termination: &netbox.Node{ID: 8, Name: "Cage 1", Slug: "cage-1"}}},
+		}},
+		{name: "netbox 4.1", siteTerminations: true, circuits: map[int]netbox.Circuit{
+			100: {ID: 100, CID: "AMS-RTM-1", Status: active, Provider: &netbox.Node{ID: 3, Name: "Lumen", Slug: "lumen"}, Tenant: acme, Tags: core,
+				TerminationA: &netbox.CircuitTermination{ID: 1000, TermSide: "A", Site: ams},
+				TerminationZ: &netbox.CircuitTermination{ID: 1001, TermSide: "Z", ProviderNetwork: &netbox.Node{ID: 5, Name: "Transit-Net"}}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(t, &FakeNetbox{Devices: devices, Circuits: tt.circuits})
+			srv.siteTerminations = tt.siteTerminations
+			rest := srv.Client()
+			graphQL := srv.Client()
+			graphQL.EnableGraphQL()
+			ids := slices.Sorted(maps.Keys(tt.circuits))
+			restCircuits, err := rest.FetchCircuitsByIDs(context.Background(), ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gqlCircuits, err := graphQL.FetchCircuitsByIDs(context.Background(), ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gqlCircuits, restCircuits) {
+				got, _ := json.Marshal(gqlCircuits)
+				want, _ := json.Marshal(restCircuits)
+				t.Errorf("circuits over GraphQL:\n%s\nover REST:\n%s", got, want)
+			}
+			restDevices, err := rest.FetchDevicesByIDs(context.Background(), []int{1, 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gqlDevices, err := graphQL.FetchDevicesByIDs(context.Background(), []int{1, 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gqlDevices, restDevices) {
+				got, _ := json.Marshal(gqlDevices)
+				want, _ := json.Marshal(restDevices)
+				t.Errorf("devices over GraphQL:\n%s\nover REST:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchCircuitsByIDsBatches(t *testing.T) {
+	fake := &FakeNetbox{Circuits: make(map[int]netbox.Circuit)}
+	var ids []int
+	for id := 1; id <= 120; id++ {
+		fake.Circuits[id] = netbox.Circuit{ID: id, CID: fmt.Sprintf("CID-%d", id)}
+		ids = append(ids, id)
+	}
+	srv := NewServer(t, fake)
+	circuits, err := srv.Client().FetchCircuitsByIDs(context.Background(), append(ids, 998, 999))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(circuits) != 120 {
+		t.Errorf("got %d circuits, want 120", len(circuits))
+	}
+	// 122 IDs in chunks of 50.
+	if got := srv.Total(); got != 3 {
+		t.Errorf("made %d requests, want 3", got)
+	}
+}
+
+func TestFetchCircuitsByIDsDedups(t *testing.T) {
+	fake := &FakeNetbox{Circuits: make(map[int]netbox.Circuit)}
+	var ids []int
+	for id := 1; id <= 50; id++ {
+		fake.Circuits[id] = netbox.Circuit{ID: id, CID: fmt.Sprintf("CID-%d", id)}
+		ids = append(ids, id)
+	}
+	srv := NewServer(t, fake)
+	circuits, err := srv.Client().FetchCircuitsByIDs(context.Background(), append(ids, ids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(circuits) != 50 {
+		t.Errorf("got %d circuits, want 50", len(circuits))
+	}
+	// 50 distinct IDs fit in one chunk.
+	if got := srv.Total(); got != 1 {
+		t.Errorf("made %d requests, want 1", got)
+	}
+	if got := srv.Lookups(1); got != 1 {
+		t.Errorf("circuit 1 looked up %d times, want 1", got)
+	}
+}
+
+func TestChaosFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		chaos Chaos
+		kind  string
+		check func(error) bool
+	}{
+		{"error", Chaos{ErrorRate: 1, ErrorStatus: http.StatusBadGateway}, FaultError, func(err error) bool {
+			var serr *netbox.StatusError
+			return errors.As(err, &serr) && serr.StatusCode == http.StatusBadGateway
+		}},
+		{"malformed", Chaos{MalformedRate: 1}, FaultMalformed, isResponseError},
+		{"truncate", Chaos{TruncateRate: 1}, FaultTruncate, isResponseError},
+		{"reset", Chaos{ResetRate: 1}, FaultReset, isResponseError},
+		{"pagination loop", Chaos{PaginationLoop: true}, FaultLoop, func(err error) bool { return errors.Is(err, netbox.ErrPaginationLoop) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(t, Sample())
+			srv.SetChaos("/api/dcim/", tt.chaos)
+			client := srv.Client()
+			_, err := client.FetchDevices(context.Background(), nil)
+			if !tt.check(err) {
+				t.Errorf("FetchDevices error = %v (%T)", err, err)
+			}
+			if srv.Injected(tt.kind) == 0 {
+				t.Errorf("no %s injected", tt.kind)
+			}
+			// The longest prefix wins and other paths are left alone.
+			srv.SetChaos("/api/dcim/sites/", Chaos{})
+			if _, err := client.FetchSitesByIDs(context.Background(), []int{1}); err != nil {
+				t.Errorf("sites: %v", err)
+			}
+			if _, err := client.FetchCircuits(context.Background(), nil); err != nil {
+				t.Errorf("circuits: %v", err)
+			}
+		})
+	}
+}
+
+func isResponseError(err error) bool {
+	var rerr *netbox.ResponseError
+	return errors.As(err, &rerr)
+}
+
+func TestChaosLatency(t *testing.T) {
+	srv := NewServer(t, Sample())
+	srv.Seed(1)
+	srv.SetChaos("", Chaos{LatencyMS: 20, JitterMS: 10, TailRate: 1, TailMS: 30})
+	start := time.Now()
+	if _, err := srv.Client().FetchDeviceByID(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("took %s, want at least 50ms", took)
+	}
+	if srv.Injected(FaultLatency) != 1 {
+		t.Errorf("latency injected %d times, want 1", srv.Injected(FaultLatency))
+	}
+}
+
+func TestChaosControlEndpoint(t *testing.T) {
+	srv := NewServer(t, Sample())
+	do := func(method, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+ChaosPath+"?seed=7", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+	if code, body := do(http.MethodPut, `{"/api/": {"error_rate": 1, "error_status": 500}}`); code != http.StatusOK || body != `{"/api/":{"error_rate":1,"error_status":500}}` {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	_, err := srv.Client().FetchDeviceByID(context.Background(), 1)
+	var serr *netbox.StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("FetchDeviceByID error = %v, want 500", err)
+	}
+	if code, _ := do(http.MethodPut, `{"": {"reset_rate": 2}}`); code != http.StatusBadRequest {
+		t.Errorf("PUT rate 2 = %d, want 400", code)
+	}
+	if code, body := do(http.MethodDelete, ""); code != http.StatusOK || body != "{}" {
+		t.Errorf("DELETE = %d %s", code, body)
+	}
+	if _, err := srv.Client().FetchDeviceByID(context.Background(), 1); err != nil {
+		t.Errorf("after DELETE: %v", err)
+	}
+	if srv.Count(ChaosPath) != 0 {
+		t.Error("control requests were counted as NetBox requests")
+	}
+}
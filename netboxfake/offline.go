@@ -0,0 +1,212 @@
+package netboxfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// offlineSections are the objects an offline export may contain, named after
+// the NetBox list endpoint each was exported from.
+var offlineSections = []string{"devices", "circuits", "interfaces", "sites", "racks", "cables", "power-feeds", "virtual-machines", "tenants", "console-server-ports", "circuit-terminations"}
+
+// SnapshotSchemaVersion is the newest offline export layout this build
+// reads. Exports record theirs in the optional meta section as
+// {"schema_version": 1}; snapshots must.
+const SnapshotSchemaVersion = 1
+
+// LoadOfflineData reads a NetBox export for calculating impact without
+// network access. path is either a directory holding one file per section
+// (devices.json, circuits.json, ...) or a single JSON object keyed by
+// section. Each section is a NetBox list response or a plain array; missing
+// sections are empty. A meta section may give the schema version. baseURL is
+// only used for object links.
+func LoadOfflineData(path, baseURL string) (*FakeNetbox, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return LoadOfflineFS(os.DirFS(path), path, baseURL)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name := range sections {
+		if name != "meta" && !slices.Contains(offlineSections, name) {
+			return nil, fmt.Errorf("%s: unknown section %q (expected %s)", path, name, strings.Join(offlineSections, ", "))
+		}
+	}
+	return offlineData(path, sections, baseURL)
+}
+
+// LoadOfflineFS reads an export laid out as a directory of section files
+// at the root of fsys, such as one embedded in the binary; name labels its
+// errors.
+func LoadOfflineFS(fsys fs.FS, name, baseURL string) (*FakeNetbox, error) {
+	sections := make(map[string]json.RawMessage)
+	for _, section := range append([]string{"meta"}, offlineSections...) {
+		data, err := fs.ReadFile(fsys, section+".json")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sections[section] = data
+	}
+	return offlineData(name, sections, baseURL)
+}
+
+func offlineData(path string, sections map[string]json.RawMessage, baseURL string) (*FakeNetbox, error) {
+	var err error
+	f := &FakeNetbox{URL: baseURL}
+	if raw, ok := sections["meta"]; ok {
+		var meta struct {
+			SchemaVersion int `json:"schema_version"`
+		}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, fmt.Errorf("%s: meta: %w", path, err)
+		}
+		if meta.SchemaVersion < 0 || meta.SchemaVersion > SnapshotSchemaVersion {
+			return nil, fmt.Errorf("%s: schema version %d is not supported (this build reads up to %d)", path, meta.SchemaVersion, SnapshotSchemaVersion)
+		}
+		f.SchemaVersion = meta.SchemaVersion
+	}
+	if f.Devices, err = offlineSection(sections, "devices", func(d netbox.Device) int { return d.ID }); err != nil {
+		return nil, err
+	}
+	if f.Circuits, err = offlineSection(sections, "circuits", func(c netbox.Circuit) int { return c.ID }); err != nil {
+		return nil, err
+	}
+	if f.Interfaces, err = offlineSection(sections, "interfaces", func(i netbox.Interface) int { return i.ID }); err != nil {
+		return nil, err
+	}
+	if f.Sites, err = offlineSection(sections, "sites", func(s netbox.Site) int { return s.ID }); err != nil {
+		return nil, err
+	}
+	if f.Racks, err = offlineSection(sections, "racks", func(n netbox.Node) int { return n.ID }); err != nil {
+		return nil, err
+	}
+	if f.Cables, err = offlineSection(sections, "cables", func(c netbox.Cable) int { return c.ID }); err != nil {
+		return nil, err
+	}
+	if f.PowerFeeds, err = offlineSection(sections, "power-feeds", func(p netbox.PowerFeed) int { return p.ID }); err != nil {
+		return nil, err
+	}
+	if f.VirtualMachines, err = offlineSection(sections, "virtual-machines", func(vm netbox.VirtualMachine) int { return vm.ID }); err != nil {
+		return nil, err
+	}
+	if f.Tenants, err = offlineSection(sections, "tenants", func(t netbox.Tenant) int { return t.ID }); err != nil {
+		return nil, err
+	}
+	if f.ConsoleServerPorts, err = offlineSection(sections, "console-server-ports", func(p netbox.ConsoleServerPort) int { return p.ID }); err != nil {
+		return nil, err
+	}
+	if f.CircuitTerminations, err = offlineSection(sections, "circuit-terminations", func(t netbox.CircuitTermination) int { return t.ID }); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func offlineSection[T any](sections map[string]json.RawMessage, name string, id func(T) int) (map[int]T, error) {
+	objects := make(map[int]T)
+	raw := bytes.TrimSpace(sections[name])
+	if len(raw) == 0 {
+		return objects, nil
+	}
+	var items []T
+	if raw[0] == '[' {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("offline %s: %w", name, err)
+		}
+	} else {
+		var list struct {
+			Results []T `json:"results"`
+		}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("offline %s: %w", name, err)
+		}
+		items = list.Results
+	}
+	for _, item := range items {
+		objects[id(item)] = item
+	}
+	return objects, nil
+}
+
+// LoadSnapshot reads an offline export used as a network snapshot. Unlike
+// -offline-data it must state its schema version.
+func LoadSnapshot(path, baseURL string) (*FakeNetbox, error) {
+	f, err := LoadOfflineData(path, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if f.SchemaVersion == 0 {
+		return nil, fmt.Errorf("%s: not a snapshot: meta.schema_version is missing", path)
+	}
+	return f, nil
+}
+
+// SnapshotStore serves the snapshots under Dir by name: either a directory
+// <name> or a file <name>.json. Snapshots are read once and kept, so a
+// changed snapshot needs a new name.
+type SnapshotStore struct {
+	Dir     string
+	BaseURL string
+
+	mu        sync.Mutex
+	snapshots map[string]*FakeNetbox
+}
+
+func NewSnapshotStore(dir, baseURL string) *SnapshotStore {
+	return &SnapshotStore{Dir: dir, BaseURL: baseURL, snapshots: make(map[string]*FakeNetbox)}
+}
+
+// Get returns the named snapshot; field names the request field for
+// validation errors.
+func (s *SnapshotStore) Get(field, name string) (*FakeNetbox, error) {
+	if name == "" {
+		return nil, &netbox.ValidationError{Field: field, Message: "is required"}
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, &netbox.ValidationError{Field: field, Message: fmt.Sprintf("invalid snapshot name %q", name)}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.snapshots[name]; ok {
+		return f, nil
+	}
+	path := filepath.Join(s.Dir, name)
+	if !fileExists(path) {
+		path += ".json"
+	}
+	if !fileExists(path) {
+		return nil, &netbox.ValidationError{Field: field, Message: fmt.Sprintf("snapshot %q not found", name)}
+	}
+	f, err := LoadSnapshot(path, s.BaseURL)
+	if err != nil {
+		return nil, &netbox.ValidationError{Field: field, Message: err.Error()}
+	}
+	s.snapshots[name] = f
+	return f, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,450 @@
+package netboxfake
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// Sample returns the in-memory NetBox the scoring tests run against:
+//
+//   - AMS01 (site 1, rack 10): core-ams01 and sw-ams01 (critical "high",
+//     tenant Acme)
+//   - RTM01 (site 2, rack 20, tenant Globex): core-rtm01 (planned) and
+//     host-rtm01 (tenant Globex, hosting vm-1), fed by power feeds 30 and 31
+//   - circuits 100 and 101 run in parallel between AMS01 and RTM01, 102 loops
+//     back to AMS01, 103 (planned) runs from FRA01 to a provider network
+//   - cable 50 connects core-ams01 to core-rtm01, cable 51 connects
+//     core-ams01 to circuit 101
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func Sample() *FakeNetbox {
+	acme := &netbox.Node{ID: 1, Name: "Acme", Slug: "acme"}
+	globex := &netbox.Node{ID: 2, Name: "Globex", Slug: "globex"}
+	active := &netbox.Choice{Value: "active", Label: "Active"}
+	planned := &netbox.Choice{Value: "planned", Label: "Planned"}
+	ams := &netbox.Node{ID: 1, Name: "AMS01", Slug: "ams01"}
+	rtm := &netbox.Node{ID: 2, Name: "RTM01", Slug: "rtm01"}
+	fra := &netbox.Node{ID: 3, Name: "FRA01", Slug: "fra01"}
+	r10 := &netbox.Node{ID: 10, Name: "R10"}
+	r20 := &netbox.Node{ID: 20, Name: "R20"}
+	router := &netbox.Node{ID: 1, Name: "Core Router", Slug: "core-router"}
+	access := &netbox.Node{ID: 2, Name: "Access Switch", Slug: "access-switch"}
+	server := &netbox.Node{ID: 3, Name: "Server", Slug: "server"}
+	term := func(id int, site *netbox.Node) *netbox.CircuitTermination {
+		return &netbox.CircuitTermination{ID: id, Site: site}
+	}
+	return &FakeNetbox{
+		URL: "https://netbox.example.com",
+		Devices: map[int]netbox.Device{
+			1: {ID: 1, Name: "core-ams01", Role: router, Site: ams, Rack: r10, Status: active},
+			2: {ID: 2, Name: "sw-ams01", Role: access, Site: ams, Rack: r10, Status: active, Tenant: acme,
+				CustomFields: map[string]interface{}{"criticality": "high"}},
+			3: {ID: 3, Name: "core-rtm01", Role: router, Site: rtm, Rack: r20, Status: planned},
+			4: {ID: 4, Name: "host-rtm01", Role: server, Site: rtm, Rack: r20, Status: active, Tenant: globex, Cluster: &netbox.Node{ID: 7, Name: "rtm-cluster"}},
+		},
+		Circuits: map[int]netbox.Circuit{
+			100: {ID: 100, CID: "AMS-RTM-1", Status: active, CommitRate: ptr(10_000_000), TerminationA: term(1000, ams), TerminationZ: term(1001, rtm)},
+			101: {ID: 101, CID: "AMS-RTM-2", Status: active, TerminationA: term(1002, ams), TerminationZ: term(1003, rtm)},
+			102: {ID: 102, CID: "AMS-LOCAL", Status: active, TerminationA: term(1004, ams), TerminationZ: term(1005, ams)},
+			103: {ID: 103, CID: "FRA-TRANSIT", Status: planned, Tenant: acme, Provider: &netbox.Node{ID: 3, Name: "Lumen", Slug: "lumen"}, TerminationA: term(1006, fra),
+				TerminationZ: &netbox.CircuitTermination{ID: 1007, ProviderNetwork: &netbox.Node{ID: 5, Name: "Transit-Net"}}},
+		},
+		Interfaces: map[int]netbox.Interface{
+			200: {ID: 200, Name: "eth0", Device: &netbox.Node{ID: 1, Name: "core-ams01"}, Speed: ptr(1_000_000)},
+			201: {ID: 201, Name: "eth1", Device: &netbox.Node{ID: 1, Name: "core-ams01"}, Enabled: ptr(false)},
+			202: {ID: 202, Name: "xe-0/0/0", Device: &netbox.Node{ID: 2, Name: "sw-ams01"}, Speed: ptr(10_000_000), ConnectedEndpoints: []netbox.CableEndpoint{{ID: 9}}},
+			203: {ID: 203, Name: "eth0", Device: &netbox.Node{ID: 3, Name: "core-rtm01"}},
+		},
+		Sites: map[int]netbox.Site{
+			1: {ID: 1, Name: "AMS01", Slug: "ams01"},
+			2: {ID: 2, Name: "RTM01", Slug: "rtm01", Tenant: globex},
+			3: {ID: 3, Name: "FRA01", Slug: "fra01"},
+		},
+		Racks: map[int]netbox.Node{10: *r10, 20: *r20},
+		Cables: map[int]netbox.Cable{
+			50: {ID: 50, Label: "X-50",
+				ATerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", ObjectID: 200, Object: netbox.CableEndpoint{ID: 200, Device: &netbox.Node{ID: 1}}}},
+				BTerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", ObjectID: 203, Object: netbox.CableEndpoint{ID: 203, Device: &netbox.Node{ID: 3}}}}},
+			51: {ID: 51, Label: "X-51",
+				ATerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", ObjectID: 200, Object: netbox.CableEndpoint{ID: 200, Device: &netbox.Node{ID: 1}}}},
+				BTerminations: []netbox.CableTermination{{ObjectType: "circuits.circuittermination", ObjectID: 1003,
+					Object: netbox.CableEndpoint{ID: 1003, Circuit: &struct {
+						ID  int    `json:"id"`
+						CID string `json:"cid"`
+					}{ID: 101, CID: "AMS-RTM-2"}}}}},
+		},
+		PowerFeeds: map[int]netbox.PowerFeed{
+			30: {ID: 30, Name: "RTM01-A", Rack: r20, Status: active},
+			31: {ID: 31, Name: "RTM01-B", Rack: r20, Status: active},
+			32: {ID: 32, Name: "spare"},
+		},
+		VirtualMachines: map[int]netbox.VirtualMachine{
+			60: {ID: 60, Name: "vm-1", Status: active, Device: &netbox.Node{ID: 4, Name: "host-rtm01"}},
+		},
+		Tenants: map[int]netbox.Tenant{
+			1: {ID: 1, Name: "Acme", Slug: "acme"},
+			2: {ID: 2, Name: "Globex", Slug: "globex", CustomFields: map[string]interface{}{"sla": "platinum"}},
+		},
+	}
+}
+
+// Instances returns a NetboxInstances holding client as its only, default
+// instance.
+func Instances(t *testing.T, client netbox.NetboxAPI) *netbox.NetboxInstances {
+	t.Helper()
+	instances := netbox.NewNetboxInstances()
+	if err := instances.Add("default", client); err != nil {
+		t.Fatal(err)
+	}
+	return instances
+}
+
+// Server serves the objects of f over the NetBox REST API, with the
+// filters NetboxClient uses, and counts the requests per path. SetChaos
+// makes it misbehave.
+type Server struct {
+	*httptest.Server
+	fake *FakeNetbox
+	// Delay is added to every response, like a distant NetBox.
+	Delay time.Duration
+	// Fail answers requests to these paths with the status.
+	Fail map[string]int
+	// siteTerminations makes /graphql/ reject the NetBox 4.2 circuit
+	// termination fields, like NetBox 4.0 and 4.1 do.
+	siteTerminations bool
+
+	mu       sync.Mutex
+	requests map[string]int
+	queries  []url.Values
+	headers  []http.Header
+	chaos    map[string]Chaos
+	rand     *rand.Rand
+	injected map[string]int
+}
+
+// New returns a Server for f that is not listening, to serve from a
+// process of its own; the embedded httptest.Server is nil.
+func New(f *FakeNetbox) *Server {
+	return &Server{
+		fake:     f,
+		requests: make(map[string]int),
+		chaos:    make(map[string]Chaos),
+		rand:     rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		injected: make(map[string]int),
+	}
+}
+
+// NewServer starts a Server for f that is closed when the test ends.
+func NewServer(t *testing.T, f *FakeNetbox) *Server {
+	t.Helper()
+	s := New(f)
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns a NetboxClient for the server without retry delays.
+func (s *Server) Client() *netbox.NetboxClient {
+	client := netbox.NewNetboxClient(s.URL, "token")
+	client.RetryBaseDelay = time.Millisecond
+	return client
+}
+
+// Count returns the number of requests made to path, with any query.
+func (s *Server) Count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Lookups returns the number of id__in requests made for id.
+func (s *Server) Lookups(id int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, q := range s.queries {
+		if slices.Contains(netbox.ParseIDs(q.Get("id__in")), id) {
+			n++
+		}
+	}
+	return n
+}
+
+// Total returns the number of requests made.
+func (s *Server) Total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.requests {
+		n += c
+	}
+	return n
+}
+
+// Queries returns the query of every request made, in order.
+func (s *Server) Queries() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.queries)
+}
+
+// Headers returns the headers of every request made, in order.
+func (s *Server) Headers() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.headers)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == ChaosPath {
+		s.serveChaos(w, r)
+		return
+	}
+	time.Sleep(s.Delay)
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	s.queries = append(s.queries, r.URL.Query())
+	s.headers = append(s.headers, r.Header.Clone())
+	f := s.roll(r.URL.Path)
+	s.mu.Unlock()
+	if status, ok := s.Fail[r.URL.Path]; ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	s.inject(w, r, f, s.serve)
+}
+
+// serve answers r from the fake; loop makes listings page forever.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, loop bool) {
+	q := r.URL.Query()
+	ids := make(map[int]bool)
+	for _, id := range netbox.ParseIDs(q.Get("id__in")) {
+		ids[id] = true
+	}
+	matches := func(key string, id int) bool {
+		values, ok := q[key]
+		return !ok || slices.Contains(values, strconv.Itoa(id))
+	}
+	inIDs := func(id int) bool { return !q.Has("id__in") || ids[id] }
+	nodeID := func(n *netbox.Node) int {
+		if n == nil {
+			return 0
+		}
+		return n.ID
+	}
+	f := s.fake
+	if r.URL.Path == "/graphql/" {
+		s.serveGraphQL(w, r)
+		return
+	}
+	var list interface{}
+	var detail func(id int) (interface{}, bool)
+	switch collection, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/"), "/"); strings.TrimSuffix(collection+"/"+rest, "/") {
+	case "dcim/devices":
+		devices := fakeFilter(f.Devices, func(d netbox.Device) bool {
+			return inIDs(d.ID) && matches("site_id", nodeID(d.Site)) && matches("rack_id", nodeID(d.Rack))
+		})
+		list = devices
+		if q.Get("brief") == "1" {
+			// NetBox's brief form has no role, site or rack.
+			var nodes []netbox.Node
+			for _, d := range devices {
+				nodes = append(nodes, netbox.Node{ID: d.ID, Name: d.Name})
+			}
+			list = nodes
+		}
+	case "circuits/circuits":
+		list = fakeFilter(f.Circuits, func(c netbox.Circuit) bool {
+			onSite := !q.Has("site_id") || (c.TerminationA != nil && matches("site_id", nodeID(c.TerminationA.Site))) ||
+				(c.TerminationZ != nil && matches("site_id", nodeID(c.TerminationZ.Site)))
+			onNetwork := !q.Has("provider_network_id") || (c.TerminationA != nil && matches("provider_network_id", nodeID(c.TerminationA.ProviderNetwork))) ||
+				(c.TerminationZ != nil && matches("provider_network_id", nodeID(c.TerminationZ.ProviderNetwork)))
+			status := "active"
+			if c.Status != nil {
+				status = c.Status.Value
+			}
+			return inIDs(c.ID) && onSite && onNetwork && (!q.Has("status") || q.Get("status") == status)
+		})
+	case "dcim/interfaces":
+		list = fakeFilter(f.Interfaces, func(i netbox.Interface) bool { return inIDs(i.ID) })
+	case "dcim/sites":
+		list = fakeFilter(f.Sites, func(s netbox.Site) bool { return inIDs(s.ID) })
+	case "dcim/racks":
+		list = fakeFilter(f.Racks, func(n netbox.Node) bool { return inIDs(n.ID) })
+	case "dcim/cables":
+		list = fakeFilter(f.Cables, func(c netbox.Cable) bool {
+			for _, t := range append(c.ATerminations, c.BTerminations...) {
+				if matches("device_id", nodeID(t.Object.Device)) {
+					return true
+				}
+			}
+			return false
+		})
+	case "virtualization/virtual-machines":
+		list = fakeFilter(f.VirtualMachines, func(vm netbox.VirtualMachine) bool {
+			return matches("device_id", nodeID(vm.Device)) && matches("cluster_id", nodeID(vm.Cluster))
+		})
+	case "dcim/power-feeds":
+		list = fakeFilter(f.PowerFeeds, func(p netbox.PowerFeed) bool { return matches("rack_id", nodeID(p.Rack)) })
+	case "tenancy/tenants":
+		list = fakeFilter(f.Tenants, func(t netbox.Tenant) bool { return inIDs(t.ID) })
+	case "circuits/circuit-terminations":
+		list = fakeFilter(f.CircuitTerminations, func(t netbox.CircuitTermination) bool { return matches("circuit_id", nodeID(t.Circuit)) })
+	case "dcim/console-server-ports":
+		list = fakeFilter(f.ConsoleServerPorts, func(p netbox.ConsoleServerPort) bool { return matches("device_id", nodeID(p.Device)) })
+	default:
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		id, err := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch strings.TrimSuffix(path, "/"+strconv.Itoa(id)) {
+		case "/api/dcim/devices":
+			detail = func(id int) (interface{}, bool) { v, ok := f.Devices[id]; return v, ok }
+		case "/api/circuits/circuits":
+			detail = func(id int) (interface{}, bool) { v, ok := f.Circuits[id]; return v, ok }
+		case "/api/dcim/cables":
+			detail = func(id int) (interface{}, bool) { v, ok := f.Cables[id]; return v, ok }
+		case "/api/dcim/power-feeds":
+			detail = func(id int) (interface{}, bool) { v, ok := f.PowerFeeds[id]; return v, ok }
+		}
+		if detail == nil {
+			http.NotFound(w, r)
+			return
+		}
+		v, ok := detail(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	// Page the listing like NetBox.
+	data, _ := json.Marshal(list)
+	var items []json.RawMessage
+	json.Unmarshal(data, &items)
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if loop {
+		offset = 0
+		s.mu.Lock()
+		s.injected[FaultLoop]++
+		s.mu.Unlock()
+	}
+	page := map[string]interface{}{"count": len(items), "next": nil, "previous": nil, "results": items[min(offset, len(items)):min(offset+limit, len(items))]}
+	if offset+limit < len(items) || loop {
+		next := *r.URL
+		nq := next.Query()
+		nq.Set("offset", strconv.Itoa(offset+limit))
+		next.RawQuery = nq.Encode()
+		page["next"] = "http://" + r.Host + next.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// serveGraphQL answers the device_list and circuit_list queries the client
+// sends, rendering IDs as strings and choices as bare values like NetBox.
+func (s *Server) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Query     string `json:"query"`
+		Variables struct {
+			IDs []string `json:"ids"`
+		} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.queries[len(s.queries)-1] = url.Values{"id__in": {strings.Join(body.Variables.IDs, ",")}}
+	s.mu.Unlock()
+	newLayout := strings.Contains(body.Query, "termination_type")
+	if newLayout && s.siteTerminations {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"message": "Cannot query field 'termination_type' on type 'CircuitTerminationType'."}}})
+		return
+	}
+	gqlNodeOf := func(n *netbox.Node) map[string]string {
+		if n == nil {
+			return nil
+		}
+		return map[string]string{"id": strconv.Itoa(n.ID), "name": n.Name, "slug": n.Slug}
+	}
+	gqlTagsOf := func(tags []netbox.Node) []map[string]string {
+		var nodes []map[string]string
+		for i := range tags {
+			nodes = append(nodes, gqlNodeOf(&tags[i]))
+		}
+		return nodes
+	}
+	gqlStatus := func(c *netbox.Choice) string {
+		if c == nil {
+			return ""
+		}
+		return strings.ToUpper(c.Value)
+	}
+	var devices []map[string]interface{}
+	var circuits []map[string]interface{}
+	for _, id := range netbox.ParseIDs(strings.Join(body.Variables.IDs, ",")) {
+		if d, ok := s.fake.Devices[id]; ok && strings.Contains(body.Query, "device_list") {
+			devices = append(devices, map[string]interface{}{"id": strconv.Itoa(d.ID), "name": d.Name, "status": gqlStatus(d.Status), "role": gqlNodeOf(d.Role), "site": gqlNodeOf(d.Site), "rack": gqlNodeOf(d.Rack),
+				"tenant": gqlNodeOf(d.Tenant), "cluster": gqlNodeOf(d.Cluster), "tags": gqlTagsOf(d.Tags), "custom_fields": d.CustomFields})
+		}
+		if c, ok := s.fake.Circuits[id]; ok && strings.Contains(body.Query, "circuit_list") {
+			var terminations []map[string]interface{}
+			for _, t := range []*netbox.CircuitTermination{c.TerminationA, c.TerminationZ} {
+				if t == nil {
+					continue
+				}
+				term := map[string]interface{}{"id": strconv.Itoa(t.ID), "term_side": t.TermSide}
+				if newLayout {
+					term["termination"] = gqlNodeOf(t.Termination)
+					if appLabel, model, ok := strings.Cut(t.TerminationType, "."); ok {
+						term["termination_type"] = map[string]string{"app_label": appLabel, "model": model}
+					}
+				} else {
+					term["site"] = gqlNodeOf(t.Site)
+					term["provider_network"] = gqlNodeOf(t.ProviderNetwork)
+				}
+				terminations = append(terminations, term)
+			}
+			circuits = append(circuits, map[string]interface{}{"id": strconv.Itoa(c.ID), "cid": c.CID, "status": gqlStatus(c.Status), "commit_rate": c.CommitRate,
+				"provider": gqlNodeOf(c.Provider), "tenant": gqlNodeOf(c.Tenant), "tags": gqlTagsOf(c.Tags), "custom_fields": c.CustomFields, "terminations": terminations})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"device_list": devices, "circuit_list": circuits}})
+}
+
+// Pages returns the number of listing pages requested with the given limit.
+func (s *Server) Pages(limit int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, q := range s.queries {
+		if q.Get("limit") == strconv.Itoa(limit) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,252 @@
+// Package publish writes calculation results to a directory or an
+// S3-compatible bucket, for consumers that poll files rather than call the
+// API.
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// Destination stores one object under key, replacing what was there.
+type Destination interface {
+	Put(ctx context.Context, key string, body []byte) error
+}
+
+// Dir is a local directory. Put writes to a temporary file next to the
+// target and renames it into place, so readers never see a partial file.
+type Dir string
+
+func (d Dir) Put(ctx context.Context, key string, body []byte) error {
+	target := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(target), ".publish-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+// DefaultKeyTemplate files results by reference.
+const DefaultKeyTemplate = "{reference}/{timestamp}.json"
+
+// LatestName is the object next to each published result that holds a copy
+// of the newest one; it is written after the result itself.
+const LatestName = "latest.json"
+
+const (
+	queueSize      = 64
+	maxRetries     = 4
+	baseRetryDelay = time.Second
+)
+
+// Publisher publishes results in the background, one at a time and in
+// order, retrying failed writes.
+type Publisher struct {
+	Dest        Destination
+	KeyTemplate string
+	// RetryDelay is the wait before the first retry, doubled for each
+	// one after it.
+	RetryDelay time.Duration
+
+	queue     chan item
+	done      chan struct{}
+	mu        sync.Mutex
+	closed    bool
+	lastAt    time.Time
+	lastErr   error
+	published atomic.Int64
+	failures  atomic.Int64
+}
+
+type item struct {
+	req    impact.ImpactRequest
+	result impact.ImpactResult
+	at     time.Time
+}
+
+// New starts a Publisher writing to dest under keys made from keyTemplate
+// ("" = DefaultKeyTemplate). The template may use {reference},
+// {impact_type}, {instance}, {history_id} and {timestamp}, and must name a
+// relative path.
+func New(dest Destination, keyTemplate string) (*Publisher, error) {
+	if keyTemplate == "" {
+		keyTemplate = DefaultKeyTemplate
+	}
+	if err := checkKeyTemplate(keyTemplate); err != nil {
+		return nil, err
+	}
+	p := &Publisher{Dest: dest, KeyTemplate: keyTemplate, RetryDelay: baseRetryDelay, queue: make(chan item, queueSize), done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+var placeholders = []string{"{reference}", "{impact_type}", "{instance}", "{history_id}", "{timestamp}"}
+
+func checkKeyTemplate(t string) error {
+	rest := t
+	for _, p := range placeholders {
+		rest = strings.ReplaceAll(rest, p, "x")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("key template %q: unknown placeholder (want %s)", t, strings.Join(placeholders, ", "))
+	}
+	if !strings.HasSuffix(t, ".json") {
+		return fmt.Errorf("key template %q: must end in .json", t)
+	}
+	if clean := path.Clean(rest); path.IsAbs(rest) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("key template %q: must be a relative path", t)
+	}
+	if path.Base(rest) == LatestName {
+		return fmt.Errorf("key template %q: %s is reserved", t, LatestName)
+	}
+	return nil
+}
+
+// keyPart makes v safe as one path segment.
+func keyPart(v string) string {
+	v = strings.Trim(v, ".")
+	if v == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+// Key is where a result of req calculated at at is published.
+func (p *Publisher) Key(req impact.ImpactRequest, result impact.ImpactResult, at time.Time) string {
+	return strings.NewReplacer(
+		"{reference}", keyPart(req.Reference),
+		"{impact_type}", keyPart(string(result.ImpactType)),
+		"{instance}", keyPart(req.Instance),
+		"{history_id}", strconv.FormatInt(result.Metadata.HistoryID, 10),
+		"{timestamp}", at.UTC().Format("20060102T150405.000Z"),
+	).Replace(p.KeyTemplate)
+}
+
+// ErrQueueFull is returned by Publish when results arrive faster than they
+// can be written.
+var ErrQueueFull = errors.New("publication queue full")
+
+// Publish queues result for publication and returns at once.
+func (p *Publisher) Publish(req impact.ImpactRequest, result impact.ImpactResult) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("publisher closed")
+	}
+	// Timestamps are kept apart so results never share a key.
+	at := time.Now().Truncate(time.Millisecond)
+	if !at.After(p.lastAt) {
+		at = p.lastAt.Add(time.Millisecond)
+	}
+	select {
+	case p.queue <- item{req: req, result: result, at: at}:
+		p.lastAt = at
+		return nil
+	default:
+		p.failures.Add(1)
+		p.lastErr = ErrQueueFull
+		return ErrQueueFull
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	for it := range p.queue {
+		err := p.publish(it)
+		p.mu.Lock()
+		p.lastErr = err
+		p.mu.Unlock()
+		if err != nil {
+			p.failures.Add(1)
+			log.Printf("warning: publishing result: %v", err)
+			continue
+		}
+		p.published.Add(1)
+	}
+}
+
+// publish writes the result, then the latest.json beside it.
+func (p *Publisher) publish(it item) error {
+	body, err := json.MarshalIndent(it.result, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := p.Key(it.req, it.result, it.at)
+	if err := p.put(key, body); err != nil {
+		return err
+	}
+	return p.put(path.Join(path.Dir(key), LatestName), body)
+}
+
+func (p *Publisher) put(key string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.RetryDelay << (attempt - 1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = p.Dest.Put(ctx, key, body)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w (after %d attempts)", key, err, maxRetries+1)
+}
+
+// Err is why the last publication failed, or nil when it succeeded.
+func (p *Publisher) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// Published counts the results published.
+func (p *Publisher) Published() int64 { return p.published.Load() }
+
+// Failures counts the results that could not be published.
+func (p *Publisher) Failures() int64 { return p.failures.Load() }
+
+// Close publishes what is queued and stops.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	<-p.done
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// APIKey is one entry of an API keys file. Only the SHA-256 of the key is
+// kept. A key with Tenants is tenant-scoped: it sees only the history of
+// calculations scoring one of those tenants, the names of every other
+// tenant are redacted from its results, and it cannot use the endpoints
+// that show other tenants' work (see scopedDenied).
+type APIKey struct {
+	Name      string   `json:"name"`
+	KeySHA256 string   `json:"key_sha256"`
+	Tenants   []string `json:"tenants,omitempty"`
+}
+
+// APIKeys authenticates requests by the key in their "Authorization:
+// Bearer" header.
+type APIKeys struct {
+	byHash map[string]APIKey
+}
+
+// NewAPIKeys checks keys: names and hashes must be unique, hashes 64 hex
+// digits.
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	k := &APIKeys{byHash: make(map[string]APIKey)}
+	names := make(map[string]bool)
+	for i, key := range keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("api key %d: name is required", i)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("api key %q: duplicate name", key.Name)
+		}
+		names[key.Name] = true
+		key.KeySHA256 = strings.ToLower(key.KeySHA256)
+		if b, err := hex.DecodeString(key.KeySHA256); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api key %q: key_sha256 must be 64 hex digits", key.Name)
+		}
+		if _, ok := k.byHash[key.KeySHA256]; ok {
+			return nil, fmt.Errorf("api key %q: duplicate key_sha256", key.Name)
+		}
+		for _, t := range key.Tenants {
+			if t == "" {
+				return nil, fmt.Errorf("api key %q: empty tenant name", key.Name)
+			}
+		}
+		k.byHash[key.KeySHA256] = key
+	}
+	if len(k.byHash) == 0 {
+		return nil, fmt.Errorf("no api keys")
+	}
+	return k, nil
+}
+
+// LoadAPIKeysFile reads a JSON list of APIKeys.
+func LoadAPIKeysFile(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k, err := NewAPIKeys(keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// Len counts the keys.
+func (k *APIKeys) Len() int { return len(k.byHash) }
+
+// publicPaths answer without a key: the banner and what probes and
+// scrapers read.
+var publicPaths = map[string]bool{"/": true, "/readyz": true, "/metrics": true, "/version": true}
+
+// scopedDenied are the path prefixes a tenant-scoped key may not use: they
+// show or change what every tenant shares (the job queue, the capacity of
+// a window, composites, configuration and caches), or are meant for
+// NetBox itself.
+var scopedDenied = []string{"/admin/", "/capacity", "/composites", "/jobs", "/webhooks/"}
+
+type apiKeyContextKey struct{}
+
+// middleware answers 401 to a request without a known key, and 403 to a
+// tenant-scoped key on a scopedDenied path. The paths in public need no
+// key either.
+func (k *APIKeys) middleware(next http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] || slices.Contains(public, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sum := sha256.Sum256([]byte(token))
+		key, known := k.byHash[hex.EncodeToString(sum[:])]
+		if !ok || token == "" || !known {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="netbox-impact"`)
+			http.Error(w, "Missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if len(key.Tenants) > 0 {
+			for _, prefix := range scopedDenied {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					http.Error(w, fmt.Sprintf("API key %q is scoped to tenants: %s is not available to it", key.Name, r.URL.Path), http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// scopedTenants returns the tenants of the request's key, or nil when the
+// key, if any, is not tenant-scoped.
+func scopedTenants(ctx context.Context) []string {
+	key, _ := ctx.Value(apiKeyContextKey{}).(APIKey)
+	return key.Tenants
+}
+
+// redactScope redacts, for a tenant-scoped key, the names of the tenants
+// outside its scope from a result that calc.Redact left readable, that
+// is, unless -redact or requested redacted every name already.
+func redactScope(r *http.Request, calc *impact.Calculator, v interface{}, requested bool) {
+	if calc.RedactAll || requested {
+		return
+	}
+	if tenants := scopedTenants(r.Context()); tenants != nil {
+		calc.Redactor.RedactTenantsExcept(v, tenants)
+	}
+}
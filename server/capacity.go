@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// parseWindow reads a /capacity window, "START/END". START is RFC3339 or a
+// date and time in loc ("2026-07-12T22:00"); END is either of those or a
+// time of day ("06:00"), on the next day when it is not after START.
+func parseWindow(s string, loc *time.Location) (time.Time, time.Time, error) {
+	startText, endText, ok := strings.Cut(s, "/")
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("window %q: want START/END", s)
+	}
+	parse := func(v string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		return time.ParseInLocation("2006-01-02T15:04", v, loc)
+	}
+	start, err := parse(startText)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("window start %q: want RFC3339 or 2006-01-02T15:04", startText)
+	}
+	end, err := parse(endText)
+	if err != nil {
+		clock, err := time.Parse("15:04", endText)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("window end %q: want RFC3339, 2006-01-02T15:04 or 15:04", endText)
+		}
+		local := start.In(loc)
+		end = time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+		if !end.After(start) {
+			end = end.AddDate(0, 0, 1)
+		}
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("window %q ends before it starts", s)
+	}
+	return start, end, nil
+}
+
+type capacityEntry struct {
+	HistoryID   int64      `json:"history_id"`
+	Reference   string     `json:"reference,omitempty"`
+	TotalImpact float64    `json:"total_impact"`
+	WindowStart *time.Time `json:"window_start"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+}
+
+type capacityReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Ceiling and Headroom are left out when no ceiling is configured.
+	Ceiling      float64         `json:"ceiling,omitempty"`
+	Scheduled    float64         `json:"scheduled"`
+	Headroom     *float64        `json:"headroom,omitempty"`
+	Calculations []capacityEntry `json:"calculations"`
+}
+
+func scheduled(ctx context.Context, store history.Store, start, end time.Time, excludeReference string) (float64, []capacityEntry, error) {
+	records, err := store.Scheduled(ctx, start, end, excludeReference)
+	if err != nil {
+		return 0, nil, err
+	}
+	total, entries := 0.0, []capacityEntry{}
+	for _, r := range records {
+		total += r.TotalImpact
+		entries = append(entries, capacityEntry{HistoryID: r.ID, Reference: r.Reference, TotalImpact: r.TotalImpact, WindowStart: r.WindowStart, WindowEnd: r.WindowEnd})
+	}
+	return total, entries, nil
+}
+
+// CapacityHandler serves GET /capacity?window=START/END: the impact
+// scheduled in the window by recorded calculations, the latest per
+// reference, and the headroom left under ceiling (0 = none).
+func CapacityHandler(store history.Store, weights impact.WeightConfig, ceiling float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loc, err := time.LoadLocation(weights.Timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		start, end, err := parseWindow(r.URL.Query().Get("window"), loc)
+		if err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		total, entries, err := scheduled(r.Context(), store, start, end, "")
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		report := capacityReport{Start: start.UTC(), End: end.UTC(), Ceiling: ceiling, Scheduled: total, Calculations: entries}
+		if ceiling > 0 {
+			headroom := ceiling - total
+			report.Headroom = &headroom
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// errCapacityExceeded refuses a strict calculation over the ceiling.
+var errCapacityExceeded = errors.New("capacity ceiling exceeded")
+
+// checkCapacity warns when result's window would carry more than ceiling
+// points together with what is already scheduled there. The request's own
+// reference is not counted: this calculation revises it. A strict request
+// over the ceiling gets errCapacityExceeded instead of the warning.
+func checkCapacity(ctx context.Context, calc *impact.Calculator, store history.Store, ceiling float64, req impact.ImpactRequest, result *impact.ImpactResult) error {
+	if ceiling <= 0 || result.Window == nil {
+		return nil
+	}
+	start, end := result.Window.StartUTC, result.Window.StartUTC.Add(time.Millisecond)
+	if result.Window.EndUTC != nil {
+		end = *result.Window.EndUTC
+	}
+	warn := func(severity impact.Severity, msg string) {
+		result.Warnings = append(result.Warnings, impact.DataWarning{
+			ObjectType:    "request",
+			Field:         "capacity",
+			Severity:      severity,
+			SeverityLabel: impact.SeverityLabel(severity, calc.Lang),
+			Message:       msg,
+		})
+	}
+	total, _, err := scheduled(ctx, store, start, end, req.Reference)
+	if err != nil {
+		warn(impact.SeverityMedium, "the capacity ceiling could not be checked: "+err.Error())
+		return nil
+	}
+	if total+result.TotalImpact <= ceiling {
+		return nil
+	}
+	msg := fmt.Sprintf("the window would carry %.2f impact points (%.2f already scheduled), above the ceiling of %.2f", total+result.TotalImpact, total, ceiling)
+	if result.Metadata.Strict {
+		return fmt.Errorf("%w: %s", errCapacityExceeded, msg)
+	}
+	warn(impact.SeverityCritical, msg)
+	return nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+)
+
+// The chaos suite runs calculations against a NetBox injecting each kind
+// of fault and checks what the service promises whatever NetBox does: it
+// does not panic or answer 500, it keeps to the call budget, and a result
+// that is not flagged partial is the result a healthy NetBox gives.
+
+var chaosModes = []struct {
+	name  string
+	chaos netboxfake.Chaos
+}{
+	{"retryable errors", netboxfake.Chaos{ErrorRate: 0.3}},
+	{"server errors", netboxfake.Chaos{ErrorRate: 0.2, ErrorStatus: http.StatusInternalServerError}},
+	{"slow responses", netboxfake.Chaos{JitterMS: 5, TailRate: 0.2, TailMS: 200}},
+	{"malformed JSON", netboxfake.Chaos{MalformedRate: 0.2}},
+	{"truncated bodies", netboxfake.Chaos{TruncateRate: 0.2}},
+	{"connection resets", netboxfake.Chaos{ResetRate: 0.2}},
+	{"pagination loops", netboxfake.Chaos{PaginationLoop: true}},
+	{"everything", netboxfake.Chaos{ErrorRate: 0.1, JitterMS: 5, TailRate: 0.05, TailMS: 200, MalformedRate: 0.05, TruncateRate: 0.05, ResetRate: 0.05, PaginationLoop: true}},
+}
+
+// chaosCalculate posts body to a fresh service whose NetBox injects chaos
+// and returns the status, the result of a 200 and the NetBox server.
+func chaosCalculate(t *testing.T, f *netboxfake.FakeNetbox, opts impact.Options, chaos netboxfake.Chaos, seed uint64, body string) (int, impact.ImpactResult, *netboxfake.Server) {
+	t.Helper()
+	srv := netboxfake.NewServer(t, f)
+	srv.Seed(seed)
+	srv.SetChaos("", chaos)
+	client := srv.Client()
+	client.Client.Timeout = 100 * time.Millisecond
+	handler := New(Config{
+		Calculator:      impact.NewCalculator(opts),
+		Instances:       netboxfake.Instances(t, client),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+	})
+	rec := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				t.Fatalf("seed %d: panic: %v", seed, p)
+			}
+		}()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(body)))
+	}()
+	var result impact.ImpactResult
+	switch rec.Code {
+	case http.StatusOK:
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if !strings.Contains(rec.Body.String(), "NetBox") {
+			t.Errorf("seed %d: %d without naming NetBox: %s", seed, rec.Code, rec.Body)
+		}
+	default:
+		t.Errorf("seed %d: status %d: %s", seed, rec.Code, rec.Body)
+	}
+	return rec.Code, result, srv
+}
+
+func TestChaosPartialResultsAreFlagged(t *testing.T) {
+	for _, allowPartial := range []bool{true, false} {
+		body := fmt.Sprintf(`{"device_ids": [1, 2], "circuit_ids": [100, 103], "site_ids": [2], "include_tenants": true, "allow_partial": %t, "impact_type": "planned-work"}`, allowPartial)
+		code, want, _ := chaosCalculate(t, netboxfake.Sample(), impact.DefaultOptions(), netboxfake.Chaos{}, 0, body)
+		if code != http.StatusOK || want.Partial {
+			t.Fatalf("without chaos: status %d, partial %v", code, want.Partial)
+		}
+		for _, mode := range chaosModes {
+			t.Run(fmt.Sprintf("%s/allow_partial=%t", mode.name, allowPartial), func(t *testing.T) {
+				succeeded := 0
+				for seed := uint64(1); seed <= 15; seed++ {
+					code, got, _ := chaosCalculate(t, netboxfake.Sample(), impact.DefaultOptions(), mode.chaos, seed, body)
+					if code != http.StatusOK {
+						continue
+					}
+					succeeded++
+					if got.Partial {
+						if !allowPartial {
+							t.Errorf("seed %d: partial result without allow_partial", seed)
+						}
+						if len(got.Warnings) == 0 {
+							t.Errorf("seed %d: partial result without a warning", seed)
+						}
+						continue
+					}
+					if got.TotalImpact != want.TotalImpact {
+						t.Errorf("seed %d: unflagged total %v, want %v; warnings %+v", seed, got.TotalImpact, want.TotalImpact, got.Warnings)
+					}
+				}
+				t.Logf("%d of 15 calculations succeeded", succeeded)
+			})
+		}
+	}
+}
+
+func TestChaosCallBudget(t *testing.T) {
+	// A chain of devices cabled to the next: the blast radius walks it one
+	// hop, and one NetBox call, at a time.
+	f := &netboxfake.FakeNetbox{URL: "https://netbox.example.com", Devices: make(map[int]netbox.Device), Cables: make(map[int]netbox.Cable)}
+	for id := 1; id <= 50; id++ {
+		f.Devices[id] = netbox.Device{ID: id, Name: fmt.Sprintf("sw-%d", id), Site: &netbox.Node{ID: 1, Name: "AMS01"}}
+		if id < 50 {
+			f.Cables[id] = netbox.Cable{ID: id,
+				ATerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", Object: netbox.CableEndpoint{Device: &netbox.Node{ID: id}}}},
+				BTerminations: []netbox.CableTermination{{ObjectType: "dcim.interface", Object: netbox.CableEndpoint{Device: &netbox.Node{ID: id + 1}}}}}
+		}
+	}
+	opts := impact.DefaultOptions()
+	opts.CallBudget = 10
+	body := `{"device_ids": [1], "blast_radius_depth": 99, "expand_vms": false, "allow_partial": true, "impact_type": "planned-work"}`
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			for seed := uint64(1); seed <= 15; seed++ {
+				code, result, srv := chaosCalculate(t, f, opts, mode.chaos, seed, body)
+				// Retries count against the budget. The transport also
+				// resends a GET whose reused connection was reset before
+				// any response, which the client never sees.
+				if served := srv.Total() - srv.Injected(netboxfake.FaultReset); served > opts.CallBudget {
+					t.Errorf("seed %d: NetBox served %d requests, budget %d", seed, served, opts.CallBudget)
+				}
+				if code == http.StatusOK && (!result.Partial || result.Metadata.NetboxCalls > int64(opts.CallBudget)) {
+					t.Errorf("seed %d: partial = %v, netbox_calls = %d", seed, result.Partial, result.Metadata.NetboxCalls)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+// Package server holds the HTTP handlers and middleware of the impact
+// service.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// wantMilliPoints reads ?units=: "points" (the default) or "millipoints".
+func wantMilliPoints(r *http.Request) (bool, error) {
+	switch units := r.URL.Query().Get("units"); units {
+	case "", "points":
+		return false, nil
+	case "millipoints":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid units %q (expected points or millipoints)", units)
+	}
+}
+
+// writeCalculationError maps a CalculateImpactDetailed error onto an HTTP
+// response. NetBox-side failures surface as 502/503/504 rather than 500.
+func writeCalculationError(w http.ResponseWriter, err error) {
+	var serr *netbox.StatusError
+	var verr *netbox.ValidationError
+	var dqerr *impact.DataQualityError
+	var uerr *impact.UnknownObjectsError
+	var rerr *impact.RangeError
+	var terr *netbox.TimeoutError
+	var gerr *impact.GuardError
+	var resperr *netbox.ResponseError
+	if errors.As(err, &gerr) {
+		w.Header().Set("X-Strict-Guard", gerr.Guard)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Printf("calculation aborted: client disconnected")
+	case errors.Is(err, netbox.ErrCallBudgetExhausted):
+		http.Error(w, "Request needs more NetBox calls than the per-calculation budget allows: "+err.Error(), http.StatusUnprocessableEntity)
+	case errors.As(err, &verr):
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+	case errors.As(err, &dqerr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    err.Error(),
+			"circuits": dqerr.Warnings,
+		})
+	case errors.As(err, &rerr):
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusUnprocessableEntity)
+	case errors.As(err, &uerr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   err.Error(),
+			"missing": uerr.Missing,
+		})
+	case errors.Is(err, netbox.ErrNotFound):
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, netbox.ErrUnauthorized):
+		http.Error(w, "NetBox rejected the API token; check -netbox-token and its permissions: "+err.Error(), http.StatusBadGateway)
+	case errors.Is(err, netbox.ErrRateLimited):
+		http.Error(w, "NetBox is rate limiting requests, try again later: "+err.Error(), http.StatusServiceUnavailable)
+	case errors.As(err, &terr), errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Timed out talking to NetBox: "+err.Error(), http.StatusGatewayTimeout)
+	case errors.As(err, &serr):
+		http.Error(w, "NetBox returned an error: "+err.Error(), http.StatusBadGateway)
+	case errors.As(err, &resperr), errors.Is(err, netbox.ErrPaginationLoop):
+		http.Error(w, "NetBox returned an unusable response: "+err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, "Error calculating impact: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func CompareImpactHandler(calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		milli, err := wantMilliPoints(r)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var sides struct {
+			A json.RawMessage `json:"a"`
+			B json.RawMessage `json:"b"`
+		}
+		if json.Unmarshal(body, &sides) == nil {
+			for _, err := range []error{impact.CheckWindowTimes(sides.A, "a."), impact.CheckWindowTimes(sides.B, "b.")} {
+				if err != nil {
+					http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		var req impact.CompareRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if calc.StrictFor(weights, req.A) || calc.StrictFor(weights, req.B) {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&impact.CompareRequest{}); err != nil {
+				w.Header().Set("X-Strict-Guard", "strict_json")
+				http.Error(w, "Invalid request payload (strict): "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		result, err := calc.Compare(r.Context(), req, instances, weights)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		for _, side := range []*impact.ImpactResult{&result.A, &result.B} {
+			if side.Metadata.Strict {
+				side.Metadata.Guards = append([]impact.GuardReport{{Name: "strict_json", Status: "passed"}}, side.Metadata.Guards...)
+			}
+		}
+		calc.Redact(&result, req.A.Redact || req.B.Redact)
+		redactScope(r, calc, &result, req.A.Redact || req.B.Redact)
+		var payload interface{} = result
+		if milli {
+			payload = result.MilliPoints()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// SnapshotCompareRequest is the body of POST /compareSnapshots.
+type SnapshotCompareRequest struct {
+	Snapshot         string               `json:"snapshot"`
+	BaselineSnapshot string               `json:"baseline_snapshot"`
+	Request          impact.ImpactRequest `json:"request"`
+}
+
+func SnapshotCompareHandler(calc *impact.Calculator, store *netboxfake.SnapshotStore, weights impact.WeightConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		milli, err := wantMilliPoints(r)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var raw struct {
+			Request json.RawMessage `json:"request"`
+		}
+		if json.Unmarshal(body, &raw) == nil {
+			if err := impact.CheckWindowTimes(raw.Request, "request."); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var req SnapshotCompareRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if calc.StrictFor(weights, req.Request) {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&SnapshotCompareRequest{}); err != nil {
+				w.Header().Set("X-Strict-Guard", "strict_json")
+				http.Error(w, "Invalid request payload (strict): "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		current, err := store.Get("snapshot", req.Snapshot)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		baseline, err := store.Get("baseline_snapshot", req.BaselineSnapshot)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		result, err := calc.CompareSnapshots(r.Context(), req.Request, current, baseline, weights)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		calc.Redact(&result, req.Request.Redact)
+		redactScope(r, calc, &result, req.Request.Redact)
+		var payload interface{} = result
+		if milli {
+			payload = result.MilliPoints()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// decodeImpactRequest reads a /calculateImpact body, answering 400 and
+// returning false when it is not a valid request.
+func decodeImpactRequest(w http.ResponseWriter, r *http.Request, calc *impact.Calculator, weights impact.WeightConfig) (impact.ImpactRequest, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return impact.ImpactRequest{}, false
+	}
+	if err := impact.CheckWindowTimes(body, ""); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return impact.ImpactRequest{}, false
+	}
+	var req impact.ImpactRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return impact.ImpactRequest{}, false
+	}
+	if calc.StrictFor(weights, req) {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&impact.ImpactRequest{}); err != nil {
+			w.Header().Set("X-Strict-Guard", "strict_json")
+			http.Error(w, "Invalid request payload (strict): "+err.Error(), http.StatusBadRequest)
+			return impact.ImpactRequest{}, false
+		}
+	}
+	return req, true
+}
+
+func ImpactMiddleware(calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig, next http.Handler) http.Handler {
+	return impactMiddleware(calc, instances, weights, nil, 0, nil, next)
+}
+
+// impactMiddleware is ImpactMiddleware recording every result in store
+// when it is set, after checking its window against the capacity ceiling.
+func impactMiddleware(calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig, store history.Store, ceiling float64, publisher *publish.Publisher, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/calculateImpact" && r.Method == http.MethodPost {
+			milli, err := wantMilliPoints(r)
+			if err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			key, ok := idempotencyKey(w, r)
+			if !ok {
+				return
+			}
+			req, ok := decodeImpactRequest(w, r, calc, weights)
+			if !ok {
+				return
+			}
+			client, err := instances.Client(req.Instance)
+			if err != nil {
+				writeCalculationError(w, err)
+				return
+			}
+			result, err := calc.Calculate(r.Context(), req, client, weights)
+			if err != nil {
+				writeCalculationError(w, err)
+				return
+			}
+			if result.Metadata.Strict {
+				result.Metadata.Guards = append([]impact.GuardReport{{Name: "strict_json", Status: "passed"}}, result.Metadata.Guards...)
+			}
+			calc.Redact(&result, req.Redact)
+			if store != nil {
+				if err := checkCapacity(r.Context(), calc, store, ceiling, req, &result); err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				recordResult(r.Context(), calc, store, req, key, &result)
+			}
+			if publisher != nil {
+				publishResult(calc, publisher, req, &result)
+			}
+			// History and publication keep every name the caller's
+			// request left readable.
+			redactScope(r, calc, &result, req.Redact)
+			var payload interface{} = result
+			if milli {
+				payload = result.MilliPoints()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(payload)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NormalizeRequestHandler serves POST /normalizeRequest: the request as a
+// calculation would score it, the warnings and errors it would raise and
+// the objects per section, without scoring.
+func NormalizeRequestHandler(calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var req impact.ImpactRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var rejected error
+		if err := impact.CheckWindowTimes(body, ""); err != nil {
+			rejected = err
+		} else if calc.StrictFor(weights, req) {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&impact.ImpactRequest{}); err != nil {
+				rejected = fmt.Errorf("strict: %w", err)
+			}
+		}
+		var n impact.Normalization
+		if rejected != nil {
+			n = impact.Normalization{Request: req, Warnings: []impact.DataWarning{}, Errors: []impact.NormalizationError{{Message: rejected.Error()}}, Sections: map[string]impact.SectionEstimate{}}
+		} else {
+			client, err := instances.Client(req.Instance)
+			if err != nil {
+				writeCalculationError(w, err)
+				return
+			}
+			if n, err = calc.Normalize(r.Context(), req, client, weights); err != nil {
+				writeCalculationError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n)
+	}
+}
+
+type QuickImpactResult struct {
+	ObjectType  string            `json:"object_type"`
+	ID          int               `json:"id"`
+	ImpactType  impact.ImpactType `json:"impact_type"`
+	TotalImpact float64           `json:"total_impact"`
+	// TotalImpactMpts is set with ?units=millipoints.
+	TotalImpactMpts *int64   `json:"total_impact_mpts,omitempty"`
+	NormalizedScore float64  `json:"normalized_score"`
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+func netboxOrigin(netboxURL string) string {
+	u, err := url.Parse(netboxURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func QuickImpactHandler(calc *impact.Calculator, instances *netbox.NetboxInstances, weights impact.WeightConfig, defaultType impact.ImpactType) http.HandlerFunc {
+	origins := make(map[string]bool)
+	for _, name := range instances.Names() {
+		client, _ := instances.Client(name)
+		if origin := netboxOrigin(client.BaseURL()); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid object ID", http.StatusBadRequest)
+			return
+		}
+		milli, err := wantMilliPoints(r)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		impactType := defaultType
+		if t := r.URL.Query().Get("impact_type"); t != "" {
+			impactType = impact.ImpactType(t)
+		}
+		req := impact.ImpactRequest{ImpactType: impactType, Instance: r.URL.Query().Get("instance"), Redact: r.URL.Query().Get("redact") == "true"}
+		objectType := r.PathValue("object_type")
+		switch objectType {
+		case "devices":
+			req.DeviceIDs = []int{id}
+		case "circuits":
+			req.CircuitIDs = []int{id}
+		case "interfaces":
+			req.InterfaceIDs = []int{id}
+		default:
+			http.Error(w, "Invalid object type (expected devices, circuits or interfaces)", http.StatusBadRequest)
+			return
+		}
+		client, err := instances.Client(req.Instance)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		result, err := calc.Calculate(r.Context(), req, client, weights)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		calc.Redact(&result, req.Redact)
+		redactScope(r, calc, &result, req.Redact)
+		quick := QuickImpactResult{
+			ObjectType:      objectType,
+			ID:              id,
+			ImpactType:      impactType,
+			TotalImpact:     result.TotalImpact,
+			NormalizedScore: result.NormalizedScore,
+		}
+		if milli {
+			mpts := result.MilliPoints().TotalImpactMpts
+			quick.TotalImpactMpts = &mpts
+		}
+		for _, warning := range impact.MostSevere(result.Warnings, 3) {
+			quick.Warnings = append(quick.Warnings, warning.Message)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quick)
+	}
+}
+
+func CompositesHandler(store *impact.CompositeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		switch {
+		case r.Method == http.MethodGet && name == "":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(store.List())
+		case r.Method == http.MethodGet:
+			c, ok := store.Get(name)
+			if !ok {
+				http.Error(w, "Composite not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+		case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut && name != "":
+			var c impact.Composite
+			if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+				http.Error(w, "Invalid composite payload", http.StatusBadRequest)
+				return
+			}
+			if name != "" {
+				c.Name = name
+			} else if _, exists := store.Get(c.Name); exists {
+				http.Error(w, "Composite already exists", http.StatusConflict)
+				return
+			}
+			if err := store.Put(c); err != nil {
+				var verr *netbox.ValidationError
+				if errors.As(err, &verr) {
+					http.Error(w, "Invalid composite: "+err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Composite not saved: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+			}
+			json.NewEncoder(w).Encode(c)
+		case r.Method == http.MethodDelete && name != "":
+			found, err := store.Delete(name)
+			if err != nil {
+				http.Error(w, "Composite not deleted: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Composite not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// DefaultJobTimeout bounds a job's calculation unless Config.JobTimeout
+// sets another limit.
+const DefaultJobTimeout = 10 * time.Minute
+
+// recordResult saves result in store and sets its history_id; a retry
+// with the same idempotency key gets the first save's. A result that
+// cannot be saved is still returned, with a warning.
+func recordResult(ctx context.Context, calc *impact.Calculator, store history.Store, req impact.ImpactRequest, key string, result *impact.ImpactResult) {
+	r := history.NewRecord(req, *result)
+	r.IdempotencyKey = key
+	record, err := store.Save(ctx, r)
+	if err != nil {
+		log.Printf("history: %v", err)
+		result.Warnings = append(result.Warnings, impact.DataWarning{
+			ObjectType:    "request",
+			Field:         "history",
+			Severity:      impact.SeverityMedium,
+			SeverityLabel: impact.SeverityLabel(impact.SeverityMedium, calc.Lang),
+			Message:       "the result was not recorded in history: " + err.Error(),
+		})
+		return
+	}
+	result.Metadata.HistoryID = record.ID
+}
+
+// historyFilter reads the record filter of a /history query.
+func historyFilter(r *http.Request) (history.Filter, error) {
+	q := r.URL.Query()
+	f := history.Filter{
+		Reference:  q.Get("reference"),
+		ImpactType: impact.ImpactType(q.Get("impact_type")),
+		Instance:   q.Get("instance"),
+		Tags:       q["tag"],
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return history.Filter{}, fmt.Errorf("%s: %q is not an RFC3339 time", name, v)
+			}
+			*t = parsed
+		}
+	}
+	for name, n := range map[string]*int{"limit": &f.Limit, "offset": &f.Offset} {
+		if v := q.Get(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				return history.Filter{}, fmt.Errorf("%s: %q is not a non-negative integer", name, v)
+			}
+			*n = parsed
+		}
+	}
+	if f.Limit > history.MaxLimit {
+		return history.Filter{}, fmt.Errorf("limit: at most %d", history.MaxLimit)
+	}
+	return f, nil
+}
+
+// maxIdempotencyKey is the longest Idempotency-Key header accepted.
+const maxIdempotencyKey = 255
+
+// idempotencyKey reads the Idempotency-Key header, answering 400 when it
+// is too long.
+func idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKey {
+		http.Error(w, fmt.Sprintf("Invalid request: Idempotency-Key longer than %d bytes", maxIdempotencyKey), http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// writeStoreError answers a failed history lookup.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, history.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, history.ErrKeyReused) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("history: %v", err)
+	http.Error(w, "History unavailable: "+err.Error(), http.StatusInternalServerError)
+}
+
+// pathID reads the {id} of the request path.
+func pathID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid ID: "+r.PathValue("id"), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HistoryHandler serves GET /history (the records a filter selects, without
+// their results), /history/{id}, /history/trend, /history/outcomes (the
+// records with an outcome, oldest first), /history/calibration (?format=csv
+// for CSV) and /history/export (JSON lines, results included). A
+// tenant-scoped API key only sees the records of its tenants, with the
+// other tenants' names redacted by calc.
+func HistoryHandler(store history.Store, calc *impact.Calculator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenants := scopedTenants(r.Context())
+		if id := r.PathValue("id"); id != "" {
+			id, ok := pathID(w, r)
+			if !ok {
+				return
+			}
+			record, err := getRecord(r.Context(), store, id, tenants)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			redactScope(r, calc, record.Result, record.Request.Redact)
+			writeJSON(w, http.StatusOK, record)
+			return
+		}
+		f, err := historyFilter(r)
+		if err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Tenants = tenants
+		switch r.URL.Path {
+		case "/history/trend":
+			points, err := store.Trend(r.Context(), f)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"points": points})
+		case "/history/outcomes":
+			samples, err := store.Outcomes(r.Context(), f)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"outcomes": samples})
+		case "/history/calibration":
+			samples, err := store.Outcomes(r.Context(), f)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			rows := history.Calibrate(samples)
+			switch format := r.URL.Query().Get("format"); format {
+			case "", "json":
+				writeJSON(w, http.StatusOK, map[string]interface{}{"calibration": rows})
+			case "csv":
+				w.Header().Set("Content-Type", "text/csv")
+				history.WriteCalibrationCSV(w, rows)
+			default:
+				http.Error(w, fmt.Sprintf("Invalid query: format %q (expected json or csv)", format), http.StatusBadRequest)
+			}
+		case "/history/export":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			redact := func(record *history.Record) { redactScope(r, calc, record.Result, record.Request.Redact) }
+			if err := history.Export(r.Context(), store, f, w, redact); err != nil {
+				// The status is sent; the client sees a cut-off stream.
+				log.Printf("history export: %v", err)
+			}
+		default:
+			records, err := store.List(r.Context(), f)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"records": records})
+		}
+	}
+}
+
+// getRecord is store.Get, limited to tenants when they are set.
+func getRecord(ctx context.Context, store history.Store, id int64, tenants []string) (history.Record, error) {
+	if tenants != nil {
+		return store.GetForTenants(ctx, id, tenants)
+	}
+	return store.Get(ctx, id)
+}
+
+// OutcomeHandler serves POST /history/{id}/outcome, which records what
+// the change of record id actually did and answers with the record. A
+// tenant-scoped API key may only record the outcomes of its tenants'
+// records.
+func OutcomeHandler(store history.Store, calc *impact.Calculator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		tenants := scopedTenants(r.Context())
+		if tenants != nil {
+			if _, err := store.GetForTenants(r.Context(), id, tenants); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		var o history.Outcome
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			http.Error(w, "Invalid outcome payload", http.StatusBadRequest)
+			return
+		}
+		o.RecordedAt = time.Time{}
+		if err := o.Check(); err != nil {
+			http.Error(w, "Invalid outcome: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		record, err := store.RecordOutcome(r.Context(), id, o)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		redactScope(r, calc, record.Result, record.Request.Redact)
+		writeJSON(w, http.StatusOK, record)
+	}
+}
+
+// JobWorker claims queued jobs from the history store and calculates
+// them, Concurrency at a time. Any number of instances may run one on the
+// same database: a claim is a lease, renewed while the job runs, and a job
+// whose worker stops renewing it is claimed again by another.
+type JobWorker struct {
+	// Name identifies the worker in the jobs it claims; it must differ
+	// between the workers sharing a database.
+	Name         string
+	Concurrency  int
+	Lease        time.Duration
+	PollInterval time.Duration
+
+	calc      *impact.Calculator
+	instances *netbox.NetboxInstances
+	weights   impact.WeightConfig
+	store     history.Store
+	timeout   time.Duration
+	ceiling   float64
+	publisher *publish.Publisher
+}
+
+// Defaults of the JobWorker fields.
+const (
+	DefaultJobConcurrency  = 4
+	DefaultJobLease        = 30 * time.Second
+	DefaultJobPollInterval = time.Second
+)
+
+// NewJobWorker returns a worker for the jobs of cfg.History, calculating
+// them as cfg's server would.
+func NewJobWorker(cfg Config, name string) *JobWorker {
+	w := &JobWorker{
+		Name:         name,
+		Concurrency:  DefaultJobConcurrency,
+		Lease:        DefaultJobLease,
+		PollInterval: DefaultJobPollInterval,
+		calc:         cfg.Calculator,
+		instances:    cfg.Instances,
+		weights:      cfg.Weights,
+		store:        cfg.History,
+		timeout:      cmp.Or(cfg.JobTimeout, DefaultJobTimeout),
+		ceiling:      cfg.CapacityCeiling,
+	}
+	if !cfg.ReadOnly {
+		w.publisher = cfg.Publisher
+	}
+	return w
+}
+
+// Run claims and calculates jobs until ctx is cancelled, then queues the
+// jobs it is running again for other workers and returns.
+func (w *JobWorker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, max(w.Concurrency, 1))
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		job, ok, err := w.store.ClaimJob(ctx, w.Name, w.Lease)
+		if err != nil || !ok {
+			<-slots
+			if err != nil && ctx.Err() == nil {
+				log.Printf("jobs: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.PollInterval):
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			w.run(ctx, job)
+		}()
+	}
+}
+
+// run calculates job, renewing the lease until it is done, and records
+// its result, or why it failed. The result is saved and published only
+// while the lease is held, so at most one worker does either.
+func (w *JobWorker) run(stop context.Context, job history.Job) {
+	ctx, cancel := context.WithTimeout(stop, w.timeout)
+	defer cancel()
+	var lost atomic.Bool
+	go func() {
+		ticker := time.NewTicker(max(w.Lease/3, time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := w.store.RenewLease(ctx, job.ID, w.Name, w.Lease)
+				if errors.Is(err, history.ErrLeaseLost) {
+					lost.Store(true)
+					cancel()
+					return
+				}
+				if err != nil && ctx.Err() == nil {
+					log.Printf("job %d: renewing the lease: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+	fail := func(err error) {
+		switch {
+		case lost.Load():
+			log.Printf("job %d: lease lost, left to the worker that claimed it", job.ID)
+		case stop.Err() != nil:
+			if err := w.store.ReleaseJob(context.Background(), job.ID, w.Name); err != nil {
+				log.Printf("job %d: %v", job.ID, err)
+			}
+		default:
+			if err := w.store.UpdateJob(context.Background(), job.ID, w.Name, history.JobFailed, err.Error()); err != nil {
+				log.Printf("job %d: %v", job.ID, err)
+			}
+		}
+	}
+	if err := w.store.UpdateJob(ctx, job.ID, w.Name, history.JobRunning, ""); err != nil {
+		fail(err)
+		return
+	}
+	client, err := w.instances.Client(job.Request.Instance)
+	if err != nil {
+		fail(err)
+		return
+	}
+	result, err := w.calc.Calculate(ctx, job.Request, client, w.weights)
+	if err != nil {
+		fail(err)
+		return
+	}
+	w.calc.Redact(&result, job.Request.Redact)
+	if err := checkCapacity(ctx, w.calc, w.store, w.ceiling, job.Request, &result); err != nil {
+		fail(err)
+		return
+	}
+	record, err := w.store.CompleteJob(context.Background(), job.ID, w.Name, history.NewRecord(job.Request, result))
+	if err != nil {
+		if errors.Is(err, history.ErrLeaseLost) {
+			lost.Store(true)
+		}
+		fail(fmt.Errorf("saving the result: %w", err))
+		return
+	}
+	if w.publisher != nil {
+		result.Metadata.HistoryID = record.ID
+		if err := w.publisher.Publish(job.Request, result); err != nil {
+			log.Printf("job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// jobsHandler answers the /jobs endpoints; a JobWorker runs the jobs.
+type jobsHandler struct {
+	calc      *impact.Calculator
+	instances *netbox.NetboxInstances
+	weights   impact.WeightConfig
+	store     history.Store
+}
+
+// handler serves POST /jobs, which queues a /calculateImpact request
+// and answers 202 with the job, GET /jobs?state=&limit= and GET
+// /jobs/{id}. A done job's history_id names the record of its result.
+func (j *jobsHandler) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			req, ok := decodeImpactRequest(w, r, j.calc, j.weights)
+			if !ok {
+				return
+			}
+			if _, err := j.instances.Client(req.Instance); err != nil {
+				writeCalculationError(w, err)
+				return
+			}
+			key, ok := idempotencyKey(w, r)
+			if !ok {
+				return
+			}
+			job, created, err := j.store.CreateJob(r.Context(), req, key)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			w.Header().Set("Location", "/jobs/"+strconv.FormatInt(job.ID, 10))
+			if !created {
+				// A retry: the job is already queued or done.
+				writeJSON(w, http.StatusOK, job)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, job)
+		case r.PathValue("id") != "":
+			id, ok := pathID(w, r)
+			if !ok {
+				return
+			}
+			job, err := j.store.GetJob(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+		default:
+			state := history.JobState(r.URL.Query().Get("state"))
+			if state != "" {
+				if err := history.CheckJobState(state); err != nil {
+					http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			limit := 0
+			if v := r.URL.Query().Get("limit"); v != "" {
+				var err error
+				if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+					http.Error(w, "Invalid query: limit: "+strconv.Quote(v)+" is not a non-negative integer", http.StatusBadRequest)
+					return
+				}
+			}
+			jobs, err := j.store.ListJobs(r.Context(), state, limit)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": jobs})
+		}
+	}
+}
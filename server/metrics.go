@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// ReadyzHandler answers 503 until every prewarmer has finished its first
+// warm-up or grace has passed since started, then 200.
+func ReadyzHandler(prewarmers []*netbox.Prewarmer, grace time.Duration, started time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if time.Since(started) < grace {
+			for _, p := range prewarmers {
+				if !p.Warmed() {
+					http.Error(w, "warming up the object cache", http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+		w.Write([]byte("ready"))
+	}
+}
+
+// MetricsHandler serves the service's metrics in the Prometheus text
+// format. publisher may be nil.
+func MetricsHandler(instances *netbox.NetboxInstances, prewarmers []*netbox.Prewarmer, publisher *publish.Publisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP netbox_impact_calculations_total Impact calculations run.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_calculations_total counter")
+		fmt.Fprintf(w, "netbox_impact_calculations_total %d\n", impact.CalculationsTotal.Load())
+		fmt.Fprintln(w, "# HELP netbox_impact_calculation_netbox_calls_total NetBox requests sent on behalf of calculations.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_calculation_netbox_calls_total counter")
+		fmt.Fprintf(w, "netbox_impact_calculation_netbox_calls_total %d\n", impact.CalculationNetboxCalls.Load())
+		fmt.Fprintln(w, "# HELP netbox_impact_call_budget_exhausted_total Calculations that stopped expanding at the NetBox call budget.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_call_budget_exhausted_total counter")
+		fmt.Fprintf(w, "netbox_impact_call_budget_exhausted_total %d\n", impact.CallBudgetExhaustions.Load())
+		fmt.Fprintln(w, "# HELP netbox_impact_netbox_denied_calls_total NetBox requests refused by the outbound allowlist.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_netbox_denied_calls_total counter")
+		if instances != nil {
+			for _, name := range instances.Names() {
+				if client, err := instances.Live(name); err == nil {
+					fmt.Fprintf(w, "netbox_impact_netbox_denied_calls_total{instance=%q} %d\n", name, client.AllowlistReport().DeniedCalls)
+				}
+			}
+		}
+		if publisher != nil {
+			fmt.Fprintln(w, "# HELP netbox_impact_published_total Results published to the -publish-dir or -publish-s3-url destination.")
+			fmt.Fprintln(w, "# TYPE netbox_impact_published_total counter")
+			fmt.Fprintf(w, "netbox_impact_published_total %d\n", publisher.Published())
+			fmt.Fprintln(w, "# HELP netbox_impact_publish_failures_total Results that could not be published after retries, or found the queue full.")
+			fmt.Fprintln(w, "# TYPE netbox_impact_publish_failures_total counter")
+			fmt.Fprintf(w, "netbox_impact_publish_failures_total %d\n", publisher.Failures())
+		}
+		if len(prewarmers) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "# HELP netbox_impact_prewarm_last_success_timestamp_seconds Unix time the last cache warm-up completed (0 = never).")
+		fmt.Fprintln(w, "# TYPE netbox_impact_prewarm_last_success_timestamp_seconds gauge")
+		for _, p := range prewarmers {
+			fmt.Fprintf(w, "netbox_impact_prewarm_last_success_timestamp_seconds{instance=%q} %d\n", p.Instance, p.LastWarm())
+		}
+		fmt.Fprintln(w, "# HELP netbox_impact_prewarm_objects Objects loaded into the cache by the last warm-up.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_prewarm_objects gauge")
+		for _, p := range prewarmers {
+			devices, circuits := p.Objects()
+			fmt.Fprintf(w, "netbox_impact_prewarm_objects{instance=%q,type=\"device\"} %d\n", p.Instance, devices)
+			fmt.Fprintf(w, "netbox_impact_prewarm_objects{instance=%q,type=\"circuit\"} %d\n", p.Instance, circuits)
+		}
+		fmt.Fprintln(w, "# HELP netbox_impact_prewarm_failures_total Cache warm-ups that failed.")
+		fmt.Fprintln(w, "# TYPE netbox_impact_prewarm_failures_total counter")
+		for _, p := range prewarmers {
+			fmt.Fprintf(w, "netbox_impact_prewarm_failures_total{instance=%q} %d\n", p.Instance, p.Failures())
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// RequestIDMiddleware gives every request an ID, taken from the caller's
+// X-Request-ID when it has one, echoes it in the response and attaches it
+// and any valid traceparent to the request context.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := netbox.SanitizeHeaderValue(r.Header.Get("X-Request-ID"))
+		if id == "" {
+			id = fmt.Sprintf("%016x", rand.Uint64())
+		}
+		traceparent := r.Header.Get("traceparent")
+		if !netbox.ValidTraceparent(traceparent) {
+			traceparent = ""
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(netbox.WithTrace(r.Context(), id, traceparent)))
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// publishResult queues result for publication. Publication runs after the
+// response, so what the result can carry is a warning that earlier results,
+// or this one, could not be published.
+func publishResult(calc *impact.Calculator, publisher *publish.Publisher, req impact.ImpactRequest, result *impact.ImpactResult) {
+	warn := func(msg string) {
+		result.Warnings = append(result.Warnings, impact.DataWarning{
+			ObjectType:    "request",
+			Field:         "publish",
+			Severity:      impact.SeverityMedium,
+			SeverityLabel: impact.SeverityLabel(impact.SeverityMedium, calc.Lang),
+			Message:       msg,
+		})
+	}
+	if err := publisher.Err(); err != nil {
+		warn("the last result could not be published: " + err.Error())
+	}
+	if err := publisher.Publish(req, *result); err != nil {
+		warn("the result will not be published: " + err.Error())
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// Config is what New serves the API from.
+type Config struct {
+	Calculator *impact.Calculator
+	Instances  *netbox.NetboxInstances
+	Weights    impact.WeightConfig
+	// QuickImpactType is the impact type of /quickImpact calls that do not
+	// pass one.
+	QuickImpactType impact.ImpactType
+	// Snapshots enables POST /compareSnapshots when set.
+	Snapshots *netboxfake.SnapshotStore
+	// Prewarmers hold /readyz back for PrewarmGrace after Started.
+	Prewarmers   []*netbox.Prewarmer
+	PrewarmGrace time.Duration
+	Started      time.Time
+	// ReadOnly (-read-only) answers every endpoint that changes state with
+	// 403; it is fixed for the life of the handler.
+	ReadOnly bool
+	// History records every /calculateImpact result and enables /history
+	// and /jobs when set. A read-only instance serves them but records
+	// nothing.
+	History history.Store
+	// JobTimeout bounds a job's calculation (0 = DefaultJobTimeout). Jobs
+	// are run by JobWorkers, which may run on other instances.
+	JobTimeout time.Duration
+	// CapacityCeiling is the most impact points the recorded calculations
+	// may schedule in one window (0 = no ceiling); see GET /capacity.
+	CapacityCeiling float64
+	// Publisher, when set, publishes every /calculateImpact and job result
+	// (not on a read-only instance).
+	Publisher *publish.Publisher
+	// Webhook shapes the answers of POST /webhooks/netbox.
+	Webhook WebhookConfig
+	// APIKeys, when set, require a known key on every request but the
+	// banner, /readyz, /metrics and /version.
+	APIKeys *APIKeys
+	// StateKeyAge is how far back GET /admin/state carries the records
+	// created with an idempotency key (0 = DefaultStateKeyAge).
+	StateKeyAge time.Duration
+	// StatsMinGroupSize is the smallest group GET /stats reports (0 =
+	// DefaultStatsMinGroupSize); with StatsPublic it needs no API key.
+	StatsMinGroupSize int
+	StatsPublic       bool
+}
+
+// readOnly wraps h to refuse requests with methods other than GET and HEAD
+// when on is set.
+func readOnly(on bool, h http.HandlerFunc) http.HandlerFunc {
+	if !on {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read-only instance: "+r.Method+" "+r.URL.Path+" is disabled", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// New returns the service's HTTP handler.
+func New(cfg Config) http.Handler {
+	calc, instances, weights := cfg.Calculator, cfg.Instances, cfg.Weights
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Netbox Impact API"))
+	})
+	quickImpact := QuickImpactHandler(calc, instances, weights, cfg.QuickImpactType)
+	mux.HandleFunc("GET /quickImpact/{object_type}/{id}", quickImpact)
+	mux.HandleFunc("OPTIONS /quickImpact/{object_type}/{id}", quickImpact)
+	composites := readOnly(cfg.ReadOnly, CompositesHandler(calc.Composites))
+	mux.HandleFunc("/composites", composites)
+	mux.HandleFunc("/composites/{name}", composites)
+	mux.HandleFunc("POST /normalizeRequest", NormalizeRequestHandler(calc, instances, weights))
+	mux.HandleFunc("POST /compareImpact", CompareImpactHandler(calc, instances, weights))
+	if cfg.Snapshots != nil {
+		mux.HandleFunc("POST /compareSnapshots", SnapshotCompareHandler(calc, cfg.Snapshots, weights))
+	}
+	var store history.Store
+	var publisher *publish.Publisher
+	if !cfg.ReadOnly {
+		publisher = cfg.Publisher
+	}
+	if cfg.History != nil {
+		historyHandler := HistoryHandler(cfg.History, calc)
+		mux.HandleFunc("GET /history", historyHandler)
+		mux.HandleFunc("GET /history/trend", historyHandler)
+		mux.HandleFunc("GET /history/export", historyHandler)
+		mux.HandleFunc("GET /history/outcomes", historyHandler)
+		mux.HandleFunc("GET /history/calibration", historyHandler)
+		mux.HandleFunc("GET /history/{id}", historyHandler)
+		mux.HandleFunc("POST /history/{id}/outcome", readOnly(cfg.ReadOnly, OutcomeHandler(cfg.History, calc)))
+		jobs := &jobsHandler{calc: calc, instances: instances, weights: weights, store: cfg.History}
+		mux.HandleFunc("GET /capacity", CapacityHandler(cfg.History, weights, cfg.CapacityCeiling))
+		mux.HandleFunc("GET /jobs", jobs.handler())
+		mux.HandleFunc("POST /jobs", readOnly(cfg.ReadOnly, jobs.handler()))
+		mux.HandleFunc("GET /jobs/{id}", jobs.handler())
+		keyAge := cfg.StateKeyAge
+		if keyAge <= 0 {
+			keyAge = DefaultStateKeyAge
+		}
+		mux.HandleFunc("GET /stats", StatsHandler(cfg.History, calc, cmp.Or(cfg.StatsMinGroupSize, DefaultStatsMinGroupSize)))
+		state := StateHandler(cfg.History, keyAge)
+		mux.HandleFunc("GET /admin/state", state)
+		mux.HandleFunc("POST /admin/state", readOnly(cfg.ReadOnly, state))
+		if !cfg.ReadOnly {
+			store = cfg.History
+		}
+	}
+	webhook := &webhookHandler{calc: calc, instances: instances, weights: weights, defaultType: cfg.QuickImpactType, store: store, jobs: cfg.History, readOnly: cfg.ReadOnly, cfg: cfg.Webhook}
+	mux.HandleFunc("POST /webhooks/netbox", webhook.handler())
+	mux.HandleFunc("POST /admin/cache/purge", readOnly(cfg.ReadOnly, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		purged := 0
+		for _, name := range instances.Names() {
+			if client, err := instances.Live(name); err == nil {
+				purged += client.PurgeCache()
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	}))
+	mux.HandleFunc("GET /admin/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		client, err := instances.Live(r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.ConditionalStats())
+	})
+	mux.HandleFunc("GET /admin/netbox-stats", func(w http.ResponseWriter, r *http.Request) {
+		client, err := instances.Live(r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.Stats())
+	})
+	mux.HandleFunc("GET /admin/netbox-allowlist", func(w http.ResponseWriter, r *http.Request) {
+		client, err := instances.Live(r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.AllowlistReport())
+	})
+	features := calc.Features.Active()
+	if features == nil {
+		features = []string{}
+	}
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": netbox.Version, "read_only": cfg.ReadOnly, "features": features})
+	})
+	// Configuration is only set by flags; nothing changes it at runtime.
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Enricher configs can hold credentials; only names and kinds are
+		// shown.
+		apiKeys := 0
+		if cfg.APIKeys != nil {
+			apiKeys = cfg.APIKeys.Len()
+		}
+		enrichers := []map[string]string{}
+		for _, e := range calc.Enrichers {
+			enrichers = append(enrichers, map[string]string{"name": e.Name, "kind": e.Kind})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"read_only":          cfg.ReadOnly,
+			"instances":          instances.Names(),
+			"weights":            weights.Name,
+			"quick_impact_type":  cfg.QuickImpactType,
+			"snapshots":          cfg.Snapshots != nil,
+			"strict":             calc.Strict,
+			"compat":             calc.Compat,
+			"lang":               calc.Lang,
+			"call_budget":        calc.CallBudget,
+			"fetch_concurrency":  calc.FetchConcurrency,
+			"blast_radius_depth": calc.BlastRadiusDepth,
+			"expand_vms":         calc.ExpandVMs,
+			"redact_all":         calc.RedactAll,
+			"enrichers":          enrichers,
+			"history":            cfg.History != nil,
+			"capacity_ceiling":   cfg.CapacityCeiling,
+			"publish":            publisher != nil,
+			"webhook_template":   cfg.Webhook.ResponseTemplate != nil,
+			"webhook_status":     cfg.Webhook.CriticalStatus,
+			"api_keys":           apiKeys,
+			"stats_public":       cfg.StatsPublic,
+		})
+	})
+	mux.HandleFunc("GET /readyz", ReadyzHandler(cfg.Prewarmers, cfg.PrewarmGrace, cfg.Started))
+	mux.HandleFunc("GET /metrics", MetricsHandler(instances, cfg.Prewarmers, publisher))
+	handler := impactMiddleware(calc, instances, weights, store, cfg.CapacityCeiling, publisher, mux)
+	if cfg.APIKeys != nil {
+		var public []string
+		if cfg.StatsPublic {
+			public = append(public, "/stats")
+		}
+		handler = cfg.APIKeys.middleware(handler, public...)
+	}
+	return RequestIDMiddleware(handler)
+}
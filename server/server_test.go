@@ -0,0 +1,1384 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/history/sqlstore"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+	"github.com/R2Unit/netbox-impact/netboxfake"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+func TestQuickImpactLatency(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	srv.Delay = 20 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /quickImpact/{object_type}/{id}", QuickImpactHandler(impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, srv.Client()), impact.DefaultWeightConfig(), impact.PlannedWork))
+	get := func(target string) (time.Duration, int) {
+		t.Helper()
+		before := srv.Total()
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+		}
+		return time.Since(start), srv.Total() - before
+	}
+	for _, target := range []string{"/quickImpact/devices/1", "/quickImpact/circuits/100", "/quickImpact/interfaces/202"} {
+		cold, coldCalls := get(target)
+		warm, warmCalls := get(target)
+		if coldCalls == 0 || cold < srv.Delay {
+			t.Errorf("%s: cold cache took %v with %d NetBox calls, want at least one %v call", target, cold, coldCalls, srv.Delay)
+		}
+		// Objects come from the cache; only listings and ID checks go out.
+		if warmCalls >= coldCalls || warm >= cold {
+			t.Errorf("%s: warm cache took %v with %d NetBox calls, cold %v with %d", target, warm, warmCalls, cold, coldCalls)
+		}
+		if strings.Contains(target, "circuits") && warmCalls != 0 {
+			t.Errorf("%s: warm cache made %d NetBox calls, want 0", target, warmCalls)
+		}
+	}
+}
+
+func TestNewRoutes(t *testing.T) {
+	handler := New(Config{
+		Calculator:      impact.NewCalculator(impact.DefaultOptions()),
+		Instances:       netboxfake.Instances(t, netboxfake.Sample()),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+	})
+	tests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{http.MethodPost, "/calculateImpact", `{"device_ids": [1], "impact_type": "planned-work"}`, http.StatusOK},
+		{http.MethodGet, "/quickImpact/devices/1", "", http.StatusOK},
+		{http.MethodPost, "/compareImpact", `{"a": {"device_ids": [1], "impact_type": "planned-work"}, "b": {"device_ids": [2], "impact_type": "planned-work"}}`, http.StatusOK},
+		{http.MethodGet, "/composites", "", http.StatusOK},
+		{http.MethodGet, "/readyz", "", http.StatusOK},
+		{http.MethodGet, "/metrics", "", http.StatusOK},
+		// Without a snapshot store the route falls through to the index.
+		{http.MethodPost, "/compareSnapshots", `{}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.target, rec.Code, tt.status, rec.Body)
+		}
+		if rec.Header().Get("X-Request-ID") == "" {
+			t.Errorf("%s %s: no X-Request-ID", tt.method, tt.target)
+		}
+	}
+}
+
+func TestCalculateImpactHandlerRejectsUnknownImpactType(t *testing.T) {
+	handler := ImpactMiddleware(impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, netboxfake.Sample()), impact.DefaultWeightConfig(), http.NotFoundHandler())
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"typo", `{"device_ids": [1], "impact_type": "incident-wrok"}`, http.StatusBadRequest, `unknown impact type "incident-wrok" (allowed: planned-work, fiber-works, electrical-work, incident-work)`},
+		{"missing", `{"device_ids": [1]}`, http.StatusBadRequest, "impact type is required"},
+		{"known", `{"device_ids": [1], "impact_type": "incident-work"}`, http.StatusOK, `"multiplier":10`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStrictGuardReports(t *testing.T) {
+	fake := netboxfake.Sample()
+	fake.Circuits[104] = netbox.Circuit{ID: 104, CID: "NO-Z", TerminationA: &netbox.CircuitTermination{ID: 1041, Site: &netbox.Node{ID: 1, Name: "AMS01"}}}
+	handler := ImpactMiddleware(impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, fake), impact.DefaultWeightConfig(), http.NotFoundHandler())
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"device_ids": [1], "impact_type": "planned-work", "strict": true}`)
+	var result impact.ImpactResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	want := []impact.GuardReport{
+		{Name: "strict_json", Status: "passed"},
+		{Name: "sanity_checks", Status: "passed"},
+		{Name: "id_validation", Status: "passed"},
+		{Name: "strict_data", Status: "skipped"},
+	}
+	if !slices.Equal(result.Metadata.Guards, want) {
+		t.Errorf("guards = %+v, want %+v", result.Metadata.Guards, want)
+	}
+
+	for body, guard := range map[string]string{
+		`{"device_ids": [1], "impact_type": "planned-work", "strict": true, "colour": "red"}`: "strict_json",
+		`{"device_ids": [99], "impact_type": "planned-work", "strict": true}`:                 "id_validation",
+		`{"device_ids": [200, 201], "impact_type": "planned-work", "strict": true}`:           "sanity_checks",
+		`{"circuit_ids": [104], "impact_type": "planned-work", "strict": true}`:               "strict_data",
+	} {
+		rec := post(body)
+		if got := rec.Header().Get("X-Strict-Guard"); got != guard || rec.Code == http.StatusOK {
+			t.Errorf("%s: status %d, X-Strict-Guard %q, want guard %q to fire", body, rec.Code, got, guard)
+		}
+	}
+	if rec := post(`{"device_ids": [1], "impact_type": "planned-work"}`); rec.Header().Get("X-Strict-Guard") != "" || strings.Contains(rec.Body.String(), `"guards"`) {
+		t.Errorf("permissive request reported guards: %s", rec.Body)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata")
+
+func TestMilliPointsGolden(t *testing.T) {
+	instances := netboxfake.Instances(t, netboxfake.Sample())
+	calculate := ImpactMiddleware(impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig(), http.NotFoundHandler())
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /compareImpact", CompareImpactHandler(impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig()))
+	mux.HandleFunc("GET /quickImpact/{object_type}/{id}", QuickImpactHandler(impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig(), impact.PlannedWork))
+	mux.Handle("/", calculate)
+	requests := []struct {
+		name, method, target, body string
+	}{
+		{"device", "POST", "/calculateImpact?units=millipoints", `{"device_ids": [1], "impact_type": "planned-work"}`},
+		{"mixed", "POST", "/calculateImpact?units=millipoints", `{"device_ids": [1, 2, 4], "circuit_ids": [100, 101, 103], "interface_ids": [200, 201, 202], "impact_type": "fiber-works"}`},
+		{"window", "POST", "/calculateImpact?units=millipoints", `{"circuit_ids": [102], "impact_type": "electrical-work", "start_time": "2026-03-03T02:00:00Z", "duration_minutes": 95}`},
+		{"compare", "POST", "/compareImpact?units=millipoints", `{"a": {"device_ids": [1], "impact_type": "planned-work"}, "b": {"device_ids": [1, 3], "circuit_ids": [100], "impact_type": "incident-work"}}`},
+		{"quick", "GET", "/quickImpact/circuits/101?units=millipoints", ""},
+	}
+	// Only the numbers are pinned; timings and the echoed weights vary.
+	keep := func(m map[string]interface{}) map[string]interface{} {
+		kept := make(map[string]interface{})
+		for _, key := range []string{"total_impact", "total_impact_before_multiplier", "total_impact_mpts", "total_impact_before_multiplier_mpts", "breakdown_mpts"} {
+			if v, ok := m[key]; ok {
+				kept[key] = v
+			}
+		}
+		return kept
+	}
+	got := make(map[string]interface{})
+	for _, r := range requests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(r.method, r.target, strings.NewReader(r.body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", r.name, rec.Code, rec.Body)
+		}
+		var body map[string]interface{}
+		dec := json.NewDecoder(rec.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if r.name == "compare" {
+			got[r.name] = map[string]interface{}{
+				"a":     keep(body["a"].(map[string]interface{})),
+				"b":     keep(body["b"].(map[string]interface{})),
+				"delta": keep(body["delta"].(map[string]interface{})),
+			}
+			continue
+		}
+		got[r.name] = keep(body)
+	}
+	data, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	golden := filepath.Join("testdata", "millipoints.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("milli-point output differs from %s (rerun with -update to accept):\n%s", golden, data)
+	}
+}
+
+func TestCompositeStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "composites.json")
+	store := impact.NewCompositeStore()
+	store.Path = path
+	handler := http.NewServeMux()
+	handler.HandleFunc("/composites", CompositesHandler(store))
+	handler.HandleFunc("/composites/{name}", CompositesHandler(store))
+	do := func(method, target, body string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec.Code
+	}
+	for _, step := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPost, "/composites", `{"name": "a", "device_ids": [1]}`, http.StatusCreated},
+		{http.MethodPost, "/composites", `{"name": "b", "circuit_ids": [100]}`, http.StatusCreated},
+		{http.MethodPut, "/composites/a", `{"device_ids": [1, 2]}`, http.StatusOK},
+		{http.MethodDelete, "/composites/b", "", http.StatusNoContent},
+	} {
+		if got := do(step.method, step.target, step.body); got != step.want {
+			t.Fatalf("%s %s = %d, want %d", step.method, step.target, got, step.want)
+		}
+	}
+	restarted := impact.NewCompositeStore()
+	if err := impact.LoadCompositesFile(path, restarted); err != nil {
+		t.Fatal(err)
+	}
+	if want := []impact.Composite{{Name: "a", DeviceIDs: []int{1, 2}}}; !reflect.DeepEqual(restarted.List(), want) {
+		t.Errorf("after restart = %+v, want %+v", restarted.List(), want)
+	}
+
+	store.Path = filepath.Join(t.TempDir(), "missing", "composites.json")
+	if got := do(http.MethodPost, "/composites", `{"name": "c", "device_ids": [3]}`); got != http.StatusInternalServerError {
+		t.Errorf("unwritable file: POST = %d, want 500", got)
+	}
+	if _, ok := store.Get("c"); ok {
+		t.Error("composite c kept although it was not saved")
+	}
+	if got := do(http.MethodDelete, "/composites/a", ""); got != http.StatusInternalServerError {
+		t.Errorf("unwritable file: DELETE = %d, want 500", got)
+	}
+	if _, ok := store.Get("a"); !ok {
+		t.Error("composite a dropped although the deletion was not saved")
+	}
+}
+
+func TestAllowFeatures(t *testing.T) {
+	server := netboxfake.NewServer(t, netboxfake.Sample())
+	client := server.Client()
+	if _, err := client.FetchTenants(context.Background(), []int{1}); !errors.Is(err, netbox.ErrEndpointNotAllowed) {
+		t.Fatalf("tenants without tier_field: err = %v, want ErrEndpointNotAllowed", err)
+	}
+	if _, err := client.FetchConsoleServerPorts(context.Background(), 1); !errors.Is(err, netbox.ErrEndpointNotAllowed) {
+		t.Fatalf("console server ports without oob_roles: err = %v, want ErrEndpointNotAllowed", err)
+	}
+	instances := netbox.NewNetboxInstances()
+	if err := instances.Add("default", client); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	MetricsHandler(instances, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `netbox_impact_netbox_denied_calls_total{instance="default"} 2`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics lack %q:\n%s", want, rec.Body.String())
+	}
+
+	weights := impact.DefaultWeightConfig()
+	weights.TierField = "sla_tier"
+	weights.OOBRoles = []string{"console-server"}
+	client.AllowFeatures(weights.NetboxFeatures())
+	if _, err := client.FetchTenants(context.Background(), []int{1}); err != nil {
+		t.Errorf("tenants with tier_field: %v", err)
+	}
+	if _, err := client.FetchConsoleServerPorts(context.Background(), 1); errors.Is(err, netbox.ErrEndpointNotAllowed) {
+		t.Errorf("console server ports with oob_roles: %v", err)
+	}
+}
+
+func TestPrewarmFillsCache(t *testing.T) {
+	server := netboxfake.NewServer(t, netboxfake.Sample())
+	client := server.Client()
+	client.SetCacheTTL(time.Minute)
+	p := netbox.NewPrewarmer("default", client, url.Values{"site_id": {"2"}}, 0)
+	readyz := ReadyzHandler([]*netbox.Prewarmer{p}, time.Hour, time.Now())
+	rec := httptest.NewRecorder()
+	readyz.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before warm-up = %d, want 503", rec.Code)
+	}
+
+	p.Run(context.Background())
+	if !p.Warmed() {
+		t.Fatal("not warmed after Run")
+	}
+	before := server.Total()
+	if _, err := client.FetchDeviceByID(context.Background(), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchCircuitsByIDs(context.Background(), []int{100, 101}); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Total() - before; n != 0 {
+		t.Errorf("%d NetBox requests after warm-up, want 0", n)
+	}
+
+	rec = httptest.NewRecorder()
+	readyz.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("readyz after warm-up = %d, want 200", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	MetricsHandler(nil, []*netbox.Prewarmer{p}, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`netbox_impact_prewarm_objects{instance="default",type="device"} 2`,
+		`netbox_impact_prewarm_objects{instance="default",type="circuit"} 2`,
+		`netbox_impact_prewarm_failures_total{instance="default"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, rec.Body.String())
+		}
+	}
+	if p.LastWarm() == 0 {
+		t.Error("last warm-up time not recorded")
+	}
+}
+
+func TestPrewarmFailureDoesNotBlock(t *testing.T) {
+	server := netboxfake.NewServer(t, netboxfake.Sample())
+	client := server.Client()
+	client.MaxRetries = 0
+	server.Close()
+	p := netbox.NewPrewarmer("default", client, nil, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	deadline := time.After(5 * time.Second)
+	for !p.Warmed() {
+		select {
+		case <-deadline:
+			t.Fatal("first warm-up did not finish")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if p.Failures() != 1 || p.LastWarm() != 0 {
+		t.Errorf("failures = %d, last warm-up = %d", p.Failures(), p.LastWarm())
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop on cancellation")
+	}
+	rec := httptest.NewRecorder()
+	ReadyzHandler([]*netbox.Prewarmer{p}, time.Hour, time.Now()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("readyz after a failed warm-up = %d, want 200", rec.Code)
+	}
+}
+
+func TestTracingHeadersReachNetbox(t *testing.T) {
+	srv := netboxfake.NewServer(t, netboxfake.Sample())
+	opts := netbox.DefaultNetboxClientOptions()
+	opts.Tracing.StaticHeaders = map[string]string{"X-Calling-Service": "netbox-impact"}
+	client, err := netbox.NewNetboxClientWithOptions(srv.URL, "token", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := RequestIDMiddleware(ImpactMiddleware(impact.NewCalculator(impact.DefaultOptions()), netboxfake.Instances(t, client), impact.DefaultWeightConfig(), http.NotFoundHandler()))
+
+	// Site expansion, the blast radius walk and VM expansion all call NetBox.
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"site_ids": [2], "circuit_ids": [100], "impact_type": "planned-work"}`))
+	req.Header.Set("X-Request-ID", "calc-42\r\nX-Evil: 1")
+	req.Header.Set("traceparent", traceparent)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	const wantID = "calc-42X-Evil: 1"
+	if got := rec.Header().Get("X-Request-ID"); got != wantID {
+		t.Errorf("response X-Request-ID = %q, want %q", got, wantID)
+	}
+	headers, queries := srv.Headers(), srv.Queries()
+	if len(headers) < 3 {
+		t.Fatalf("NetBox saw %d requests, want the expansion calls too", len(headers))
+	}
+	for i, h := range headers {
+		if h.Get("X-Request-ID") != wantID || h.Get("traceparent") != traceparent || h.Get("X-Calling-Service") != "netbox-impact" || h.Get("X-Evil") != "" {
+			t.Errorf("NetBox request %d (%v) carried %v", i, queries[i], h)
+		}
+	}
+}
+
+func TestTracingOptionsValidation(t *testing.T) {
+	for _, tracing := range []netbox.TracingOptions{
+		{RequestIDHeader: "X Request ID"},
+		{TraceparentHeader: "trace:parent"},
+		{StaticHeaders: map[string]string{"X-Calling-Service": "impact\r\nX-Evil: 1"}},
+	} {
+		opts := netbox.DefaultNetboxClientOptions()
+		opts.Tracing = tracing
+		if _, err := netbox.NewNetboxClientWithOptions("https://netbox.example.com", "token", opts); err == nil {
+			t.Errorf("%+v: accepted", tracing)
+		}
+	}
+	// A generated ID is used when the caller sends none or an invalid traceparent.
+	rec := httptest.NewRecorder()
+	var requestID, traceparent string
+	RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID, traceparent = netbox.TraceFrom(r.Context())
+	})).ServeHTTP(rec, func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("traceparent", "not-a-trace")
+		return r
+	}())
+	if len(requestID) != 16 || requestID != rec.Header().Get("X-Request-ID") || traceparent != "" {
+		t.Errorf("got request ID %q, traceparent %q", requestID, traceparent)
+	}
+}
+
+func TestNaiveTimestampsRejected(t *testing.T) {
+	instances := netboxfake.Instances(t, netboxfake.Sample())
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /compareImpact", CompareImpactHandler(impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig()))
+	handler := ImpactMiddleware(impact.NewCalculator(impact.DefaultOptions()), instances, impact.DefaultWeightConfig(), mux)
+	tests := []struct {
+		target, body, want string
+	}{
+		{"/calculateImpact", `{"device_ids": [1], "impact_type": "planned-work", "start_time": "2026-03-29T02:30:00"}`, `start_time: "2026-03-29T02:30:00" is not an RFC3339 time with a UTC offset`},
+		{"/calculateImpact", `{"device_ids": [1], "impact_type": "planned-work", "start_time": "2026-03-29T02:30:00Z", "end_time": "2026-03-29 04:00"}`, `end_time: "2026-03-29 04:00" is not an RFC3339`},
+		{"/compareImpact", `{"a": {"device_ids": [1], "impact_type": "planned-work"}, "b": {"device_ids": [1], "impact_type": "planned-work", "start_time": "2026-03-29T02:30"}}`, `b.start_time: "2026-03-29T02:30" is not an RFC3339`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: status %d, body %q; want 400 with %q", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		calc := impact.NewCalculator(impact.DefaultOptions())
+		handler := New(Config{
+			Calculator:      calc,
+			Instances:       netboxfake.Instances(t, netboxfake.NewServer(t, netboxfake.Sample()).Client()),
+			Weights:         impact.DefaultWeightConfig(),
+			QuickImpactType: impact.PlannedWork,
+			ReadOnly:        readOnly,
+		})
+		do := func(method, target, body string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+			return rec
+		}
+		writes := []struct{ method, target, body string }{
+			{http.MethodPost, "/composites", `{"name": "c", "device_ids": [1]}`},
+			{http.MethodPut, "/composites/c", `{"device_ids": [2]}`},
+			{http.MethodDelete, "/composites/c", ""},
+			{http.MethodPost, "/admin/cache/purge", ""},
+		}
+		for _, tt := range writes {
+			rec := do(tt.method, tt.target, tt.body)
+			denied := rec.Code == http.StatusForbidden && strings.HasPrefix(rec.Body.String(), "read-only instance")
+			if denied != readOnly {
+				t.Errorf("read_only=%t: %s %s = %d %s", readOnly, tt.method, tt.target, rec.Code, rec.Body)
+			}
+		}
+		if _, ok := calc.Composites.Get("c"); ok {
+			t.Errorf("read_only=%t: composite c left behind", readOnly)
+		}
+		// Reads and calculations keep working.
+		for _, target := range []string{"/composites", "/admin/cache/stats", "/readyz"} {
+			if rec := do(http.MethodGet, target, ""); rec.Code != http.StatusOK {
+				t.Errorf("read_only=%t: GET %s = %d", readOnly, target, rec.Code)
+			}
+		}
+		if rec := do(http.MethodPost, "/calculateImpact", `{"device_ids": [1], "impact_type": "planned-work"}`); rec.Code != http.StatusOK {
+			t.Errorf("read_only=%t: calculateImpact = %d %s", readOnly, rec.Code, rec.Body)
+		}
+		for _, target := range []string{"/version", "/admin/config"} {
+			var body struct {
+				ReadOnly *bool `json:"read_only"`
+			}
+			rec := do(http.MethodGet, target, "")
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.ReadOnly == nil || *body.ReadOnly != readOnly {
+				t.Errorf("read_only=%t: GET %s = %s", readOnly, target, rec.Body)
+			}
+		}
+		// The mode cannot be changed over HTTP.
+		if rec := do(http.MethodPut, "/admin/config", `{"read_only": false}`); rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("read_only=%t: PUT /admin/config = %d", readOnly, rec.Code)
+		}
+	}
+}
+
+func TestNormalizeRequest(t *testing.T) {
+	opts := impact.DefaultOptions()
+	opts.Strict = true
+	handler := New(Config{
+		Calculator:      impact.NewCalculator(opts),
+		Instances:       netboxfake.Instances(t, netboxfake.NewServer(t, netboxfake.Sample()).Client()),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+	})
+	tests := []struct {
+		body      string
+		code      int
+		devices   int
+		wantError string
+	}{
+		{`{"device_ids": [1, 2, 1], "impact_type": "planned-work"}`, http.StatusOK, 2, ""},
+		{`{"device_ids": [1], "impact_type": "planned-work", "devices": [2]}`, http.StatusOK, 0, `unknown field "devices"`},
+		{`{"device_ids": [99], "impact_type": "planned-work"}`, http.StatusOK, 0, "device_ids 99"},
+		{`{"device_ids": [1], "impact_type": "nope"}`, http.StatusOK, 0, "nope"},
+		{`{"device_ids": `, http.StatusBadRequest, 0, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/normalizeRequest", strings.NewReader(tt.body)))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, rec.Code, tt.code, rec.Body)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var n impact.Normalization
+		if err := json.Unmarshal(rec.Body.Bytes(), &n); err != nil {
+			t.Fatal(err)
+		}
+		if got := n.Sections["devices"].Count; got != tt.devices {
+			t.Errorf("%s: %d devices, want %d", tt.body, got, tt.devices)
+		}
+		if tt.wantError == "" && len(n.Errors) > 0 {
+			t.Errorf("%s: errors %+v", tt.body, n.Errors)
+		}
+		if tt.wantError != "" && (len(n.Errors) != 1 || !strings.Contains(n.Errors[0].Message, tt.wantError)) {
+			t.Errorf("%s: errors %+v, want %q", tt.body, n.Errors, tt.wantError)
+		}
+	}
+}
+
+// historyConfig is a Config over the sample data with a history store.
+func historyConfig(t *testing.T, netboxServer *netboxfake.Server) Config {
+	t.Helper()
+	store, err := sqlstore.Open(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return Config{
+		Calculator:      impact.NewCalculator(impact.DefaultOptions()),
+		Instances:       netboxfake.Instances(t, netboxServer.Client()),
+		Weights:         impact.DefaultWeightConfig(),
+		QuickImpactType: impact.PlannedWork,
+		History:         store,
+	}
+}
+
+// startWorker runs a JobWorker for cfg until the test ends.
+func startWorker(t *testing.T, cfg Config, name string) *JobWorker {
+	w := NewJobWorker(cfg, name)
+	w.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return w
+}
+
+// historyHandler serves historyConfig, changed by configure, with a job
+// worker unless it is read-only.
+func historyHandler(t *testing.T, configure func(*Config)) (http.Handler, history.Store) {
+	t.Helper()
+	cfg := historyConfig(t, netboxfake.NewServer(t, netboxfake.Sample()))
+	if configure != nil {
+		configure(&cfg)
+	}
+	if !cfg.ReadOnly {
+		startWorker(t, cfg, "test")
+	}
+	return New(cfg), cfg.History
+}
+
+func TestHistory(t *testing.T) {
+	handler, _ := historyHandler(t, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	var ids []int64
+	for _, body := range []string{
+		`{"device_ids": [1], "impact_type": "planned-work", "reference": "CHG-1"}`,
+		`{"device_ids": [1, 2], "impact_type": "planned-work", "reference": "CHG-1", "tags": ["dc-move", "q3"]}`,
+		`{"device_ids": [2], "impact_type": "fiber-works", "reference": "CHG-2", "tags": ["dc-move"]}`,
+	} {
+		rec := do(http.MethodPost, "/calculateImpact", body)
+		var result impact.ImpactResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Metadata.HistoryID == 0 {
+			t.Fatalf("calculateImpact = %d %s", rec.Code, rec.Body)
+		}
+		ids = append(ids, result.Metadata.HistoryID)
+	}
+
+	rec := do(http.MethodGet, "/history/"+strconv.FormatInt(ids[1], 10), "")
+	var record history.Record
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil || record.Reference != "CHG-1" || record.Result == nil || record.Result.Metadata.HistoryID != 0 {
+		t.Errorf("GET /history/%d = %d %s", ids[1], rec.Code, rec.Body)
+	}
+	if !slices.Equal(record.Tags, []string{"dc-move", "q3"}) {
+		t.Errorf("GET /history/%d tags = %v", ids[1], record.Tags)
+	}
+
+	tests := []struct {
+		target string
+		code   int
+		want   []int64
+	}{
+		{"/history", http.StatusOK, []int64{ids[2], ids[1], ids[0]}},
+		{"/history?reference=CHG-1&limit=1", http.StatusOK, []int64{ids[1]}},
+		{"/history?impact_type=fiber-works", http.StatusOK, []int64{ids[2]}},
+		{"/history?tag=dc-move", http.StatusOK, []int64{ids[2], ids[1]}},
+		{"/history?tag=dc-move&tag=q3", http.StatusOK, []int64{ids[1]}},
+		{"/history?until=2000-01-01T00:00:00Z", http.StatusOK, nil},
+		{"/history?since=yesterday", http.StatusBadRequest, nil},
+		{"/history?limit=-1", http.StatusBadRequest, nil},
+		{"/history?limit=5000", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		rec := do(http.MethodGet, tt.target, "")
+		if rec.Code != tt.code {
+			t.Errorf("GET %s = %d %s", tt.target, rec.Code, rec.Body)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Records []history.Record `json:"records"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, r := range body.Records {
+			got = append(got, r.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("GET %s = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+
+	rec = do(http.MethodGet, "/history/trend?reference=CHG-1", "")
+	var trend struct {
+		Points []history.TrendPoint `json:"points"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &trend); err != nil || len(trend.Points) != 1 || trend.Points[0].Count != 2 {
+		t.Errorf("GET /history/trend = %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/history/export?reference=CHG-1", "")
+	if lines := strings.Count(rec.Body.String(), "\n"); rec.Code != http.StatusOK || lines != 2 || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("GET /history/export = %d, %d lines", rec.Code, lines)
+	}
+	for target, code := range map[string]int{"/history/9999": http.StatusNotFound, "/history/abc": http.StatusBadRequest} {
+		if rec := do(http.MethodGet, target, ""); rec.Code != code {
+			t.Errorf("GET %s = %d, want %d", target, rec.Code, code)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	handler, store := historyHandler(t, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	rec := do(http.MethodPost, "/jobs", `{"device_ids": [1], "impact_type": "planned-work", "reference": "CHG-7"}`)
+	var job history.Job
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || rec.Code != http.StatusAccepted || job.State != history.JobQueued {
+		t.Fatalf("POST /jobs = %d %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	if location != "/jobs/"+strconv.FormatInt(job.ID, 10) {
+		t.Errorf("Location = %q", location)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for job.State != history.JobDone && job.State != history.JobFailed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		json.Unmarshal(do(http.MethodGet, location, "").Body.Bytes(), &job)
+	}
+	if job.State != history.JobDone || job.HistoryID == 0 {
+		t.Fatalf("job = %+v", job)
+	}
+	record, err := store.Get(context.Background(), job.HistoryID)
+	if err != nil || record.Reference != "CHG-7" || record.Result == nil || record.Result.TotalImpact == 0 {
+		t.Errorf("job record = %+v, %v", record, err)
+	}
+
+	// An unknown instance fails before a job is created.
+	if rec := do(http.MethodPost, "/jobs", `{"device_ids": [1], "impact_type": "planned-work", "instance": "nope"}`); rec.Code == http.StatusAccepted {
+		t.Errorf("POST /jobs with an unknown instance = %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/jobs", `{"device_ids": `); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /jobs with broken JSON = %d", rec.Code)
+	}
+	for target, code := range map[string]int{
+		"/jobs?state=done":   http.StatusOK,
+		"/jobs?state=asleep": http.StatusBadRequest,
+		"/jobs/9999":         http.StatusNotFound,
+	} {
+		if rec := do(http.MethodGet, target, ""); rec.Code != code {
+			t.Errorf("GET %s = %d, want %d", target, rec.Code, code)
+		}
+	}
+	var jobs struct {
+		Jobs []history.Job `json:"jobs"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/jobs?state=done", "").Body.Bytes(), &jobs); err != nil || len(jobs.Jobs) != 1 || jobs.Jobs[0].ID != job.ID {
+		t.Errorf("done jobs = %+v, %v", jobs, err)
+	}
+}
+
+// TestJobRecovery runs the jobs a crashed worker and a stopped one
+// left behind.
+func TestJobRecovery(t *testing.T) {
+	netboxServer := netboxfake.NewServer(t, netboxfake.Sample())
+	cfg := historyConfig(t, netboxServer)
+	dir := t.TempDir()
+	publisher, err := publish.New(publish.Dir(dir), "{history_id}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Publisher = publisher
+	store, ctx := cfg.History, context.Background()
+	handler := New(cfg)
+	submit := func(reference string) history.Job {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work", "reference": "`+reference+`"}`)))
+		var job history.Job
+		if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || rec.Code != http.StatusAccepted {
+			t.Fatalf("POST /jobs = %d %s", rec.Code, rec.Body)
+		}
+		return job
+	}
+	wait := func(id int64, done func(history.Job) bool) history.Job {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if job, err := store.GetJob(ctx, id); err == nil && done(job) {
+				return job
+			}
+		}
+		job, _ := store.GetJob(ctx, id)
+		t.Fatalf("job = %+v", job)
+		return job
+	}
+
+	// A worker stopping mid-calculation queues its job again.
+	netboxServer.SetChaos("", netboxfake.Chaos{LatencyMS: 200})
+	job := submit("CHG-1")
+	stopping := NewJobWorker(cfg, "stopping")
+	stopping.PollInterval = 10 * time.Millisecond
+	stopCtx, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		stopping.Run(stopCtx)
+		close(stopped)
+	}()
+	wait(job.ID, func(j history.Job) bool { return j.State == history.JobRunning })
+	stop()
+	<-stopped
+	if got, _ := store.GetJob(ctx, job.ID); got.State != history.JobQueued || got.Attempts != 0 {
+		t.Errorf("job after its worker stopped = %+v", got)
+	}
+	netboxServer.ResetChaos()
+
+	// A worker claims it again, then crashes: its lease runs out.
+	if claimed, ok, err := store.ClaimJob(ctx, "crashed", 50*time.Millisecond); !ok || err != nil || claimed.ID != job.ID {
+		t.Fatalf("ClaimJob = %+v, %v, %v", claimed, ok, err)
+	}
+	other := submit("CHG-2")
+	startWorker(t, cfg, "survivor")
+	job = wait(job.ID, func(j history.Job) bool { return j.State == history.JobDone })
+	other = wait(other.ID, func(j history.Job) bool { return j.State == history.JobDone })
+	if job.Attempts != 2 || job.Worker != "survivor" || other.Attempts != 1 {
+		t.Errorf("jobs = %+v, %+v", job, other)
+	}
+	records, err := store.List(ctx, history.Filter{})
+	if err != nil || len(records) != 2 {
+		t.Errorf("records = %+v, %v; want one per job", records, err)
+	}
+	publisher.Close()
+	if publisher.Published() != 2 {
+		t.Errorf("%d results published, want 2", publisher.Published())
+	}
+}
+
+// TestHistoryReadOnly checks a read-only instance serves history but
+// neither records results nor queues jobs.
+func TestHistoryReadOnly(t *testing.T) {
+	handler, store := historyHandler(t, func(cfg *Config) { cfg.ReadOnly = true })
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work"}`)))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "history_id") {
+		t.Errorf("calculateImpact = %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /jobs = %d", rec.Code)
+	}
+	for _, target := range []string{"/history", "/jobs"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d", target, rec.Code)
+		}
+	}
+	if records, err := store.List(context.Background(), history.Filter{}); err != nil || len(records) != 0 {
+		t.Errorf("records = %+v, %v", records, err)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	const ceiling = 12
+	handler, _ := historyHandler(t, func(cfg *Config) { cfg.CapacityCeiling = ceiling })
+	calculate := func(reference, window string, strict bool) (*httptest.ResponseRecorder, impact.ImpactResult) {
+		body := `{"device_ids": [1], "impact_type": "planned-work", "reference": "` + reference + `", ` + window + `, "strict": ` + strconv.FormatBool(strict) + `}`
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(body)))
+		var result impact.ImpactResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec, result
+	}
+	capacityWarning := func(result impact.ImpactResult) *impact.DataWarning {
+		for _, w := range result.Warnings {
+			if w.Field == "capacity" {
+				return &w
+			}
+		}
+		return nil
+	}
+	night := `"start_time": "2026-07-12T22:00:00Z", "end_time": "2026-07-13T02:00:00Z"`
+	_, first := calculate("CHG-1", night, false)
+	// A revision replaces the first estimate instead of adding to it.
+	_, revised := calculate("CHG-1", night, false)
+	if first.TotalImpact > ceiling || first.TotalImpact*2 <= ceiling {
+		t.Fatalf("the test needs a total between %v and %v, got %v", ceiling/2.0, ceiling, first.TotalImpact)
+	}
+	if w := capacityWarning(revised); w != nil {
+		t.Errorf("revised estimate warned: %+v", w)
+	}
+	_, other := calculate("CHG-2", `"start_time": "2026-07-13T01:00:00Z", "duration_minutes": 240`, false)
+	if w := capacityWarning(other); w == nil || w.Severity != impact.SeverityCritical || !strings.Contains(w.Message, "above the ceiling of 12.00") {
+		t.Errorf("CHG-2 capacity warning = %+v", w)
+	}
+	// Another night is empty.
+	if _, result := calculate("CHG-3", `"start_time": "2026-07-14T22:00:00Z"`, false); capacityWarning(result) != nil {
+		t.Errorf("CHG-3 warned: %+v", result.Warnings)
+	}
+	rec, _ := calculate("CHG-4", night, true)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "capacity ceiling exceeded") {
+		t.Errorf("strict calculation over the ceiling = %d %s", rec.Code, rec.Body)
+	}
+
+	var report capacityReport
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capacity?window=2026-07-12T22:00/06:00", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("GET /capacity = %d %s", rec.Code, rec.Body)
+	}
+	wantScheduled := revised.TotalImpact + other.TotalImpact
+	if len(report.Calculations) != 2 || report.Calculations[0].HistoryID != revised.Metadata.HistoryID || report.Scheduled != wantScheduled ||
+		report.Headroom == nil || *report.Headroom != ceiling-wantScheduled || !report.End.Equal(time.Date(2026, 7, 13, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("capacity report = %+v", report)
+	}
+	for _, window := range []string{"", "2026-07-12T22:00", "tonight/06:00", "2026-07-12T22:00/2026-07-12T21:00"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capacity?window="+url.QueryEscape(window), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("window %q: %d", window, rec.Code)
+		}
+	}
+}
+
+// failingDestination refuses every write.
+type failingDestination struct{}
+
+func (failingDestination) Put(context.Context, string, []byte) error {
+	return errors.New("bucket unreachable")
+}
+
+func TestPublish(t *testing.T) {
+	dir := t.TempDir()
+	publisher, err := publish.New(publish.Dir(dir), "{reference}/{history_id}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := historyHandler(t, func(cfg *Config) { cfg.Publisher = publisher })
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work", "reference": "CHG-1"}`)))
+	var result impact.ImpactResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Metadata.HistoryID == 0 {
+		t.Fatalf("calculateImpact = %d %s", rec.Code, rec.Body)
+	}
+	publisher.Close()
+	for _, name := range []string{strconv.FormatInt(result.Metadata.HistoryID, 10) + ".json", publish.LatestName} {
+		data, err := os.ReadFile(filepath.Join(dir, "CHG-1", name))
+		var published impact.ImpactResult
+		if err != nil || json.Unmarshal(data, &published) != nil || published.TotalImpact != result.TotalImpact || published.Metadata.HistoryID != result.Metadata.HistoryID {
+			t.Errorf("CHG-1/%s = %s, %v", name, data, err)
+		}
+	}
+
+	// Failures surface on the results after them; a read-only instance
+	// publishes nothing.
+	failing, _ := publish.New(failingDestination{}, "")
+	failing.RetryDelay = time.Millisecond
+	defer failing.Close()
+	handler, _ = historyHandler(t, func(cfg *Config) { cfg.Publisher = failing })
+	readOnlyHandler, _ := historyHandler(t, func(cfg *Config) { cfg.Publisher = failing; cfg.ReadOnly = true })
+	calculate := func(h http.Handler) impact.ImpactResult {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work"}`)))
+		var result impact.ImpactResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result
+	}
+	calculate(handler)
+	for deadline := time.Now().Add(5 * time.Second); failing.Err() == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	warned := false
+	for _, w := range calculate(handler).Warnings {
+		warned = warned || w.Field == "publish" && strings.Contains(w.Message, "bucket unreachable")
+	}
+	if !warned {
+		t.Error("no publish warning after a failed publication")
+	}
+	for _, w := range calculate(readOnlyHandler).Warnings {
+		if w.Field == "publish" {
+			t.Errorf("read-only instance: %+v", w)
+		}
+	}
+	failing.Close()
+	if got := failing.Published() + failing.Failures(); got != 2 {
+		t.Errorf("%d publications, want 2: none from the read-only instance", got)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	handler, store := historyHandler(t, nil)
+	fixtures := map[string]string{}
+	for _, version := range []string{"3.7", "4.x"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "webhook-netbox-"+version+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixtures[version] = string(data)
+	}
+	post := func(h http.Handler, query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhooks/netbox"+query, strings.NewReader(body)))
+		return rec
+	}
+
+	first := map[string]int64{}
+	for _, version := range []string{"3.7", "4.x", "3.7"} {
+		rec := post(handler, "", fixtures[version])
+		var resp WebhookResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("NetBox %s event = %d %s", version, rec.Code, rec.Body)
+		}
+		if resp.Event != "updated" || resp.Model != "device" || resp.ObjectID != 1 || resp.ImpactType != impact.PlannedWork ||
+			resp.TotalImpact == 0 || resp.Severity != impact.ScoreSeverity(resp.Score) || resp.HistoryID == 0 {
+			t.Errorf("NetBox %s event answer = %+v", version, resp)
+		}
+		// The retry of an event gets the first answer's record.
+		if id, ok := first[version]; ok && id != resp.HistoryID {
+			t.Errorf("retried NetBox %s event recorded as %d, want %d", version, resp.HistoryID, id)
+		}
+		first[version] = resp.HistoryID
+	}
+	records, err := store.List(context.Background(), history.Filter{Tags: []string{WebhookTag}})
+	if err != nil || len(records) != 2 {
+		t.Errorf("webhook records = %+v, %v; want one per event", records, err)
+	}
+
+	deleted := strings.Replace(fixtures["4.x"], "object_updated", "object_deleted", 1)
+	tests := []struct {
+		query string
+		body  string
+		code  int
+	}{
+		{"", deleted, http.StatusNoContent},
+		{"", strings.Replace(fixtures["3.7"], `"model": "device"`, `"model": "tenant"`, 1), http.StatusUnprocessableEntity},
+		{"", strings.Replace(fixtures["3.7"], `"updated"`, `"renamed"`, 1), http.StatusBadRequest},
+		{"", `{"event": "updated", "model": "device"}`, http.StatusBadRequest},
+		{"", `{"event": `, http.StatusBadRequest},
+		{"?mode=later", fixtures["3.7"], http.StatusBadRequest},
+		{"?impact_type=nope", fixtures["3.7"], http.StatusBadRequest},
+		{"?instance=nope", fixtures["3.7"], http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := post(handler, tt.query, tt.body); rec.Code != tt.code {
+			t.Errorf("POST /webhooks/netbox%s with %.60q = %d %s, want %d", tt.query, tt.body, rec.Code, rec.Body, tt.code)
+		}
+	}
+
+	async := strings.Replace(fixtures["3.7"], "6f1c2a5e", "7a2d3b6f", 1)
+	rec := post(handler, "?mode=async&impact_type=fiber-works", async)
+	var job history.Job
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || rec.Code != http.StatusAccepted || job.Request.ImpactType != impact.FiberWorks {
+		t.Fatalf("async event = %d %s", rec.Code, rec.Body)
+	}
+	var again history.Job
+	if rec := post(handler, "?mode=async&impact_type=fiber-works", async); json.Unmarshal(rec.Body.Bytes(), &again) != nil || rec.Code != http.StatusOK || again.ID != job.ID {
+		t.Errorf("retried async event = %d %s, want job %d", rec.Code, rec.Body, job.ID)
+	}
+
+	// A critical result answers with the configured status and template.
+	handler, _ = historyHandler(t, func(cfg *Config) {
+		cfg.Weights.NormalizationK = 1e-6
+		cfg.Webhook = WebhookConfig{
+			ResponseTemplate: template.Must(template.New("webhook").Parse(`{{.Severity}} {{printf "%.0f" .Score}}`)),
+			CriticalStatus:   http.StatusConflict,
+		}
+	})
+	rec = post(handler, "", fixtures["4.x"])
+	if rec.Code != http.StatusConflict || rec.Body.String() != "critical 100" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("critical event = %d %q (%s)", rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	handler, _ := historyHandler(t, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	var result impact.ImpactResult
+	rec := do(http.MethodPost, "/calculateImpact", `{"device_ids": [1], "impact_type": "planned-work", "reference": "CHG-1"}`)
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Metadata.HistoryID == 0 {
+		t.Fatalf("calculateImpact = %d %s", rec.Code, rec.Body)
+	}
+	target := "/history/" + strconv.FormatInt(result.Metadata.HistoryID, 10) + "/outcome"
+
+	tests := []struct {
+		target string
+		body   string
+		code   int
+	}{
+		{target, `{"actual_severity": "medium", "customer_tickets": 3, "notes": "two sites saw a flap"}`, http.StatusOK},
+		{target, `{"actual_severity": "dire"}`, http.StatusBadRequest},
+		{target, `{"actual_severity": "none", "customer_tickets": -1}`, http.StatusBadRequest},
+		{target, `{"actual_severity": `, http.StatusBadRequest},
+		{"/history/9999/outcome", `{"actual_severity": "none"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := do(http.MethodPost, tt.target, tt.body); rec.Code != tt.code {
+			t.Errorf("POST %s %s = %d %s, want %d", tt.target, tt.body, rec.Code, rec.Body, tt.code)
+		}
+	}
+	var record history.Record
+	rec = do(http.MethodGet, "/history/"+strconv.FormatInt(result.Metadata.HistoryID, 10), "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil || record.Outcome == nil || record.Outcome.ActualSeverity != "medium" || record.Outcome.CustomerTickets != 3 {
+		t.Errorf("record after the outcome = %d %s", rec.Code, rec.Body)
+	}
+
+	var report struct {
+		Calibration []history.CalibrationRow `json:"calibration"`
+	}
+	rec = do(http.MethodGet, "/history/calibration?impact_type=planned-work&since=2000-01-01T00:00:00Z", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil || len(report.Calibration) != 1 || report.Calibration[0].Count != 1 || report.Calibration[0].AverageTickets != 3 {
+		t.Errorf("GET /history/calibration = %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/history/calibration?format=csv", "")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	band := impact.ScoreSeverity(result.NormalizedScore)
+	if rec.Header().Get("Content-Type") != "text/csv" || len(lines) != 2 || !strings.HasPrefix(lines[0], "impact_type,band,count,") ||
+		!strings.HasPrefix(lines[1], "planned-work,"+string(band)+",1,1,1.0000,") {
+		t.Errorf("GET /history/calibration?format=csv = %d %q", rec.Code, lines)
+	}
+	if rec := do(http.MethodGet, "/history/calibration?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /history/calibration?format=xml = %d", rec.Code)
+	}
+
+	readOnly, _ := historyHandler(t, func(cfg *Config) { cfg.ReadOnly = true })
+	rec = httptest.NewRecorder()
+	readOnly.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"actual_severity": "none"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("outcome on a read-only instance = %d", rec.Code)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	keys, err := NewAPIKeys([]APIKey{
+		{Name: "ops", KeySHA256: hash("ops-key")},
+		{Name: "acme", KeySHA256: strings.ToUpper(hash("acme-key")), Tenants: []string{"Acme"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := historyHandler(t, func(cfg *Config) { cfg.APIKeys = keys })
+	do := func(key, method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	var ids []int64
+	for _, body := range []string{
+		`{"device_ids": [2], "impact_type": "planned-work", "reference": "CHG-1"}`,
+		`{"device_ids": [4], "impact_type": "planned-work", "reference": "CHG-2"}`,
+		`{"device_ids": [2, 4], "impact_type": "planned-work", "reference": "CHG-3", "include_tenants": true}`,
+	} {
+		rec := do("ops-key", http.MethodPost, "/calculateImpact", body)
+		var result impact.ImpactResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Metadata.HistoryID == 0 {
+			t.Fatalf("calculateImpact = %d %s", rec.Code, rec.Body)
+		}
+		ids = append(ids, result.Metadata.HistoryID)
+	}
+	globex, shared := "/history/"+strconv.FormatInt(ids[1], 10), "/history/"+strconv.FormatInt(ids[2], 10)
+
+	tests := []struct {
+		key    string
+		method string
+		target string
+		code   int
+	}{
+		{"", http.MethodGet, "/history", http.StatusUnauthorized},
+		{"wrong", http.MethodGet, "/history", http.StatusUnauthorized},
+		{"", http.MethodGet, "/version", http.StatusOK},
+		{"acme-key", http.MethodGet, "/jobs", http.StatusForbidden},
+		{"acme-key", http.MethodGet, "/admin/config", http.StatusForbidden},
+		{"acme-key", http.MethodGet, "/capacity", http.StatusForbidden},
+		{"acme-key", http.MethodGet, globex, http.StatusNotFound},
+		{"acme-key", http.MethodPost, globex + "/outcome", http.StatusNotFound},
+		{"ops-key", http.MethodGet, "/admin/config", http.StatusOK},
+		{"ops-key", http.MethodGet, globex, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.key, tt.method, tt.target, `{"actual_severity": "none"}`); rec.Code != tt.code {
+			t.Errorf("%s %s with key %q = %d %s, want %d", tt.method, tt.target, tt.key, rec.Code, rec.Body, tt.code)
+		}
+	}
+
+	rec := do("acme-key", http.MethodGet, "/history", "")
+	var list struct {
+		Records []history.Record `json:"records"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Records) != 2 || list.Records[0].ID != ids[2] || list.Records[1].ID != ids[0] {
+		t.Errorf("GET /history with a scoped key = %d %s", rec.Code, rec.Body)
+	}
+	for _, tt := range []struct {
+		key, method, target, body string
+		globex                    bool
+	}{
+		{"ops-key", http.MethodGet, shared, "", true},
+		{"acme-key", http.MethodGet, shared, "", false},
+		{"acme-key", http.MethodGet, "/history/export", "", false},
+		{"acme-key", http.MethodPost, "/calculateImpact", `{"device_ids": [2, 4], "impact_type": "planned-work", "include_tenants": true}`, false},
+	} {
+		rec := do(tt.key, tt.method, tt.target, tt.body)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Acme") || strings.Contains(rec.Body.String(), "Globex") != tt.globex {
+			t.Errorf("%s %s with key %q = %d %s; want Acme, and Globex %v", tt.method, tt.target, tt.key, rec.Code, rec.Body, tt.globex)
+		}
+	}
+
+	for _, keys := range [][]APIKey{
+		nil,
+		{{Name: "a", KeySHA256: "abc"}},
+		{{Name: "a", KeySHA256: hash("x")}, {Name: "a", KeySHA256: hash("y")}},
+		{{Name: "a", KeySHA256: hash("x")}, {Name: "b", KeySHA256: hash("x")}},
+		{{Name: "a", KeySHA256: hash("x"), Tenants: []string{""}}},
+	} {
+		if _, err := NewAPIKeys(keys); err == nil {
+			t.Errorf("NewAPIKeys(%+v) accepted", keys)
+		}
+	}
+}
+
+// TestStateTakeover exports the state of an instance whose worker never
+// ran and imports it into a fresh one with a database of its own, which
+// calculates the pending job and answers retries as the first would.
+func TestStateTakeover(t *testing.T) {
+	netboxServer := netboxfake.NewServer(t, netboxfake.Sample())
+	active := New(historyConfig(t, netboxServer))
+	standby, store := historyHandler(t, nil)
+	do := func(handler http.Handler, method, target, key, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	const calculation = `{"device_ids": [1], "impact_type": "planned-work", "reference": "CHG-1"}`
+	if rec := do(active, http.MethodPost, "/jobs", "job-1", calculation); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /jobs = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(active, http.MethodPost, "/calculateImpact", "calc-1", calculation); rec.Code != http.StatusOK {
+		t.Fatalf("POST /calculateImpact = %d %s", rec.Code, rec.Body)
+	}
+	rec := do(active, http.MethodGet, "/admin/state", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/state = %d %s", rec.Code, rec.Body)
+	}
+	state := rec.Body.String()
+
+	rec = do(standby, http.MethodPost, "/admin/state", "", state)
+	var n history.StateImport
+	if err := json.Unmarshal(rec.Body.Bytes(), &n); err != nil || n != (history.StateImport{Jobs: 1, Records: 1}) {
+		t.Fatalf("POST /admin/state = %d %s", rec.Code, rec.Body)
+	}
+	jobs, err := store.ListJobs(context.Background(), "", 10)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("standby jobs = %+v, %v", jobs, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job := jobs[0]; job.State != history.JobDone; {
+		if time.Now().After(deadline) {
+			t.Fatalf("imported job still %s", job.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if job, err = store.GetJob(context.Background(), job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := do(standby, http.MethodPost, "/jobs", "job-1", calculation); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"done"`) {
+		t.Errorf("retried POST /jobs = %d %s; want the imported job", rec.Code, rec.Body)
+	}
+	rec = do(standby, http.MethodPost, "/calculateImpact", "calc-1", calculation)
+	records, err := store.List(context.Background(), history.Filter{})
+	if err != nil || rec.Code != http.StatusOK || len(records) != 2 {
+		t.Errorf("retried calculation = %d, %d records, %v; want the imported record and the job's", rec.Code, len(records), err)
+	}
+
+	for body, code := range map[string]int{`{"version": 99}`: http.StatusUnprocessableEntity, `{"version": `: http.StatusBadRequest} {
+		if rec := do(standby, http.MethodPost, "/admin/state", "", body); rec.Code != code {
+			t.Errorf("POST /admin/state %s = %d, want %d", body, rec.Code, code)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	sum := sha256.Sum256([]byte("ops-key"))
+	keys, err := NewAPIKeys([]APIKey{{Name: "ops", KeySHA256: hex.EncodeToString(sum[:])}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, public := range []bool{true, false} {
+		handler, _ := historyHandler(t, func(cfg *Config) {
+			cfg.APIKeys, cfg.StatsPublic, cfg.StatsMinGroupSize = keys, public, 1
+		})
+		do := func(method, target, body string, key bool) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			if key {
+				req.Header.Set("Authorization", "Bearer ops-key")
+			}
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+		calculate := func() {
+			if rec := do(http.MethodPost, "/calculateImpact", `{"device_ids": [2], "impact_type": "planned-work", "reference": "CHG-SECRET"}`, true); rec.Code != http.StatusOK {
+				t.Fatalf("calculateImpact = %d %s", rec.Code, rec.Body)
+			}
+		}
+		calculate()
+		rec := do(http.MethodGet, "/stats", "", false)
+		if !public {
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("GET /stats without a key = %d, want 401", rec.Code)
+			}
+			continue
+		}
+		var st history.Stats
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || len(st.Months) != 1 || st.Months[0].Count != 1 || len(st.TopSites) != 1 || st.TopSites[0].Site != "AMS01" {
+			t.Fatalf("GET /stats = %d %s", rec.Code, rec.Body)
+		}
+		for _, secret := range []string{"CHG-SECRET", "Acme", "sw-ams01", `"id"`} {
+			if strings.Contains(rec.Body.String(), secret) {
+				t.Errorf("GET /stats shows %s: %s", secret, rec.Body)
+			}
+		}
+		calculate()
+		if again := do(http.MethodGet, "/stats", "", true); again.Body.String() != rec.Body.String() {
+			t.Errorf("GET /stats within the cache time = %s, want %s", again.Body, rec.Body)
+		}
+	}
+}
+
+// TestFeatureFlags runs the paths a feature switches both ways, as long
+// as both exist.
+func TestFeatureFlags(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		opts := impact.DefaultOptions()
+		opts.Features = impact.FeatureFlags{impact.StrictMultiplierValidation: on}
+		handler := New(Config{
+			Calculator:      impact.NewCalculator(opts),
+			Instances:       netboxfake.Instances(t, netboxfake.NewServer(t, netboxfake.Sample()).Client()),
+			Weights:         impact.DefaultWeightConfig(),
+			QuickImpactType: impact.PlannedWork,
+		})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work", "overrides": {"multiplier": 0}}`)))
+		var result impact.ImpactResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		switch {
+		case on && (rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "multiplier 0")):
+			t.Errorf("zero multiplier with %s on = %d %s, want 400", impact.StrictMultiplierValidation, rec.Code, rec.Body)
+		case !on && (rec.Code != http.StatusOK || result.TotalImpact != 0 || len(result.Warnings) == 0 || result.Warnings[0].Field != "impact_type" || result.Metadata.Features != nil):
+			t.Errorf("zero multiplier with %s off = %d %s, want 200 with a warning", impact.StrictMultiplierValidation, rec.Code, rec.Body)
+		}
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/calculateImpact", strings.NewReader(`{"device_ids": [1], "impact_type": "planned-work"}`)))
+		result = impact.ImpactResult{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.TotalImpact == 0 || (len(result.Metadata.Features) == 1) != on {
+			t.Errorf("calculation with %s=%v = %d %s", impact.StrictMultiplierValidation, on, rec.Code, rec.Body)
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+		if got := strings.Contains(rec.Body.String(), `"features":["strict_multiplier_validation"]`); got != on {
+			t.Errorf("GET /version with %s=%v = %s", impact.StrictMultiplierValidation, on, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/publish"
+)
+
+// DefaultStateKeyAge is how far back the exported state carries the
+// records created with an idempotency key.
+const DefaultStateKeyAge = 24 * time.Hour
+
+// StateFile is the name of the state snapshot in a state directory.
+const StateFile = "state.json"
+
+// StateHandler serves GET /admin/state, the history.State of store with
+// the keyed records of the last keyAge, and POST /admin/state, which
+// imports one and answers with the history.StateImport.
+func StateHandler(store history.Store, keyAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			st, err := history.ExportState(r.Context(), store, time.Now().Add(-keyAge))
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+		var st history.State
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			http.Error(w, "Invalid state payload", http.StatusBadRequest)
+			return
+		}
+		n, err := history.ImportState(r.Context(), store, st)
+		var versionErr *history.StateVersionError
+		if errors.As(err, &versionErr) {
+			http.Error(w, "Invalid state: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, n)
+	}
+}
+
+// SaveState writes the state of store to StateFile in dir, replacing the
+// previous snapshot at once.
+func SaveState(ctx context.Context, store history.Store, dir string, keyAge time.Duration) error {
+	st, err := history.ExportState(ctx, store, time.Now().Add(-keyAge))
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return publish.Dir(dir).Put(ctx, StateFile, body)
+}
+
+// LoadState imports the snapshot in dir into store when store has no jobs
+// yet, as on a standby starting with a database of its own; imported is
+// false when there is no snapshot or store is in use.
+func LoadState(ctx context.Context, store history.Store, dir string) (n history.StateImport, imported bool, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, StateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return n, false, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if jobs, err := store.ListJobs(ctx, "", 1); err != nil || len(jobs) > 0 {
+		return n, false, err
+	}
+	var st history.State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return n, false, fmt.Errorf("%s: %w", StateFile, err)
+	}
+	n, err = history.ImportState(ctx, store, st)
+	return n, err == nil, err
+}
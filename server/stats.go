@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+)
+
+// DefaultStatsMinGroupSize is the smallest group /stats reports unless
+// Config.StatsMinGroupSize sets another.
+const DefaultStatsMinGroupSize = 5
+
+const (
+	statsCacheTTL = 5 * time.Minute
+	statsTopSites = 10
+)
+
+// StatsHandler serves GET /stats, the history.Stats of every record in
+// store, leaving out the groups smaller than minGroupSize. The answer is
+// computed at most every five minutes. Text matching a -redact-pattern,
+// such as a site name, is pseudonymized by calc.
+func StatsHandler(store history.Store, calc *impact.Calculator, minGroupSize int) http.HandlerFunc {
+	var mu sync.Mutex
+	var cached *history.Stats
+	var expires time.Time
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached == nil || time.Now().After(expires) {
+			st, err := store.Stats(r.Context(), time.Time{}, minGroupSize, statsTopSites)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			calc.Redactor.Redact(&st)
+			cached, expires = &st, time.Now().Add(statsCacheTTL)
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(w, http.StatusOK, cached)
+	}
+}
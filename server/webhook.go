@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/R2Unit/netbox-impact/history"
+	"github.com/R2Unit/netbox-impact/impact"
+	"github.com/R2Unit/netbox-impact/netbox"
+)
+
+// WebhookConfig shapes the synchronous answers of POST /webhooks/netbox.
+type WebhookConfig struct {
+	// ResponseTemplate, when set, renders the answer body from a
+	// WebhookResponse instead of encoding it as JSON.
+	ResponseTemplate *template.Template
+	// CriticalStatus answers a result of critical severity (0 = 200), so
+	// the caller can tell it apart by status alone.
+	CriticalStatus int
+}
+
+// WebhookTag labels the calculations the webhook receiver records.
+const WebhookTag = "netbox-webhook"
+
+// WebhookResponse is the compact answer to a NetBox event. Severity bands
+// the normalized score (impact.ScoreSeverity).
+type WebhookResponse struct {
+	Event       string            `json:"event"`
+	Model       string            `json:"model"`
+	ObjectID    int               `json:"object_id"`
+	ImpactType  impact.ImpactType `json:"impact_type"`
+	Severity    impact.Severity   `json:"severity"`
+	Score       float64           `json:"score"`
+	TotalImpact float64           `json:"total_impact"`
+	HistoryID   int64             `json:"history_id,omitempty"`
+}
+
+// netboxEvent is the body of a NetBox webhook. NetBox 3.7 and 4.0 name the
+// event "created", "updated" or "deleted", 4.1 and later "object_created"
+// and so on; the fields the receiver reads are otherwise the same.
+type netboxEvent struct {
+	Event     string `json:"event"`
+	Timestamp string `json:"timestamp"`
+	Model     string `json:"model"`
+	Username  string `json:"username"`
+	RequestID string `json:"request_id"`
+	Data      struct {
+		ID int `json:"id"`
+	} `json:"data"`
+}
+
+// webhookModels sets the request field of each NetBox model the receiver
+// scores.
+var webhookModels = map[string]func(*impact.ImpactRequest, int){
+	"device":    func(r *impact.ImpactRequest, id int) { r.DeviceIDs = []int{id} },
+	"circuit":   func(r *impact.ImpactRequest, id int) { r.CircuitIDs = []int{id} },
+	"interface": func(r *impact.ImpactRequest, id int) { r.InterfaceIDs = []int{id} },
+	"site":      func(r *impact.ImpactRequest, id int) { r.SiteIDs = []int{id} },
+	"rack":      func(r *impact.ImpactRequest, id int) { r.RackIDs = []int{id} },
+	"powerfeed": func(r *impact.ImpactRequest, id int) { r.PowerFeedIDs = []int{id} },
+	"cable":     func(r *impact.ImpactRequest, id int) { r.CableIDs = []int{id} },
+}
+
+// maxWebhookRequestID bounds the request_id of an event; NetBox sends a
+// UUID.
+const maxWebhookRequestID = 64
+
+// webhookHandler answers NetBox webhooks. store is nil on an instance that
+// records nothing; jobs is nil without history.
+type webhookHandler struct {
+	calc        *impact.Calculator
+	instances   *netbox.NetboxInstances
+	weights     impact.WeightConfig
+	defaultType impact.ImpactType
+	store       history.Store
+	jobs        history.Store
+	readOnly    bool
+	cfg         WebhookConfig
+}
+
+// handler serves POST /webhooks/netbox?impact_type=&instance=&mode=: a
+// created or updated object is scored with impact_type (default the
+// /quickImpact one) and, in mode=sync (the default), answered with a
+// WebhookResponse; mode=async queues a job instead. Deleted objects are
+// answered 204. NetBox sends a retry with the event's request_id, model and
+// object unchanged, and they key the record or job so the retry gets the
+// first answer.
+func (h *webhookHandler) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ev netboxEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+			return
+		}
+		event := strings.TrimPrefix(ev.Event, "object_")
+		switch event {
+		case "created", "updated":
+		case "deleted":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			http.Error(w, fmt.Sprintf("Invalid webhook payload: unknown event %q", ev.Event), http.StatusBadRequest)
+			return
+		}
+		set, ok := webhookModels[ev.Model]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unsupported model %q (expected device, circuit, interface, site, rack, powerfeed or cable)", ev.Model), http.StatusUnprocessableEntity)
+			return
+		}
+		if ev.Data.ID <= 0 {
+			http.Error(w, "Invalid webhook payload: data.id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if len(ev.RequestID) > maxWebhookRequestID {
+			http.Error(w, fmt.Sprintf("Invalid webhook payload: request_id longer than %d bytes", maxWebhookRequestID), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		req := impact.ImpactRequest{ImpactType: h.defaultType, Instance: q.Get("instance"), Tags: []string{WebhookTag}}
+		if t := q.Get("impact_type"); t != "" {
+			req.ImpactType = impact.ImpactType(t)
+		}
+		if err := h.weights.CheckImpactType(req.ImpactType); err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		set(&req, ev.Data.ID)
+		var key string
+		if ev.RequestID != "" {
+			key = strings.Join([]string{WebhookTag, ev.RequestID, event, ev.Model, strconv.Itoa(ev.Data.ID)}, ":")
+		}
+		client, err := h.instances.Client(req.Instance)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		switch q.Get("mode") {
+		case "", "sync":
+		case "async":
+			h.queue(w, r, req, key)
+			return
+		default:
+			http.Error(w, fmt.Sprintf("Invalid query: mode %q (expected sync or async)", q.Get("mode")), http.StatusBadRequest)
+			return
+		}
+		result, err := h.calc.Calculate(r.Context(), req, client, h.weights)
+		if err != nil {
+			writeCalculationError(w, err)
+			return
+		}
+		h.calc.Redact(&result, false)
+		if h.store != nil {
+			recordResult(r.Context(), h.calc, h.store, req, key, &result)
+			// A retry answers with the first calculation, not this one.
+			if key != "" && result.Metadata.HistoryID != 0 {
+				if record, err := h.store.Get(r.Context(), result.Metadata.HistoryID); err == nil && record.Result != nil {
+					result = *record.Result
+					result.Metadata.HistoryID = record.ID
+				}
+			}
+		}
+		resp := WebhookResponse{
+			Event:       event,
+			Model:       ev.Model,
+			ObjectID:    ev.Data.ID,
+			ImpactType:  result.ImpactType,
+			Severity:    impact.ScoreSeverity(result.NormalizedScore),
+			Score:       result.NormalizedScore,
+			TotalImpact: result.TotalImpact,
+			HistoryID:   result.Metadata.HistoryID,
+		}
+		status := http.StatusOK
+		if resp.Severity == impact.SeverityCritical && h.cfg.CriticalStatus != 0 {
+			status = h.cfg.CriticalStatus
+		}
+		if h.cfg.ResponseTemplate == nil {
+			writeJSON(w, status, resp)
+			return
+		}
+		var body bytes.Buffer
+		if err := h.cfg.ResponseTemplate.Execute(&body, resp); err != nil {
+			http.Error(w, "Webhook response template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if json.Valid(body.Bytes()) {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(status)
+		w.Write(body.Bytes())
+	}
+}
+
+// queue answers mode=async like POST /jobs.
+func (h *webhookHandler) queue(w http.ResponseWriter, r *http.Request, req impact.ImpactRequest, key string) {
+	switch {
+	case h.readOnly:
+		http.Error(w, "read-only instance: jobs are disabled", http.StatusForbidden)
+		return
+	case h.jobs == nil:
+		http.Error(w, "Invalid query: mode=async needs a history store", http.StatusBadRequest)
+		return
+	}
+	job, created, err := h.jobs.CreateJob(r.Context(), req, key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+strconv.FormatInt(job.ID, 10))
+	if !created {
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}